@@ -7,6 +7,7 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"syscall"
 	"time"
 
@@ -14,6 +15,12 @@ import (
 	"github.com/generic/selectel-craas-web/internal/auth"
 	"github.com/generic/selectel-craas-web/internal/config"
 	"github.com/generic/selectel-craas-web/internal/craas"
+	"github.com/generic/selectel-craas-web/internal/inventory"
+	"github.com/generic/selectel-craas-web/internal/sealer"
+	"github.com/generic/selectel-craas-web/internal/session"
+	"github.com/generic/selectel-craas-web/internal/state"
+	"github.com/generic/selectel-craas-web/internal/transport"
+	"github.com/generic/selectel-craas-web/internal/users"
 	"github.com/generic/selectel-craas-web/pkg/logger"
 )
 
@@ -29,7 +36,12 @@ func main() {
 	appLogger.Info("starting application", "version", Version, "port", cfg.WebPort, "log_level", cfg.LogLevel)
 
 	// Auth validation
-	if cfg.AuthEnabled {
+	if cfg.HeaderAuth() {
+		if len(cfg.TrustedProxies) == 0 {
+			log.Fatal("AUTH_MODE=header requires TRUSTED_PROXIES, otherwise anyone could set the identity headers.")
+		}
+		appLogger.Info("Authentication: ENABLED (trusted proxy headers)", "user_header", cfg.AuthHeaderUser, "groups_header", cfg.AuthHeaderGroups)
+	} else if cfg.AuthEnabled {
 		if cfg.AuthLogin == "" || cfg.AuthPassword == "" {
 			log.Fatal("Authentication is ENABLED but AUTH_LOGIN or AUTH_PASSWORD is not set. Please set these environment variables.")
 		}
@@ -38,6 +50,31 @@ func main() {
 		appLogger.Warn("Authentication: DISABLED (Anyone can access the application)")
 	}
 
+	for _, account := range cfg.AllAccounts() {
+		if err := account.Validate(); err != nil {
+			log.Fatalf("Invalid Selectel account configuration: %v", err)
+		}
+		appLogger.Info("Selectel account", "id", account.ID, "name", account.Name, "auth_method", account.AuthMethod)
+	}
+
+	if cfg.SelectelPerUserCredentials {
+		if !cfg.AuthEnabled {
+			log.Fatal("SELECTEL_PER_USER_CREDENTIALS requires authentication to be enabled.")
+		}
+		if cfg.CredentialsEncryptionKey == "" {
+			log.Fatal("SELECTEL_PER_USER_CREDENTIALS requires CREDENTIALS_ENCRYPTION_KEY to be set.")
+		}
+		appLogger.Info("Selectel credentials: per user (default account)")
+	}
+
+	if cfg.CredentialsEncryptionKey != "" {
+		if _, err := sealer.New(cfg.CredentialsEncryptionKey); err != nil {
+			log.Fatalf("Invalid CREDENTIALS_ENCRYPTION_KEY: %v", err)
+		}
+	} else if cfg.AuthEnabled && !cfg.HeaderAuth() {
+		appLogger.Warn("CREDENTIALS_ENCRYPTION_KEY is not set: TOTP secrets are stored in plaintext.")
+	}
+
 	if cfg.CORSAllowedOrigin == "*" {
 		appLogger.Warn("CORS: ALLOWED_ORIGIN is set to '*' (INSECURE). Do not use this in production.")
 	} else if cfg.CORSAllowedOrigin == "" {
@@ -46,10 +83,105 @@ func main() {
 		appLogger.Info("CORS: ALLOWED_ORIGIN is set", "origin", cfg.CORSAllowedOrigin)
 	}
 
-	authClient := auth.New(cfg, appLogger)
+	// Rate limits, lockouts, tokens, sessions and caches shared by replicas
+	sharedState, err := state.New(cfg)
+	if err != nil {
+		log.Fatalf("Error connecting to the state backend: %v", err)
+	}
+	defer sharedState.Close()
+	if cfg.SharedState() {
+		appLogger.Info("State: SHARED (redis)", "prefix", cfg.StatePrefix)
+		if cfg.Secrets.Get("JWT_SECRET", "") == "" {
+			// Every replica must sign sessions with the same key
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			secret, err := state.GetOrSet(ctx, sharedState, "jwt_secret", []byte(cfg.JWTSecret), 0)
+			cancel()
+			if err != nil {
+				log.Fatalf("Error sharing the JWT secret: %v", err)
+			}
+			cfg.JWTSecret = string(secret)
+		}
+	}
+
+	var sessionFile, usersFile, tagIndexFile, inventoryFile string
+	if cfg.DataDir != "" {
+		sessionFile = filepath.Join(cfg.DataDir, "sessions.json")
+		usersFile = filepath.Join(cfg.DataDir, "users.json")
+		tagIndexFile = filepath.Join(cfg.DataDir, "tag_index.json")
+		inventoryFile = filepath.Join(cfg.DataDir, "inventory.json")
+	} else if cfg.AuthEnabled && !cfg.SharedState() {
+		appLogger.Warn("DATA_DIR is not set: sessions and two-factor enrollments are lost on restart")
+	}
+	var sessionStore session.Store
+	if cfg.SharedState() {
+		sessionStore = session.NewSharedStore(sharedState)
+	} else if sessionStore, err = session.NewMemoryStore(sessionFile); err != nil {
+		log.Fatalf("Error loading sessions: %v", err)
+	}
+	sessions := session.NewManager(sessionStore, cfg.SessionIdleTimeout, cfg.SessionMaxLifetime)
+	sessions.StartCleanup(time.Minute)
+
+	userStore, err := users.NewStore(usersFile)
+	if err != nil {
+		log.Fatalf("Error loading users: %v", err)
+	}
+	if cfg.SharedState() {
+		if err := userStore.Share(sharedState); err != nil {
+			log.Fatalf("Error sharing users: %v", err)
+		}
+	}
+
+	// One pooled transport for every call to Selectel
+	httpClient, err := transport.New(cfg)
+	if err != nil {
+		log.Fatalf("Invalid outbound HTTP configuration: %v", err)
+	}
+
 	craasService := craas.New(cfg, appLogger)
+	craasService.HTTPClient = httpClient
+	var accounts []*auth.Client
+	for _, account := range cfg.AllAccounts() {
+		client := auth.NewAccount(cfg, account, appLogger)
+		client.HTTPClient = httpClient
+		client.Retired = craasService.RetireToken
+		if cfg.SharedState() {
+			client.Shared = sharedState
+		}
+		accounts = append(accounts, client)
+	}
+	if cfg.SharedState() {
+		craasService.ShareCache(sharedState)
+	}
+	if cfg.EnableMissingTagsCheck {
+		if cfg.SharedState() {
+			craasService.Tags, _ = craas.NewTagIndex("", cfg.TagIndexMaxAge, appLogger)
+			craasService.Tags.Share(sharedState)
+		} else if craasService.Tags, err = craas.NewTagIndex(tagIndexFile, cfg.TagIndexMaxAge, appLogger); err != nil {
+			log.Fatalf("Error loading tag index: %v", err)
+		}
+	}
 
-	router := api.New(authClient, craasService, appLogger, cfg)
+	var crawler *inventory.Crawler
+	if cfg.InventoryInterval > 0 {
+		store, err := inventory.NewStore(inventoryFile, appLogger)
+		if err != nil {
+			log.Fatalf("Error loading inventory: %v", err)
+		}
+		var sources []inventory.Source
+		for _, client := range accounts {
+			if cfg.SelectelPerUserCredentials && client.Account().ID == config.DefaultAccountID {
+				continue // Users bring their own credentials for the default account
+			}
+			sources = append(sources, inventory.Source{Account: client.Account().ID, Auth: client})
+		}
+		crawler = inventory.NewCrawler(cfg, craasService, sources, store, appLogger)
+		if cfg.SharedState() {
+			crawler.Share(sharedState)
+		}
+		appLogger.Info("Inventory: ENABLED", "interval", cfg.InventoryInterval, "rate_per_minute", cfg.InventoryRate)
+	}
+
+	router := api.New(accounts, craasService, crawler, sessions, userStore, sharedState, appLogger, cfg)
 
 	srv := &http.Server{
 		Addr:         ":" + cfg.WebPort,
@@ -61,6 +193,13 @@ func main() {
 	// Server run context
 	serverCtx, serverStopCtx := context.WithCancel(context.Background())
 
+	// Follow rotations of secrets mounted as files or stored in Vault
+	go cfg.Secrets.Watch(serverCtx, cfg.SecretsRefreshInterval, appLogger)
+
+	if crawler != nil {
+		go crawler.Run(serverCtx)
+	}
+
 	// Listen for syscall signals for process to interrupt/quit
 	sig := make(chan os.Signal, 1)
 	signal.Notify(sig, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
@@ -84,6 +223,11 @@ func main() {
 		if err := srv.Shutdown(shutdownCtx); err != nil {
 			log.Fatal(err)
 		}
+		if f, ok := sessionStore.(interface{ Flush() error }); ok {
+			if err := f.Flush(); err != nil {
+				appLogger.Error("failed to persist sessions", "error", err)
+			}
+		}
 		serverStopCtx()
 	}()
 
@@ -0,0 +1,63 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"github.com/generic/selectel-craas-web/internal/auth"
+	"github.com/generic/selectel-craas-web/internal/config"
+	"github.com/go-chi/chi/v5"
+)
+
+var ErrAccountNotFound = errors.New("account not found")
+
+const accountKey contextKey = "account"
+
+// AccountInfo is the public view of a configured Selectel account.
+type AccountInfo struct {
+	ID      string `json:"id"`
+	Name    string `json:"name"`
+	Default bool   `json:"default"`
+}
+
+// authClient returns the auth client of the account selected by the route,
+// falling back to the default account.
+func (s *Server) authClient(ctx context.Context) *auth.Client {
+	if c, ok := ctx.Value(accountKey).(*auth.Client); ok {
+		return c
+	}
+	return s.Auth
+}
+
+func (s *Server) account(id string) *auth.Client {
+	for _, c := range s.Accounts {
+		if c.Account().ID == id {
+			return c
+		}
+	}
+	return nil
+}
+
+// AccountScope selects the account named by the {aid} URL parameter.
+func (s *Server) AccountScope(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c := s.account(chi.URLParam(r, "aid"))
+		if c == nil {
+			RespondError(w, http.StatusNotFound, ErrAccountNotFound)
+			return
+		}
+		ctx := context.WithValue(r.Context(), accountKey, c)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// ListAccounts lists the configured Selectel accounts without credentials.
+func (s *Server) ListAccounts(w http.ResponseWriter, r *http.Request) {
+	result := make([]AccountInfo, 0, len(s.Accounts))
+	for _, c := range s.Accounts {
+		a := c.Account()
+		result = append(result, AccountInfo{ID: a.ID, Name: a.Name, Default: a.ID == config.DefaultAccountID})
+	}
+	RespondList(w, r, result, cacheStatic)
+}
@@ -0,0 +1,85 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/generic/selectel-craas-web/internal/auth"
+	"github.com/generic/selectel-craas-web/internal/config"
+	"github.com/generic/selectel-craas-web/internal/craas"
+	"github.com/generic/selectel-craas-web/internal/state"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAccountRoutes(t *testing.T) {
+	// Fake Keystone that issues a token per account and lists its projects
+	keystone := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/tokens":
+			var body struct {
+				Auth struct {
+					Identity struct {
+						Password struct {
+							User struct {
+								Name string `json:"name"`
+							} `json:"user"`
+						} `json:"password"`
+					} `json:"identity"`
+				} `json:"auth"`
+			}
+			json.NewDecoder(r.Body).Decode(&body)
+			w.Header().Set("X-Subject-Token", "token-"+body.Auth.Identity.Password.User.Name)
+			w.WriteHeader(http.StatusCreated)
+			w.Write([]byte(`{}`))
+		case "/projects":
+			w.Write([]byte(`{"projects": [{"id": "` + r.Header.Get("X-Auth-Token") + `", "name": "p"}]}`))
+		}
+	}))
+	defer keystone.Close()
+
+	cfg := &config.Config{
+		SelectelUsername:           "first",
+		SelectelAuthURL:            keystone.URL + "/tokens",
+		SelectelProjURL:            keystone.URL + "/projects",
+		SelectelDefaultAccountName: "Main",
+		Accounts:                   []config.Account{{ID: "second", Name: "Second", Username: "second"}},
+	}
+	var accounts []*auth.Client
+	for _, a := range cfg.AllAccounts() {
+		accounts = append(accounts, auth.NewAccount(cfg, a, testLogger))
+	}
+	router := New(accounts, craas.New(cfg, testLogger), nil, newTestSessions(t), newTestUsers(t), state.NewMemory(), testLogger, cfg)
+
+	get := func(path string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, httptest.NewRequest("GET", path, nil))
+		return rr
+	}
+
+	rr := get("/api/accounts")
+	require.Equal(t, http.StatusOK, rr.Code)
+	var list []AccountInfo
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&list))
+	assert.Equal(t, []AccountInfo{
+		{ID: "default", Name: "Main", Default: true},
+		{ID: "second", Name: "Second"},
+	}, list)
+
+	projectOf := func(path string) string {
+		rr := get(path)
+		require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+		var projects []auth.Project
+		require.NoError(t, json.NewDecoder(rr.Body).Decode(&projects))
+		require.Len(t, projects, 1)
+		return projects[0].ID
+	}
+
+	assert.Equal(t, "token-first", projectOf("/api/projects"))
+	assert.Equal(t, "token-first", projectOf("/api/accounts/default/projects"))
+	assert.Equal(t, "token-second", projectOf("/api/accounts/second/projects"))
+
+	assert.Equal(t, http.StatusNotFound, get("/api/accounts/unknown/projects").Code)
+}
@@ -8,6 +8,7 @@ import (
 	"strings"
 	"time"
 
+	"github.com/generic/selectel-craas-web/internal/session"
 	"github.com/golang-jwt/jwt/v5"
 )
 
@@ -17,9 +18,16 @@ type LoginRequest struct {
 }
 
 type LoginResponse struct {
-	User string `json:"user"`
+	User      string     `json:"user"`
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+	// MFARequired is set when the password was correct but a second factor
+	// must be submitted to /api/login/2fa together with MFAToken.
+	MFARequired bool   `json:"mfaRequired,omitempty"`
+	MFAToken    string `json:"mfaToken,omitempty"`
 }
 
+const authCookieName = "auth_token"
+
 func (s *Server) getSameSiteMode() http.SameSite {
 	switch strings.ToLower(s.Config.CookieSameSite) {
 	case "none":
@@ -38,6 +46,10 @@ func (s *Server) Login(w http.ResponseWriter, r *http.Request) {
 		RespondError(w, http.StatusBadRequest, errors.New("authentication is disabled"))
 		return
 	}
+	if s.Config.HeaderAuth() {
+		RespondError(w, http.StatusBadRequest, ErrHeaderAuthLogin)
+		return
+	}
 
 	var req LoginRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -45,42 +57,146 @@ func (s *Server) Login(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Locked accounts are refused even with the right password.
+	if !s.checkLockout(w, r, req.Login) {
+		return
+	}
+
 	loginMatch := subtle.ConstantTimeCompare([]byte(req.Login), []byte(s.Config.AuthLogin))
-	passMatch := subtle.ConstantTimeCompare([]byte(req.Password), []byte(s.Config.AuthPassword))
+	passMatch := subtle.ConstantTimeCompare([]byte(req.Password), []byte(s.Config.Secrets.Get("AUTH_PASSWORD", s.Config.AuthPassword)))
 
 	if loginMatch&passMatch != 1 {
+		s.loginFailed(r, req.Login)
 		RespondError(w, http.StatusUnauthorized, errors.New("invalid credentials"))
 		return
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
-		"sub": req.Login,
-		"exp": time.Now().Add(24 * time.Hour).Unix(),
-	})
+	u, _, err := s.Users.Get(req.Login)
+	if err != nil {
+		s.Logger.Error("failed to load user", "user", req.Login, "error", err)
+		RespondError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if u.TOTPEnabled() {
+		challenge, err := s.signMFAChallenge(req.Login)
+		if err != nil {
+			s.Logger.Error("failed to sign mfa challenge", "error", err)
+			RespondError(w, http.StatusInternalServerError, err)
+			return
+		}
+		RespondJSON(w, http.StatusOK, LoginResponse{User: req.Login, MFARequired: true, MFAToken: challenge})
+		return
+	}
+
+	s.completeLogin(w, r, req.Login, false)
+}
 
-	tokenString, err := token.SignedString([]byte(s.Config.JWTSecret))
+// completeLogin starts a session for an authenticated user and responds with it.
+func (s *Server) completeLogin(w http.ResponseWriter, r *http.Request, user string, mfa bool) {
+	sess, err := s.startSession(w, r, user, mfa)
 	if err != nil {
-		s.Logger.Error("failed to sign token", "error", err)
+		s.Logger.Error("failed to create session", "error", err)
 		RespondError(w, http.StatusInternalServerError, err)
 		return
 	}
 
+	if err := s.Lockout.Reset(r.Context(), user); err != nil {
+		s.Logger.Warn("failed to reset login failures", "user", user, "error", err)
+	}
+	s.Logger.Info("user logged in", "user", user, "session_id", sess.ID, "mfa", mfa)
+	RespondJSON(w, http.StatusOK, LoginResponse{User: user, ExpiresAt: &sess.ExpiresAt})
+}
+
+// checkLockout refuses the login of a locked account.
+func (s *Server) checkLockout(w http.ResponseWriter, r *http.Request, user string) bool {
+	wait, err := s.Lockout.Locked(r.Context(), user)
+	if err != nil {
+		s.Logger.Error("failed to check login lockout", "user", user, "error", err)
+		RespondError(w, http.StatusInternalServerError, err)
+		return false
+	}
+	if wait > 0 {
+		setRetryAfter(w, wait)
+		RespondError(w, http.StatusTooManyRequests, ErrAccountLocked)
+		return false
+	}
+	return true
+}
+
+// loginFailed records a failed password or second factor for the lockout.
+func (s *Server) loginFailed(r *http.Request, user string) {
+	lock, err := s.Lockout.Fail(r.Context(), user)
+	if err != nil {
+		s.Logger.Error("failed to record failed login", "user", user, "error", err)
+	} else if lock > 0 {
+		s.Logger.Warn("account locked after failed logins", "user", user, "client_ip", s.clientIP(r), "duration", lock)
+	}
+}
+
+// startSession creates a server-side session for the user and sets the auth cookie.
+func (s *Server) startSession(w http.ResponseWriter, r *http.Request, user string, mfa bool) (*session.Session, error) {
+	sess, err := s.Sessions.Create(user, r.UserAgent(), s.clientIP(r), mfa)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.setAuthCookie(w, sess); err != nil {
+		s.Sessions.Revoke(sess.ID)
+		return nil, err
+	}
+	// A new session gets a new CSRF token.
+	if _, err := s.setCSRFCookie(w); err != nil {
+		s.Sessions.Revoke(sess.ID)
+		return nil, err
+	}
+	return sess, nil
+}
+
+// jwtSecret returns the current signing key. Rotating it ends all sessions.
+func (s *Server) jwtSecret() []byte {
+	return []byte(s.Config.Secrets.Get("JWT_SECRET", s.Config.JWTSecret))
+}
+
+// signSessionToken issues a JWT bound to the session ID.
+func (s *Server) signSessionToken(sess *session.Session) (string, error) {
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"sub": sess.User,
+		"sid": sess.ID,
+		"iat": time.Now().Unix(),
+		"exp": sess.ExpiresAt.Unix(),
+	})
+	return token.SignedString(s.jwtSecret())
+}
+
+func (s *Server) setAuthCookie(w http.ResponseWriter, sess *session.Session) error {
+	tokenString, err := s.signSessionToken(sess)
+	if err != nil {
+		return err
+	}
+
 	http.SetCookie(w, &http.Cookie{
-		Name:     "auth_token",
+		Name:     authCookieName,
 		Value:    tokenString,
 		Path:     "/",
-		Expires:  time.Now().Add(24 * time.Hour),
+		Expires:  sess.ExpiresAt,
 		HttpOnly: true,
 		Secure:   s.Config.CookieSecure,
 		SameSite: s.getSameSiteMode(),
 	})
-
-	RespondJSON(w, http.StatusOK, LoginResponse{User: req.Login})
+	return nil
 }
 
 func (s *Server) Logout(w http.ResponseWriter, r *http.Request) {
+	// Revoke the server-side session so that copies of the token stop working too.
+	if tokenString, _ := tokenFromRequest(r); tokenString != "" && s.Sessions != nil {
+		if claims, err := s.parseSessionToken(tokenString); err == nil {
+			if err := s.Sessions.Revoke(claims.SessionID); err != nil {
+				s.Logger.Error("failed to revoke session", "session_id", claims.SessionID, "error", err)
+			}
+		}
+	}
+
 	http.SetCookie(w, &http.Cookie{
-		Name:     "auth_token",
+		Name:     authCookieName,
 		Value:    "",
 		Path:     "/",
 		MaxAge:   -1,
@@ -88,13 +204,27 @@ func (s *Server) Logout(w http.ResponseWriter, r *http.Request) {
 		Secure:   s.Config.CookieSecure,
 		SameSite: s.getSameSiteMode(),
 	})
+	s.clearCSRFCookie(w)
 	w.WriteHeader(http.StatusOK)
 }
 
 func (s *Server) AuthCheck(w http.ResponseWriter, r *http.Request) {
 	// If the request reached here, it passed the AuthMiddleware (if enabled).
+	user := s.Config.AuthLogin
+	var mfa bool
+	groups := []string{}
+	if p := PrincipalFromContext(r.Context()); p != nil {
+		user = p.User
+		mfa = p.MFA
+		if p.Groups != nil {
+			groups = p.Groups
+		}
+	}
 	RespondJSON(w, http.StatusOK, map[string]interface{}{
-		"authenticated": true,
-		"user":          s.Config.AuthLogin,
+		"authenticated":         true,
+		"user":                  user,
+		"groups":                groups,
+		"mfa":                   mfa,
+		"mfaEnrollmentRequired": s.mfaEnrollmentRequired(user),
 	})
 }
@@ -8,10 +8,29 @@ import (
 	"net/http/httptest"
 	"os"
 	"testing"
+	"time"
 
 	"github.com/generic/selectel-craas-web/internal/config"
+	"github.com/generic/selectel-craas-web/internal/session"
+	"github.com/generic/selectel-craas-web/internal/users"
 )
 
+func newTestUsers(t *testing.T) *users.Store {
+	store, err := users.NewStore("")
+	if err != nil {
+		t.Fatalf("failed to create user store: %v", err)
+	}
+	return store
+}
+
+func newTestSessions(t *testing.T) *session.Manager {
+	store, err := session.NewMemoryStore("")
+	if err != nil {
+		t.Fatalf("failed to create session store: %v", err)
+	}
+	return session.NewManager(store, time.Hour, 24*time.Hour)
+}
+
 func TestLogin(t *testing.T) {
 	logger := slog.New(slog.NewTextHandler(os.Stdout, nil))
 
@@ -57,7 +76,7 @@ func TestLogin(t *testing.T) {
 			authPassword:   "password",
 			requestBody:    LoginRequest{Login: "wrong-user", Password: "password"},
 			expectedStatus: http.StatusUnauthorized,
-			expectCookie:    false,
+			expectCookie:   false,
 		},
 		{
 			name:           "Successful Login",
@@ -96,8 +115,10 @@ func TestLogin(t *testing.T) {
 				CookieSameSite: tt.cookieSameSite,
 			}
 			server := &Server{
-				Config: cfg,
-				Logger: logger,
+				Config:   cfg,
+				Logger:   logger,
+				Sessions: newTestSessions(t),
+				Users:    newTestUsers(t),
 			}
 
 			var body []byte
@@ -154,6 +175,18 @@ func TestLogin(t *testing.T) {
 				if !found {
 					t.Error("expected auth_token cookie not found")
 				}
+
+				var csrf *http.Cookie
+				for _, cookie := range cookies {
+					if cookie.Name == "csrf_token" {
+						csrf = cookie
+					}
+				}
+				if csrf == nil || csrf.Value == "" {
+					t.Error("expected csrf_token cookie to be issued at login")
+				} else if csrf.HttpOnly {
+					t.Error("expected csrf_token cookie to be readable by scripts")
+				}
 			}
 		})
 	}
@@ -190,6 +223,35 @@ func TestLogout(t *testing.T) {
 	}
 }
 
+func TestLogoutRevokesSession(t *testing.T) {
+	server := &Server{
+		Config: &config.Config{
+			AuthEnabled: true,
+			JWTSecret:   "secret",
+		},
+		Logger:   testLogger,
+		Sessions: newTestSessions(t),
+	}
+
+	sess, err := server.Sessions.Create("admin", "", "", false)
+	if err != nil {
+		t.Fatalf("failed to create session: %v", err)
+	}
+	token, err := server.signSessionToken(sess)
+	if err != nil {
+		t.Fatalf("failed to sign token: %v", err)
+	}
+
+	req := httptest.NewRequest("POST", "/api/logout", nil)
+	req.AddCookie(&http.Cookie{Name: "auth_token", Value: token})
+	rr := httptest.NewRecorder()
+	server.Logout(rr, req)
+
+	if _, err := server.Sessions.Get(sess.ID); err == nil {
+		t.Error("expected session to be revoked after logout")
+	}
+}
+
 func TestAuthCheck(t *testing.T) {
 	cfg := &config.Config{
 		AuthLogin: "admin",
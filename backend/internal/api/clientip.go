@@ -0,0 +1,63 @@
+package api
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// remoteIP returns the IP address of the direct peer.
+func remoteIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		// RemoteAddr without a port, use it as is.
+		host = r.RemoteAddr
+	}
+	return net.ParseIP(host)
+}
+
+// fromTrustedProxy reports whether the direct peer is one of TRUSTED_PROXIES.
+// Headers set by anyone else must not be trusted.
+func (s *Server) fromTrustedProxy(r *http.Request) bool {
+	ip := remoteIP(r)
+	return ip != nil && s.isTrustedProxy(ip)
+}
+
+func (s *Server) isTrustedProxy(ip net.IP) bool {
+	for _, n := range s.Config.TrustedProxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the address of the client. X-Forwarded-For and X-Real-IP
+// are only honoured when the direct peer is a trusted proxy; in that case the
+// rightmost address that is not itself a trusted proxy is the client.
+func (s *Server) clientIP(r *http.Request) string {
+	peer := remoteIP(r)
+	if peer == nil {
+		return r.RemoteAddr
+	}
+	if !s.fromTrustedProxy(r) {
+		return peer.String()
+	}
+
+	if xff := r.Header.Values("X-Forwarded-For"); len(xff) > 0 {
+		hops := strings.Split(strings.Join(xff, ","), ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			ip := net.ParseIP(strings.TrimSpace(hops[i]))
+			if ip == nil {
+				break
+			}
+			if !s.isTrustedProxy(ip) {
+				return ip.String()
+			}
+		}
+	}
+	if ip := net.ParseIP(strings.TrimSpace(r.Header.Get("X-Real-IP"))); ip != nil {
+		return ip.String()
+	}
+	return peer.String()
+}
@@ -13,6 +13,9 @@ func (s *Server) GetConfig(w http.ResponseWriter, r *http.Request) {
 		"enableDeleteImage":      s.Config.EnableDeleteImage,
 		"protectedTags":          s.Config.ProtectedTags,
 		"authEnabled":            s.Config.AuthEnabled,
+		"authMode":               s.Config.AuthMode,
+		"require2FAForDelete":    s.Config.AuthEnabled && s.Config.AuthRequire2FAForDelete,
+		"perUserCredentials":     s.Config.SelectelPerUserCredentials,
 	}
 	RespondJSON(w, http.StatusOK, cfg)
 }
@@ -20,26 +23,26 @@ func (s *Server) GetConfig(w http.ResponseWriter, r *http.Request) {
 // Error forbidden
 var ErrForbidden = fmt.Errorf("action disabled by configuration")
 
-func (s *Server) checkDeleteRegistry(w http.ResponseWriter) bool {
+func (s *Server) checkDeleteRegistry(w http.ResponseWriter, r *http.Request) bool {
 	if !s.Config.EnableDeleteRegistry {
 		RespondError(w, http.StatusForbidden, ErrForbidden)
 		return false
 	}
-	return true
+	return s.checkMFA(w, r)
 }
 
-func (s *Server) checkDeleteRepository(w http.ResponseWriter) bool {
+func (s *Server) checkDeleteRepository(w http.ResponseWriter, r *http.Request) bool {
 	if !s.Config.EnableDeleteRepository {
 		RespondError(w, http.StatusForbidden, ErrForbidden)
 		return false
 	}
-	return true
+	return s.checkMFA(w, r)
 }
 
-func (s *Server) checkDeleteImage(w http.ResponseWriter) bool {
+func (s *Server) checkDeleteImage(w http.ResponseWriter, r *http.Request) bool {
 	if !s.Config.EnableDeleteImage {
 		RespondError(w, http.StatusForbidden, ErrForbidden)
 		return false
 	}
-	return true
+	return s.checkMFA(w, r)
 }
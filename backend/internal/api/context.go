@@ -0,0 +1,48 @@
+package api
+
+import (
+	"context"
+)
+
+type contextKey string
+
+const (
+	principalKey contextKey = "principal"
+	auditKey     contextKey = "audit"
+)
+
+// Principal describes the authenticated caller of a request.
+type Principal struct {
+	User      string
+	SessionID string // Empty for identities asserted by a trusted proxy
+	Groups    []string
+	// MFA is true if the session was established with a second factor.
+	MFA bool
+}
+
+// auditRecord is filled in by the auth middleware so that the request logger,
+// which runs before it, can attribute the request to a user.
+type auditRecord struct {
+	principal *Principal
+}
+
+func withAuditRecord(ctx context.Context) (context.Context, *auditRecord) {
+	rec := &auditRecord{}
+	return context.WithValue(ctx, auditKey, rec), rec
+}
+
+func withPrincipal(ctx context.Context, p *Principal) context.Context {
+	if rec, ok := ctx.Value(auditKey).(*auditRecord); ok {
+		rec.principal = p
+	}
+	ctx = context.WithValue(ctx, principalKey, p)
+	// Kept for handlers that read the plain user name.
+	return context.WithValue(ctx, "user", p.User)
+}
+
+// PrincipalFromContext returns the authenticated caller, or nil if the request
+// was not authenticated (e.g. authentication is disabled).
+func PrincipalFromContext(ctx context.Context) *Principal {
+	p, _ := ctx.Value(principalKey).(*Principal)
+	return p
+}
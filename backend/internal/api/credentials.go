@@ -0,0 +1,314 @@
+package api
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/generic/selectel-craas-web/internal/auth"
+	"github.com/generic/selectel-craas-web/internal/config"
+	"github.com/generic/selectel-craas-web/internal/craas"
+	"github.com/generic/selectel-craas-web/internal/users"
+)
+
+var (
+	ErrNoUserCredentials  = errors.New("link your Selectel credentials first")
+	ErrPerUserDisabled    = errors.New("per-user Selectel credentials are not enabled")
+	ErrInvalidCredentials = errors.New("selectel rejected the credentials")
+)
+
+// SelectelCredentialsRequest links the caller's own Selectel identity.
+type SelectelCredentialsRequest struct {
+	AuthMethod          string `json:"authMethod"` // "password" (default) or "application_credential"
+	Username            string `json:"username"`
+	AccountID           string `json:"accountId"`
+	Password            string `json:"password"`
+	ProjectName         string `json:"projectName"`
+	AppCredentialID     string `json:"appCredentialId"`
+	AppCredentialSecret string `json:"appCredentialSecret"`
+}
+
+// SelectelCredentialsStatus describes the linked credentials without secrets.
+type SelectelCredentialsStatus struct {
+	Linked          bool   `json:"linked"`
+	AuthMethod      string `json:"authMethod,omitempty"`
+	Username        string `json:"username,omitempty"`
+	AccountID       string `json:"accountId,omitempty"`
+	ProjectName     string `json:"projectName,omitempty"`
+	AppCredentialID string `json:"appCredentialId,omitempty"`
+}
+
+// userAuthCache keeps one auth client per user so that their tokens are cached.
+type userAuthCache struct {
+	mu      sync.Mutex
+	clients map[string]userAuthEntry
+}
+
+// userAuthEntry is a cached client with the sealed credentials it was made
+// from, so that it is replaced once they change, e.g. through another replica.
+type userAuthEntry struct {
+	client *auth.Client
+	sealed string
+}
+
+// caller identifies the user and their credentials to the listing cache, so
+// that listings are neither shared between users nor kept across a change of
+// credentials.
+func (e userAuthEntry) caller() string {
+	sum := sha256.Sum256([]byte(e.sealed))
+	return e.client.Account().ID + "/" + hex.EncodeToString(sum[:8])
+}
+
+func newUserAuthCache() *userAuthCache {
+	return &userAuthCache{clients: make(map[string]userAuthEntry)}
+}
+
+func (c *userAuthCache) drop(user string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.clients, user)
+}
+
+func (c *userAuthCache) all() []*auth.Client {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	result := make([]*auth.Client, 0, len(c.clients))
+	for _, e := range c.clients {
+		result = append(result, e.client)
+	}
+	return result
+}
+
+// userAuthClient returns an auth client acting with the user's own credentials.
+func (s *Server) userAuthClient(user string) (userAuthEntry, error) {
+	u, _, err := s.Users.Get(user)
+	if err != nil {
+		return userAuthEntry{}, err
+	}
+
+	s.userAuth.mu.Lock()
+	defer s.userAuth.mu.Unlock()
+	if e, ok := s.userAuth.clients[user]; ok && e.sealed == u.SelectelCredentials {
+		return e, nil
+	}
+	delete(s.userAuth.clients, user)
+
+	account, err := s.openUserCredentials(u)
+	if err != nil {
+		return userAuthEntry{}, err
+	}
+	c := auth.NewAccount(s.Config, account, s.Logger)
+	c.HTTPClient = s.Auth.HTTPClient
+	c.Retired = s.Auth.Retired
+	e := userAuthEntry{client: c, sealed: u.SelectelCredentials}
+	s.userAuth.clients[user] = e
+	return e, nil
+}
+
+func (s *Server) loadUserCredentials(user string) (config.Account, error) {
+	u, _, err := s.Users.Get(user)
+	if err != nil {
+		return config.Account{}, err
+	}
+	return s.openUserCredentials(u)
+}
+
+func (s *Server) openUserCredentials(u *users.User) (config.Account, error) {
+	if u.SelectelCredentials == "" {
+		return config.Account{}, ErrNoUserCredentials
+	}
+	plaintext, err := s.Sealer.Open(u.SelectelCredentials, credentialsLabel(u.Name))
+	if err != nil {
+		return config.Account{}, fmt.Errorf("failed to decrypt credentials of %s: %w", u.Name, err)
+	}
+	var account config.Account
+	if err := json.Unmarshal(plaintext, &account); err != nil {
+		return config.Account{}, err
+	}
+	return account, nil
+}
+
+// credentialsLabel binds sealed credentials to their user, so that they do
+// not open when copied to another one in the users file.
+func credentialsLabel(user string) string {
+	return "selectel-credentials/" + user
+}
+
+// UserCredentials makes the default account act as the calling user when
+// SELECTEL_PER_USER_CREDENTIALS is enabled. Accounts from SELECTEL_ACCOUNTS
+// keep their service users.
+func (s *Server) UserCredentials(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !s.Config.SelectelPerUserCredentials {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if c, ok := r.Context().Value(accountKey).(*auth.Client); ok && c.Account().ID != config.DefaultAccountID {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		p := PrincipalFromContext(r.Context())
+		if p == nil {
+			RespondError(w, http.StatusForbidden, ErrNoUserCredentials)
+			return
+		}
+		e, err := s.userAuthClient(p.User)
+		if errors.Is(err, ErrNoUserCredentials) {
+			RespondError(w, http.StatusForbidden, err)
+			return
+		}
+		if err != nil {
+			s.Logger.Error("failed to load user credentials", "user", p.User, "error", err)
+			RespondError(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), accountKey, e.client)
+		ctx = craas.WithCaller(ctx, e.caller())
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// GetSelectelCredentials reports which credentials the caller has linked.
+func (s *Server) GetSelectelCredentials(w http.ResponseWriter, r *http.Request) {
+	p := s.requirePerUser(w, r)
+	if p == nil {
+		return
+	}
+
+	account, err := s.loadUserCredentials(p.User)
+	if errors.Is(err, ErrNoUserCredentials) {
+		RespondJSON(w, http.StatusOK, SelectelCredentialsStatus{})
+		return
+	}
+	if err != nil {
+		s.Logger.Error("failed to load user credentials", "user", p.User, "error", err)
+		RespondError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	RespondJSON(w, http.StatusOK, SelectelCredentialsStatus{
+		Linked:          true,
+		AuthMethod:      account.AuthMethod,
+		Username:        account.Username,
+		AccountID:       account.AccountID,
+		ProjectName:     account.ProjectName,
+		AppCredentialID: account.AppCredentialID,
+	})
+}
+
+// SetSelectelCredentials verifies the credentials with Selectel and stores them encrypted.
+func (s *Server) SetSelectelCredentials(w http.ResponseWriter, r *http.Request) {
+	p := s.requirePerUser(w, r)
+	if p == nil {
+		return
+	}
+
+	var req SelectelCredentialsRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		RespondError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	account := config.Account{
+		ID:        "user:" + p.User,
+		Name:      p.User,
+		AccountID: req.AccountID,
+	}
+	switch req.AuthMethod {
+	case "", config.AuthMethodPassword:
+		if req.Username == "" || req.Password == "" || req.AccountID == "" || req.ProjectName == "" {
+			RespondError(w, http.StatusBadRequest, errors.New("username, password, accountId and projectName are required"))
+			return
+		}
+		account.AuthMethod = config.AuthMethodPassword
+		account.Username = req.Username
+		account.Password = req.Password
+		account.ProjectName = req.ProjectName
+	case config.AuthMethodAppCredential:
+		if req.AppCredentialID == "" || req.AppCredentialSecret == "" {
+			RespondError(w, http.StatusBadRequest, errors.New("appCredentialId and appCredentialSecret are required"))
+			return
+		}
+		account.AuthMethod = config.AuthMethodAppCredential
+		account.AppCredentialID = req.AppCredentialID
+		account.AppCredentialSecret = req.AppCredentialSecret
+	default:
+		// The token method is not offered: a token file would read server-side paths.
+		RespondError(w, http.StatusBadRequest, fmt.Errorf("unsupported authMethod %q", req.AuthMethod))
+		return
+	}
+
+	client := auth.NewAccount(s.Config, account, s.Logger)
+	client.HTTPClient = s.Auth.HTTPClient
+	client.Retired = s.Auth.Retired
+	if _, err := client.GetAccountToken(r.Context()); err != nil {
+		s.Logger.Warn("user credentials rejected by selectel", "user", p.User, "error", err)
+		RespondError(w, http.StatusBadRequest, ErrInvalidCredentials)
+		return
+	}
+
+	plaintext, err := json.Marshal(account)
+	if err != nil {
+		RespondError(w, http.StatusInternalServerError, err)
+		return
+	}
+	sealed, err := s.Sealer.Seal(plaintext, credentialsLabel(p.User))
+	if err != nil {
+		RespondError(w, http.StatusInternalServerError, err)
+		return
+	}
+	err = s.Users.Update(p.User, func(u *users.User) error {
+		u.SelectelCredentials = sealed
+		return nil
+	})
+	if err != nil {
+		s.Logger.Error("failed to store user credentials", "user", p.User, "error", err)
+		RespondError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	// Reuse the verified client and its token.
+	s.userAuth.mu.Lock()
+	s.userAuth.clients[p.User] = userAuthEntry{client: client, sealed: sealed}
+	s.userAuth.mu.Unlock()
+
+	s.Logger.Info("selectel credentials linked", "user", p.User, "auth_method", account.AuthMethod)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// DeleteSelectelCredentials unlinks the caller's credentials.
+func (s *Server) DeleteSelectelCredentials(w http.ResponseWriter, r *http.Request) {
+	p := s.requirePerUser(w, r)
+	if p == nil {
+		return
+	}
+
+	err := s.Users.Update(p.User, func(u *users.User) error {
+		u.SelectelCredentials = ""
+		return nil
+	})
+	if err != nil {
+		s.Logger.Error("failed to remove user credentials", "user", p.User, "error", err)
+		RespondError(w, http.StatusInternalServerError, err)
+		return
+	}
+	s.userAuth.drop(p.User)
+
+	s.Logger.Info("selectel credentials unlinked", "user", p.User)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) requirePerUser(w http.ResponseWriter, r *http.Request) *Principal {
+	if !s.Config.SelectelPerUserCredentials || s.Sealer == nil {
+		RespondError(w, http.StatusNotFound, ErrPerUserDisabled)
+		return nil
+	}
+	return s.requirePrincipal(w, r)
+}
@@ -0,0 +1,233 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/generic/selectel-craas-web/internal/auth"
+	"github.com/generic/selectel-craas-web/internal/config"
+	"github.com/generic/selectel-craas-web/internal/craas"
+	"github.com/generic/selectel-craas-web/internal/sealer"
+	"github.com/generic/selectel-craas-web/internal/users"
+	"github.com/go-chi/chi/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testEncryptionKey is a valid CREDENTIALS_ENCRYPTION_KEY, 32 bytes in base64.
+const testEncryptionKey = "MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY="
+
+func TestSelectelCredentials(t *testing.T) {
+	// Fake Keystone that accepts only the password "good"
+	keystone := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Auth struct {
+				Identity struct {
+					Password struct {
+						User struct {
+							Name     string `json:"name"`
+							Password string `json:"password"`
+						} `json:"user"`
+					} `json:"password"`
+				} `json:"identity"`
+			} `json:"auth"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		if body.Auth.Identity.Password.User.Password != "good" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("X-Subject-Token", "token-"+body.Auth.Identity.Password.User.Name)
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{}`))
+	}))
+	defer keystone.Close()
+
+	s, err := sealer.New(testEncryptionKey)
+	require.NoError(t, err)
+	cfg := &config.Config{
+		AuthEnabled:                true,
+		SelectelAuthURL:            keystone.URL,
+		SelectelPerUserCredentials: true,
+	}
+	server := &Server{
+		Auth:     auth.New(cfg, testLogger),
+		Config:   cfg,
+		Logger:   testLogger,
+		Users:    newTestUsers(t),
+		Sealer:   s,
+		userAuth: newUserAuthCache(),
+	}
+
+	call := func(handler http.HandlerFunc, method string, body interface{}) *httptest.ResponseRecorder {
+		data, err := json.Marshal(body)
+		require.NoError(t, err)
+		req := withTestPrincipal(httptest.NewRequest(method, "/", bytes.NewBuffer(data)), "alice")
+		rr := httptest.NewRecorder()
+		handler(rr, req)
+		return rr
+	}
+	resolved := func() (int, *auth.Client) {
+		var client *auth.Client
+		handler := server.UserCredentials(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			client = server.authClient(r.Context())
+		}))
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, withTestPrincipal(httptest.NewRequest("GET", "/", nil), "alice"))
+		return rr.Code, client
+	}
+
+	code, _ := resolved()
+	assert.Equal(t, http.StatusForbidden, code, "unlinked users cannot reach Selectel")
+
+	req := SelectelCredentialsRequest{Username: "alice", Password: "bad", AccountID: "123", ProjectName: "p"}
+	rr := call(server.SetSelectelCredentials, "POST", req)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+
+	rr = call(server.SetSelectelCredentials, "POST", SelectelCredentialsRequest{AuthMethod: config.AuthMethodToken})
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+
+	req.Password = "good"
+	rr = call(server.SetSelectelCredentials, "POST", req)
+	require.Equal(t, http.StatusNoContent, rr.Code, rr.Body.String())
+
+	u, _, _ := server.Users.Get("alice")
+	assert.NotEmpty(t, u.SelectelCredentials)
+	assert.NotContains(t, u.SelectelCredentials, "good", "credentials are stored encrypted")
+
+	// Sealed credentials copied to another user do not open
+	require.NoError(t, server.Users.Update("mallory", func(m *users.User) error {
+		m.SelectelCredentials = u.SelectelCredentials
+		return nil
+	}))
+	_, err = server.loadUserCredentials("mallory")
+	assert.ErrorIs(t, err, sealer.ErrInvalid)
+
+	rr = call(server.GetSelectelCredentials, "GET", nil)
+	require.Equal(t, http.StatusOK, rr.Code)
+	assert.NotContains(t, rr.Body.String(), "good", "the password is never returned")
+	var status SelectelCredentialsStatus
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&status))
+	assert.Equal(t, SelectelCredentialsStatus{
+		Linked: true, AuthMethod: config.AuthMethodPassword, Username: "alice", AccountID: "123", ProjectName: "p",
+	}, status)
+
+	// A fresh cache decrypts the stored credentials
+	server.userAuth = newUserAuthCache()
+	code, client := resolved()
+	require.Equal(t, http.StatusOK, code)
+	token, err := client.GetAccountToken(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, "token-alice", token)
+
+	rr = call(server.DeleteSelectelCredentials, "DELETE", nil)
+	require.Equal(t, http.StatusNoContent, rr.Code)
+	code, _ = resolved()
+	assert.Equal(t, http.StatusForbidden, code)
+}
+
+func TestSelectelCredentials_Disabled(t *testing.T) {
+	server := &Server{Config: &config.Config{}, Logger: testLogger, userAuth: newUserAuthCache()}
+
+	rr := httptest.NewRecorder()
+	server.GetSelectelCredentials(rr, withTestPrincipal(httptest.NewRequest("GET", "/", nil), "alice"))
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+}
+
+func TestSelectelCredentials_ListingCache(t *testing.T) {
+	// Fake Keystone issuing tokens named after the user
+	keystone := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Auth struct {
+				Identity struct {
+					Password struct {
+						User struct {
+							Name string `json:"name"`
+						} `json:"user"`
+					} `json:"password"`
+				} `json:"identity"`
+			} `json:"auth"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		w.Header().Set("X-Subject-Token", "token-"+body.Auth.Identity.Password.User.Name)
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{}`))
+	}))
+	defer keystone.Close()
+
+	// Each user may only see their own registry of the shared project
+	var listings atomic.Int32
+	registry := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		listings.Add(1)
+		name := strings.TrimPrefix(r.Header.Get("X-Auth-Token"), "token-")
+		w.Write([]byte(`[{"id": "reg-` + name + `", "name": "` + name + `"}]`))
+	}))
+	defer registry.Close()
+
+	s, err := sealer.New(testEncryptionKey)
+	require.NoError(t, err)
+	cfg := &config.Config{
+		AuthEnabled:                true,
+		SelectelAuthURL:            keystone.URL,
+		SelectelCraasURL:           registry.URL + "/v1",
+		SelectelPerUserCredentials: true,
+		CacheTTL:                   time.Minute,
+	}
+	client := auth.New(cfg, testLogger)
+	server := &Server{
+		Auth:     client,
+		Accounts: []*auth.Client{client},
+		Craas:    craas.New(cfg, testLogger),
+		Config:   cfg,
+		Logger:   testLogger,
+		Users:    newTestUsers(t),
+		Sealer:   s,
+		userAuth: newUserAuthCache(),
+
+		projectCache: newProjectCache(time.Minute),
+	}
+	handler := server.UserCredentials(server.ProjectScope(http.HandlerFunc(server.ListRegistries)))
+
+	list := func(user string) string {
+		t.Helper()
+		rctx := chi.NewRouteContext()
+		rctx.URLParams.Add("pid", "p1")
+		req := httptest.NewRequest("GET", "/", nil)
+		req = withTestPrincipal(req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, rctx)), user)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+		return rr.Body.String()
+	}
+	link := func(user string) {
+		t.Helper()
+		data, err := json.Marshal(SelectelCredentialsRequest{Username: user, Password: "good", AccountID: "123", ProjectName: "p"})
+		require.NoError(t, err)
+		rr := httptest.NewRecorder()
+		server.SetSelectelCredentials(rr, withTestPrincipal(httptest.NewRequest("POST", "/", bytes.NewBuffer(data)), user))
+		require.Equal(t, http.StatusNoContent, rr.Code, rr.Body.String())
+	}
+	link("alice")
+	link("bob")
+
+	assert.Contains(t, list("alice"), "reg-alice")
+	assert.Contains(t, list("alice"), "reg-alice")
+	assert.Equal(t, int32(1), listings.Load(), "a user's listings are cached")
+
+	body := list("bob")
+	assert.Contains(t, body, "reg-bob")
+	assert.NotContains(t, body, "reg-alice", "another user's listing is not served")
+	assert.Equal(t, int32(2), listings.Load())
+
+	// New credentials do not reuse the listings of the old ones
+	link("alice")
+	list("alice")
+	assert.Equal(t, int32(3), listings.Load())
+}
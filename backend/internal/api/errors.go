@@ -0,0 +1,96 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/generic/selectel-craas-web/internal/craas"
+	"github.com/generic/selectel-craas-web/internal/resilience"
+)
+
+// Error codes sent in the "code" field of every error response. They are
+// stable, so the UI and scripts can branch on them instead of the message.
+const (
+	CodeBadRequest          = "bad_request"
+	CodeUnauthorized        = "unauthorized"
+	CodeForbidden           = "forbidden"
+	CodeNotFound            = "not_found"
+	CodeConflict            = "conflict"
+	CodeRateLimited         = "rate_limited"
+	CodeInternal            = "internal_error"
+	CodeUpstream            = "upstream_error"        // Selectel failed or sent an unexpected response
+	CodeUpstreamAuth        = "upstream_unauthorized" // Selectel rejected our credentials
+	CodeUpstreamUnavailable = "upstream_unavailable"  // The circuit to Selectel is open
+	CodeUpstreamTimeout     = "upstream_timeout"
+)
+
+// classifyError maps a failure to the status and code reported to the client.
+// It returns false for errors that carry no information beyond a 500.
+func classifyError(err error) (status int, code string, ok bool) {
+	var urlErr *url.Error
+	switch {
+	case errors.Is(err, craas.ErrNotFound):
+		return http.StatusNotFound, CodeNotFound, true
+	case errors.Is(err, craas.ErrConflict):
+		return http.StatusConflict, CodeConflict, true
+	case errors.Is(err, craas.ErrForbidden):
+		return http.StatusForbidden, CodeForbidden, true
+	case errors.Is(err, craas.ErrRateLimited):
+		return http.StatusTooManyRequests, CodeRateLimited, true
+	case errors.Is(err, craas.ErrBadRequest):
+		return http.StatusBadRequest, CodeBadRequest, true
+	// A 401 from CRaaS survives the token refresh in ExecuteWithRetry only when
+	// the credentials themselves are wrong; the user's own session is fine.
+	case errors.Is(err, craas.ErrUnauthorized):
+		return http.StatusBadGateway, CodeUpstreamAuth, true
+	case errors.Is(err, craas.ErrUpstream):
+		return http.StatusBadGateway, CodeUpstream, true
+	case errors.Is(err, resilience.ErrCircuitOpen):
+		return http.StatusServiceUnavailable, CodeUpstreamUnavailable, true
+	case errors.Is(err, context.DeadlineExceeded):
+		return http.StatusGatewayTimeout, CodeUpstreamTimeout, true
+	case errors.As(err, &urlErr):
+		if urlErr.Timeout() {
+			return http.StatusGatewayTimeout, CodeUpstreamTimeout, true
+		}
+		return http.StatusBadGateway, CodeUpstream, true
+	}
+	return 0, "", false
+}
+
+// codeForStatus is the code of errors that were not classified.
+func codeForStatus(status int) string {
+	switch status {
+	case http.StatusUnauthorized:
+		return CodeUnauthorized
+	case http.StatusForbidden:
+		return CodeForbidden
+	case http.StatusNotFound:
+		return CodeNotFound
+	case http.StatusConflict:
+		return CodeConflict
+	case http.StatusTooManyRequests:
+		return CodeRateLimited
+	case http.StatusBadGateway:
+		return CodeUpstream
+	case http.StatusServiceUnavailable:
+		return CodeUpstreamUnavailable
+	case http.StatusGatewayTimeout:
+		return CodeUpstreamTimeout
+	}
+	if status >= 400 && status < 500 {
+		return CodeBadRequest
+	}
+	return CodeInternal
+}
+
+// retryAfterHeader passes on how long CRaaS asked us to back off.
+func retryAfterHeader(w http.ResponseWriter, err error) {
+	var e *craas.Error
+	if errors.As(err, &e) && e.RetryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(e.RetryAfter.Seconds())))
+	}
+}
@@ -0,0 +1,79 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/generic/selectel-craas-web/internal/craas"
+	"github.com/generic/selectel-craas-web/internal/resilience"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRespondError(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		err    error
+		want   int
+		code   string
+	}{
+		{"Not Found", 500, &craas.Error{Kind: craas.ErrNotFound, Status: 404}, http.StatusNotFound, CodeNotFound},
+		{"Conflict", 500, fmt.Errorf("start gc: %w", &craas.Error{Kind: craas.ErrConflict, Status: 409}), http.StatusConflict, CodeConflict},
+		{"Forbidden", 500, &craas.Error{Kind: craas.ErrForbidden, Status: 403}, http.StatusForbidden, CodeForbidden},
+		{"Rate Limited", 500, &craas.Error{Kind: craas.ErrRateLimited, Status: 429}, http.StatusTooManyRequests, CodeRateLimited},
+		{"Rejected", 500, &craas.Error{Kind: craas.ErrBadRequest, Status: 400}, http.StatusBadRequest, CodeBadRequest},
+		{"Upstream Auth", 500, &craas.Error{Kind: craas.ErrUnauthorized, Status: 401}, http.StatusBadGateway, CodeUpstreamAuth},
+		{"Upstream", 500, &craas.Error{Kind: craas.ErrUpstream, Status: 500}, http.StatusBadGateway, CodeUpstream},
+		{"Circuit Open", 500, fmt.Errorf("x: %w", resilience.ErrCircuitOpen), http.StatusServiceUnavailable, CodeUpstreamUnavailable},
+		{"Timeout", 500, context.DeadlineExceeded, http.StatusGatewayTimeout, CodeUpstreamTimeout},
+		{"Internal", 500, errors.New("boom"), http.StatusInternalServerError, CodeInternal},
+		{"Explicit Status", http.StatusBadRequest, errors.New("invalid body"), http.StatusBadRequest, CodeBadRequest},
+		{"Explicit Unauthorized", http.StatusUnauthorized, errors.New("login required"), http.StatusUnauthorized, CodeUnauthorized},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			RespondError(rr, tt.status, tt.err)
+			assert.Equal(t, tt.want, rr.Code)
+
+			var body ErrorResponse
+			require.NoError(t, json.NewDecoder(rr.Body).Decode(&body))
+			assert.Equal(t, tt.code, body.Code)
+			assert.Equal(t, tt.err.Error(), body.Error)
+		})
+	}
+
+	rr := httptest.NewRecorder()
+	RespondError(rr, 500, &craas.Error{Kind: craas.ErrRateLimited, Status: 429, RetryAfter: 30 * time.Second})
+	assert.Equal(t, "30", rr.Header().Get("Retry-After"))
+}
+
+func TestRequestID(t *testing.T) {
+	s := &Server{Logger: testLogger}
+	handler := s.RequestID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		RespondError(w, http.StatusNotFound, errors.New("missing"))
+	}))
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("GET", "/", nil))
+	id := rr.Header().Get("X-Request-ID")
+	assert.NotEmpty(t, id)
+	var body ErrorResponse
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&body))
+	assert.Equal(t, id, body.RequestID)
+
+	// An ID set by a proxy is kept
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("X-Request-ID", "proxy-42")
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	assert.Equal(t, "proxy-42", rr.Header().Get("X-Request-ID"))
+}
@@ -4,6 +4,7 @@ import (
 	"net/http"
 
 	"github.com/go-chi/chi/v5"
+	"github.com/selectel/craas-go/pkg/v1/repository"
 )
 
 func (s *Server) ListImages(w http.ResponseWriter, r *http.Request) {
@@ -15,8 +16,14 @@ func (s *Server) ListImages(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var result interface{}
-	err := s.ExecuteWithRetry(r.Context(), pid, func(token string) error {
+	query, err := parseListQuery(r.URL.Query(), imageFields)
+	if err != nil {
+		RespondError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	var result []*repository.Image
+	err = s.ExecuteWithRetry(r.Context(), pid, func(token string) error {
 		var err error
 		result, err = s.Craas.ListImages(r.Context(), token, rid, rname)
 		return err
@@ -28,7 +35,7 @@ func (s *Server) ListImages(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	RespondJSON(w, http.StatusOK, result)
+	respondListing(w, r, query, result, imageFields)
 }
 
 func (s *Server) ListTags(w http.ResponseWriter, r *http.Request) {
@@ -40,8 +47,14 @@ func (s *Server) ListTags(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var result interface{}
-	err := s.ExecuteWithRetry(r.Context(), pid, func(token string) error {
+	query, err := parseListQuery(r.URL.Query(), tagFields)
+	if err != nil {
+		RespondError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	var result []string
+	err = s.ExecuteWithRetry(r.Context(), pid, func(token string) error {
 		var err error
 		result, err = s.Craas.ListTags(r.Context(), token, rid, rname)
 		return err
@@ -53,11 +66,11 @@ func (s *Server) ListTags(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	RespondJSON(w, http.StatusOK, result)
+	respondListing(w, r, query, result, tagFields)
 }
 
 func (s *Server) DeleteImage(w http.ResponseWriter, r *http.Request) {
-	if !s.checkDeleteImage(w) {
+	if !s.checkDeleteImage(w, r) {
 		return
 	}
 
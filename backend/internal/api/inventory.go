@@ -0,0 +1,61 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+)
+
+var ErrInventoryUnavailable = errors.New("inventory is not available")
+
+// maxSearchResults caps the limit parameter of SearchInventory.
+const maxSearchResults = 1000
+
+// inventoryAccount returns the ID of the configured account selected by the
+// route. The crawler does not use per-user credentials, so it fails for them,
+// as it does when the inventory is disabled.
+func (s *Server) inventoryAccount(w http.ResponseWriter, r *http.Request) (string, bool) {
+	client := s.authClient(r.Context())
+	if s.Inventory == nil || s.account(client.Account().ID) != client {
+		RespondError(w, http.StatusNotFound, ErrInventoryUnavailable)
+		return "", false
+	}
+	return client.Account().ID, true
+}
+
+// InventoryStatus reports the crawler's progress and when each registry of
+// the account was last crawled.
+func (s *Server) InventoryStatus(w http.ResponseWriter, r *http.Request) {
+	account, ok := s.inventoryAccount(w, r)
+	if !ok {
+		return
+	}
+	RespondJSON(w, http.StatusOK, s.Inventory.Status(r.Context(), account))
+}
+
+// SearchInventory finds images of the account by repository name, tag or
+// digest in the inventory, without calling Selectel.
+func (s *Server) SearchInventory(w http.ResponseWriter, r *http.Request) {
+	account, ok := s.inventoryAccount(w, r)
+	if !ok {
+		return
+	}
+
+	query := r.URL.Query().Get("q")
+	if query == "" {
+		RespondError(w, http.StatusBadRequest, errors.New("q parameter required"))
+		return
+	}
+	limit := 100
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxSearchResults {
+			RespondError(w, http.StatusBadRequest, errors.New("limit must be between 1 and 1000"))
+			return
+		}
+		limit = n
+	}
+
+	hits, total := s.Inventory.Search(r.Context(), account, query, limit)
+	RespondJSON(w, http.StatusOK, map[string]interface{}{"results": hits, "total": total})
+}
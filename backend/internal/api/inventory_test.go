@@ -0,0 +1,57 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/generic/selectel-craas-web/internal/auth"
+	"github.com/generic/selectel-craas-web/internal/config"
+	"github.com/generic/selectel-craas-web/internal/craas"
+	"github.com/generic/selectel-craas-web/internal/inventory"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInventoryRoutes(t *testing.T) {
+	cfg := &config.Config{}
+	client := auth.New(cfg, testLogger)
+	server := &Server{Auth: client, Accounts: []*auth.Client{client}, Config: cfg, Logger: testLogger}
+
+	get := func(handler http.HandlerFunc, target string, ctx context.Context) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		handler(rr, httptest.NewRequest("GET", target, nil).WithContext(ctx))
+		return rr
+	}
+
+	// Disabled
+	rr := get(server.InventoryStatus, "/api/inventory", t.Context())
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+
+	store, err := inventory.NewStore("", testLogger)
+	require.NoError(t, err)
+	server.Inventory = inventory.NewCrawler(cfg, craas.New(cfg, testLogger), nil, store, testLogger)
+
+	rr = get(server.InventoryStatus, "/api/inventory", t.Context())
+	require.Equal(t, http.StatusOK, rr.Code)
+	var status inventory.Status
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&status))
+	assert.Empty(t, status.Registries)
+
+	rr = get(server.SearchInventory, "/api/inventory/search?q=app", t.Context())
+	require.Equal(t, http.StatusOK, rr.Code)
+	assert.JSONEq(t, `{"results": [], "total": 0}`, rr.Body.String())
+
+	for _, target := range []string{"/api/inventory/search", "/api/inventory/search?q=app&limit=0"} {
+		rr = get(server.SearchInventory, target, t.Context())
+		assert.Equal(t, http.StatusBadRequest, rr.Code, target)
+	}
+
+	// Per-user credentials are not crawled
+	userClient := auth.New(cfg, testLogger)
+	ctx := context.WithValue(t.Context(), accountKey, userClient)
+	rr = get(server.InventoryStatus, "/api/inventory", ctx)
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+}
@@ -0,0 +1,328 @@
+package api
+
+import (
+	"cmp"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/selectel/craas-go/pkg/v1/repository"
+)
+
+// maxPageSize caps the limit parameter of paginated listings.
+const maxPageSize = 1000
+
+// Page is a paginated listing, returned instead of a bare array when the
+// request has a limit or a cursor.
+type Page[T any] struct {
+	Items      []T    `json:"items"`
+	Total      int    `json:"total"`               // Items matching the filters, on all pages
+	TotalSize  *int64 `json:"totalSize,omitempty"` // Their size in bytes, for images and repositories
+	NextCursor string `json:"nextCursor,omitempty"`
+}
+
+// listQuery holds the sorting, filtering and pagination parameters of a
+// repository, image or tag listing.
+type listQuery struct {
+	paged  bool
+	limit  int
+	offset int
+
+	sort string
+	desc bool
+
+	match     string // Glob matched against the name, or any tag of an image
+	untagged  bool
+	minSize   int64
+	maxSize   int64 // 0 means no maximum
+	after     time.Time
+	before    time.Time
+	hasFilter bool
+}
+
+// listFields describes what a listing of T can be sorted and filtered by.
+// Fields left nil are not supported and rejected when requested.
+type listFields[T any] struct {
+	key       func(T) string // Unique; sorts by name and breaks ties
+	name      func(T) string // Sort by name; nil sorts by key
+	matches   func(T, string) bool
+	matchName string // Query parameter of the glob
+	tags      func(T) []string
+	size      func(T) int64
+	time      func(T) time.Time
+	timeName  string // createdAt or updatedAt
+}
+
+var repositoryFields = listFields[*repository.Repository]{
+	key:       func(r *repository.Repository) string { return r.Name },
+	matches:   func(r *repository.Repository, pattern string) bool { return globMatch(pattern, r.Name) },
+	matchName: "name",
+	size:      func(r *repository.Repository) int64 { return r.Size },
+	time:      func(r *repository.Repository) time.Time { return r.UpdatedAt },
+	timeName:  "updatedAt",
+}
+
+var imageFields = listFields[*repository.Image]{
+	key: func(img *repository.Image) string { return img.Digest },
+	// Images sort by their first tag in order; untagged ones come last
+	name: func(img *repository.Image) string {
+		if len(img.Tags) == 0 {
+			return "\uffff"
+		}
+		return slices.Min(img.Tags)
+	},
+	matches: func(img *repository.Image, pattern string) bool {
+		return slices.ContainsFunc(img.Tags, func(tag string) bool { return globMatch(pattern, tag) })
+	},
+	matchName: "tag",
+	tags:      func(img *repository.Image) []string { return img.Tags },
+	size:      func(img *repository.Image) int64 { return img.Size },
+	time:      func(img *repository.Image) time.Time { return img.CreatedAt },
+	timeName:  "createdAt",
+}
+
+var tagFields = listFields[string]{
+	key:       func(tag string) string { return tag },
+	matches:   func(tag, pattern string) bool { return globMatch(pattern, tag) },
+	matchName: "tag",
+}
+
+func globMatch(pattern, name string) bool {
+	ok, _ := path.Match(pattern, name)
+	return ok
+}
+
+// parseListQuery reads the listing parameters supported by fields:
+//
+//	limit, cursor                 paginate; either one selects the Page envelope
+//	sort=name|size|<time>, order  sort, ascending unless order=desc
+//	name or tag                   glob, e.g. tag=v1.*
+//	untagged=true                 images without tags only
+//	minSize, maxSize              size range in bytes, inclusive
+//	createdAfter, createdBefore   RFC 3339, e.g. 2024-01-01T00:00:00Z; updated* for repositories
+func parseListQuery[T any](v url.Values, fields listFields[T]) (listQuery, error) {
+	var q listQuery
+
+	if s := v.Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 || n > maxPageSize {
+			return q, fmt.Errorf("limit must be between 1 and %d", maxPageSize)
+		}
+		q.limit = n
+		q.paged = true
+	}
+	if s := v.Get("cursor"); s != "" {
+		offset, err := decodeCursor(s)
+		if err != nil {
+			return q, err
+		}
+		q.offset = offset
+		q.paged = true
+	}
+
+	q.sort = v.Get("sort")
+	switch q.sort {
+	case "", "name":
+	case "size":
+		if fields.size == nil {
+			return q, errors.New("sort by size is not supported here")
+		}
+	default:
+		if fields.time == nil || q.sort != fields.timeName {
+			return q, fmt.Errorf("unsupported sort %q", q.sort)
+		}
+	}
+	switch v.Get("order") {
+	case "", "asc":
+	case "desc":
+		q.desc = true
+	default:
+		return q, errors.New("order must be asc or desc")
+	}
+
+	if q.match = v.Get(fields.matchName); q.match != "" {
+		if _, err := path.Match(q.match, ""); err != nil {
+			return q, fmt.Errorf("invalid %s pattern", fields.matchName)
+		}
+		q.hasFilter = true
+	}
+
+	if s := v.Get("untagged"); s != "" {
+		if fields.tags == nil {
+			return q, errors.New("untagged filter is not supported here")
+		}
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return q, errors.New("untagged must be true or false")
+		}
+		q.untagged = b
+		q.hasFilter = q.hasFilter || b
+	}
+
+	for _, p := range []struct {
+		name string
+		dst  *int64
+	}{{"minSize", &q.minSize}, {"maxSize", &q.maxSize}} {
+		s := v.Get(p.name)
+		if s == "" {
+			continue
+		}
+		if fields.size == nil {
+			return q, fmt.Errorf("%s filter is not supported here", p.name)
+		}
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil || n < 0 {
+			return q, fmt.Errorf("%s must be a number of bytes", p.name)
+		}
+		*p.dst = n
+		q.hasFilter = true
+	}
+
+	if fields.time != nil {
+		prefix := strings.TrimSuffix(fields.timeName, "At") // createdAfter, not createdAtAfter
+		for _, p := range []struct {
+			name string
+			dst  *time.Time
+		}{{prefix + "After", &q.after}, {prefix + "Before", &q.before}} {
+			s := v.Get(p.name)
+			if s == "" {
+				continue
+			}
+			t, err := time.Parse(time.RFC3339, s)
+			if err != nil {
+				return q, fmt.Errorf("%s must be an RFC 3339 time", p.name)
+			}
+			*p.dst = t
+			q.hasFilter = true
+		}
+	}
+	return q, nil
+}
+
+// applyListQuery filters and sorts items, which it may reorder, and cuts out
+// the requested page. Pages are sorted by name by default; without limit and
+// cursor all items are returned, and only sorted if asked to.
+func applyListQuery[T any](q listQuery, items []T, fields listFields[T]) Page[T] {
+	if q.hasFilter {
+		items = slices.DeleteFunc(items, func(item T) bool { return !keepItem(q, item, fields) })
+	}
+	if q.sort == "" && !q.paged {
+		return Page[T]{Items: items, Total: len(items)} // Keeps the order of CRaaS
+	}
+
+	name := fields.name
+	if name == nil {
+		name = fields.key
+	}
+	slices.SortStableFunc(items, func(a, b T) int {
+		var c int
+		switch {
+		case q.sort == "size":
+			c = cmp.Compare(fields.size(a), fields.size(b))
+		case q.sort != "" && q.sort != "name":
+			c = fields.time(a).Compare(fields.time(b))
+		default:
+			c = strings.Compare(name(a), name(b))
+		}
+		if c == 0 {
+			c = strings.Compare(fields.key(a), fields.key(b))
+		}
+		if q.desc {
+			return -c
+		}
+		return c
+	})
+	if !q.paged {
+		return Page[T]{Items: items, Total: len(items)}
+	}
+
+	page := Page[T]{Items: []T{}, Total: len(items)}
+	if fields.size != nil {
+		var total int64
+		for _, item := range items {
+			total += fields.size(item)
+		}
+		page.TotalSize = &total
+	}
+	if q.offset < len(items) {
+		end := len(items)
+		if q.limit > 0 {
+			end = min(q.offset+q.limit, len(items))
+		}
+		page.Items = items[q.offset:end]
+		if end < len(items) {
+			page.NextCursor = encodeCursor(end)
+		}
+	}
+	return page
+}
+
+// respondListing sends the page of items selected by q: as a Page envelope
+// when the request has a limit or a cursor, as a bare array otherwise, or as
+// NDJSON when the client accepts it. NDJSON pages carry the envelope's fields
+// in X-Total-Count and X-Next-Cursor headers.
+func respondListing[T any](w http.ResponseWriter, r *http.Request, q listQuery, items []T, fields listFields[T]) {
+	page := applyListQuery(q, items, fields)
+	w.Header().Add("Vary", "Accept")
+	switch {
+	case acceptsNDJSON(r):
+		if q.paged {
+			w.Header().Set("X-Total-Count", strconv.Itoa(page.Total))
+			if page.NextCursor != "" {
+				w.Header().Set("X-Next-Cursor", page.NextCursor)
+			}
+		}
+		RespondNDJSON(w, page.Items)
+	case q.paged:
+		RespondList(w, r, page, cacheRevalidate)
+	default:
+		RespondList(w, r, page.Items, cacheRevalidate)
+	}
+}
+
+func keepItem[T any](q listQuery, item T, fields listFields[T]) bool {
+	if q.match != "" && !fields.matches(item, q.match) {
+		return false
+	}
+	if q.untagged && len(fields.tags(item)) > 0 {
+		return false
+	}
+	if fields.size != nil {
+		size := fields.size(item)
+		if size < q.minSize || (q.maxSize > 0 && size > q.maxSize) {
+			return false
+		}
+	}
+	if fields.time != nil {
+		t := fields.time(item)
+		if (!q.after.IsZero() && !t.After(q.after)) || (!q.before.IsZero() && !t.Before(q.before)) {
+			return false
+		}
+	}
+	return true
+}
+
+// Cursors are opaque to clients; they hold the offset of the next page in
+// the sorted and filtered listing.
+func encodeCursor(offset int) string {
+	return base64.RawURLEncoding.EncodeToString([]byte("o:" + strconv.Itoa(offset)))
+}
+
+func decodeCursor(s string) (int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err == nil {
+		if rest, ok := strings.CutPrefix(string(b), "o:"); ok {
+			if n, err := strconv.Atoi(rest); err == nil && n >= 0 {
+				return n, nil
+			}
+		}
+	}
+	return 0, errors.New("invalid cursor")
+}
@@ -0,0 +1,187 @@
+package api
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/selectel/craas-go/pkg/v1/repository"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testImages() []*repository.Image {
+	day := func(d int) time.Time { return time.Date(2024, 1, d, 0, 0, 0, 0, time.UTC) }
+	return []*repository.Image{
+		{Digest: "sha256:c", Tags: []string{"v1.0", "stable"}, Size: 300, CreatedAt: day(1)},
+		{Digest: "sha256:a", Tags: nil, Size: 100, CreatedAt: day(2)},
+		{Digest: "sha256:b", Tags: []string{"v2.0"}, Size: 200, CreatedAt: day(3)},
+		{Digest: "sha256:d", Tags: []string{"latest"}, Size: 200, CreatedAt: day(4)},
+	}
+}
+
+func digests(images []*repository.Image) []string {
+	var result []string
+	for _, img := range images {
+		result = append(result, img.Digest)
+	}
+	return result
+}
+
+func queryImages(t *testing.T, query string) Page[*repository.Image] {
+	v, err := url.ParseQuery(query)
+	require.NoError(t, err)
+	q, err := parseListQuery(v, imageFields)
+	require.NoError(t, err, query)
+	return applyListQuery(q, testImages(), imageFields)
+}
+
+func TestListQueryArray(t *testing.T) {
+	// Without parameters the listing is unchanged
+	result := queryImages(t, "")
+	assert.Equal(t, []string{"sha256:c", "sha256:a", "sha256:b", "sha256:d"}, digests(result.Items))
+
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{"sort=name", []string{"sha256:d", "sha256:c", "sha256:b", "sha256:a"}},
+		{"sort=size", []string{"sha256:a", "sha256:b", "sha256:d", "sha256:c"}},
+		{"sort=size&order=desc", []string{"sha256:c", "sha256:d", "sha256:b", "sha256:a"}},
+		{"sort=createdAt&order=desc", []string{"sha256:d", "sha256:b", "sha256:a", "sha256:c"}},
+		{"tag=v*", []string{"sha256:c", "sha256:b"}},
+		{"untagged=true", []string{"sha256:a"}},
+		{"minSize=150&maxSize=250", []string{"sha256:b", "sha256:d"}},
+		{"createdAfter=2024-01-01T00:00:00Z&createdBefore=2024-01-04T00:00:00Z", []string{"sha256:a", "sha256:b"}},
+	}
+	for _, tt := range tests {
+		result := queryImages(t, tt.query)
+		assert.Equal(t, tt.want, digests(result.Items), tt.query)
+	}
+}
+
+func TestListQueryPages(t *testing.T) {
+	var all []string
+	cursor := ""
+	for range 3 {
+		query := "limit=3&sort=size"
+		if cursor != "" {
+			query += "&cursor=" + cursor
+		}
+		page := queryImages(t, query)
+		assert.Equal(t, 4, page.Total)
+		require.NotNil(t, page.TotalSize)
+		assert.Equal(t, int64(800), *page.TotalSize)
+		all = append(all, digests(page.Items)...)
+		cursor = page.NextCursor
+		if cursor == "" {
+			break
+		}
+	}
+	assert.Equal(t, []string{"sha256:a", "sha256:b", "sha256:d", "sha256:c"}, all)
+
+	// Totals count the filtered items
+	page := queryImages(t, "limit=10&tag=v*")
+	assert.Equal(t, 2, page.Total)
+	assert.Equal(t, int64(500), *page.TotalSize)
+	assert.Empty(t, page.NextCursor)
+
+	// A cursor past the end gives an empty page
+	page = queryImages(t, "cursor="+encodeCursor(10))
+	assert.Empty(t, page.Items)
+	assert.NotNil(t, page.Items)
+}
+
+func TestListQueryTags(t *testing.T) {
+	v := url.Values{"tag": {"v1.*"}, "limit": {"1"}}
+	q, err := parseListQuery(v, tagFields)
+	require.NoError(t, err)
+	page := applyListQuery(q, []string{"v1.2", "latest", "v1.10", "v2.0"}, tagFields)
+	assert.Equal(t, []string{"v1.10"}, page.Items)
+	assert.Equal(t, 2, page.Total)
+	assert.Nil(t, page.TotalSize)
+	assert.NotEmpty(t, page.NextCursor)
+}
+
+func TestListQueryInvalid(t *testing.T) {
+	for _, query := range []string{
+		"limit=0", "limit=1001", "limit=x", "cursor=bogus", "sort=digest", "sort=updatedAt",
+		"order=up", "tag=[", "untagged=maybe", "minSize=-1", "createdAfter=yesterday",
+	} {
+		v, _ := url.ParseQuery(query)
+		_, err := parseListQuery(v, imageFields)
+		assert.Error(t, err, query)
+	}
+
+	// Parameters that do not apply to the listing are rejected, not ignored
+	for _, query := range []string{"sort=size", "untagged=true", "minSize=1"} {
+		v, _ := url.ParseQuery(query)
+		_, err := parseListQuery(v, tagFields)
+		assert.Error(t, err, query)
+	}
+	v, _ := url.ParseQuery("sort=updatedAt&updatedAfter=2024-01-01T00:00:00Z")
+	_, err := parseListQuery(v, repositoryFields)
+	assert.NoError(t, err)
+}
+
+func TestRespondListing(t *testing.T) {
+	var tags []string
+	for i := range 250 {
+		tags = append(tags, fmt.Sprintf("v%03d", i))
+	}
+	get := func(query, accept string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/api/projects/p1/registries/r1/tags?"+query, nil)
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		q, err := parseListQuery(req.URL.Query(), tagFields)
+		require.NoError(t, err)
+		rr := httptest.NewRecorder()
+		respondListing(rr, req, q, slices.Clone(tags), tagFields)
+		require.Equal(t, http.StatusOK, rr.Code)
+		assert.Equal(t, "Accept", rr.Header().Get("Vary"))
+		return rr
+	}
+	lines := func(rr *httptest.ResponseRecorder) []string {
+		var result []string
+		scanner := bufio.NewScanner(rr.Body)
+		for scanner.Scan() {
+			var tag string
+			require.NoError(t, json.Unmarshal(scanner.Bytes(), &tag))
+			result = append(result, tag)
+		}
+		return result
+	}
+
+	rr := get("", "")
+	assert.Equal(t, "application/json", rr.Header().Get("Content-Type"))
+	assert.NotEmpty(t, rr.Header().Get("ETag"))
+	var array []string
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&array))
+	assert.Equal(t, tags, array)
+
+	rr = get("", "application/json, application/x-ndjson;q=0.9")
+	assert.Equal(t, "application/json", rr.Header().Get("Content-Type"), "JSON is preferred")
+
+	rr = get("", "application/json;q=0.5, application/x-ndjson")
+	assert.Equal(t, "application/x-ndjson", rr.Header().Get("Content-Type"))
+	assert.Empty(t, rr.Header().Get("ETag"))
+	assert.Equal(t, tags, lines(rr))
+
+	// Pages are sent as NDJSON too, with the envelope's fields in headers
+	rr = get("limit=100&tag=v1*", "application/x-ndjson")
+	assert.Equal(t, tags[100:200], lines(rr))
+	assert.Equal(t, "100", rr.Header().Get("X-Total-Count"))
+	assert.Empty(t, rr.Header().Get("X-Next-Cursor"))
+
+	rr = get("limit=100", "application/x-ndjson")
+	assert.Equal(t, tags[:100], lines(rr))
+	assert.Equal(t, "250", rr.Header().Get("X-Total-Count"))
+	assert.Equal(t, encodeCursor(100), rr.Header().Get("X-Next-Cursor"))
+}
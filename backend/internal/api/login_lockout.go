@@ -0,0 +1,108 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/generic/selectel-craas-web/internal/state"
+)
+
+var ErrAccountLocked = errors.New("too many failed login attempts, try again later")
+
+// LoginLockout counts failed logins per username. After threshold consecutive
+// failures the account is locked, and each further failure doubles the lock
+// up to maxLock. Unlike the per-IP rate limit, this also stops attacks spread
+// over many addresses. The counts are kept in the state store, so replicas
+// sharing it lock together. A nil *LoginLockout never locks.
+type LoginLockout struct {
+	state     state.Store
+	threshold int
+	baseLock  time.Duration
+	maxLock   time.Duration
+	now       func() time.Time
+}
+
+type lockoutEntry struct {
+	Failures    int       `json:"failures"`
+	LockedUntil time.Time `json:"lockedUntil"`
+}
+
+// NewLoginLockout returns nil (disabled) when threshold is not positive.
+func NewLoginLockout(st state.Store, threshold int, baseLock, maxLock time.Duration) *LoginLockout {
+	if threshold <= 0 {
+		return nil
+	}
+	return &LoginLockout{
+		state:     st,
+		threshold: threshold,
+		baseLock:  baseLock,
+		maxLock:   max(maxLock, baseLock),
+		now:       time.Now,
+	}
+}
+
+func lockoutKey(user string) string {
+	return "lockout/" + user
+}
+
+// Locked returns how long the account stays locked, or zero.
+func (l *LoginLockout) Locked(ctx context.Context, user string) (time.Duration, error) {
+	if l == nil {
+		return 0, nil
+	}
+	data, err := l.state.Get(ctx, lockoutKey(user))
+	if errors.Is(err, state.ErrNotFound) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	var e lockoutEntry
+	if err := json.Unmarshal(data, &e); err != nil {
+		return 0, err
+	}
+	return max(e.LockedUntil.Sub(l.now()), 0), nil
+}
+
+// Fail records a failed attempt and returns the lock duration it caused, if any.
+// Accounts without failures for longer than the maximum lock are forgotten.
+func (l *LoginLockout) Fail(ctx context.Context, user string) (time.Duration, error) {
+	if l == nil {
+		return 0, nil
+	}
+	var lock time.Duration
+	err := l.state.Update(ctx, lockoutKey(user), func(old []byte) ([]byte, time.Duration, error) {
+		var e lockoutEntry
+		if old != nil {
+			if err := json.Unmarshal(old, &e); err != nil {
+				return nil, 0, err
+			}
+		}
+		now := l.now()
+		e.Failures++
+
+		lock = 0
+		if e.Failures >= l.threshold {
+			lock = l.baseLock
+			for i := l.threshold; i < e.Failures && lock < l.maxLock; i++ {
+				lock *= 2
+			}
+			lock = min(lock, l.maxLock)
+			e.LockedUntil = now.Add(lock)
+		}
+
+		value, err := json.Marshal(e)
+		return value, l.maxLock, err
+	})
+	return lock, err
+}
+
+// Reset clears the failures after a successful login.
+func (l *LoginLockout) Reset(ctx context.Context, user string) error {
+	if l == nil {
+		return nil
+	}
+	return l.state.Delete(ctx, lockoutKey(user))
+}
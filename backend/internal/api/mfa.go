@@ -0,0 +1,414 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/generic/selectel-craas-web/internal/mfa"
+	"github.com/generic/selectel-craas-web/internal/sealer"
+	"github.com/generic/selectel-craas-web/internal/users"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+var (
+	ErrMFARequired    = errors.New("two-factor authentication is required for this action")
+	ErrInvalidMFACode = errors.New("invalid two-factor authentication code")
+	ErrMFANotEnabled  = errors.New("two-factor authentication is not enabled")
+	ErrMFANotPending  = errors.New("no pending two-factor enrollment, start enrollment first")
+	ErrMFAAlreadyOn   = errors.New("two-factor authentication is already enabled")
+	ErrMFAChallenge   = errors.New("invalid or expired two-factor challenge")
+)
+
+// mfaChallengeExpiry is how long the user has to submit the second factor.
+const mfaChallengeExpiry = 5 * time.Minute
+
+type MFACodeRequest struct {
+	Code string `json:"code"`
+}
+
+type MFALoginRequest struct {
+	MFAToken string `json:"mfaToken"`
+	Code     string `json:"code"`
+}
+
+type MFAStatusResponse struct {
+	Enabled                bool `json:"enabled"`
+	Pending                bool `json:"pending"`
+	Required               bool `json:"required"`
+	RecoveryCodesRemaining int  `json:"recoveryCodesRemaining"`
+}
+
+type RecoveryCodesResponse struct {
+	RecoveryCodes []string `json:"recoveryCodes"`
+}
+
+// signMFAChallenge issues a short-lived token proving that the password step
+// succeeded. It cannot be used as a session token because it has no session ID.
+func (s *Server) signMFAChallenge(user string) (string, error) {
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"sub": user,
+		"pur": "mfa",
+		"exp": time.Now().Add(mfaChallengeExpiry).Unix(),
+	})
+	return token.SignedString(s.jwtSecret())
+}
+
+func (s *Server) parseMFAChallenge(tokenString string) (string, error) {
+	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, errors.New("unexpected signing method")
+		}
+		return s.jwtSecret(), nil
+	})
+	if err != nil || !token.Valid {
+		return "", ErrMFAChallenge
+	}
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok || claims["pur"] != "mfa" {
+		return "", ErrMFAChallenge
+	}
+	sub, _ := claims["sub"].(string)
+	if sub == "" {
+		return "", ErrMFAChallenge
+	}
+	return sub, nil
+}
+
+// sealedPrefix marks TOTP secrets sealed with CREDENTIALS_ENCRYPTION_KEY.
+// Without the key they are stored in plaintext; base32 has no colon.
+const sealedPrefix = "sealed:"
+
+// totpLabel binds a sealed TOTP secret to its user.
+func totpLabel(user string) string {
+	return "totp/" + user
+}
+
+// sealTOTPSecret returns the secret as it is stored: sealed if a key is
+// configured, plaintext otherwise.
+func (s *Server) sealTOTPSecret(user, secret string) (string, error) {
+	if s.Sealer == nil {
+		return secret, nil
+	}
+	sealed, err := s.Sealer.Seal([]byte(secret), totpLabel(user))
+	if err != nil {
+		return "", err
+	}
+	return sealedPrefix + sealed, nil
+}
+
+// openTOTPSecret returns the plaintext of a stored secret.
+func (s *Server) openTOTPSecret(user, stored string) (string, error) {
+	sealed, ok := strings.CutPrefix(stored, sealedPrefix)
+	if !ok {
+		return stored, nil
+	}
+	if s.Sealer == nil {
+		return "", sealer.ErrNoKey
+	}
+	secret, err := s.Sealer.Open(sealed, totpLabel(user))
+	if err != nil {
+		return "", err
+	}
+	return string(secret), nil
+}
+
+// verifySecondFactor accepts either a current TOTP code or an unused recovery code.
+// A secret stored in plaintext before a key was configured is sealed on the way.
+func (s *Server) verifySecondFactor(user, code string) error {
+	return s.Users.Update(user, func(u *users.User) error {
+		if !u.TOTPEnabled() {
+			return ErrMFANotEnabled
+		}
+		secret, err := s.openTOTPSecret(user, u.TOTP.Secret)
+		if err != nil {
+			return err
+		}
+		if s.Sealer != nil && !strings.HasPrefix(u.TOTP.Secret, sealedPrefix) {
+			if u.TOTP.Secret, err = s.sealTOTPSecret(user, secret); err != nil {
+				return err
+			}
+		}
+		if step, ok := mfa.ValidateCode(secret, code, u.TOTP.LastUsedStep, time.Now()); ok {
+			u.TOTP.LastUsedStep = step
+			return nil
+		}
+		if remaining, ok := mfa.UseRecoveryCode(u.TOTP.RecoveryCodes, code); ok {
+			u.TOTP.RecoveryCodes = remaining
+			s.Logger.Warn("recovery code used", "user", user, "remaining", len(remaining))
+			return nil
+		}
+		return ErrInvalidMFACode
+	})
+}
+
+// mfaEnrollmentRequired reports whether the user must enroll before deleting.
+func (s *Server) mfaEnrollmentRequired(user string) bool {
+	if !s.Config.AuthEnabled || !s.Config.AuthRequire2FAForDelete || !s.Config.DeleteEnabled() || s.Config.HeaderAuth() {
+		return false
+	}
+	u, _, err := s.Users.Get(user)
+	if err != nil {
+		s.Logger.Warn("failed to load user", "user", user, "error", err)
+		return false // Only a hint; deleting still requires the second factor
+	}
+	return !u.TOTPEnabled()
+}
+
+// checkMFA enforces AUTH_REQUIRE_2FA_FOR_DELETE for destructive actions.
+func (s *Server) checkMFA(w http.ResponseWriter, r *http.Request) bool {
+	if !s.Config.AuthEnabled || !s.Config.AuthRequire2FAForDelete {
+		return true
+	}
+	if p := PrincipalFromContext(r.Context()); p == nil || !p.MFA {
+		RespondError(w, http.StatusForbidden, ErrMFARequired)
+		return false
+	}
+	return true
+}
+
+// LoginMFA completes a login that requires a second factor.
+func (s *Server) LoginMFA(w http.ResponseWriter, r *http.Request) {
+	if !s.Config.AuthEnabled {
+		RespondError(w, http.StatusBadRequest, errors.New("authentication is disabled"))
+		return
+	}
+	if s.Config.HeaderAuth() {
+		RespondError(w, http.StatusBadRequest, ErrHeaderAuthLogin)
+		return
+	}
+
+	var req MFALoginRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		RespondError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	user, err := s.parseMFAChallenge(req.MFAToken)
+	if err != nil {
+		RespondError(w, http.StatusUnauthorized, err)
+		return
+	}
+	if !s.checkLockout(w, r, user) {
+		return
+	}
+	if err := s.verifySecondFactor(user, req.Code); err != nil {
+		s.Logger.Warn("second factor rejected", "user", user, "error", err)
+		s.loginFailed(r, user)
+		RespondError(w, http.StatusUnauthorized, ErrInvalidMFACode)
+		return
+	}
+
+	s.completeLogin(w, r, user, true)
+}
+
+// MFAStatus reports the 2FA enrollment of the current user.
+func (s *Server) MFAStatus(w http.ResponseWriter, r *http.Request) {
+	p := s.requirePrincipal(w, r)
+	if p == nil {
+		return
+	}
+
+	u, _, err := s.Users.Get(p.User)
+	if err != nil {
+		RespondError(w, http.StatusInternalServerError, err)
+		return
+	}
+	resp := MFAStatusResponse{
+		Enabled:  u.TOTPEnabled(),
+		Required: s.Config.AuthRequire2FAForDelete && s.Config.DeleteEnabled(),
+	}
+	if u.TOTP != nil {
+		resp.Pending = u.TOTP.PendingSecret != ""
+		resp.RecoveryCodesRemaining = len(u.TOTP.RecoveryCodes)
+	}
+	RespondJSON(w, http.StatusOK, resp)
+}
+
+// EnrollMFA generates a new TOTP secret. It becomes active after ConfirmMFA.
+func (s *Server) EnrollMFA(w http.ResponseWriter, r *http.Request) {
+	p := s.requirePrincipal(w, r)
+	if p == nil {
+		return
+	}
+
+	enrollment, err := mfa.NewEnrollment(s.Config.TOTPIssuer, p.User)
+	if err != nil {
+		s.Logger.Error("failed to generate totp secret", "error", err)
+		RespondError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	pending, err := s.sealTOTPSecret(p.User, enrollment.Secret)
+	if err != nil {
+		s.Logger.Error("failed to seal totp secret", "user", p.User, "error", err)
+		RespondError(w, http.StatusInternalServerError, err)
+		return
+	}
+	err = s.Users.Update(p.User, func(u *users.User) error {
+		if u.TOTPEnabled() {
+			return ErrMFAAlreadyOn
+		}
+		u.TOTP = &users.TOTP{PendingSecret: pending}
+		return nil
+	})
+	if errors.Is(err, ErrMFAAlreadyOn) {
+		RespondError(w, http.StatusConflict, err)
+		return
+	}
+	if err != nil {
+		s.Logger.Error("failed to store totp enrollment", "user", p.User, "error", err)
+		RespondError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	RespondJSON(w, http.StatusOK, enrollment)
+}
+
+// ConfirmMFA activates a pending enrollment and returns recovery codes.
+func (s *Server) ConfirmMFA(w http.ResponseWriter, r *http.Request) {
+	p := s.requirePrincipal(w, r)
+	if p == nil {
+		return
+	}
+
+	var req MFACodeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		RespondError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	codes, hashes, err := mfa.NewRecoveryCodes()
+	if err != nil {
+		RespondError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	err = s.Users.Update(p.User, func(u *users.User) error {
+		if u.TOTP == nil || u.TOTP.PendingSecret == "" {
+			return ErrMFANotPending
+		}
+		secret, err := s.openTOTPSecret(p.User, u.TOTP.PendingSecret)
+		if err != nil {
+			return err
+		}
+		step, ok := mfa.ValidateCode(secret, req.Code, 0, time.Now())
+		if !ok {
+			return ErrInvalidMFACode
+		}
+		stored, err := s.sealTOTPSecret(p.User, secret)
+		if err != nil {
+			return err
+		}
+		u.TOTP = &users.TOTP{
+			Secret:        stored,
+			LastUsedStep:  step,
+			RecoveryCodes: hashes,
+		}
+		return nil
+	})
+	if err != nil {
+		s.respondMFAError(w, p.User, err)
+		return
+	}
+
+	// The user just proved possession of the second factor.
+	if p.SessionID != "" {
+		if err := s.Sessions.MarkMFA(p.SessionID); err != nil {
+			s.Logger.Error("failed to mark session as mfa", "session_id", p.SessionID, "error", err)
+		}
+	}
+
+	s.Logger.Info("two-factor authentication enabled", "user", p.User)
+	RespondJSON(w, http.StatusOK, RecoveryCodesResponse{RecoveryCodes: codes})
+}
+
+// DisableMFA removes the enrollment. A valid code is required.
+func (s *Server) DisableMFA(w http.ResponseWriter, r *http.Request) {
+	p := s.requirePrincipal(w, r)
+	if p == nil {
+		return
+	}
+
+	var req MFACodeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		RespondError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := s.verifySecondFactor(p.User, req.Code); err != nil {
+		s.respondMFAError(w, p.User, err)
+		return
+	}
+
+	err := s.Users.Update(p.User, func(u *users.User) error {
+		u.TOTP = nil
+		return nil
+	})
+	if err != nil {
+		s.respondMFAError(w, p.User, err)
+		return
+	}
+
+	s.Logger.Info("two-factor authentication disabled", "user", p.User)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// RegenerateRecoveryCodes replaces all recovery codes. A valid code is required.
+func (s *Server) RegenerateRecoveryCodes(w http.ResponseWriter, r *http.Request) {
+	p := s.requirePrincipal(w, r)
+	if p == nil {
+		return
+	}
+
+	var req MFACodeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		RespondError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := s.verifySecondFactor(p.User, req.Code); err != nil {
+		s.respondMFAError(w, p.User, err)
+		return
+	}
+
+	codes, hashes, err := mfa.NewRecoveryCodes()
+	if err != nil {
+		RespondError(w, http.StatusInternalServerError, err)
+		return
+	}
+	err = s.Users.Update(p.User, func(u *users.User) error {
+		if !u.TOTPEnabled() {
+			return ErrMFANotEnabled
+		}
+		u.TOTP.RecoveryCodes = hashes
+		return nil
+	})
+	if err != nil {
+		s.respondMFAError(w, p.User, err)
+		return
+	}
+
+	RespondJSON(w, http.StatusOK, RecoveryCodesResponse{RecoveryCodes: codes})
+}
+
+// requirePrincipal returns the authenticated caller or responds with an error.
+// Per-user settings make no sense when authentication is disabled.
+func (s *Server) requirePrincipal(w http.ResponseWriter, r *http.Request) *Principal {
+	p := PrincipalFromContext(r.Context())
+	if p == nil {
+		RespondError(w, http.StatusBadRequest, errors.New("authentication is disabled"))
+	}
+	return p
+}
+
+func (s *Server) respondMFAError(w http.ResponseWriter, user string, err error) {
+	// Not 401: the session itself is fine, only the submitted code is wrong.
+	switch {
+	case errors.Is(err, ErrInvalidMFACode), errors.Is(err, ErrMFANotEnabled), errors.Is(err, ErrMFANotPending):
+		RespondError(w, http.StatusBadRequest, err)
+	default:
+		s.Logger.Error("two-factor operation failed", "user", user, "error", err)
+		RespondError(w, http.StatusInternalServerError, err)
+	}
+}
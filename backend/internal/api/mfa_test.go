@@ -0,0 +1,181 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/generic/selectel-craas-web/internal/config"
+	"github.com/generic/selectel-craas-web/internal/mfa"
+	"github.com/generic/selectel-craas-web/internal/sealer"
+	"github.com/generic/selectel-craas-web/internal/users"
+	"github.com/pquerna/otp/totp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newMFATestServer(t *testing.T) (*Server, string, []string) {
+	server := &Server{
+		Config: &config.Config{
+			AuthEnabled:             true,
+			AuthLogin:               "admin",
+			AuthPassword:            "password",
+			JWTSecret:               "secret",
+			AuthRequire2FAForDelete: true,
+			EnableDeleteImage:       true,
+		},
+		Logger:   testLogger,
+		Sessions: newTestSessions(t),
+		Users:    newTestUsers(t),
+	}
+
+	enrollment, err := mfa.NewEnrollment("test", "admin")
+	require.NoError(t, err)
+	codes, hashes, err := mfa.NewRecoveryCodes()
+	require.NoError(t, err)
+	require.NoError(t, server.Users.Update("admin", func(u *users.User) error {
+		u.TOTP = &users.TOTP{Secret: enrollment.Secret, RecoveryCodes: hashes}
+		return nil
+	}))
+	return server, enrollment.Secret, codes
+}
+
+func postJSON(t *testing.T, handler http.HandlerFunc, body interface{}) *httptest.ResponseRecorder {
+	data, err := json.Marshal(body)
+	require.NoError(t, err)
+	req := httptest.NewRequest("POST", "/", bytes.NewBuffer(data))
+	rr := httptest.NewRecorder()
+	handler(rr, req)
+	return rr
+}
+
+func TestLogin_TOTPChallenge(t *testing.T) {
+	server, secret, _ := newMFATestServer(t)
+
+	rr := postJSON(t, server.Login, LoginRequest{Login: "admin", Password: "password"})
+	require.Equal(t, http.StatusOK, rr.Code)
+	assert.Empty(t, rr.Result().Cookies(), "no session before the second factor")
+
+	var resp LoginResponse
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&resp))
+	require.True(t, resp.MFARequired)
+	require.NotEmpty(t, resp.MFAToken)
+
+	// The challenge token is not a session token
+	_, err := server.parseSessionToken(resp.MFAToken)
+	assert.Error(t, err)
+
+	rr = postJSON(t, server.LoginMFA, MFALoginRequest{MFAToken: resp.MFAToken, Code: "000000"})
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+
+	code, err := totp.GenerateCode(secret, time.Now())
+	require.NoError(t, err)
+	rr = postJSON(t, server.LoginMFA, MFALoginRequest{MFAToken: resp.MFAToken, Code: code})
+	require.Equal(t, http.StatusOK, rr.Code)
+
+	var cookie *http.Cookie
+	for _, c := range rr.Result().Cookies() {
+		if c.Name == "auth_token" {
+			cookie = c
+		}
+	}
+	require.NotNil(t, cookie)
+	claims, err := server.parseSessionToken(cookie.Value)
+	require.NoError(t, err)
+	sess, err := server.Sessions.Get(claims.SessionID)
+	require.NoError(t, err)
+	assert.True(t, sess.MFA)
+
+	// The same code cannot be replayed
+	rr = postJSON(t, server.LoginMFA, MFALoginRequest{MFAToken: resp.MFAToken, Code: code})
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+}
+
+func TestLogin_RecoveryCode(t *testing.T) {
+	server, _, codes := newMFATestServer(t)
+
+	challenge, err := server.signMFAChallenge("admin")
+	require.NoError(t, err)
+
+	rr := postJSON(t, server.LoginMFA, MFALoginRequest{MFAToken: challenge, Code: codes[0]})
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	rr = postJSON(t, server.LoginMFA, MFALoginRequest{MFAToken: challenge, Code: codes[0]})
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+
+	u, _, _ := server.Users.Get("admin")
+	assert.Len(t, u.TOTP.RecoveryCodes, mfa.RecoveryCodeCount-1)
+}
+
+func TestCheckDelete_RequiresMFA(t *testing.T) {
+	server, _, _ := newMFATestServer(t)
+
+	for _, withMFA := range []bool{false, true} {
+		req := httptest.NewRequest("DELETE", "/", nil)
+		req = req.WithContext(withPrincipal(req.Context(), &Principal{User: "admin", MFA: withMFA}))
+		rr := httptest.NewRecorder()
+
+		allowed := server.checkDeleteImage(rr, req)
+		assert.Equal(t, withMFA, allowed)
+		if !withMFA {
+			assert.Equal(t, http.StatusForbidden, rr.Code)
+		}
+	}
+}
+
+func TestMFA_SealedSecrets(t *testing.T) {
+	server, secret, _ := newMFATestServer(t)
+	s, err := sealer.New(testEncryptionKey)
+	require.NoError(t, err)
+	server.Sealer = s
+	server.Config.TOTPIssuer = "test"
+
+	login := func(user, secret string) int {
+		t.Helper()
+		challenge, err := server.signMFAChallenge(user)
+		require.NoError(t, err)
+		code, err := totp.GenerateCode(secret, time.Now())
+		require.NoError(t, err)
+		return postJSON(t, server.LoginMFA, MFALoginRequest{MFAToken: challenge, Code: code}).Code
+	}
+
+	// A secret stored before the key was configured is sealed once used
+	require.Equal(t, http.StatusOK, login("admin", secret))
+	u, _, _ := server.Users.Get("admin")
+	assert.True(t, strings.HasPrefix(u.TOTP.Secret, sealedPrefix))
+	assert.NotContains(t, u.TOTP.Secret, secret)
+
+	// New enrollments are sealed from the start
+	call := func(handler http.HandlerFunc, body interface{}) *httptest.ResponseRecorder {
+		data, err := json.Marshal(body)
+		require.NoError(t, err)
+		rr := httptest.NewRecorder()
+		handler(rr, withTestPrincipal(httptest.NewRequest("POST", "/", bytes.NewBuffer(data)), "alice"))
+		return rr
+	}
+	rr := call(server.EnrollMFA, nil)
+	require.Equal(t, http.StatusOK, rr.Code)
+	var enrollment mfa.Enrollment
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&enrollment))
+	u, _, _ = server.Users.Get("alice")
+	assert.NotContains(t, u.TOTP.PendingSecret, enrollment.Secret)
+
+	code, err := totp.GenerateCode(enrollment.Secret, time.Now())
+	require.NoError(t, err)
+	rr = call(server.ConfirmMFA, MFACodeRequest{Code: code})
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	u, _, _ = server.Users.Get("alice")
+	assert.True(t, strings.HasPrefix(u.TOTP.Secret, sealedPrefix))
+	assert.NotContains(t, u.TOTP.Secret, enrollment.Secret)
+
+	// A sealed secret copied to another user does not open
+	require.NoError(t, server.Users.Update("admin", func(a *users.User) error {
+		a.TOTP.Secret = u.TOTP.Secret
+		return nil
+	}))
+	assert.Equal(t, http.StatusUnauthorized, login("admin", enrollment.Secret))
+}
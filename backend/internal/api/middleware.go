@@ -4,33 +4,54 @@ import (
 	"context"
 	"errors"
 	"net/http"
-	"strings"
 	"time"
 
 	"github.com/generic/selectel-craas-web/internal/craas"
 	"github.com/go-chi/chi/v5/middleware"
 )
 
+const requestIDHeader = "X-Request-ID"
+
+// RequestID middleware assigns every request an ID, or keeps the one sent in
+// X-Request-ID by a proxy. It is echoed in the response header and in error
+// bodies, and logged, so a user's report can be matched to the logs.
+func (s *Server) RequestID(next http.Handler) http.Handler {
+	return middleware.RequestID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(requestIDHeader, middleware.GetReqID(r.Context()))
+		next.ServeHTTP(w, r)
+	}))
+}
+
 // RequestLogger middleware logs request details.
 func (s *Server) RequestLogger(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		start := time.Now()
 		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		ctx, audit := withAuditRecord(r.Context())
 
 		s.Logger.Debug("request started",
+			"request_id", middleware.GetReqID(r.Context()),
 			"method", r.Method,
 			"path", r.URL.Path,
 			"remote_addr", r.RemoteAddr,
 		)
 
-		next.ServeHTTP(ww, r)
+		next.ServeHTTP(ww, r.WithContext(ctx))
 
-		s.Logger.Info("request completed",
+		attrs := []any{
+			"request_id", middleware.GetReqID(r.Context()),
 			"method", r.Method,
 			"path", r.URL.Path,
 			"status", ww.Status(),
 			"duration", time.Since(start),
-		)
+		}
+		if p := audit.principal; p != nil {
+			attrs = append(attrs, "user", p.User)
+			if len(p.Groups) > 0 {
+				attrs = append(attrs, "groups", p.Groups)
+			}
+		}
+		s.Logger.Info("request completed", attrs...)
 	})
 }
 
@@ -52,7 +73,7 @@ func (s *Server) EnableCORS(next http.Handler) http.Handler {
 		w.Header().Set("Access-Control-Allow-Origin", s.Config.CORSAllowedOrigin)
 		w.Header().Set("Access-Control-Allow-Credentials", "true")
 		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, DELETE, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-CSRF-Token")
 
 		if r.Method == "OPTIONS" {
 			w.WriteHeader(http.StatusOK)
@@ -66,13 +87,15 @@ func (s *Server) EnableCORS(next http.Handler) http.Handler {
 // ExecuteWithRetry executes an operation that requires a project token,
 // handling token invalidation and retries automatically.
 func (s *Server) ExecuteWithRetry(ctx context.Context, pid string, op func(token string) error) error {
+	client := s.authClient(ctx)
+
 	// 1. Get initial token
-	token, err := s.Auth.GetProjectToken(pid)
+	token, err := client.GetProjectToken(ctx, pid)
 	if err != nil {
 		// If getting token fails, try invalidating and getting fresh one
 		s.Logger.Warn("failed to get project token, retrying", "project_id", pid, "error", err)
-		s.Auth.InvalidateProjectToken(pid)
-		token, err = s.Auth.GetProjectToken(pid)
+		client.InvalidateProjectToken(pid)
+		token, err = client.GetProjectToken(ctx, pid)
 		if err != nil {
 			return err
 		}
@@ -86,12 +109,10 @@ func (s *Server) ExecuteWithRetry(ctx context.Context, pid string, op func(token
 
 	// 3. Check if the error is auth-related (401 Unauthorized)
 	// We only retry if we suspect the token is invalid/expired.
-	isAuthError := errors.Is(err, craas.ErrUnauthorized) || strings.Contains(err.Error(), "401") || strings.Contains(err.Error(), "Unauthorized")
-
-	if isAuthError {
+	if errors.Is(err, craas.ErrUnauthorized) {
 		s.Logger.Warn("auth error detected, retrying with token invalidation", "project_id", pid, "error", err)
-		s.Auth.InvalidateProjectToken(pid)
-		token, err = s.Auth.GetProjectToken(pid)
+		client.InvalidateProjectToken(pid)
+		token, err = client.GetProjectToken(ctx, pid)
 		if err != nil {
 			return err // Failed to get fresh token
 		}
@@ -1,7 +1,6 @@
 package api
 
 import (
-	"context"
 	"errors"
 	"net/http"
 	"strings"
@@ -9,7 +8,58 @@ import (
 	"github.com/golang-jwt/jwt/v5"
 )
 
-var ErrUnauthorized = errors.New("unauthorized")
+var (
+	ErrUnauthorized    = errors.New("unauthorized")
+	ErrHeaderAuthLogin = errors.New("login is handled by the authentication proxy")
+)
+
+// sessionClaims are the fields of the auth JWT that identify a session.
+type sessionClaims struct {
+	User      string
+	SessionID string
+}
+
+// tokenFromRequest extracts the auth token from the cookie or the
+// Authorization header. bearer is true if the header was used.
+func tokenFromRequest(r *http.Request) (token string, bearer bool) {
+	// First try to get token from cookie
+	if cookie, err := r.Cookie(authCookieName); err == nil && cookie.Value != "" {
+		return cookie.Value, false
+	}
+
+	// Fallback to Authorization header
+	authHeader := r.Header.Get("Authorization")
+	if authHeader != "" {
+		parts := strings.Split(authHeader, " ")
+		if len(parts) == 2 && parts[0] == "Bearer" {
+			return parts[1], true
+		}
+	}
+	return "", false
+}
+
+func (s *Server) parseSessionToken(tokenString string) (*sessionClaims, error) {
+	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, errors.New("unexpected signing method")
+		}
+		return s.jwtSecret(), nil
+	})
+	if err != nil || !token.Valid {
+		return nil, ErrUnauthorized
+	}
+
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok {
+		return nil, ErrUnauthorized
+	}
+	sub, _ := claims["sub"].(string)
+	sid, _ := claims["sid"].(string)
+	if sub == "" || sid == "" {
+		return nil, ErrUnauthorized
+	}
+	return &sessionClaims{User: sub, SessionID: sid}, nil
+}
 
 func (s *Server) AuthMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -18,46 +68,76 @@ func (s *Server) AuthMiddleware(next http.Handler) http.Handler {
 			return
 		}
 
-		var tokenString string
-
-		// First try to get token from cookie
-		if cookie, err := r.Cookie("auth_token"); err == nil {
-			tokenString = cookie.Value
+		if s.Config.HeaderAuth() {
+			s.headerAuth(next, w, r)
+			return
 		}
 
-		// Fallback to Authorization header
+		tokenString, _ := tokenFromRequest(r)
 		if tokenString == "" {
-			authHeader := r.Header.Get("Authorization")
-			if authHeader != "" {
-				parts := strings.Split(authHeader, " ")
-				if len(parts) == 2 && parts[0] == "Bearer" {
-					tokenString = parts[1]
-				}
-			}
+			RespondError(w, http.StatusUnauthorized, ErrUnauthorized)
+			return
 		}
 
-		if tokenString == "" {
+		claims, err := s.parseSessionToken(tokenString)
+		if err != nil {
 			RespondError(w, http.StatusUnauthorized, ErrUnauthorized)
 			return
 		}
-		token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-			if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-				return nil, errors.New("unexpected signing method")
-			}
-			return []byte(s.Config.JWTSecret), nil
-		})
 
-		if err != nil || !token.Valid {
+		// The token alone is not enough: the session must still exist so that
+		// logout and revocation take effect immediately.
+		sess, err := s.Sessions.Validate(claims.SessionID)
+		if err != nil || sess.User != claims.User {
 			RespondError(w, http.StatusUnauthorized, ErrUnauthorized)
 			return
 		}
 
-		// Optionally extract claims and put in context
-		if claims, ok := token.Claims.(jwt.MapClaims); ok {
-			ctx := context.WithValue(r.Context(), "user", claims["sub"])
-			next.ServeHTTP(w, r.WithContext(ctx))
-		} else {
-			RespondError(w, http.StatusUnauthorized, ErrUnauthorized)
+		ctx := withPrincipal(r.Context(), &Principal{User: sess.User, SessionID: sess.ID, MFA: sess.MFA})
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// headerAuth trusts the identity headers set by an authenticating reverse proxy
+// such as oauth2-proxy or Authelia, but only if the request came from it.
+func (s *Server) headerAuth(next http.Handler, w http.ResponseWriter, r *http.Request) {
+	if !s.fromTrustedProxy(r) {
+		s.Logger.Warn("identity headers from untrusted peer ignored", "remote_addr", r.RemoteAddr)
+		RespondError(w, http.StatusUnauthorized, ErrUnauthorized)
+		return
+	}
+
+	user := strings.TrimSpace(r.Header.Get(s.Config.AuthHeaderUser))
+	if user == "" {
+		RespondError(w, http.StatusUnauthorized, ErrUnauthorized)
+		return
+	}
+
+	var groups []string
+	for _, g := range strings.Split(r.Header.Get(s.Config.AuthHeaderGroups), ",") {
+		if g = strings.TrimSpace(g); g != "" {
+			groups = append(groups, g)
+		}
+	}
+
+	// Second factors are the identity provider's responsibility in this mode.
+	ctx := withPrincipal(r.Context(), &Principal{User: user, Groups: groups, MFA: true})
+	next.ServeHTTP(w, r.WithContext(ctx))
+}
+
+// RequireAdmin restricts the route to administrators.
+func (s *Server) RequireAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !s.Config.AuthEnabled {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		p := PrincipalFromContext(r.Context())
+		if p == nil || !s.Config.IsAdmin(p.User, p.Groups) {
+			RespondError(w, http.StatusForbidden, ErrAdminRequired)
+			return
 		}
+		next.ServeHTTP(w, r)
 	})
 }
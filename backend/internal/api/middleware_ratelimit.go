@@ -1,81 +1,68 @@
 package api
 
 import (
-	"net"
+	"errors"
+	"math"
 	"net/http"
-	"sync"
+	"strconv"
 	"time"
 
-	"golang.org/x/time/rate"
+	"github.com/generic/selectel-craas-web/internal/state"
 )
 
-type RateLimiter struct {
-	visitors map[string]*visitor
-	mu       sync.Mutex
-}
-
-type visitor struct {
-	limiter  *rate.Limiter
-	lastSeen time.Time
-}
-
-func NewRateLimiter() *RateLimiter {
-	rl := &RateLimiter{
-		visitors: make(map[string]*visitor),
-	}
-	go rl.cleanup()
-	return rl
-}
-
-func (rl *RateLimiter) getVisitor(ip string) *rate.Limiter {
-	rl.mu.Lock()
-	defer rl.mu.Unlock()
+var ErrTooManyRequests = errors.New("too many requests, try again later")
 
-	v, exists := rl.visitors[ip]
-	if !exists {
-		// 5 requests per minute, burst of 10
-		limiter := rate.NewLimiter(rate.Every(time.Minute/5), 10)
-		v = &visitor{
-			limiter:  limiter,
-			lastSeen: time.Now(),
-		}
-		rl.visitors[ip] = v
-		return limiter
-	}
-
-	v.lastSeen = time.Now()
-	return v.limiter
+// RateLimiter keeps a token bucket per client IP in the state store, so that
+// replicas sharing it enforce one limit.
+type RateLimiter struct {
+	state    state.Store
+	limit    state.Limit
+	clientIP func(r *http.Request) string
+	now      func() time.Time
 }
 
-// cleanup removes old entries from the visitors map to prevent memory leaks.
-func (rl *RateLimiter) cleanup() {
-	for {
-		time.Sleep(time.Minute)
-		rl.mu.Lock()
-		for ip, v := range rl.visitors {
-			if time.Since(v.lastSeen) > 3*time.Minute {
-				delete(rl.visitors, ip)
+// NewRateLimiter allows perMinute requests per client with the given burst.
+// clientIP resolves the client address; nil uses the direct peer address.
+func NewRateLimiter(st state.Store, perMinute, burst int, clientIP func(r *http.Request) string) *RateLimiter {
+	if clientIP == nil {
+		clientIP = func(r *http.Request) string {
+			if ip := remoteIP(r); ip != nil {
+				return ip.String()
 			}
+			// If RemoteAddr is invalid, use it as is.
+			return r.RemoteAddr
 		}
-		rl.mu.Unlock()
+	}
+	return &RateLimiter{
+		state:    st,
+		limit:    state.Limit{Every: time.Minute / time.Duration(max(perMinute, 1)), Burst: burst},
+		clientIP: clientIP,
+		now:      time.Now,
 	}
 }
 
 // RateLimit is the middleware function.
 func (rl *RateLimiter) RateLimit(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		ip, _, err := net.SplitHostPort(r.RemoteAddr)
+		d, err := state.Allow(r.Context(), rl.state, "ratelimit/"+rl.clientIP(r), rl.limit, rl.now())
 		if err != nil {
-			// If RemoteAddr doesn't have a port (unlikely for http.Server) or is invalid, use it as is.
-			ip = r.RemoteAddr
+			RespondError(w, http.StatusInternalServerError, err)
+			return
 		}
+		w.Header().Set("X-RateLimit-Limit", strconv.Itoa(rl.limit.Burst))
+		w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(d.Remaining))
 
-		limiter := rl.getVisitor(ip)
-		if !limiter.Allow() {
-			http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+		if !d.Allowed {
+			setRetryAfter(w, d.RetryAfter)
+			RespondError(w, http.StatusTooManyRequests, ErrTooManyRequests)
 			return
 		}
 
 		next.ServeHTTP(w, r)
 	})
 }
+
+// setRetryAfter sets the Retry-After header, rounded up to whole seconds.
+func setRetryAfter(w http.ResponseWriter, d time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(d.Seconds()))))
+}
@@ -2,15 +2,21 @@ package api
 
 import (
 	"fmt"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"strconv"
 	"testing"
+	"time"
 
+	"github.com/generic/selectel-craas-web/internal/config"
+	"github.com/generic/selectel-craas-web/internal/state"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestRateLimiter(t *testing.T) {
-	rl := NewRateLimiter()
+	rl := NewRateLimiter(state.NewMemory(), 5, 10, nil)
 
 	handler := rl.RateLimit(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
@@ -45,3 +51,121 @@ func TestRateLimiter(t *testing.T) {
 	code = makeRequest(ip2)
 	assert.Equal(t, http.StatusOK, code, "Request from new IP should succeed")
 }
+
+func TestRateLimiter_Headers(t *testing.T) {
+	rl := NewRateLimiter(state.NewMemory(), 1, 1, nil)
+	handler := rl.RateLimit(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	req := httptest.NewRequest("POST", "/", nil)
+	req.RemoteAddr = "192.168.1.1:1234"
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "1", w.Header().Get("X-RateLimit-Limit"))
+	assert.Equal(t, "0", w.Header().Get("X-RateLimit-Remaining"))
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	retryAfter, err := strconv.Atoi(w.Header().Get("Retry-After"))
+	require.NoError(t, err)
+	assert.InDelta(t, 60, retryAfter, 1)
+}
+
+func TestClientIP(t *testing.T) {
+	_, proxies, _ := net.ParseCIDR("10.0.0.0/8")
+	server := &Server{Config: &config.Config{TrustedProxies: []*net.IPNet{proxies}}}
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		xff        string
+		realIP     string
+		expected   string
+	}{
+		{"Direct Client", "203.0.113.5:1234", "", "", "203.0.113.5"},
+		{"Spoofed Header From Untrusted Peer", "203.0.113.5:1234", "1.2.3.4", "1.2.3.4", "203.0.113.5"},
+		{"Forwarded By Trusted Proxy", "10.0.0.1:1234", "198.51.100.7", "", "198.51.100.7"},
+		{"Client Prepends Fake Hop", "10.0.0.1:1234", "1.2.3.4, 198.51.100.7, 10.0.0.2", "", "198.51.100.7"},
+		{"X-Real-IP From Trusted Proxy", "10.0.0.1:1234", "", "198.51.100.8", "198.51.100.8"},
+		{"Trusted Proxy Without Headers", "10.0.0.1:1234", "", "", "10.0.0.1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/", nil)
+			req.RemoteAddr = tt.remoteAddr
+			if tt.xff != "" {
+				req.Header.Set("X-Forwarded-For", tt.xff)
+			}
+			if tt.realIP != "" {
+				req.Header.Set("X-Real-IP", tt.realIP)
+			}
+			assert.Equal(t, tt.expected, server.clientIP(req))
+		})
+	}
+}
+
+func TestLoginLockout(t *testing.T) {
+	assert.Nil(t, NewLoginLockout(state.NewMemory(), 0, time.Minute, time.Hour), "threshold 0 disables the lockout")
+
+	now := time.Now()
+	l := NewLoginLockout(state.NewMemory(), 3, time.Minute, 5*time.Minute)
+	l.now = func() time.Time { return now }
+	fail := func(user string) time.Duration {
+		lock, err := l.Fail(t.Context(), user)
+		require.NoError(t, err)
+		return lock
+	}
+	locked := func(user string) time.Duration {
+		wait, err := l.Locked(t.Context(), user)
+		require.NoError(t, err)
+		return wait
+	}
+
+	assert.Zero(t, fail("admin"))
+	assert.Zero(t, fail("admin"))
+	assert.Zero(t, locked("admin"))
+
+	// Lock doubles with each failure past the threshold, up to the maximum
+	assert.Equal(t, time.Minute, fail("admin"))
+	assert.Equal(t, time.Minute, locked("admin"))
+	assert.Equal(t, 2*time.Minute, fail("admin"))
+	assert.Equal(t, 4*time.Minute, fail("admin"))
+	assert.Equal(t, 5*time.Minute, fail("admin"))
+	assert.Zero(t, locked("other"), "other accounts are unaffected")
+
+	now = now.Add(6 * time.Minute)
+	assert.Zero(t, locked("admin"))
+
+	require.NoError(t, l.Reset(t.Context(), "admin"))
+	assert.Zero(t, fail("admin"))
+}
+
+func TestLogin_Lockout(t *testing.T) {
+	server := &Server{
+		Config: &config.Config{
+			AuthEnabled:  true,
+			AuthLogin:    "admin",
+			AuthPassword: "password",
+			JWTSecret:    "secret",
+		},
+		Logger:   testLogger,
+		Sessions: newTestSessions(t),
+		Users:    newTestUsers(t),
+		Lockout:  NewLoginLockout(state.NewMemory(), 2, time.Minute, time.Hour),
+	}
+
+	for i := 0; i < 2; i++ {
+		rr := postJSON(t, server.Login, LoginRequest{Login: "admin", Password: "wrong"})
+		assert.Equal(t, http.StatusUnauthorized, rr.Code)
+	}
+
+	// Even the right password is refused while locked
+	rr := postJSON(t, server.Login, LoginRequest{Login: "admin", Password: "password"})
+	assert.Equal(t, http.StatusTooManyRequests, rr.Code)
+	assert.Equal(t, "60", rr.Header().Get("Retry-After"))
+}
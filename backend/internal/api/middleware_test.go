@@ -10,6 +10,7 @@ import (
 	"errors"
 	"fmt"
 	"log/slog"
+	"net"
 	"os"
 
 	"github.com/generic/selectel-craas-web/internal/auth"
@@ -348,15 +349,28 @@ func TestAuthMiddleware(t *testing.T) {
 		JWTSecret:   secret,
 	}
 	server := &Server{
-		Config: cfg,
+		Config:   cfg,
+		Sessions: newTestSessions(t),
 	}
 
-	// Create a valid token
+	// Create a valid session token
+	sess, err := server.Sessions.Create("testuser", "", "", false)
+	if err != nil {
+		t.Fatalf("failed to create session: %v", err)
+	}
+	tokenString, _ := server.signSessionToken(sess)
+
+	// A token signed with the right secret but without a session
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
 		"sub": "testuser",
 		"exp": time.Now().Add(time.Hour).Unix(),
 	})
-	tokenString, _ := token.SignedString([]byte(secret))
+	sessionlessToken, _ := token.SignedString([]byte(secret))
+
+	// A token whose session was revoked
+	revoked, _ := server.Sessions.Create("testuser", "", "", false)
+	revokedToken, _ := server.signSessionToken(revoked)
+	server.Sessions.Revoke(revoked.ID)
 
 	nextHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		user, ok := r.Context().Value("user").(string)
@@ -402,6 +416,17 @@ func TestAuthMiddleware(t *testing.T) {
 			authHeader:     "Bearer invalid",
 			expectedStatus: http.StatusUnauthorized,
 		},
+		{
+			name:           "Token Without Session",
+			authHeader:     "Bearer " + sessionlessToken,
+			expectedStatus: http.StatusUnauthorized,
+		},
+		{
+			name:           "Revoked Session",
+			cookieName:     "auth_token",
+			cookieValue:    revokedToken,
+			expectedStatus: http.StatusUnauthorized,
+		},
 		{
 			name:           "Wrong Cookie Name",
 			cookieName:     "wrong_token",
@@ -429,3 +454,186 @@ func TestAuthMiddleware(t *testing.T) {
 		})
 	}
 }
+
+func TestAuthMiddleware_HeaderMode(t *testing.T) {
+	_, trusted, _ := net.ParseCIDR("10.0.0.0/8")
+	server := &Server{
+		Config: &config.Config{
+			AuthEnabled:      true,
+			AuthMode:         config.AuthModeHeader,
+			AuthHeaderUser:   "X-Forwarded-User",
+			AuthHeaderGroups: "X-Forwarded-Groups",
+			AuthAdminGroups:  []string{"ops"},
+			TrustedProxies:   []*net.IPNet{trusted},
+		},
+		Logger: testLogger,
+	}
+
+	var got *Principal
+	handler := server.AuthMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = PrincipalFromContext(r.Context())
+		w.WriteHeader(http.StatusOK)
+	}))
+	admin := server.AuthMiddleware(server.RequireAdmin(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})))
+
+	tests := []struct {
+		name           string
+		handler        http.Handler
+		remoteAddr     string
+		user           string
+		groups         string
+		expectedStatus int
+		expectedGroups []string
+	}{
+		{
+			name:           "Trusted Proxy",
+			handler:        handler,
+			remoteAddr:     "10.1.2.3:4567",
+			user:           "alice",
+			groups:         "dev, ops",
+			expectedStatus: http.StatusOK,
+			expectedGroups: []string{"dev", "ops"},
+		},
+		{
+			name:           "Untrusted Peer",
+			handler:        handler,
+			remoteAddr:     "192.168.1.10:4567",
+			user:           "alice",
+			expectedStatus: http.StatusUnauthorized,
+		},
+		{
+			name:           "Missing User Header",
+			handler:        handler,
+			remoteAddr:     "10.1.2.3:4567",
+			expectedStatus: http.StatusUnauthorized,
+		},
+		{
+			name:           "Admin Group",
+			handler:        admin,
+			remoteAddr:     "10.1.2.3:4567",
+			user:           "alice",
+			groups:         "ops",
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "Not In Admin Group",
+			handler:        admin,
+			remoteAddr:     "10.1.2.3:4567",
+			user:           "bob",
+			groups:         "dev",
+			expectedStatus: http.StatusForbidden,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got = nil
+			req := httptest.NewRequest("GET", "/", nil)
+			req.RemoteAddr = tt.remoteAddr
+			if tt.user != "" {
+				req.Header.Set("X-Forwarded-User", tt.user)
+			}
+			if tt.groups != "" {
+				req.Header.Set("X-Forwarded-Groups", tt.groups)
+			}
+			rr := httptest.NewRecorder()
+			tt.handler.ServeHTTP(rr, req)
+
+			if rr.Code != tt.expectedStatus {
+				t.Errorf("expected status %d, got %d", tt.expectedStatus, rr.Code)
+			}
+			if tt.expectedGroups != nil {
+				if got == nil || got.User != tt.user || fmt.Sprint(got.Groups) != fmt.Sprint(tt.expectedGroups) {
+					t.Errorf("unexpected principal %+v", got)
+				}
+			}
+		})
+	}
+
+	// Logging in is the proxy's job
+	rr := httptest.NewRecorder()
+	server.Login(rr, httptest.NewRequest("POST", "/api/login", nil))
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("expected login to be refused, got %d", rr.Code)
+	}
+}
+
+func TestCSRFProtect(t *testing.T) {
+	server := &Server{
+		Config: &config.Config{AuthEnabled: true},
+		Logger: testLogger,
+	}
+	handler := server.CSRFProtect(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	tests := []struct {
+		name           string
+		method         string
+		cookie         string
+		header         string
+		authHeader     string
+		expectedStatus int
+	}{
+		{
+			name:           "Safe Method",
+			method:         "GET",
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "Missing Token",
+			method:         "DELETE",
+			cookie:         "token",
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name:           "Mismatched Token",
+			method:         "POST",
+			cookie:         "token",
+			header:         "other",
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name:           "Header Without Cookie",
+			method:         "POST",
+			header:         "token",
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name:           "Matching Token",
+			method:         "POST",
+			cookie:         "token",
+			header:         "token",
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "Bearer Exempt",
+			method:         "DELETE",
+			authHeader:     "Bearer abc",
+			expectedStatus: http.StatusOK,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, "/", nil)
+			if tt.cookie != "" {
+				req.AddCookie(&http.Cookie{Name: "csrf_token", Value: tt.cookie})
+			}
+			if tt.header != "" {
+				req.Header.Set("X-CSRF-Token", tt.header)
+			}
+			if tt.authHeader != "" {
+				req.Header.Set("Authorization", tt.authHeader)
+			}
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+
+			if rr.Code != tt.expectedStatus {
+				t.Errorf("expected status %d, got %d", tt.expectedStatus, rr.Code)
+			}
+		})
+	}
+}
@@ -0,0 +1,406 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/generic/selectel-craas-web/internal/config"
+	"github.com/generic/selectel-craas-web/internal/state"
+	"github.com/generic/selectel-craas-web/internal/users"
+	"github.com/go-chi/chi/v5"
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+)
+
+var (
+	ErrPasskeysDisabled = errors.New("passkeys are not configured")
+	ErrCeremonyInvalid  = errors.New("unknown or expired passkey ceremony")
+	ErrPasskeyNotFound  = errors.New("passkey not found")
+	ErrPasskeyRejected  = errors.New("passkey verification failed")
+)
+
+// ceremonyTimeout bounds how long a begun registration or login stays valid.
+const ceremonyTimeout = 5 * time.Minute
+
+// CeremonyResponse starts a WebAuthn ceremony. The client passes Options to
+// navigator.credentials and sends the result back with the ceremony ID.
+type CeremonyResponse struct {
+	CeremonyID string      `json:"ceremonyId"`
+	Options    interface{} `json:"options"`
+}
+
+type PasskeyLoginRequest struct {
+	// Login is optional; without it the authenticator picks a discoverable credential.
+	Login string `json:"login"`
+}
+
+type PasskeyInfo struct {
+	ID         string    `json:"id"`
+	Name       string    `json:"name"`
+	CreatedAt  time.Time `json:"createdAt"`
+	LastUsedAt time.Time `json:"lastUsedAt,omitempty"`
+}
+
+func newWebAuthn(cfg *config.Config) (*webauthn.WebAuthn, error) {
+	if cfg.WebAuthnRPID == "" {
+		return nil, nil
+	}
+	origins := cfg.WebAuthnRPOrigins
+	if len(origins) == 0 {
+		origins = []string{"https://" + cfg.WebAuthnRPID}
+	}
+	return webauthn.New(&webauthn.Config{
+		RPID:          cfg.WebAuthnRPID,
+		RPDisplayName: cfg.WebAuthnRPName,
+		RPOrigins:     origins,
+	})
+}
+
+// webauthnUser adapts a stored user to the webauthn.User interface.
+type webauthnUser struct {
+	*users.User
+}
+
+func (u webauthnUser) WebAuthnID() []byte          { return u.User.WebAuthnID }
+func (u webauthnUser) WebAuthnName() string        { return u.Name }
+func (u webauthnUser) WebAuthnDisplayName() string { return u.Name }
+
+func (u webauthnUser) WebAuthnCredentials() []webauthn.Credential {
+	creds := make([]webauthn.Credential, 0, len(u.Passkeys))
+	for _, pk := range u.Passkeys {
+		creds = append(creds, pk.Credential)
+	}
+	return creds
+}
+
+// ceremonyStore keeps the server side of in-flight WebAuthn ceremonies in the
+// state store, so that a ceremony begun on one replica can finish on another.
+type ceremonyStore struct {
+	state state.Store
+}
+
+type ceremony struct {
+	User string               `json:"user"`
+	Data webauthn.SessionData `json:"data"`
+}
+
+func newCeremonyStore(st state.Store) *ceremonyStore {
+	return &ceremonyStore{state: st}
+}
+
+func (cs *ceremonyStore) put(ctx context.Context, user string, data *webauthn.SessionData) (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	id := hex.EncodeToString(b)
+
+	value, err := json.Marshal(ceremony{User: user, Data: *data})
+	if err != nil {
+		return "", err
+	}
+	if err := cs.state.Set(ctx, "webauthn/"+id, value, ceremonyTimeout); err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+// take returns the ceremony and removes it, so each can be finished only once.
+func (cs *ceremonyStore) take(ctx context.Context, id string) (ceremony, bool) {
+	var c ceremony
+	if id == "" {
+		return c, false
+	}
+	value, err := state.Take(ctx, cs.state, "webauthn/"+id)
+	if err != nil || json.Unmarshal(value, &c) != nil {
+		return ceremony{}, false
+	}
+	return c, true
+}
+
+func (s *Server) checkPasskeys(w http.ResponseWriter) bool {
+	if !s.Config.AuthEnabled || s.Config.HeaderAuth() || s.WebAuthn == nil {
+		RespondError(w, http.StatusNotFound, ErrPasskeysDisabled)
+		return false
+	}
+	return true
+}
+
+// BeginPasskeyRegistration starts registering a new passkey for the current user.
+func (s *Server) BeginPasskeyRegistration(w http.ResponseWriter, r *http.Request) {
+	if !s.checkPasskeys(w) {
+		return
+	}
+	p := s.requirePrincipal(w, r)
+	if p == nil {
+		return
+	}
+
+	// Assign a random user handle on first registration.
+	err := s.Users.Update(p.User, func(u *users.User) error {
+		if len(u.WebAuthnID) > 0 {
+			return nil
+		}
+		u.WebAuthnID = make([]byte, 32)
+		_, err := rand.Read(u.WebAuthnID)
+		return err
+	})
+	if err != nil {
+		s.Logger.Error("failed to assign webauthn id", "user", p.User, "error", err)
+		RespondError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	u, _, err := s.Users.Get(p.User)
+	if err != nil {
+		RespondError(w, http.StatusInternalServerError, err)
+		return
+	}
+	wu := webauthnUser{u}
+	creation, data, err := s.WebAuthn.BeginRegistration(wu,
+		webauthn.WithExclusions(webauthn.Credentials(wu.WebAuthnCredentials()).CredentialDescriptors()),
+		webauthn.WithResidentKeyRequirement(protocol.ResidentKeyRequirementPreferred),
+	)
+	if err != nil {
+		s.Logger.Error("failed to begin passkey registration", "user", p.User, "error", err)
+		RespondError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	s.respondCeremony(w, r, p.User, data, creation)
+}
+
+// FinishPasskeyRegistration verifies the authenticator response and stores the passkey.
+func (s *Server) FinishPasskeyRegistration(w http.ResponseWriter, r *http.Request) {
+	if !s.checkPasskeys(w) {
+		return
+	}
+	p := s.requirePrincipal(w, r)
+	if p == nil {
+		return
+	}
+
+	c, ok := s.ceremonies.take(r.Context(), r.URL.Query().Get("ceremony"))
+	if !ok || c.User != p.User {
+		RespondError(w, http.StatusBadRequest, ErrCeremonyInvalid)
+		return
+	}
+
+	u, _, err := s.Users.Get(p.User)
+	if err != nil {
+		RespondError(w, http.StatusInternalServerError, err)
+		return
+	}
+	cred, err := s.WebAuthn.FinishRegistration(webauthnUser{u}, c.Data, r)
+	if err != nil {
+		s.Logger.Warn("passkey registration rejected", "user", p.User, "error", err)
+		RespondError(w, http.StatusBadRequest, ErrPasskeyRejected)
+		return
+	}
+
+	name := r.URL.Query().Get("name")
+	if name == "" {
+		name = "Passkey"
+	}
+	pk := users.Passkey{Name: name, CreatedAt: time.Now(), Credential: *cred}
+	err = s.Users.Update(p.User, func(u *users.User) error {
+		u.Passkeys = append(u.Passkeys, pk)
+		return nil
+	})
+	if err != nil {
+		s.Logger.Error("failed to store passkey", "user", p.User, "error", err)
+		RespondError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	s.Logger.Info("passkey registered", "user", p.User, "name", name)
+	RespondJSON(w, http.StatusCreated, passkeyInfo(pk))
+}
+
+// ListPasskeys lists the passkeys of the current user.
+func (s *Server) ListPasskeys(w http.ResponseWriter, r *http.Request) {
+	p := s.requirePrincipal(w, r)
+	if p == nil {
+		return
+	}
+
+	u, _, err := s.Users.Get(p.User)
+	if err != nil {
+		RespondError(w, http.StatusInternalServerError, err)
+		return
+	}
+	result := make([]PasskeyInfo, 0, len(u.Passkeys))
+	for _, pk := range u.Passkeys {
+		result = append(result, passkeyInfo(pk))
+	}
+	RespondJSON(w, http.StatusOK, result)
+}
+
+// DeletePasskey removes one of the current user's passkeys.
+func (s *Server) DeletePasskey(w http.ResponseWriter, r *http.Request) {
+	p := s.requirePrincipal(w, r)
+	if p == nil {
+		return
+	}
+
+	id, err := base64.RawURLEncoding.DecodeString(chi.URLParam(r, "id"))
+	if err != nil {
+		RespondError(w, http.StatusNotFound, ErrPasskeyNotFound)
+		return
+	}
+
+	err = s.Users.Update(p.User, func(u *users.User) error {
+		for i, pk := range u.Passkeys {
+			if bytes.Equal(pk.Credential.ID, id) {
+				u.Passkeys = append(u.Passkeys[:i], u.Passkeys[i+1:]...)
+				return nil
+			}
+		}
+		return ErrPasskeyNotFound
+	})
+	if errors.Is(err, ErrPasskeyNotFound) {
+		RespondError(w, http.StatusNotFound, err)
+		return
+	}
+	if err != nil {
+		RespondError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	s.Logger.Info("passkey removed", "user", p.User)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// BeginPasskeyLogin starts a passkey login. Public route.
+func (s *Server) BeginPasskeyLogin(w http.ResponseWriter, r *http.Request) {
+	if !s.checkPasskeys(w) {
+		return
+	}
+
+	var req PasskeyLoginRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			RespondError(w, http.StatusBadRequest, err)
+			return
+		}
+	}
+
+	var (
+		assertion *protocol.CredentialAssertion
+		data      *webauthn.SessionData
+		err       error
+	)
+	if req.Login == "" {
+		assertion, data, err = s.WebAuthn.BeginDiscoverableLogin()
+	} else {
+		var u *users.User
+		if u, _, err = s.Users.Get(req.Login); err != nil {
+			RespondError(w, http.StatusInternalServerError, err)
+			return
+		}
+		if len(u.Passkeys) == 0 {
+			// Same answer as a wrong password to avoid revealing which users exist.
+			RespondError(w, http.StatusUnauthorized, errors.New("invalid credentials"))
+			return
+		}
+		assertion, data, err = s.WebAuthn.BeginLogin(webauthnUser{u})
+	}
+	if err != nil {
+		s.Logger.Error("failed to begin passkey login", "error", err)
+		RespondError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	s.respondCeremony(w, r, req.Login, data, assertion)
+}
+
+// FinishPasskeyLogin verifies the assertion and starts a session. Public route.
+func (s *Server) FinishPasskeyLogin(w http.ResponseWriter, r *http.Request) {
+	if !s.checkPasskeys(w) {
+		return
+	}
+
+	c, ok := s.ceremonies.take(r.Context(), r.URL.Query().Get("ceremony"))
+	if !ok {
+		RespondError(w, http.StatusUnauthorized, ErrCeremonyInvalid)
+		return
+	}
+
+	var (
+		user *users.User
+		cred *webauthn.Credential
+		err  error
+	)
+	if c.User == "" {
+		cred, err = s.WebAuthn.FinishDiscoverableLogin(func(rawID, userHandle []byte) (webauthn.User, error) {
+			u, found, err := s.Users.Find(func(u *users.User) bool {
+				return len(u.WebAuthnID) > 0 && bytes.Equal(u.WebAuthnID, userHandle)
+			})
+			if err != nil {
+				return nil, err
+			}
+			if !found {
+				return nil, ErrPasskeyNotFound
+			}
+			user = u
+			return webauthnUser{u}, nil
+		}, c.Data, r)
+	} else {
+		user, _, err = s.Users.Get(c.User)
+		if err == nil {
+			cred, err = s.WebAuthn.FinishLogin(webauthnUser{user}, c.Data, r)
+		}
+	}
+	if err != nil || user == nil {
+		s.Logger.Warn("passkey login rejected", "user", c.User, "error", err)
+		RespondError(w, http.StatusUnauthorized, ErrPasskeyRejected)
+		return
+	}
+
+	// Track the signature counter to detect cloned authenticators.
+	err = s.Users.Update(user.Name, func(u *users.User) error {
+		for i := range u.Passkeys {
+			if bytes.Equal(u.Passkeys[i].Credential.ID, cred.ID) {
+				u.Passkeys[i].Credential.Authenticator = cred.Authenticator
+				u.Passkeys[i].LastUsedAt = time.Now()
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		s.Logger.Error("failed to update passkey", "user", user.Name, "error", err)
+	}
+	if cred.Authenticator.CloneWarning {
+		s.Logger.Warn("passkey signature counter went backwards, authenticator may be cloned", "user", user.Name)
+		RespondError(w, http.StatusUnauthorized, ErrPasskeyRejected)
+		return
+	}
+
+	// With user verification (PIN or biometrics) the passkey alone is two factors.
+	s.completeLogin(w, r, user.Name, cred.Flags.UserVerified)
+}
+
+func (s *Server) respondCeremony(w http.ResponseWriter, r *http.Request, user string, data *webauthn.SessionData, options interface{}) {
+	id, err := s.ceremonies.put(r.Context(), user, data)
+	if err != nil {
+		RespondError(w, http.StatusInternalServerError, err)
+		return
+	}
+	RespondJSON(w, http.StatusOK, CeremonyResponse{CeremonyID: id, Options: options})
+}
+
+func passkeyInfo(pk users.Passkey) PasskeyInfo {
+	return PasskeyInfo{
+		ID:         base64.RawURLEncoding.EncodeToString(pk.Credential.ID),
+		Name:       pk.Name,
+		CreatedAt:  pk.CreatedAt,
+		LastUsedAt: pk.LastUsedAt,
+	}
+}
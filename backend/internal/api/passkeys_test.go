@@ -0,0 +1,159 @@
+package api
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/generic/selectel-craas-web/internal/config"
+	"github.com/generic/selectel-craas-web/internal/state"
+	"github.com/generic/selectel-craas-web/internal/users"
+	"github.com/go-chi/chi/v5"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newPasskeyTestServer(t *testing.T) *Server {
+	cfg := &config.Config{
+		AuthEnabled:    true,
+		AuthLogin:      "admin",
+		AuthPassword:   "password",
+		JWTSecret:      "secret",
+		WebAuthnRPID:   "localhost",
+		WebAuthnRPName: "test",
+	}
+	wa, err := newWebAuthn(cfg)
+	require.NoError(t, err)
+	return &Server{
+		Config:     cfg,
+		Logger:     testLogger,
+		Sessions:   newTestSessions(t),
+		Users:      newTestUsers(t),
+		WebAuthn:   wa,
+		ceremonies: newCeremonyStore(state.NewMemory()),
+	}
+}
+
+func withTestPrincipal(r *http.Request, user string) *http.Request {
+	return r.WithContext(withPrincipal(r.Context(), &Principal{User: user, SessionID: "sid"}))
+}
+
+func TestPasskeys_Disabled(t *testing.T) {
+	server := newPasskeyTestServer(t)
+	server.WebAuthn = nil
+
+	rr := httptest.NewRecorder()
+	server.BeginPasskeyLogin(rr, httptest.NewRequest("POST", "/", nil))
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+}
+
+func TestBeginPasskeyRegistration(t *testing.T) {
+	server := newPasskeyTestServer(t)
+
+	rr := httptest.NewRecorder()
+	server.BeginPasskeyRegistration(rr, withTestPrincipal(httptest.NewRequest("POST", "/", nil), "admin"))
+	require.Equal(t, http.StatusOK, rr.Code)
+
+	var resp struct {
+		CeremonyID string `json:"ceremonyId"`
+		Options    struct {
+			PublicKey struct {
+				Challenge string `json:"challenge"`
+				RP        struct {
+					ID string `json:"id"`
+				} `json:"rp"`
+			} `json:"publicKey"`
+		} `json:"options"`
+	}
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&resp))
+	assert.NotEmpty(t, resp.CeremonyID)
+	assert.NotEmpty(t, resp.Options.PublicKey.Challenge)
+	assert.Equal(t, "localhost", resp.Options.PublicKey.RP.ID)
+
+	u, _, _ := server.Users.Get("admin")
+	assert.Len(t, u.WebAuthnID, 32, "user handle assigned on first registration")
+
+	// The ceremony belongs to the user who started it
+	rr = httptest.NewRecorder()
+	req := httptest.NewRequest("POST", "/?ceremony="+resp.CeremonyID, nil)
+	server.FinishPasskeyRegistration(rr, withTestPrincipal(req, "other"))
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+
+	// ...and is consumed by the first attempt
+	rr = httptest.NewRecorder()
+	req = httptest.NewRequest("POST", "/?ceremony="+resp.CeremonyID, nil)
+	server.FinishPasskeyRegistration(rr, withTestPrincipal(req, "admin"))
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	assert.Contains(t, rr.Body.String(), ErrCeremonyInvalid.Error())
+}
+
+func TestBeginPasskeyLogin(t *testing.T) {
+	server := newPasskeyTestServer(t)
+
+	// Unknown user or user without passkeys looks like a wrong password
+	rr := postJSON(t, server.BeginPasskeyLogin, PasskeyLoginRequest{Login: "admin"})
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+
+	// Discoverable login does not need a username
+	rr = httptest.NewRecorder()
+	server.BeginPasskeyLogin(rr, httptest.NewRequest("POST", "/", nil))
+	require.Equal(t, http.StatusOK, rr.Code)
+
+	var resp CeremonyResponse
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&resp))
+	assert.NotEmpty(t, resp.CeremonyID)
+
+	// A bogus assertion does not produce a session
+	rr = httptest.NewRecorder()
+	server.FinishPasskeyLogin(rr, httptest.NewRequest("POST", "/?ceremony="+resp.CeremonyID, nil))
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+	assert.Empty(t, rr.Result().Cookies())
+
+	rr = httptest.NewRecorder()
+	server.FinishPasskeyLogin(rr, httptest.NewRequest("POST", "/?ceremony=unknown", nil))
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+}
+
+func TestListAndDeletePasskeys(t *testing.T) {
+	server := newPasskeyTestServer(t)
+	credID := []byte("credential-1")
+	require.NoError(t, server.Users.Update("admin", func(u *users.User) error {
+		u.Passkeys = []users.Passkey{{
+			Name:       "YubiKey",
+			CreatedAt:  time.Now(),
+			Credential: webauthn.Credential{ID: credID},
+		}}
+		return nil
+	}))
+
+	rr := httptest.NewRecorder()
+	server.ListPasskeys(rr, withTestPrincipal(httptest.NewRequest("GET", "/", nil), "admin"))
+	require.Equal(t, http.StatusOK, rr.Code)
+
+	var list []PasskeyInfo
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&list))
+	require.Len(t, list, 1)
+	assert.Equal(t, "YubiKey", list[0].Name)
+	assert.Equal(t, base64.RawURLEncoding.EncodeToString(credID), list[0].ID)
+
+	deleteReq := func(id string) *httptest.ResponseRecorder {
+		rctx := chi.NewRouteContext()
+		rctx.URLParams.Add("id", id)
+		req := httptest.NewRequest("DELETE", "/", nil)
+		req = req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, rctx))
+		rr := httptest.NewRecorder()
+		server.DeletePasskey(rr, withTestPrincipal(req, "admin"))
+		return rr
+	}
+
+	assert.Equal(t, http.StatusNotFound, deleteReq("bm9wZQ").Code)
+	assert.Equal(t, http.StatusNoContent, deleteReq(list[0].ID).Code)
+
+	u, _, _ := server.Users.Get("admin")
+	assert.Empty(t, u.Passkeys)
+}
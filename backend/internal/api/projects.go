@@ -1,11 +1,24 @@
 package api
 
 import (
+	"context"
+	"errors"
 	"net/http"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/generic/selectel-craas-web/internal/auth"
+	"github.com/generic/selectel-craas-web/internal/craas"
+	"github.com/generic/selectel-craas-web/internal/governor"
+	"github.com/go-chi/chi/v5"
 )
 
+var ErrProjectNotFound = errors.New("project not found")
+
 func (s *Server) AuthStatus(w http.ResponseWriter, r *http.Request) {
-	_, err := s.Auth.GetAccountToken()
+	_, err := s.authClient(r.Context()).GetAccountToken(r.Context())
 	if err != nil {
 		s.Logger.Warn("auth check failed", "error", err)
 		RespondError(w, http.StatusUnauthorized, err)
@@ -15,27 +28,153 @@ func (s *Server) AuthStatus(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *Server) ListProjects(w http.ResponseWriter, r *http.Request) {
-	token, err := s.Auth.GetAccountToken()
+	projects, err := s.projects(r.Context(), s.authClient(r.Context()))
 	if err != nil {
-		s.Logger.Error("failed to get account token", "error", err)
 		RespondError(w, http.StatusInternalServerError, err)
 		return
 	}
+	// Revalidated rather than reused: with per-user credentials the list
+	// depends on who is signed in.
+	RespondList(w, r, projects, cacheRevalidate)
+}
+
+// projects lists the account's projects allowed by PROJECTS_ALLOW and
+// PROJECTS_DENY, with aliases and in PROJECTS_ORDER. The result is cached so
+// that ProjectScope can resolve project names.
+func (s *Server) projects(ctx context.Context, client *auth.Client) ([]auth.Project, error) {
+	token, err := client.GetAccountToken(ctx)
+	if err != nil {
+		s.Logger.Error("failed to get account token", "error", err)
+		return nil, err
+	}
 
-	projects, err := s.Auth.ListProjects(token)
+	projects, err := client.ListProjects(ctx, token)
 	if err != nil {
 		s.Logger.Warn("failed to list projects, retrying with token invalidation", "error", err)
-		s.Auth.InvalidateAccountToken()
-		token, err = s.Auth.GetAccountToken()
+		client.InvalidateAccountToken()
+		token, err = client.GetAccountToken(ctx)
 		if err == nil {
-			projects, err = s.Auth.ListProjects(token)
+			projects, err = client.ListProjects(ctx, token)
 		}
 	}
 	if err != nil {
 		s.Logger.Error("failed to list projects after retry", "error", err)
-		RespondError(w, http.StatusInternalServerError, err)
-		return
+		return nil, err
 	}
 
-	RespondJSON(w, http.StatusOK, projects)
+	policy := s.Config.Projects
+	allowed := make([]auth.Project, 0, len(projects))
+	for _, p := range projects {
+		if !policy.Allowed(p.ID, p.Name) {
+			continue
+		}
+		p.Alias = policy.Alias(p.ID, p.Name)
+		allowed = append(allowed, p)
+	}
+	sort.SliceStable(allowed, func(i, j int) bool {
+		return policy.Rank(allowed[i].ID, allowed[i].Name) < policy.Rank(allowed[j].ID, allowed[j].Name)
+	})
+
+	s.projectCache.put(client, allowed)
+	return allowed, nil
+}
+
+// ProjectScope rejects project routes whose {pid} is not an allowed project,
+// and routes CRaaS calls to the region of the project and {rid}. Calls count
+// against the project's concurrency cap. With ?refresh=true, listings are
+// fetched from CRaaS instead of the cache. Listings of configured accounts
+// are cached per account; UserCredentials sets the caller of per-user ones.
+func (s *Server) ProjectScope(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		pid := chi.URLParam(r, "pid")
+		ctx := craas.WithScope(r.Context(), pid, chi.URLParam(r, "rid"))
+		ctx = governor.WithProject(ctx, pid)
+		if client := s.authClient(ctx); s.account(client.Account().ID) == client {
+			ctx = craas.WithCaller(ctx, client.Account().ID)
+		}
+		if r.URL.Query().Get("refresh") == "true" {
+			ctx = craas.WithRefresh(ctx)
+		}
+		r = r.WithContext(ctx)
+		if !s.Config.Projects.Active() {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		client := s.authClient(r.Context())
+		found, known := s.projectCache.contains(client, pid)
+		if !known {
+			// Not cached yet or expired: list the projects again.
+			projects, err := s.projects(r.Context(), client)
+			if err != nil {
+				RespondError(w, http.StatusInternalServerError, err)
+				return
+			}
+			found = slices.ContainsFunc(projects, func(p auth.Project) bool { return p.ID == pid })
+		}
+		if !found {
+			RespondError(w, http.StatusNotFound, ErrProjectNotFound)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// projectCache remembers the allowed projects of each account for a minute.
+// Per-user clients are replaced when their credentials change, so expired
+// entries are evicted rather than left for a client that never comes back.
+type projectCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	now     func() time.Time
+	entries map[*auth.Client]projectCacheEntry
+}
+
+type projectCacheEntry struct {
+	ids       map[string]bool
+	fetchedAt time.Time
+}
+
+func newProjectCache(ttl time.Duration) *projectCache {
+	return &projectCache{ttl: ttl, now: time.Now, entries: make(map[*auth.Client]projectCacheEntry)}
+}
+
+func (c *projectCache) put(client *auth.Client, projects []auth.Project) {
+	ids := make(map[string]bool, len(projects))
+	for _, p := range projects {
+		ids[p.ID] = true
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.now()
+	for k, e := range c.entries {
+		if now.Sub(e.fetchedAt) > c.ttl {
+			delete(c.entries, k)
+		}
+	}
+	c.entries[client] = projectCacheEntry{ids: ids, fetchedAt: now}
+}
+
+// contains reports whether the project is allowed. known is false when the
+// projects are not cached or the cache expired.
+func (c *projectCache) contains(client *auth.Client, id string) (found, known bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[client]
+	if !ok || c.now().Sub(e.fetchedAt) > c.ttl {
+		return false, false
+	}
+	return e.ids[id], true
+}
+
+// ListTokens shows the state of the cached Keystone tokens, never their values. Admin only.
+func (s *Server) ListTokens(w http.ResponseWriter, r *http.Request) {
+	result := []auth.TokenInfo{}
+	for _, c := range s.Accounts {
+		result = append(result, c.Tokens()...)
+	}
+	for _, c := range s.userAuth.all() {
+		result = append(result, c.Tokens()...)
+	}
+	RespondJSON(w, http.StatusOK, result)
 }
@@ -0,0 +1,105 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/generic/selectel-craas-web/internal/auth"
+	"github.com/generic/selectel-craas-web/internal/config"
+	"github.com/go-chi/chi/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProjectPolicy(t *testing.T) {
+	var listed int32
+	keystone := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/tokens":
+			w.Header().Set("X-Subject-Token", "token")
+			w.WriteHeader(http.StatusCreated)
+			w.Write([]byte(`{}`))
+		case "/projects":
+			atomic.AddInt32(&listed, 1)
+			w.Write([]byte(`{"projects": [
+				{"id": "p1", "name": "sandbox-alice"},
+				{"id": "p2", "name": "prod-api"},
+				{"id": "p3", "name": "finance"},
+				{"id": "p4", "name": "prod-web"}
+			]}`))
+		}
+	}))
+	defer keystone.Close()
+
+	cfg := &config.Config{
+		SelectelAuthURL: keystone.URL + "/tokens",
+		SelectelProjURL: keystone.URL + "/projects",
+		Projects: config.ProjectPolicy{
+			Allow:   []string{"prod-*", "p1"},
+			Deny:    []string{"sandbox-*"},
+			Aliases: map[string]string{"p4": "Website"},
+			Order:   []string{"prod-web"},
+		},
+	}
+	server := &Server{
+		Auth:         auth.New(cfg, testLogger),
+		Config:       cfg,
+		Logger:       testLogger,
+		projectCache: newProjectCache(time.Minute),
+	}
+
+	rr := httptest.NewRecorder()
+	server.ListProjects(rr, httptest.NewRequest("GET", "/", nil))
+	require.Equal(t, http.StatusOK, rr.Code)
+	var projects []auth.Project
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&projects))
+	assert.Equal(t, []auth.Project{
+		{ID: "p4", Name: "prod-web", Alias: "Website"},
+		{ID: "p2", Name: "prod-api"},
+	}, projects, "deny wins over allow, ordered projects come first")
+
+	router := chi.NewRouter()
+	router.With(server.ProjectScope).Get("/projects/{pid}/registries", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	status := func(pid string) int {
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, httptest.NewRequest("GET", "/projects/"+pid+"/registries", nil))
+		return rr.Code
+	}
+
+	assert.Equal(t, http.StatusOK, status("p2"))
+	assert.Equal(t, http.StatusNotFound, status("p1"), "denied by name")
+	assert.Equal(t, http.StatusNotFound, status("p3"), "not in the allow-list")
+	assert.Equal(t, http.StatusNotFound, status("unknown"))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&listed), "the project list is cached")
+
+	// Without a policy every project is accepted without listing
+	cfg.Projects = config.ProjectPolicy{}
+	assert.Equal(t, http.StatusOK, status("p3"))
+}
+
+func TestProjectCache_Evicts(t *testing.T) {
+	c := newProjectCache(time.Minute)
+	now := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+	c.now = func() time.Time { return now }
+
+	cfg := &config.Config{}
+	replaced := auth.New(cfg, testLogger)
+	c.put(replaced, []auth.Project{{ID: "p1"}})
+	found, known := c.contains(replaced, "p1")
+	assert.True(t, found)
+	assert.True(t, known)
+
+	// A client that is never used again is dropped once its entry expired
+	now = now.Add(2 * time.Minute)
+	current := auth.New(cfg, testLogger)
+	c.put(current, []auth.Project{{ID: "p1"}})
+	assert.Len(t, c.entries, 1)
+	_, known = c.contains(replaced, "p1")
+	assert.False(t, known)
+}
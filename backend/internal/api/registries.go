@@ -1,8 +1,10 @@
 package api
 
 import (
+	"errors"
 	"net/http"
 
+	"github.com/generic/selectel-craas-web/internal/craas"
 	"github.com/go-chi/chi/v5"
 )
 
@@ -23,11 +25,11 @@ func (s *Server) ListRegistries(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	RespondJSON(w, http.StatusOK, result)
+	RespondList(w, r, result, cacheRevalidate)
 }
 
 func (s *Server) DeleteRegistry(w http.ResponseWriter, r *http.Request) {
-	if !s.checkDeleteRegistry(w) {
+	if !s.checkDeleteRegistry(w, r) {
 		return
 	}
 
@@ -77,7 +79,7 @@ func (s *Server) StartGC(w http.ResponseWriter, r *http.Request) {
 	})
 
 	if err != nil {
-		if err.Error() == "garbage collection already in progress" {
+		if errors.Is(err, craas.ErrConflict) {
 			RespondError(w, http.StatusConflict, err)
 			return
 		}
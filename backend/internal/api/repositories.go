@@ -7,14 +7,21 @@ import (
 
 	"github.com/generic/selectel-craas-web/internal/craas"
 	"github.com/go-chi/chi/v5"
+	"github.com/selectel/craas-go/pkg/v1/repository"
 )
 
 func (s *Server) ListRepositories(w http.ResponseWriter, r *http.Request) {
 	pid := chi.URLParam(r, "pid")
 	rid := chi.URLParam(r, "rid")
 
-	var result interface{}
-	err := s.ExecuteWithRetry(r.Context(), pid, func(token string) error {
+	query, err := parseListQuery(r.URL.Query(), repositoryFields)
+	if err != nil {
+		RespondError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	var result []*repository.Repository
+	err = s.ExecuteWithRetry(r.Context(), pid, func(token string) error {
 		var err error
 		result, err = s.Craas.ListRepositories(r.Context(), token, rid)
 		return err
@@ -26,11 +33,11 @@ func (s *Server) ListRepositories(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	RespondJSON(w, http.StatusOK, result)
+	respondListing(w, r, query, result, repositoryFields)
 }
 
 func (s *Server) DeleteRepository(w http.ResponseWriter, r *http.Request) {
-	if !s.checkDeleteRepository(w) {
+	if !s.checkDeleteRepository(w, r) {
 		return
 	}
 
@@ -56,7 +63,7 @@ func (s *Server) DeleteRepository(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *Server) CleanupRepository(w http.ResponseWriter, r *http.Request) {
-	if !s.checkDeleteImage(w) {
+	if !s.checkDeleteImage(w, r) {
 		return
 	}
 
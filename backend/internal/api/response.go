@@ -1,8 +1,12 @@
 package api
 
 import (
+	"crypto/sha256"
+	"encoding/base64"
 	"encoding/json"
 	"net/http"
+	"strconv"
+	"strings"
 )
 
 // RespondJSON sends a JSON response with the given status code.
@@ -16,10 +20,152 @@ func RespondJSON(w http.ResponseWriter, status int, data interface{}) {
 	}
 }
 
-// RespondError sends a JSON error response with the given status code and message.
+// Cache-Control policies of list responses. Listings are per user, so
+// shared caches never store them.
+const (
+	// Revalidated on every use; with the ETag an unchanged listing costs a 304.
+	cacheRevalidate = "private, no-cache"
+	// Reused by the browser for a while. Only for listings that are the same
+	// for every user and change only with the configuration.
+	cacheStatic = "private, max-age=300"
+)
+
+// RespondList sends data like RespondJSON with status 200, plus an ETag
+// derived from the encoded body and the given Cache-Control policy. A request
+// whose If-None-Match matches the ETag gets 304 Not Modified without a body.
+func RespondList(w http.ResponseWriter, r *http.Request, data interface{}, cacheControl string) {
+	body, err := json.Marshal(data)
+	if err != nil {
+		http.Error(w, "Failed to encode response", http.StatusInternalServerError)
+		return
+	}
+	body = append(body, '\n')
+
+	sum := sha256.Sum256(body)
+	etag := `"` + base64.RawURLEncoding.EncodeToString(sum[:16]) + `"`
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", cacheControl)
+
+	if etagMatches(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(body)
+}
+
+// etagMatches implements the weak comparison If-None-Match calls for.
+func etagMatches(header, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// ndjsonType is the media type of newline-delimited JSON, one value per line.
+const ndjsonType = "application/x-ndjson"
+
+// acceptsNDJSON reports whether the Accept header prefers NDJSON to JSON.
+// JSON wins ties, so it stays the default for */* and without the header.
+func acceptsNDJSON(r *http.Request) bool {
+	return acceptQuality(r, ndjsonType) > acceptQuality(r, "application/json")
+}
+
+// acceptQuality returns the q-value the Accept header gives the media type,
+// taken from the most specific media range matching it. It is 1 without the
+// header and 0 if no range matches.
+func acceptQuality(r *http.Request, mediaType string) float64 {
+	values := r.Header.Values("Accept")
+	if len(values) == 0 {
+		return 1
+	}
+	quality, specificity := 0.0, -1
+	for _, accept := range values {
+		for _, mediaRange := range strings.Split(accept, ",") {
+			rangeType, params, _ := strings.Cut(mediaRange, ";")
+			rangeType = strings.ToLower(strings.TrimSpace(rangeType))
+			var s int
+			switch {
+			case rangeType == mediaType:
+				s = 2
+			case strings.HasSuffix(rangeType, "/*") && strings.HasPrefix(mediaType, strings.TrimSuffix(rangeType, "*")):
+				s = 1
+			case rangeType == "*/*":
+				s = 0
+			default:
+				continue
+			}
+			if s > specificity {
+				quality, specificity = rangeQuality(params), s
+			}
+		}
+	}
+	return quality
+}
+
+// rangeQuality returns the q parameter of a media range, 1 if it has none or
+// it is invalid.
+func rangeQuality(params string) float64 {
+	for _, param := range strings.Split(params, ";") {
+		name, value, _ := strings.Cut(param, "=")
+		if !strings.EqualFold(strings.TrimSpace(name), "q") {
+			continue
+		}
+		q, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+		if err != nil || q < 0 || q > 1 {
+			return 1
+		}
+		return q
+	}
+	return 1
+}
+
+// RespondNDJSON sends items as newline-delimited JSON with status 200, one
+// item per line, for clients that process a listing line by line. The
+// listing is complete before the first line is written; unlike RespondList,
+// the items are encoded one at a time rather than into one body.
+func RespondNDJSON[T any](w http.ResponseWriter, items []T) {
+	w.Header().Set("Content-Type", ndjsonType)
+	w.Header().Set("Cache-Control", cacheRevalidate)
+	w.WriteHeader(http.StatusOK)
+
+	enc := json.NewEncoder(w)
+	for _, item := range items {
+		if err := enc.Encode(item); err != nil {
+			return // The client went away
+		}
+	}
+}
+
+// ErrorResponse is the body of every error response.
+type ErrorResponse struct {
+	Error     string `json:"error"`
+	Code      string `json:"code"`
+	RequestID string `json:"requestId,omitempty"`
+}
+
+// RespondError sends a JSON error response. Handlers pass 500 for failures
+// they do not handle themselves; those take the status of the error kind,
+// e.g. 404 for craas.ErrNotFound or 503 for an open upstream circuit.
 func RespondError(w http.ResponseWriter, status int, err error) {
+	code := codeForStatus(status)
+	if status == http.StatusInternalServerError {
+		if s, c, ok := classifyError(err); ok {
+			status, code = s, c
+		}
+	}
+	if status == http.StatusTooManyRequests {
+		retryAfterHeader(w, err)
+	}
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(status)
-	response := map[string]string{"error": err.Error()}
-	json.NewEncoder(w).Encode(response)
+	json.NewEncoder(w).Encode(ErrorResponse{
+		Error:     err.Error(),
+		Code:      code,
+		RequestID: w.Header().Get(requestIDHeader),
+	})
 }
@@ -0,0 +1,72 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRespondList(t *testing.T) {
+	data := []map[string]string{{"name": "app"}, {"name": "web"}}
+	get := func(ifNoneMatch string, data interface{}) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/api/projects/p1/registries", nil)
+		if ifNoneMatch != "" {
+			req.Header.Set("If-None-Match", ifNoneMatch)
+		}
+		rr := httptest.NewRecorder()
+		RespondList(rr, req, data, cacheRevalidate)
+		return rr
+	}
+
+	rr := get("", data)
+	require.Equal(t, http.StatusOK, rr.Code)
+	etag := rr.Header().Get("ETag")
+	assert.Regexp(t, `^"[A-Za-z0-9_-]+"$`, etag)
+	assert.Equal(t, "private, no-cache", rr.Header().Get("Cache-Control"))
+	assert.JSONEq(t, `[{"name": "app"}, {"name": "web"}]`, rr.Body.String())
+
+	// The ETag is stable for the same content
+	assert.Equal(t, etag, get("", data).Header().Get("ETag"))
+
+	for _, header := range []string{etag, "W/" + etag, `"other", ` + etag, "*"} {
+		rr = get(header, data)
+		assert.Equal(t, http.StatusNotModified, rr.Code, header)
+		assert.Empty(t, rr.Body.String())
+		assert.Equal(t, etag, rr.Header().Get("ETag"))
+	}
+
+	// Changed content does not match the old ETag
+	rr = get(etag, data[:1])
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.NotEqual(t, etag, rr.Header().Get("ETag"))
+}
+
+func TestAcceptsNDJSON(t *testing.T) {
+	tests := []struct {
+		accept string
+		want   bool
+	}{
+		{"", false},
+		{"*/*", false},
+		{"application/json", false},
+		{"application/x-ndjson", true},
+		{"Application/X-NDJSON; charset=utf-8", true},
+		{"application/x-ndjson;q=0", false},
+		{"application/json, application/x-ndjson;q=0.9", false},
+		{"application/json;q=0.5, application/x-ndjson", true},
+		{"application/x-ndjson, */*;q=0.1", true},
+		{"application/*;q=0.2, application/x-ndjson;q=0.3", true},
+		{"application/x-ndjson;q=0.3, application/*;q=0.5", false},
+		{"application/x-ndjson;q=bogus, application/json;q=0.9", true},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "/", nil)
+		if tt.accept != "" {
+			req.Header.Set("Accept", tt.accept)
+		}
+		assert.Equal(t, tt.want, acceptsNDJSON(req), tt.accept)
+	}
+}
@@ -2,32 +2,76 @@ package api
 
 import (
 	"log/slog"
+	"time"
 
 	"github.com/generic/selectel-craas-web/internal/auth"
 	"github.com/generic/selectel-craas-web/internal/config"
 	"github.com/generic/selectel-craas-web/internal/craas"
+	"github.com/generic/selectel-craas-web/internal/inventory"
+	"github.com/generic/selectel-craas-web/internal/sealer"
+	"github.com/generic/selectel-craas-web/internal/session"
+	"github.com/generic/selectel-craas-web/internal/state"
+	"github.com/generic/selectel-craas-web/internal/users"
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
+	"github.com/go-webauthn/webauthn/webauthn"
 )
 
 type Server struct {
-	Auth        *auth.Client
+	Auth        *auth.Client   // Default account
+	Accounts    []*auth.Client // All accounts, the default first
 	Craas       *craas.Service
+	Inventory   *inventory.Crawler // Nil unless INVENTORY_INTERVAL is set
 	Logger      *slog.Logger
 	Config      *config.Config
 	RateLimiter *RateLimiter
+	Lockout     *LoginLockout
+	Sessions    *session.Manager
+	Users       *users.Store
+	State       state.Store // Rate limits, lockouts and passkey ceremonies
+	WebAuthn    *webauthn.WebAuthn
+	Sealer      *sealer.Sealer // Encrypts per-user Selectel credentials
+
+	ceremonies *ceremonyStore
+	userAuth   *userAuthCache
+
+	projectCache *projectCache
 }
 
-func New(auth *auth.Client, craas *craas.Service, logger *slog.Logger, cfg *config.Config) *chi.Mux {
+func New(accounts []*auth.Client, craas *craas.Service, inv *inventory.Crawler, sessions *session.Manager, users *users.Store, st state.Store, logger *slog.Logger, cfg *config.Config) *chi.Mux {
 	s := &Server{
-		Auth:        auth,
-		Craas:       craas,
-		Logger:      logger.With("service", "api"),
-		Config:      cfg,
-		RateLimiter: NewRateLimiter(),
+		Auth:       accounts[0],
+		Accounts:   accounts,
+		Craas:      craas,
+		Inventory:  inv,
+		Sessions:   sessions,
+		Users:      users,
+		State:      st,
+		Logger:     logger.With("service", "api"),
+		Config:     cfg,
+		Lockout:    NewLoginLockout(st, cfg.LoginLockoutThreshold, cfg.LoginLockoutDuration, cfg.LoginLockoutMax),
+		ceremonies: newCeremonyStore(st),
+		userAuth:   newUserAuthCache(),
+
+		projectCache: newProjectCache(time.Minute),
+	}
+	s.RateLimiter = NewRateLimiter(st, cfg.LoginRateLimit, cfg.LoginRateBurst, s.clientIP)
+
+	wa, err := newWebAuthn(cfg)
+	if err != nil {
+		s.Logger.Error("invalid webauthn configuration, passkeys disabled", "error", err)
+	}
+	s.WebAuthn = wa
+
+	if cfg.CredentialsEncryptionKey != "" {
+		s.Sealer, err = sealer.New(cfg.CredentialsEncryptionKey)
+		if err != nil {
+			s.Logger.Error("invalid credentials encryption key, per-user credentials disabled", "error", err)
+		}
 	}
 
 	r := chi.NewRouter()
+	r.Use(s.RequestID)
 	r.Use(middleware.Recoverer)
 	r.Use(s.SecurityHeaders)
 	r.Use(s.EnableCORS)
@@ -36,34 +80,99 @@ func New(auth *auth.Client, craas *craas.Service, logger *slog.Logger, cfg *conf
 	// Public routes
 	r.Get("/api/config", s.GetConfig)
 	r.With(s.RateLimiter.RateLimit).Post("/api/login", s.Login)
+	r.With(s.RateLimiter.RateLimit).Post("/api/login/2fa", s.LoginMFA)
+	r.With(s.RateLimiter.RateLimit).Post("/api/login/passkey/begin", s.BeginPasskeyLogin)
+	r.With(s.RateLimiter.RateLimit).Post("/api/login/passkey/finish", s.FinishPasskeyLogin)
 	r.Post("/api/logout", s.Logout)
 
 	// Protected routes
 	r.Group(func(r chi.Router) {
 		r.Use(s.AuthMiddleware)
+		r.Use(s.CSRFProtect)
 
 		r.Get("/api/auth/check", s.AuthCheck)
+		r.Get("/api/auth/csrf", s.GetCSRFToken)
+		r.Post("/api/auth/refresh", s.RefreshSession)
+
+		// Two-factor authentication
+		r.Get("/api/auth/2fa", s.MFAStatus)
+		r.Post("/api/auth/2fa/enroll", s.EnrollMFA)
+		r.Post("/api/auth/2fa/confirm", s.ConfirmMFA)
+		r.Post("/api/auth/2fa/disable", s.DisableMFA)
+		r.Post("/api/auth/2fa/recovery-codes", s.RegenerateRecoveryCodes)
+
+		// Passkeys
+		r.Get("/api/auth/passkeys", s.ListPasskeys)
+		r.Post("/api/auth/passkeys/register/begin", s.BeginPasskeyRegistration)
+		r.Post("/api/auth/passkeys/register/finish", s.FinishPasskeyRegistration)
+		r.Delete("/api/auth/passkeys/{id}", s.DeletePasskey)
+
+		// Sessions
+		r.Get("/api/sessions", s.ListMySessions)
+		r.Delete("/api/sessions/{sid}", s.RevokeMySession)
+
+		// Per-user Selectel credentials
+		r.Get("/api/me/selectel-credentials", s.GetSelectelCredentials)
+		r.Post("/api/me/selectel-credentials", s.SetSelectelCredentials)
+		r.Delete("/api/me/selectel-credentials", s.DeleteSelectelCredentials)
+
+		r.Group(func(r chi.Router) {
+			r.Use(s.RequireAdmin)
 
-		// Projects
-		r.Get("/api/auth/status", s.AuthStatus) // Checks upstream auth status
-		r.Get("/api/projects", s.ListProjects)
+			r.Get("/api/admin/sessions", s.ListAllSessions)
+			r.Delete("/api/admin/sessions/{sid}", s.RevokeSession)
+			r.Delete("/api/admin/users/{user}/sessions", s.RevokeUserSessions)
+			r.Get("/api/admin/tokens", s.ListTokens)
+			r.Get("/api/admin/upstream/concurrency", s.UpstreamConcurrency)
+		})
+
+		// Health of the Selectel endpoints as seen by the circuit breakers
+		r.Get("/api/upstream/status", s.UpstreamStatus)
+
+		// Accounts. The unprefixed routes use the default account.
+		r.Get("/api/accounts", s.ListAccounts)
+		r.Group(func(r chi.Router) {
+			r.Use(s.UserCredentials)
+			s.accountRoutes(r, "/api")
+		})
+		r.Group(func(r chi.Router) {
+			r.Use(s.AccountScope)
+			r.Use(s.UserCredentials)
+			s.accountRoutes(r, "/api/accounts/{aid}")
+		})
+	})
+
+	return r
+}
+
+// accountRoutes registers the routes that operate on one Selectel account.
+func (s *Server) accountRoutes(r chi.Router, prefix string) {
+	// Projects
+	r.Get(prefix+"/auth/status", s.AuthStatus) // Checks upstream auth status
+	r.Get(prefix+"/projects", s.ListProjects)
+
+	// Inventory kept by the background crawler
+	r.Get(prefix+"/inventory", s.InventoryStatus)
+	r.Get(prefix+"/inventory/search", s.SearchInventory)
+
+	// Project routes only accept allowed projects
+	r.Group(func(r chi.Router) {
+		r.Use(s.ProjectScope)
 
 		// Registries
-		r.Get("/api/projects/{pid}/registries", s.ListRegistries)
-		r.Delete("/api/projects/{pid}/registries/{rid}", s.DeleteRegistry)
-		r.Get("/api/projects/{pid}/registries/{rid}/gc", s.GetGCInfo)
-		r.Post("/api/projects/{pid}/registries/{rid}/gc", s.StartGC)
+		r.Get(prefix+"/projects/{pid}/registries", s.ListRegistries)
+		r.Delete(prefix+"/projects/{pid}/registries/{rid}", s.DeleteRegistry)
+		r.Get(prefix+"/projects/{pid}/registries/{rid}/gc", s.GetGCInfo)
+		r.Post(prefix+"/projects/{pid}/registries/{rid}/gc", s.StartGC)
 
 		// Repositories
-		r.Get("/api/projects/{pid}/registries/{rid}/repositories", s.ListRepositories)
-		r.Delete("/api/projects/{pid}/registries/{rid}/repository", s.DeleteRepository)
-		r.Post("/api/projects/{pid}/registries/{rid}/cleanup", s.CleanupRepository)
+		r.Get(prefix+"/projects/{pid}/registries/{rid}/repositories", s.ListRepositories)
+		r.Delete(prefix+"/projects/{pid}/registries/{rid}/repository", s.DeleteRepository)
+		r.Post(prefix+"/projects/{pid}/registries/{rid}/cleanup", s.CleanupRepository)
 
 		// Images
-		r.Get("/api/projects/{pid}/registries/{rid}/images", s.ListImages)
-		r.Delete("/api/projects/{pid}/registries/{rid}/images/{digest}", s.DeleteImage)
-		r.Get("/api/projects/{pid}/registries/{rid}/tags", s.ListTags)
+		r.Get(prefix+"/projects/{pid}/registries/{rid}/images", s.ListImages)
+		r.Delete(prefix+"/projects/{pid}/registries/{rid}/images/{digest}", s.DeleteImage)
+		r.Get(prefix+"/projects/{pid}/registries/{rid}/tags", s.ListTags)
 	})
-
-	return r
 }
@@ -0,0 +1,177 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/generic/selectel-craas-web/internal/session"
+	"github.com/go-chi/chi/v5"
+)
+
+var ErrAdminRequired = errors.New("administrator privileges required")
+
+// SessionInfo is the public view of a session.
+type SessionInfo struct {
+	ID            string    `json:"id"`
+	User          string    `json:"user"`
+	CreatedAt     time.Time `json:"createdAt"`
+	LastSeenAt    time.Time `json:"lastSeenAt"`
+	IdleExpiresAt time.Time `json:"idleExpiresAt"`
+	ExpiresAt     time.Time `json:"expiresAt"`
+	UserAgent     string    `json:"userAgent,omitempty"`
+	RemoteAddr    string    `json:"remoteAddr,omitempty"`
+	Current       bool      `json:"current"`
+}
+
+// RefreshResponse is returned by the session refresh endpoint.
+type RefreshResponse struct {
+	User          string    `json:"user"`
+	Token         string    `json:"token,omitempty"`
+	IdleExpiresAt time.Time `json:"idleExpiresAt"`
+	ExpiresAt     time.Time `json:"expiresAt"`
+}
+
+func (s *Server) sessionInfos(r *http.Request, sessions []*session.Session) []SessionInfo {
+	var currentID string
+	if p := PrincipalFromContext(r.Context()); p != nil {
+		currentID = p.SessionID
+	}
+
+	result := make([]SessionInfo, 0, len(sessions))
+	for _, sess := range sessions {
+		result = append(result, SessionInfo{
+			ID:            sess.ID,
+			User:          sess.User,
+			CreatedAt:     sess.CreatedAt,
+			LastSeenAt:    sess.LastSeenAt,
+			IdleExpiresAt: s.Sessions.IdleExpiresAt(sess),
+			ExpiresAt:     sess.ExpiresAt,
+			UserAgent:     sess.UserAgent,
+			RemoteAddr:    sess.RemoteAddr,
+			Current:       sess.ID == currentID,
+		})
+	}
+	return result
+}
+
+// RefreshSession slides the idle window of the current session and re-issues
+// the auth token. Bearer clients receive the new token in the response body.
+func (s *Server) RefreshSession(w http.ResponseWriter, r *http.Request) {
+	p := PrincipalFromContext(r.Context())
+	if p == nil {
+		RespondError(w, http.StatusBadRequest, errors.New("authentication is disabled"))
+		return
+	}
+
+	// AuthMiddleware already validated the session, which recorded its activity
+	// to within Validate's interval.
+	sess, err := s.Sessions.Get(p.SessionID)
+	if err != nil {
+		RespondError(w, http.StatusUnauthorized, ErrUnauthorized)
+		return
+	}
+
+	resp := RefreshResponse{
+		User:          sess.User,
+		IdleExpiresAt: s.Sessions.IdleExpiresAt(sess),
+		ExpiresAt:     sess.ExpiresAt,
+	}
+
+	if _, bearer := tokenFromRequest(r); bearer {
+		resp.Token, err = s.signSessionToken(sess)
+	} else {
+		err = s.setAuthCookie(w, sess)
+	}
+	if err != nil {
+		s.Logger.Error("failed to refresh session token", "session_id", sess.ID, "error", err)
+		RespondError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	RespondJSON(w, http.StatusOK, resp)
+}
+
+// ListMySessions lists the sessions of the current user.
+func (s *Server) ListMySessions(w http.ResponseWriter, r *http.Request) {
+	p := PrincipalFromContext(r.Context())
+	if p == nil {
+		RespondJSON(w, http.StatusOK, []SessionInfo{})
+		return
+	}
+
+	sessions, err := s.Sessions.ListUser(p.User)
+	if err != nil {
+		s.Logger.Error("failed to list sessions", "user", p.User, "error", err)
+		RespondError(w, http.StatusInternalServerError, err)
+		return
+	}
+	RespondJSON(w, http.StatusOK, s.sessionInfos(r, sessions))
+}
+
+// RevokeMySession revokes one of the current user's sessions.
+func (s *Server) RevokeMySession(w http.ResponseWriter, r *http.Request) {
+	p := PrincipalFromContext(r.Context())
+	sid := chi.URLParam(r, "sid")
+	if p == nil {
+		RespondError(w, http.StatusNotFound, session.ErrNotFound)
+		return
+	}
+
+	sessions, err := s.Sessions.ListUser(p.User)
+	if err != nil {
+		RespondError(w, http.StatusInternalServerError, err)
+		return
+	}
+	for _, sess := range sessions {
+		if sess.ID == sid {
+			s.revokeSession(w, sid)
+			return
+		}
+	}
+	RespondError(w, http.StatusNotFound, session.ErrNotFound)
+}
+
+// ListAllSessions lists the sessions of every user. Admin only.
+func (s *Server) ListAllSessions(w http.ResponseWriter, r *http.Request) {
+	sessions, err := s.Sessions.List()
+	if err != nil {
+		s.Logger.Error("failed to list sessions", "error", err)
+		RespondError(w, http.StatusInternalServerError, err)
+		return
+	}
+	RespondJSON(w, http.StatusOK, s.sessionInfos(r, sessions))
+}
+
+// RevokeSession revokes any session by ID. Admin only.
+func (s *Server) RevokeSession(w http.ResponseWriter, r *http.Request) {
+	sid := chi.URLParam(r, "sid")
+	if _, err := s.Sessions.Get(sid); err != nil {
+		RespondError(w, http.StatusNotFound, session.ErrNotFound)
+		return
+	}
+	s.revokeSession(w, sid)
+}
+
+// RevokeUserSessions revokes all sessions of a user. Admin only.
+func (s *Server) RevokeUserSessions(w http.ResponseWriter, r *http.Request) {
+	user := chi.URLParam(r, "user")
+	count, err := s.Sessions.RevokeUser(user)
+	if err != nil {
+		s.Logger.Error("failed to revoke user sessions", "user", user, "error", err)
+		RespondError(w, http.StatusInternalServerError, err)
+		return
+	}
+	s.Logger.Info("revoked user sessions", "user", user, "count", count)
+	RespondJSON(w, http.StatusOK, map[string]int{"revoked": count})
+}
+
+func (s *Server) revokeSession(w http.ResponseWriter, sid string) {
+	if err := s.Sessions.Revoke(sid); err != nil {
+		s.Logger.Error("failed to revoke session", "session_id", sid, "error", err)
+		RespondError(w, http.StatusInternalServerError, err)
+		return
+	}
+	s.Logger.Info("session revoked", "session_id", sid)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,35 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/generic/selectel-craas-web/internal/governor"
+	"github.com/generic/selectel-craas-web/internal/resilience"
+)
+
+// UpstreamStatus lists the circuit breaker state of every Selectel endpoint
+// called so far, so the UI can tell users when Selectel is degraded.
+func (s *Server) UpstreamStatus(w http.ResponseWriter, r *http.Request) {
+	result := []resilience.EndpointStatus{}
+	if s.Auth != nil && s.Auth.HTTPClient != nil {
+		if t, ok := s.Auth.HTTPClient.Transport.(*resilience.Transport); ok {
+			result = t.Status()
+		}
+	}
+	RespondJSON(w, http.StatusOK, result)
+}
+
+// UpstreamConcurrency shows the limits on concurrent calls to Selectel, the
+// calls in flight and waiting, and how long calls waited. Admin only.
+func (s *Server) UpstreamConcurrency(w http.ResponseWriter, r *http.Request) {
+	var g *governor.Governor
+	if s.Auth != nil {
+		g = governor.Find(s.Auth.HTTPClient)
+	}
+	if g == nil {
+		RespondError(w, http.StatusNotFound, errors.New("concurrency limits are not enabled"))
+		return
+	}
+	RespondJSON(w, http.StatusOK, g.Stats())
+}
@@ -0,0 +1,79 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/generic/selectel-craas-web/internal/auth"
+	"github.com/generic/selectel-craas-web/internal/config"
+	"github.com/generic/selectel-craas-web/internal/governor"
+	"github.com/generic/selectel-craas-web/internal/resilience"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUpstreamStatus(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer ts.Close()
+
+	client := auth.New(&config.Config{}, testLogger)
+	client.HTTPClient = &http.Client{Transport: resilience.New(nil, resilience.Options{BreakerThreshold: 1, BreakerCooldown: time.Hour})}
+	client.AuthURL = ts.URL
+	server := &Server{Auth: client, Config: &config.Config{}, Logger: testLogger}
+
+	_, err := client.GetAccountToken(t.Context())
+	require.Error(t, err)
+	_, err = client.GetAccountToken(t.Context())
+	require.ErrorIs(t, err, resilience.ErrCircuitOpen)
+
+	rr := httptest.NewRecorder()
+	RespondError(rr, http.StatusInternalServerError, fmt.Errorf("list projects: %w", err))
+	assert.Equal(t, http.StatusServiceUnavailable, rr.Code)
+
+	rr = httptest.NewRecorder()
+	server.UpstreamStatus(rr, httptest.NewRequest("GET", "/api/upstream/status", nil))
+	require.Equal(t, http.StatusOK, rr.Code)
+	var status []resilience.EndpointStatus
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&status))
+	require.Len(t, status, 1)
+	assert.Equal(t, ts.URL, status[0].Endpoint)
+	assert.Equal(t, resilience.StateOpen, status[0].State)
+}
+
+func TestUpstreamConcurrency(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer ts.Close()
+
+	client := auth.New(&config.Config{}, testLogger)
+	client.AuthURL = ts.URL
+	server := &Server{Auth: client, Config: &config.Config{}, Logger: testLogger}
+
+	rr := httptest.NewRecorder()
+	server.UpstreamConcurrency(rr, httptest.NewRequest("GET", "/api/admin/upstream/concurrency", nil))
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+
+	g := governor.New(nil, governor.Options{Global: 4, PerProject: 2})
+	client.HTTPClient = &http.Client{Transport: resilience.New(g, resilience.Options{})}
+	_, err := client.GetAccountToken(governor.WithProject(t.Context(), "p1"))
+	require.Error(t, err)
+
+	rr = httptest.NewRecorder()
+	server.UpstreamConcurrency(rr, httptest.NewRequest("GET", "/api/admin/upstream/concurrency", nil))
+	require.Equal(t, http.StatusOK, rr.Code)
+	var stats governor.Stats
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&stats))
+	assert.Equal(t, 4, stats.GlobalLimit)
+	assert.Equal(t, 2, stats.PerProjectLimit)
+	assert.Zero(t, stats.InFlight)
+	require.Len(t, stats.Priorities, 2)
+	assert.Equal(t, "interactive", stats.Priorities[0].Priority)
+	assert.Equal(t, int64(1), stats.Priorities[0].Acquired)
+}
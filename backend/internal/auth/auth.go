@@ -2,6 +2,7 @@ package auth
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -11,166 +12,273 @@ import (
 	"time"
 
 	"github.com/generic/selectel-craas-web/internal/config"
+	"github.com/generic/selectel-craas-web/internal/resilience"
+	"github.com/generic/selectel-craas-web/internal/state"
+	"golang.org/x/sync/singleflight"
 )
 
 type Authenticator interface {
-	GetAccountToken() (string, error)
+	GetAccountToken(ctx context.Context) (string, error)
 	InvalidateAccountToken()
-	ListProjects(accountToken string) ([]Project, error)
-	GetProjectToken(projectID string) (string, error)
+	ListProjects(ctx context.Context, accountToken string) ([]Project, error)
+	GetProjectToken(ctx context.Context, projectID string) (string, error)
 	InvalidateProjectToken(projectID string)
 }
 
 type Client struct {
 	cfg           *config.Config
-	client        *http.Client
+	account       config.Account
+	HTTPClient    *http.Client       // Shared outbound client, see the transport package
+	Shared        state.Store        // Shares the tokens with other replicas; nil keeps them in this process
+	Retired       func(token string) // Called with each token no longer used once renewed or invalidated
 	AuthURL       string
 	ProjURL       string
 	mu            sync.Mutex
-	accountToken  string
-	projectTokens map[string]string
+	accountToken  token
+	projectTokens map[string]token
+	inflight      singleflight.Group
 	logger        *slog.Logger
+	now           func() time.Time
 }
 
 type Project struct {
-	ID   string `json:"id"`
-	Name string `json:"name"`
+	ID    string `json:"id"`
+	Name  string `json:"name"`
+	Alias string `json:"alias,omitempty"` // Display name from PROJECT_ALIASES
 }
 
+// New returns a client for the default account.
 func New(cfg *config.Config, logger *slog.Logger) *Client {
+	return NewAccount(cfg, cfg.DefaultAccount(), logger)
+}
+
+// NewAccount returns a client for one of the configured accounts.
+func NewAccount(cfg *config.Config, account config.Account, logger *slog.Logger) *Client {
 	return &Client{
 		cfg:           cfg,
-		client:        &http.Client{Timeout: 60 * time.Second},
+		account:       account,
+		HTTPClient:    http.DefaultClient,
 		AuthURL:       cfg.SelectelAuthURL,
 		ProjURL:       cfg.SelectelProjURL,
-		projectTokens: make(map[string]string),
-		logger:        logger.With("service", "auth"),
+		projectTokens: make(map[string]token),
+		logger:        logger.With("service", "auth", "account", account.ID),
+		now:           time.Now,
 	}
 }
 
-func (c *Client) getAuthPayload(projectID string) map[string]interface{} {
-	userAuth := map[string]interface{}{
-		"methods": []string{"password"},
-		"password": map[string]interface{}{
-			"user": map[string]interface{}{
-				"name": c.cfg.SelectelUsername,
-				"domain": map[string]interface{}{
-					"name": c.cfg.SelectelAccountID,
-				},
-				"password": c.cfg.SelectelPassword,
-			},
-		},
+// Account returns the account this client authenticates as.
+func (c *Client) Account() config.Account {
+	return c.account
+}
+
+func (c *Client) getAuthPayload(projectID string) (map[string]interface{}, error) {
+	identity, err := c.identity()
+	if err != nil {
+		return nil, err
 	}
 
-	var scope map[string]interface{}
-	if projectID != "" {
-		scope = map[string]interface{}{
-			"project": map[string]interface{}{
-				"id": projectID,
-			},
-		}
-	} else {
-		scope = map[string]interface{}{
-			"project": map[string]interface{}{
-				"name": c.cfg.SelectelProjectName,
-				"domain": map[string]interface{}{
-					"name": c.cfg.SelectelAccountID,
+	auth := map[string]interface{}{
+		"identity": identity,
+	}
+
+	// Application credentials are bound to their project and must not be scoped.
+	if c.account.AuthMethod != config.AuthMethodAppCredential {
+		if projectID != "" {
+			auth["scope"] = map[string]interface{}{
+				"project": map[string]interface{}{
+					"id": projectID,
 				},
-			},
+			}
+		} else {
+			auth["scope"] = map[string]interface{}{
+				"project": map[string]interface{}{
+					"name": c.account.ProjectName,
+					"domain": map[string]interface{}{
+						"name": c.account.AccountID,
+					},
+				},
+			}
 		}
 	}
 
 	return map[string]interface{}{
-		"auth": map[string]interface{}{
-			"identity": userAuth,
-			"scope":    scope,
-		},
-	}
+		"auth": auth,
+	}, nil
 }
 
-func (c *Client) GetAccountToken() (string, error) {
+// GetAccountToken returns the token scoped to the configured project,
+// requesting a new one when it is missing or about to expire.
+func (c *Client) GetAccountToken(ctx context.Context) (string, error) {
 	c.mu.Lock()
-	if c.accountToken != "" {
-		token := c.accountToken
+	if c.fresh(c.accountToken) {
+		value := c.accountToken.value
 		c.mu.Unlock()
 		c.logger.Debug("cache hit for account token")
-		return token, nil
+		return value, nil
 	}
 	c.mu.Unlock()
 
-	c.logger.Debug("requesting new account token")
-
-	token, err := c.requestToken(c.getAuthPayload(""))
+	// Concurrent misses share a single upstream request.
+	v, err := c.shared(ctx, "account", func(ctx context.Context) (interface{}, error) {
+		t, err := c.obtain(ctx, "account", func(ctx context.Context) (token, error) {
+			c.logger.Debug("requesting new account token")
+			payload, err := c.getAuthPayload("")
+			if err != nil {
+				return token{}, err
+			}
+			return c.requestToken(ctx, payload)
+		})
+		if err != nil {
+			return nil, err
+		}
+		c.mu.Lock()
+		old := c.accountToken.value
+		c.accountToken = t
+		c.mu.Unlock()
+		if old != t.value {
+			c.retire(old)
+		}
+		c.logger.Debug("successfully acquired account token", "expires_at", t.expiresAt)
+		return t.value, nil
+	})
 	if err != nil {
 		c.logger.Error("failed to get account token", "error", err)
 		return "", err
 	}
-
-	c.mu.Lock()
-	c.accountToken = token
-	c.mu.Unlock()
-
-	c.logger.Debug("successfully acquired account token")
-	return token, nil
+	return v.(string), nil
 }
 
 func (c *Client) InvalidateAccountToken() {
 	c.mu.Lock()
-	defer c.mu.Unlock()
-	c.accountToken = ""
+	value := c.accountToken.value
+	c.accountToken = token{}
+	c.mu.Unlock()
+	c.dropShared("account", value)
+	c.retire(value)
 	c.logger.Debug("invalidated account token")
 }
 
-func (c *Client) GetProjectToken(projectID string) (string, error) {
+// GetProjectToken returns a token scoped to the project, requesting a new one
+// when it is missing or about to expire.
+func (c *Client) GetProjectToken(ctx context.Context, projectID string) (string, error) {
 	c.mu.Lock()
-	if token, ok := c.projectTokens[projectID]; ok {
+	if t, ok := c.projectTokens[projectID]; ok && c.fresh(t) {
 		c.mu.Unlock()
 		c.logger.Debug("cache hit for project token", "project_id", projectID)
-		return token, nil
+		return t.value, nil
 	}
 	c.mu.Unlock()
 
-	c.logger.Debug("requesting new project token", "project_id", projectID)
-
-	token, err := c.requestToken(c.getAuthPayload(projectID))
+	v, err := c.shared(ctx, "project:"+projectID, func(ctx context.Context) (interface{}, error) {
+		t, err := c.obtain(ctx, "project/"+projectID, func(ctx context.Context) (token, error) {
+			c.logger.Debug("requesting new project token", "project_id", projectID)
+			payload, err := c.getAuthPayload(projectID)
+			if err != nil {
+				return token{}, err
+			}
+			t, err := c.requestToken(ctx, payload)
+			if err != nil {
+				return token{}, err
+			}
+			if t.projectID != "" && t.projectID != projectID {
+				return token{}, fmt.Errorf("%w: token is scoped to project %s, not %s", ErrWrongProject, t.projectID, projectID)
+			}
+			return t, nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		c.mu.Lock()
+		old := c.projectTokens[projectID].value
+		c.projectTokens[projectID] = t
+		c.mu.Unlock()
+		if old != t.value {
+			c.retire(old)
+		}
+		c.logger.Debug("successfully acquired project token", "project_id", projectID, "expires_at", t.expiresAt)
+		return t.value, nil
+	})
 	if err != nil {
 		c.logger.Error("failed to get project token", "project_id", projectID, "error", err)
 		return "", err
 	}
-
-	c.mu.Lock()
-	c.projectTokens[projectID] = token
-	c.mu.Unlock()
-
-	c.logger.Debug("successfully acquired project token", "project_id", projectID)
-	return token, nil
+	return v.(string), nil
 }
 
 func (c *Client) InvalidateProjectToken(projectID string) {
 	c.mu.Lock()
-	defer c.mu.Unlock()
+	value := c.projectTokens[projectID].value
 	delete(c.projectTokens, projectID)
+	c.mu.Unlock()
+	c.dropShared("project/"+projectID, value)
+	c.retire(value)
 	c.logger.Debug("invalidated project token", "project_id", projectID)
 }
 
-func (c *Client) requestToken(payload map[string]interface{}) (string, error) {
+// retire reports a token that is no longer used to Retired.
+func (c *Client) retire(value string) {
+	if c.Retired != nil && value != "" {
+		c.Retired(value)
+	}
+}
+
+// fresh reports whether the token can still be used. Tokens are renewed
+// SELECTEL_TOKEN_REFRESH_BEFORE ahead of their expiry so that requests in
+// flight do not fail. Tokens without a known expiry are kept until invalidated.
+func (c *Client) fresh(t token) bool {
+	if t.value == "" {
+		return false
+	}
+	if t.expiresAt.IsZero() {
+		return true
+	}
+	return c.now().Add(c.cfg.SelectelTokenRefreshBefore).Before(t.expiresAt)
+}
+
+// shared runs fn once for concurrent callers with the same key. The request
+// is not cancelled when one caller gives up, as others may still wait for it;
+// each caller stops waiting when its own context ends.
+func (c *Client) shared(ctx context.Context, key string, fn func(ctx context.Context) (interface{}, error)) (interface{}, error) {
+	ch := c.inflight.DoChan(key, func() (interface{}, error) {
+		ctx, cancel := c.withTimeout(context.WithoutCancel(ctx))
+		defer cancel()
+		return fn(ctx)
+	})
+	select {
+	case res := <-ch:
+		return res.Val, res.Err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// withTimeout bounds one upstream call by UPSTREAM_TIMEOUT.
+func (c *Client) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if c.cfg.UpstreamTimeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return resilience.WithTimeout(ctx, c.cfg.UpstreamTimeout)
+}
+
+func (c *Client) requestToken(ctx context.Context, payload map[string]interface{}) (token, error) {
 	body, err := json.Marshal(payload)
 	if err != nil {
-		return "", err
+		return token{}, err
 	}
 
-	req, err := http.NewRequest("POST", c.AuthURL, bytes.NewBuffer(body))
+	// Issuing a token has no side effects, so transient failures may be retried
+	req, err := http.NewRequestWithContext(resilience.Idempotent(ctx), "POST", c.AuthURL, bytes.NewBuffer(body))
 	if err != nil {
-		return "", err
+		return token{}, err
 	}
 	req.Header.Set("Content-Type", "application/json")
 
 	start := time.Now()
-	resp, err := c.client.Do(req)
+	resp, err := c.HTTPClient.Do(req)
 	duration := time.Since(start)
 
 	if err != nil {
-		return "", err
+		return token{}, err
 	}
 	defer resp.Body.Close()
 
@@ -178,21 +286,41 @@ func (c *Client) requestToken(payload map[string]interface{}) (string, error) {
 
 	if resp.StatusCode != http.StatusCreated {
 		respBody, _ := io.ReadAll(resp.Body)
-		return "", fmt.Errorf("failed to get token: status %d, body: %s", resp.StatusCode, string(respBody))
+		return token{}, fmt.Errorf("failed to get token: status %d, body: %s", resp.StatusCode, string(respBody))
 	}
 
-	token := resp.Header.Get("X-Subject-Token")
-	if token == "" {
-		return "", fmt.Errorf("response did not contain X-Subject-Token header")
+	value := resp.Header.Get("X-Subject-Token")
+	if value == "" {
+		return token{}, fmt.Errorf("response did not contain X-Subject-Token header")
+	}
+
+	t := token{value: value, issuedAt: c.now()}
+
+	// The body describes the token; only the expiry and scope are of interest here.
+	var result struct {
+		Token struct {
+			ExpiresAt time.Time `json:"expires_at"`
+			Project   struct {
+				ID string `json:"id"`
+			} `json:"project"`
+		} `json:"token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		c.logger.Warn("could not parse token response, expiry unknown", "error", err)
+	} else {
+		t.expiresAt = result.Token.ExpiresAt
+		t.projectID = result.Token.Project.ID
 	}
 
-	return token, nil
+	return t, nil
 }
 
 // ListProjects lists projects accessible by the account token.
-func (c *Client) ListProjects(accountToken string) ([]Project, error) {
+func (c *Client) ListProjects(ctx context.Context, accountToken string) ([]Project, error) {
 	c.logger.Debug("listing projects")
-	req, err := http.NewRequest("GET", c.ProjURL, nil)
+	ctx, cancel := c.withTimeout(ctx)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", c.ProjURL, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -200,7 +328,7 @@ func (c *Client) ListProjects(accountToken string) ([]Project, error) {
 	req.Header.Set("Content-Type", "application/json")
 
 	start := time.Now()
-	resp, err := c.client.Do(req)
+	resp, err := c.HTTPClient.Do(req)
 	duration := time.Since(start)
 	if err != nil {
 		c.logger.Error("failed to list projects request", "error", err)
@@ -1,15 +1,24 @@
 package auth
 
 import (
+	"context"
 	"encoding/json"
+	"fmt"
 	"log/slog"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/alicebob/miniredis/v2"
 	"github.com/generic/selectel-craas-web/internal/config"
+	"github.com/generic/selectel-craas-web/internal/state"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 var testLogger = slog.New(slog.NewTextHandler(os.Stdout, nil))
@@ -34,7 +43,7 @@ func TestGetAccountToken(t *testing.T) {
 	client := New(cfg, testLogger)
 	client.AuthURL = ts.URL + "/v3/auth/tokens"
 
-	token, err := client.GetAccountToken()
+	token, err := client.GetAccountToken(context.Background())
 	assert.NoError(t, err)
 	assert.Equal(t, "fake-token", token)
 }
@@ -59,7 +68,7 @@ func TestListProjects(t *testing.T) {
 	client := New(cfg, testLogger)
 	client.ProjURL = ts.URL + "/v3/auth/projects"
 
-	projects, err := client.ListProjects("fake-token")
+	projects, err := client.ListProjects(context.Background(), "fake-token")
 	assert.NoError(t, err)
 	assert.Len(t, projects, 1)
 	assert.Equal(t, "p1", projects[0].ID)
@@ -94,7 +103,249 @@ func TestGetProjectToken(t *testing.T) {
 	client := New(cfg, testLogger)
 	client.AuthURL = ts.URL + "/v3/auth/tokens"
 
-	token, err := client.GetProjectToken("p1")
+	token, err := client.GetProjectToken(context.Background(), "p1")
 	assert.NoError(t, err)
 	assert.Equal(t, "project-token", token)
 }
+
+func TestTokenExpiry(t *testing.T) {
+	var requests atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := requests.Add(1)
+		w.Header().Set("X-Subject-Token", fmt.Sprintf("token-%d", n))
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"token": {"expires_at": "2030-01-01T12:00:00.000000Z"}}`))
+	}))
+	defer ts.Close()
+
+	cfg := &config.Config{SelectelTokenRefreshBefore: 5 * time.Minute}
+	client := New(cfg, testLogger)
+	client.AuthURL = ts.URL
+	now := time.Date(2030, 1, 1, 11, 0, 0, 0, time.UTC)
+	client.now = func() time.Time { return now }
+	var retired []string
+	client.Retired = func(token string) { retired = append(retired, token) }
+
+	token, err := client.GetProjectToken(context.Background(), "p1")
+	assert.NoError(t, err)
+	assert.Equal(t, "token-1", token)
+
+	// Cached while far from expiry
+	now = now.Add(50 * time.Minute)
+	token, _ = client.GetProjectToken(context.Background(), "p1")
+	assert.Equal(t, "token-1", token)
+
+	// Renewed ahead of expiry
+	now = now.Add(6 * time.Minute)
+	token, _ = client.GetProjectToken(context.Background(), "p1")
+	assert.Equal(t, "token-2", token)
+	assert.Equal(t, []string{"token-1"}, retired, "the renewed token is retired")
+
+	infos := client.Tokens()
+	assert.Len(t, infos, 1)
+	assert.Equal(t, "project", infos[0].Scope)
+	assert.Equal(t, "p1", infos[0].ProjectID)
+	assert.Equal(t, time.Date(2030, 1, 1, 12, 0, 0, 0, time.UTC), *infos[0].ExpiresAt)
+	assert.Equal(t, time.Date(2030, 1, 1, 11, 55, 0, 0, time.UTC), *infos[0].RefreshAt)
+
+	data, _ := json.Marshal(infos)
+	assert.NotContains(t, string(data), "token-2", "token values are never exposed")
+
+	client.InvalidateProjectToken("p1")
+	assert.Equal(t, []string{"token-1", "token-2"}, retired)
+}
+
+func TestTokenSingleFlight(t *testing.T) {
+	var requests atomic.Int32
+	release := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		<-release
+		w.Header().Set("X-Subject-Token", "shared-token")
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{}`))
+	}))
+	defer ts.Close()
+
+	client := New(&config.Config{}, testLogger)
+	client.AuthURL = ts.URL
+
+	var wg sync.WaitGroup
+	tokens := make([]string, 10)
+	for i := range tokens {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			tokens[i], _ = client.GetProjectToken(context.Background(), "p1")
+		}(i)
+	}
+
+	// Give all goroutines a chance to join the in-flight request
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	assert.Equal(t, int32(1), requests.Load())
+	for _, token := range tokens {
+		assert.Equal(t, "shared-token", token)
+	}
+}
+
+func TestTokenRequestCancellation(t *testing.T) {
+	release := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		w.Header().Set("X-Subject-Token", "late-token")
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{}`))
+	}))
+	defer ts.Close()
+	defer close(release)
+
+	client := New(&config.Config{UpstreamTimeout: time.Minute}, testLogger)
+	client.AuthURL = ts.URL
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := client.GetProjectToken(ctx, "p1")
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Less(t, time.Since(start), time.Second, "the caller stops waiting when its context ends")
+
+	// The upstream call itself is bounded by UPSTREAM_TIMEOUT
+	client = New(&config.Config{UpstreamTimeout: 50 * time.Millisecond}, testLogger)
+	client.AuthURL = ts.URL
+	_, err = client.GetAccountToken(context.Background())
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+}
+
+func TestAuthMethods(t *testing.T) {
+	var identity map[string]interface{}
+	var scoped bool
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&body)
+		auth := body["auth"].(map[string]interface{})
+		identity = auth["identity"].(map[string]interface{})
+		_, scoped = auth["scope"]
+
+		w.Header().Set("X-Subject-Token", "token")
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"token": {"project": {"id": "p1"}}}`))
+	}))
+	defer ts.Close()
+
+	t.Run("Application Credential", func(t *testing.T) {
+		client := New(&config.Config{
+			SelectelAuthMethod:          config.AuthMethodAppCredential,
+			SelectelAppCredentialID:     "cred-id",
+			SelectelAppCredentialSecret: "cred-secret",
+		}, testLogger)
+		client.AuthURL = ts.URL
+
+		_, err := client.GetProjectToken(context.Background(), "p1")
+		assert.NoError(t, err)
+		assert.Equal(t, []interface{}{"application_credential"}, identity["methods"])
+		cred := identity["application_credential"].(map[string]interface{})
+		assert.Equal(t, "cred-id", cred["id"])
+		assert.Equal(t, "cred-secret", cred["secret"])
+		assert.False(t, scoped, "application credentials must not be scoped")
+
+		// The credential belongs to p1 only
+		_, err = client.GetProjectToken(context.Background(), "p2")
+		assert.ErrorIs(t, err, ErrWrongProject)
+	})
+
+	t.Run("Token File", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "token")
+		assert.NoError(t, os.WriteFile(path, []byte("first\n"), 0o600))
+
+		client := New(&config.Config{
+			SelectelAuthMethod: config.AuthMethodToken,
+			SelectelTokenFile:  path,
+		}, testLogger)
+		client.AuthURL = ts.URL
+
+		_, err := client.GetProjectToken(context.Background(), "p1")
+		assert.NoError(t, err)
+		assert.Equal(t, []interface{}{"token"}, identity["methods"])
+		assert.Equal(t, "first", identity["token"].(map[string]interface{})["id"])
+		assert.True(t, scoped)
+
+		// A rotated token is picked up without a restart
+		assert.NoError(t, os.WriteFile(path, []byte("second"), 0o600))
+		client.InvalidateProjectToken("p1")
+		_, err = client.GetProjectToken(context.Background(), "p1")
+		assert.NoError(t, err)
+		assert.Equal(t, "second", identity["token"].(map[string]interface{})["id"])
+	})
+
+	t.Run("Missing Token", func(t *testing.T) {
+		client := New(&config.Config{SelectelAuthMethod: config.AuthMethodToken}, testLogger)
+		client.AuthURL = ts.URL
+
+		_, err := client.GetAccountToken(context.Background())
+		assert.ErrorIs(t, err, ErrNoToken)
+	})
+}
+
+func TestSharedTokens(t *testing.T) {
+	var requests atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := requests.Add(1)
+		time.Sleep(20 * time.Millisecond)
+		w.Header().Set("X-Subject-Token", fmt.Sprintf("token-%d", n))
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"token": {"expires_at": "2030-01-01T00:00:00Z", "project": {"id": "p1"}}}`))
+	}))
+	defer ts.Close()
+
+	// Two replicas of the same account
+	mr := miniredis.RunT(t)
+	cfg := &config.Config{SelectelUsername: "user", SelectelAccountID: "12345", SelectelPassword: "password"}
+	newReplica := func() *Client {
+		st, err := state.NewRedis("redis://"+mr.Addr(), "test:")
+		require.NoError(t, err)
+		t.Cleanup(func() { st.Close() })
+		client := New(cfg, testLogger)
+		client.AuthURL = ts.URL
+		client.Shared = st
+		return client
+	}
+	a, b := newReplica(), newReplica()
+
+	// Only one replica asks Keystone, the other uses its token
+	var wg sync.WaitGroup
+	tokens := make([]string, 2)
+	for i, client := range []*Client{a, b} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var err error
+			tokens[i], err = client.GetProjectToken(t.Context(), "p1")
+			assert.NoError(t, err)
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int32(1), requests.Load())
+	assert.Equal(t, "token-1", tokens[0])
+	assert.Equal(t, tokens[0], tokens[1])
+
+	// A rejected token is renewed once, even when both replicas drop it
+	a.InvalidateProjectToken("p1")
+	token, err := a.GetProjectToken(t.Context(), "p1")
+	require.NoError(t, err)
+	assert.Equal(t, "token-2", token)
+	b.InvalidateProjectToken("p1")
+	token, err = b.GetProjectToken(t.Context(), "p1")
+	require.NoError(t, err)
+	assert.Equal(t, "token-2", token)
+	assert.Equal(t, int32(2), requests.Load())
+
+	// Per-process clients keep their own
+	local := New(cfg, testLogger)
+	local.AuthURL = ts.URL
+	token, err = local.GetProjectToken(t.Context(), "p1")
+	require.NoError(t, err)
+	assert.Equal(t, "token-3", token)
+}
@@ -0,0 +1,87 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/generic/selectel-craas-web/internal/config"
+)
+
+var (
+	// ErrNoToken indicates that the token auth method has no token to use.
+	ErrNoToken = errors.New("no Selectel token configured")
+	// ErrWrongProject indicates a token that cannot be scoped to the requested
+	// project, e.g. an application credential created in another project.
+	ErrWrongProject = errors.New("credentials are not valid for this project")
+)
+
+// identity builds the Keystone identity for the configured auth method.
+func (c *Client) identity() (map[string]interface{}, error) {
+	switch c.account.AuthMethod {
+	case config.AuthMethodAppCredential:
+		return map[string]interface{}{
+			"methods": []string{"application_credential"},
+			"application_credential": map[string]interface{}{
+				"id":     c.account.AppCredentialID,
+				"secret": c.secret("APP_CREDENTIAL_SECRET", c.account.AppCredentialSecret),
+			},
+		}, nil
+
+	case config.AuthMethodToken:
+		// The pre-issued token is exchanged for scoped ones, like a password would be.
+		value, err := c.staticToken()
+		if err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{
+			"methods": []string{"token"},
+			"token": map[string]interface{}{
+				"id": value,
+			},
+		}, nil
+
+	default:
+		return map[string]interface{}{
+			"methods": []string{"password"},
+			"password": map[string]interface{}{
+				"user": map[string]interface{}{
+					"name": c.account.Username,
+					"domain": map[string]interface{}{
+						"name": c.account.AccountID,
+					},
+					"password": c.secret("PASSWORD", c.account.Password),
+				},
+			},
+		}, nil
+	}
+}
+
+// staticToken returns the pre-issued token. The file is read on every call so
+// that a sidecar can rotate it without restarting the application.
+func (c *Client) staticToken() (string, error) {
+	if c.account.TokenFile != "" {
+		data, err := os.ReadFile(c.account.TokenFile)
+		if err != nil {
+			return "", fmt.Errorf("failed to read token file: %w", err)
+		}
+		if value := strings.TrimSpace(string(data)); value != "" {
+			return value, nil
+		}
+		return "", ErrNoToken
+	}
+	if value := c.secret("TOKEN", c.account.Token); value != "" {
+		return value, nil
+	}
+	return "", ErrNoToken
+}
+
+// secret returns the current value of an account secret, following rotations
+// of the *_FILE variables and Vault. loaded is the value read at startup.
+func (c *Client) secret(name, loaded string) string {
+	if c.account.SecretPrefix == "" {
+		return loaded
+	}
+	return c.cfg.Secrets.Get(c.account.SecretPrefix+name, loaded)
+}
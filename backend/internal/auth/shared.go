@@ -0,0 +1,118 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/generic/selectel-craas-web/internal/state"
+)
+
+// sharedTimeout bounds the calls to the state store made outside a request.
+const sharedTimeout = 5 * time.Second
+
+// sharedToken is a token as kept in the state store.
+type sharedToken struct {
+	Value     string    `json:"value"`
+	IssuedAt  time.Time `json:"issuedAt"`
+	ExpiresAt time.Time `json:"expiresAt,omitzero"`
+	ProjectID string    `json:"projectId,omitempty"`
+}
+
+func (c *Client) sharedKey(scope string) string {
+	return "token/" + c.account.ID + "/" + scope
+}
+
+// obtain returns the token for the scope that another replica stored, or
+// calls request. Only one replica at a time requests a token for a scope;
+// the others wait and use it. Without a working state store, each replica
+// requests its own.
+func (c *Client) obtain(ctx context.Context, scope string, request func(ctx context.Context) (token, error)) (token, error) {
+	if c.Shared == nil {
+		return request(ctx)
+	}
+	key := c.sharedKey(scope)
+	if t, ok := c.loadShared(ctx, key); ok {
+		return t, nil
+	}
+
+	lockTTL := max(c.cfg.UpstreamTimeout, 10*time.Second)
+	unlock, err := state.Lock(ctx, c.Shared, key, lockTTL)
+	if err != nil {
+		if ctx.Err() != nil {
+			return token{}, err
+		}
+		c.logger.Warn("failed to lock shared token, requesting one", "scope", scope, "error", err)
+		return request(ctx)
+	}
+	defer unlock()
+
+	// Another replica may have requested it while we waited
+	if t, ok := c.loadShared(ctx, key); ok {
+		return t, nil
+	}
+	t, err := request(ctx)
+	if err != nil {
+		return token{}, err
+	}
+
+	data, err := json.Marshal(sharedToken{Value: t.value, IssuedAt: t.issuedAt, ExpiresAt: t.expiresAt, ProjectID: t.projectID})
+	if err == nil {
+		var ttl time.Duration // Tokens without a known expiry are kept until invalidated
+		if !t.expiresAt.IsZero() {
+			ttl = t.expiresAt.Sub(c.now())
+		}
+		if ttl >= 0 {
+			err = c.Shared.Set(ctx, key, data, ttl)
+		}
+	}
+	if err != nil {
+		c.logger.Warn("failed to share token", "scope", scope, "error", err)
+	}
+	return t, nil
+}
+
+// loadShared returns the token stored under key if it is still fresh.
+func (c *Client) loadShared(ctx context.Context, key string) (token, bool) {
+	data, err := c.Shared.Get(ctx, key)
+	if err != nil {
+		if !errors.Is(err, state.ErrNotFound) {
+			c.logger.Warn("failed to read shared token", "key", key, "error", err)
+		}
+		return token{}, false
+	}
+	var st sharedToken
+	if err := json.Unmarshal(data, &st); err != nil {
+		return token{}, false
+	}
+	t := token{value: st.Value, issuedAt: st.IssuedAt, expiresAt: st.ExpiresAt, projectID: st.ProjectID}
+	if !c.fresh(t) {
+		return token{}, false
+	}
+	c.logger.Debug("using token shared by another replica", "key", key)
+	return t, true
+}
+
+// dropShared removes the shared token for the scope if it is the invalidated
+// value, and not one that another replica already renewed.
+func (c *Client) dropShared(scope, value string) {
+	if c.Shared == nil || value == "" {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), sharedTimeout)
+	defer cancel()
+	err := c.Shared.Update(ctx, c.sharedKey(scope), func(old []byte) ([]byte, time.Duration, error) {
+		var st sharedToken
+		if old == nil || json.Unmarshal(old, &st) != nil || st.Value != value {
+			return nil, 0, errRenewed
+		}
+		return nil, 0, nil
+	})
+	if err != nil && !errors.Is(err, errRenewed) {
+		c.logger.Warn("failed to drop shared token", "scope", scope, "error", err)
+	}
+}
+
+// errRenewed leaves a shared token that is not the invalidated one in place.
+var errRenewed = errors.New("shared token was renewed")
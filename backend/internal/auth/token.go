@@ -0,0 +1,57 @@
+package auth
+
+import (
+	"sort"
+	"time"
+)
+
+// token is a cached Keystone token.
+type token struct {
+	value     string
+	issuedAt  time.Time
+	expiresAt time.Time // Zero if Keystone did not report it
+	projectID string
+}
+
+// TokenInfo describes a cached token without revealing its value.
+type TokenInfo struct {
+	Account   string     `json:"account"`
+	Scope     string     `json:"scope"` // "account" or "project"
+	ProjectID string     `json:"projectId,omitempty"`
+	IssuedAt  time.Time  `json:"issuedAt"`
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+	// RefreshAt is when the token will be renewed ahead of its expiry.
+	RefreshAt *time.Time `json:"refreshAt,omitempty"`
+}
+
+// Tokens returns the state of all cached tokens.
+func (c *Client) Tokens() []TokenInfo {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	result := []TokenInfo{}
+	if c.accountToken.value != "" {
+		result = append(result, c.tokenInfo("account", "", c.accountToken))
+	}
+
+	ids := make([]string, 0, len(c.projectTokens))
+	for id := range c.projectTokens {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		result = append(result, c.tokenInfo("project", id, c.projectTokens[id]))
+	}
+	return result
+}
+
+func (c *Client) tokenInfo(scope, projectID string, t token) TokenInfo {
+	info := TokenInfo{Account: c.account.ID, Scope: scope, ProjectID: projectID, IssuedAt: t.issuedAt}
+	if !t.expiresAt.IsZero() {
+		expiresAt := t.expiresAt
+		refreshAt := t.expiresAt.Add(-c.cfg.SelectelTokenRefreshBefore)
+		info.ExpiresAt = &expiresAt
+		info.RefreshAt = &refreshAt
+	}
+	return info
+}
@@ -0,0 +1,124 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/generic/selectel-craas-web/internal/secrets"
+)
+
+// DefaultAccountID identifies the account configured by the top-level
+// SELECTEL_* variables. The unprefixed /api/projects routes use it.
+const DefaultAccountID = "default"
+
+// Account holds the credentials of one Selectel account.
+type Account struct {
+	ID                  string `json:"id"`
+	Name                string `json:"name,omitempty"`
+	Username            string `json:"username,omitempty"`
+	AccountID           string `json:"accountId,omitempty"`
+	Password            string `json:"password,omitempty"`
+	ProjectName         string `json:"projectName,omitempty"`
+	AuthMethod          string `json:"authMethod"`
+	AppCredentialID     string `json:"appCredentialId,omitempty"`
+	AppCredentialSecret string `json:"appCredentialSecret,omitempty"`
+	Token               string `json:"token,omitempty"`
+	TokenFile           string `json:"tokenFile,omitempty"`
+
+	// SecretPrefix is the environment prefix of the account's secrets, used
+	// to follow their rotation. Empty for accounts not configured by env.
+	SecretPrefix string `json:"-"`
+}
+
+// accountSecrets are the secret variables of an account, without its prefix.
+var accountSecrets = []string{"PASSWORD", "APP_CREDENTIAL_SECRET", "TOKEN"}
+
+func (a *Account) resolveSecrets(store *secrets.Store) {
+	a.Password = store.Get(a.SecretPrefix+"PASSWORD", "")
+	a.AppCredentialSecret = store.Get(a.SecretPrefix+"APP_CREDENTIAL_SECRET", "")
+	a.Token = store.Get(a.SecretPrefix+"TOKEN", "")
+}
+
+// DefaultAccount returns the account configured by the top-level variables.
+func (c *Config) DefaultAccount() Account {
+	return Account{
+		ID:                  DefaultAccountID,
+		Name:                c.SelectelDefaultAccountName,
+		Username:            c.SelectelUsername,
+		AccountID:           c.SelectelAccountID,
+		Password:            c.SelectelPassword,
+		ProjectName:         c.SelectelProjectName,
+		AuthMethod:          c.SelectelAuthMethod,
+		AppCredentialID:     c.SelectelAppCredentialID,
+		AppCredentialSecret: c.SelectelAppCredentialSecret,
+		Token:               c.SelectelToken,
+		TokenFile:           c.SelectelTokenFile,
+		SecretPrefix:        "SELECTEL_",
+	}
+}
+
+// AllAccounts returns the default account followed by SELECTEL_ACCOUNTS.
+func (c *Config) AllAccounts() []Account {
+	return append([]Account{c.DefaultAccount()}, c.Accounts...)
+}
+
+// Validate checks that the credentials required by the auth method are set.
+func (a Account) Validate() error {
+	switch a.AuthMethod {
+	case AuthMethodAppCredential:
+		if a.AppCredentialID == "" || a.AppCredentialSecret == "" {
+			return fmt.Errorf("account %q: application_credential requires an application credential ID and secret", a.ID)
+		}
+	case AuthMethodToken:
+		if a.Token == "" && a.TokenFile == "" {
+			return fmt.Errorf("account %q: token requires a token or a token file", a.ID)
+		}
+	}
+	return nil
+}
+
+// loadAccounts reads the profiles listed in SELECTEL_ACCOUNTS. Each profile is
+// configured by SELECTEL_ACCOUNT_<ID>_* variables mirroring the top-level ones.
+// Their secrets are tracked in store and filled in by resolveSecrets.
+func loadAccounts(store *secrets.Store) ([]Account, error) {
+	var accounts []Account
+	seen := map[string]bool{DefaultAccountID: true}
+	for _, id := range getEnvSlice("SELECTEL_ACCOUNTS", nil) {
+		id = strings.ToLower(id)
+		if seen[id] {
+			return nil, fmt.Errorf("duplicate or reserved account ID %q in SELECTEL_ACCOUNTS", id)
+		}
+		seen[id] = true
+
+		prefix := "SELECTEL_ACCOUNT_" + strings.ToUpper(strings.ReplaceAll(id, "-", "_")) + "_"
+		method, err := parseAuthMethod(prefix+"AUTH_METHOD", getEnv(prefix+"AUTH_METHOD", AuthMethodPassword))
+		if err != nil {
+			return nil, err
+		}
+		for _, key := range accountSecrets {
+			store.Track(prefix+key, getEnv(prefix+key, ""))
+		}
+		accounts = append(accounts, Account{
+			ID:              id,
+			Name:            getEnv(prefix+"NAME", id),
+			Username:        getEnv(prefix+"USERNAME", ""),
+			AccountID:       getEnv(prefix+"ACCOUNT_ID", ""),
+			ProjectName:     getEnv(prefix+"PROJECT_NAME", ""),
+			AuthMethod:      method,
+			AppCredentialID: getEnv(prefix+"APP_CREDENTIAL_ID", ""),
+			TokenFile:       getEnv(prefix+"TOKEN_FILE", ""),
+			SecretPrefix:    prefix,
+		})
+	}
+	return accounts, nil
+}
+
+func parseAuthMethod(key, value string) (string, error) {
+	method := strings.ToLower(value)
+	switch method {
+	case AuthMethodPassword, AuthMethodAppCredential, AuthMethodToken:
+		return method, nil
+	}
+	return "", fmt.Errorf("invalid %s %q: expected %q, %q or %q",
+		key, value, AuthMethodPassword, AuthMethodAppCredential, AuthMethodToken)
+}
@@ -1,13 +1,19 @@
 package config
 
 import (
+	"context"
 	"crypto/rand"
 	"encoding/hex"
+	"fmt"
 	"log"
+	"net"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
 
+	"github.com/generic/selectel-craas-web/internal/secrets"
 	"github.com/joho/godotenv"
 )
 
@@ -23,6 +29,53 @@ type Config struct {
 	LogLevel            string // "debug", "info", "warn", "error"
 	LogFormat           string // "text", "json"
 
+	// Selectel auth method: "password", "application_credential" or "token"
+	SelectelAuthMethod          string
+	SelectelAppCredentialID     string
+	SelectelAppCredentialSecret string
+	SelectelToken               string
+	SelectelTokenFile           string // Re-read on every token request
+
+	// Additional accounts from SELECTEL_ACCOUNTS; the top-level variables
+	// above configure the default account.
+	Accounts                   []Account
+	SelectelDefaultAccountName string
+
+	// Per-user mode: every UI user links their own Selectel credentials, which
+	// are stored encrypted with CredentialsEncryptionKey.
+	SelectelPerUserCredentials bool
+	CredentialsEncryptionKey   string
+
+	// Named CRaaS endpoints besides the default SelectelCraasURL, and which
+	// of them hold each project's registries (overridable per registry).
+	CraasRegions         map[string]string
+	CraasProjectRegions  map[string][]string
+	CraasRegistryRegions map[string]string
+
+	// Outbound HTTP to Selectel. HTTPS_PROXY and NO_PROXY apply unless
+	// OutboundProxy is set.
+	OutboundProxy               string
+	OutboundCAFiles             []string // Extra PEM bundles trusted besides the system roots
+	OutboundClientCert          string
+	OutboundClientKey           string
+	OutboundMaxIdleConnsPerHost int
+	UpstreamTimeout             time.Duration // Per upstream call
+	UpstreamLongTimeout         time.Duration // Cleanup and garbage collection
+
+	// Retries of idempotent upstream calls and per-endpoint circuit breakers
+	UpstreamRetries          int
+	UpstreamRetryBaseDelay   time.Duration
+	UpstreamRetryMaxDelay    time.Duration // Also the longest Retry-After honoured
+	UpstreamBreakerThreshold int           // Consecutive failures that open a circuit; 0 disables
+	UpstreamBreakerCooldown  time.Duration
+
+	// Calls to Selectel in flight at once, process wide and per project; 0 is unlimited
+	UpstreamMaxConcurrency           int
+	UpstreamMaxConcurrencyPerProject int
+
+	// Keystone tokens are renewed this long before they expire.
+	SelectelTokenRefreshBefore time.Duration
+
 	// Feature Flags
 	EnableDeleteRegistry   bool
 	EnableDeleteRepository bool
@@ -31,13 +84,72 @@ type Config struct {
 
 	ProtectedTags []string
 
+	// CacheTTL is how long registry, repository, image and tag listings are
+	// reused; 0 disables the cache.
+	CacheTTL time.Duration
+
+	// TagIndexMaxAge is how long a resolved missing tag is trusted while its
+	// repository is unchanged, before its manifest digest is checked again.
+	TagIndexMaxAge time.Duration
+
+	// Background inventory of every account; an interval of 0 disables it
+	InventoryInterval time.Duration // Pause between two crawls
+	InventoryRate     int           // Listing calls per minute
+
+	// Projects limits, labels and orders the projects of every account.
+	Projects ProjectPolicy
+
 	// Authentication
-	AuthEnabled  bool
-	AuthLogin    string
-	AuthPassword   string
-	JWTSecret      string
-	CookieSecure   bool
-	CookieSameSite string
+	AuthEnabled     bool
+	AuthMode        string // "local" (login form) or "header" (trusted reverse proxy)
+	AuthLogin       string
+	AuthPassword    string
+	AuthAdmins      []string
+	AuthAdminGroups []string
+	JWTSecret       string
+	CookieSecure    bool
+	CookieSameSite  string
+
+	// Two-factor authentication
+	AuthRequire2FAForDelete bool // Destructive actions need a session with a second factor
+	TOTPIssuer              string
+
+	// Passkeys (WebAuthn). Disabled while WebAuthnRPID is empty.
+	WebAuthnRPID      string
+	WebAuthnRPName    string
+	WebAuthnRPOrigins []string
+
+	// Trusted-header authentication (AuthMode "header")
+	AuthHeaderUser   string
+	AuthHeaderGroups string
+
+	// TrustedProxies are the networks allowed to set identity and client IP headers.
+	TrustedProxies []*net.IPNet
+
+	// Login brute-force protection
+	LoginRateLimit        int // Login attempts per minute per client IP
+	LoginRateBurst        int
+	LoginLockoutThreshold int // Failed attempts per username before locking, 0 disables
+	LoginLockoutDuration  time.Duration
+	LoginLockoutMax       time.Duration
+
+	// Sessions
+	SessionIdleTimeout time.Duration
+	SessionMaxLifetime time.Duration
+
+	// Secrets follows rotations of the secrets above loaded from *_FILE
+	// variables or Vault; the string fields keep the values read at startup.
+	Secrets                *secrets.Store
+	SecretsRefreshInterval time.Duration
+
+	// DataDir holds state that must survive restarts. Empty keeps everything in memory.
+	DataDir string
+
+	// State shared by replicas: "memory" keeps it in this process, "redis"
+	// shares it through RedisURL.
+	StateBackend string
+	RedisURL     string
+	StatePrefix  string // Prepended to every Redis key
 
 	// CORS
 	CORSAllowedOrigin string
@@ -49,21 +161,76 @@ func Load() (*Config, error) {
 		log.Println("No .env file found, relying on environment variables")
 	}
 
-	jwtSecret := getEnv("JWT_SECRET", "")
+	dataDir := getEnv("DATA_DIR", "")
+
+	store, err := newSecretStore()
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range []string{"SELECTEL_PASSWORD", "SELECTEL_APP_CREDENTIAL_SECRET", "SELECTEL_TOKEN", "AUTH_PASSWORD", "JWT_SECRET", "CREDENTIALS_ENCRYPTION_KEY", "REDIS_URL"} {
+		store.Track(key, getEnv(key, ""))
+	}
+	accounts, err := loadAccounts(store)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := store.Refresh(ctx); err != nil {
+		return nil, fmt.Errorf("failed to load secrets: %w", err)
+	}
+	for i := range accounts {
+		accounts[i].resolveSecrets(store)
+	}
+
+	jwtSecret := store.Get("JWT_SECRET", "")
 	if jwtSecret == "" {
-		b := make([]byte, 32)
-		if _, err := rand.Read(b); err != nil {
+		var err error
+		jwtSecret, err = loadOrGenerateSecret(dataDir)
+		if err != nil {
 			log.Fatalf("Failed to generate random JWT secret: %v", err)
 		}
-		jwtSecret = hex.EncodeToString(b)
-		log.Println("JWT_SECRET not provided, generated a random secure secret for this session")
+	}
+
+	authMode := strings.ToLower(getEnv("AUTH_MODE", AuthModeLocal))
+	if authMode != AuthModeLocal && authMode != AuthModeHeader {
+		return nil, fmt.Errorf("invalid AUTH_MODE %q: expected %q or %q", authMode, AuthModeLocal, AuthModeHeader)
+	}
+
+	authMethod, err := parseAuthMethod("SELECTEL_AUTH_METHOD", getEnv("SELECTEL_AUTH_METHOD", AuthMethodPassword))
+	if err != nil {
+		return nil, err
+	}
+
+	regions, projectRegions, registryRegions, err := loadCraasRegions()
+	if err != nil {
+		return nil, err
+	}
+
+	projects, err := loadProjectPolicy()
+	if err != nil {
+		return nil, err
+	}
+
+	trustedProxies, err := parseCIDRs(getEnvSlice("TRUSTED_PROXIES", nil))
+	if err != nil {
+		return nil, fmt.Errorf("invalid TRUSTED_PROXIES: %w", err)
+	}
+
+	stateBackend := strings.ToLower(getEnv("STATE_BACKEND", StateBackendMemory))
+	redisURL := store.Get("REDIS_URL", "")
+	switch {
+	case stateBackend != StateBackendMemory && stateBackend != StateBackendRedis:
+		return nil, fmt.Errorf("invalid STATE_BACKEND %q: expected %q or %q", stateBackend, StateBackendMemory, StateBackendRedis)
+	case stateBackend == StateBackendRedis && redisURL == "":
+		return nil, fmt.Errorf("STATE_BACKEND=%s requires REDIS_URL", StateBackendRedis)
 	}
 
 	return &Config{
 		WebPort:             getEnv("WEB_PORT", "8080"),
 		SelectelUsername:    getEnv("SELECTEL_USERNAME", ""),
 		SelectelAccountID:   getEnv("SELECTEL_ACCOUNT_ID", ""),
-		SelectelPassword:    getEnv("SELECTEL_PASSWORD", ""),
+		SelectelPassword:    store.Get("SELECTEL_PASSWORD", ""),
 		SelectelProjectName: getEnv("SELECTEL_PROJECT_NAME", ""),
 		SelectelAuthURL:     getEnv("SELECTEL_AUTH_URL", "https://cloud.api.selcloud.ru/identity/v3/auth/tokens"),
 		SelectelProjURL:     getEnv("SELECTEL_PROJ_URL", "https://cloud.api.selcloud.ru/identity/v3/auth/projects"),
@@ -71,6 +238,41 @@ func Load() (*Config, error) {
 		LogLevel:            getEnv("LOG_LEVEL", "INFO"),
 		LogFormat:           getEnv("LOG_FORMAT", "TEXT"),
 
+		SelectelAuthMethod:          authMethod,
+		SelectelAppCredentialID:     getEnv("SELECTEL_APP_CREDENTIAL_ID", ""),
+		SelectelAppCredentialSecret: store.Get("SELECTEL_APP_CREDENTIAL_SECRET", ""),
+		SelectelToken:               store.Get("SELECTEL_TOKEN", ""),
+		SelectelTokenFile:           getEnv("SELECTEL_TOKEN_FILE", ""),
+
+		Accounts:                   accounts,
+		SelectelDefaultAccountName: getEnv("SELECTEL_ACCOUNT_NAME", "Default"),
+
+		SelectelPerUserCredentials: getEnvBool("SELECTEL_PER_USER_CREDENTIALS", false),
+		CredentialsEncryptionKey:   store.Get("CREDENTIALS_ENCRYPTION_KEY", ""),
+
+		CraasRegions:         regions,
+		CraasProjectRegions:  projectRegions,
+		CraasRegistryRegions: registryRegions,
+
+		OutboundProxy:               getEnv("OUTBOUND_PROXY", ""),
+		OutboundCAFiles:             getEnvSlice("OUTBOUND_CA_FILES", nil),
+		OutboundClientCert:          getEnv("OUTBOUND_CLIENT_CERT", ""),
+		OutboundClientKey:           getEnv("OUTBOUND_CLIENT_KEY", ""),
+		OutboundMaxIdleConnsPerHost: getEnvInt("OUTBOUND_MAX_IDLE_CONNS_PER_HOST", 16),
+		UpstreamTimeout:             getEnvDuration("UPSTREAM_TIMEOUT", time.Minute),
+		UpstreamLongTimeout:         getEnvDuration("UPSTREAM_LONG_TIMEOUT", 5*time.Minute),
+
+		UpstreamRetries:          getEnvInt("UPSTREAM_RETRIES", 2),
+		UpstreamRetryBaseDelay:   getEnvDuration("UPSTREAM_RETRY_BASE_DELAY", 200*time.Millisecond),
+		UpstreamRetryMaxDelay:    getEnvDuration("UPSTREAM_RETRY_MAX_DELAY", 5*time.Second),
+		UpstreamBreakerThreshold: getEnvInt("UPSTREAM_BREAKER_THRESHOLD", 5),
+		UpstreamBreakerCooldown:  getEnvDuration("UPSTREAM_BREAKER_COOLDOWN", 30*time.Second),
+
+		UpstreamMaxConcurrency:           getEnvInt("UPSTREAM_MAX_CONCURRENCY", 32),
+		UpstreamMaxConcurrencyPerProject: getEnvInt("UPSTREAM_MAX_CONCURRENCY_PER_PROJECT", 8),
+
+		SelectelTokenRefreshBefore: getEnvDuration("SELECTEL_TOKEN_REFRESH_BEFORE", 5*time.Minute),
+
 		EnableDeleteRegistry:   getEnvBool("ENABLE_DELETE_REGISTRY", false),
 		EnableDeleteRepository: getEnvBool("ENABLE_DELETE_REPOSITORY", false),
 		EnableDeleteImage:      getEnvBool("ENABLE_DELETE_IMAGE", false),
@@ -78,17 +280,261 @@ func Load() (*Config, error) {
 
 		ProtectedTags: getEnvSlice("PROTECTED_TAGS", nil),
 
-		AuthEnabled:  getEnvBool("AUTH_ENABLED", false),
-		AuthLogin:    getEnv("AUTH_LOGIN", ""),
-		AuthPassword: getEnv("AUTH_PASSWORD", ""),
+		CacheTTL: getEnvDuration("CACHE_TTL", 30*time.Second),
+
+		TagIndexMaxAge: getEnvDuration("TAG_INDEX_MAX_AGE", 24*time.Hour),
+
+		InventoryInterval: getEnvDuration("INVENTORY_INTERVAL", 0),
+		InventoryRate:     getEnvInt("INVENTORY_RATE", 120),
+
+		Projects: projects,
+
+		// The proxy always authenticates in header mode, so it implies AUTH_ENABLED.
+		AuthEnabled:     getEnvBool("AUTH_ENABLED", false) || authMode == AuthModeHeader,
+		AuthMode:        authMode,
+		AuthLogin:       getEnv("AUTH_LOGIN", ""),
+		AuthPassword:    store.Get("AUTH_PASSWORD", ""),
+		AuthAdmins:      getEnvSlice("AUTH_ADMINS", nil),
+		AuthAdminGroups: getEnvSlice("AUTH_ADMIN_GROUPS", nil),
+
+		AuthHeaderUser:   getEnv("AUTH_HEADER_USER", "X-Forwarded-User"),
+		AuthHeaderGroups: getEnv("AUTH_HEADER_GROUPS", "X-Forwarded-Groups"),
+		TrustedProxies:   trustedProxies,
+
+		AuthRequire2FAForDelete: getEnvBool("AUTH_REQUIRE_2FA_FOR_DELETE", false),
+		TOTPIssuer:              getEnv("AUTH_TOTP_ISSUER", "Selectel CRaaS UI"),
+
+		WebAuthnRPID:      getEnv("WEBAUTHN_RP_ID", ""),
+		WebAuthnRPName:    getEnv("WEBAUTHN_RP_NAME", "Selectel CRaaS UI"),
+		WebAuthnRPOrigins: getEnvSlice("WEBAUTHN_RP_ORIGINS", nil),
+
 		JWTSecret:      jwtSecret,
 		CookieSecure:   getEnvBool("COOKIE_SECURE", true),
 		CookieSameSite: getEnv("COOKIE_SAMESITE", "lax"),
 
+		LoginRateLimit:        getEnvInt("LOGIN_RATE_LIMIT", 5),
+		LoginRateBurst:        getEnvInt("LOGIN_RATE_BURST", 10),
+		LoginLockoutThreshold: getEnvInt("LOGIN_LOCKOUT_THRESHOLD", 5),
+		LoginLockoutDuration:  getEnvDuration("LOGIN_LOCKOUT_DURATION", time.Minute),
+		LoginLockoutMax:       getEnvDuration("LOGIN_LOCKOUT_MAX", time.Hour),
+
+		SessionIdleTimeout: getEnvDuration("SESSION_IDLE_TIMEOUT", 2*time.Hour),
+		SessionMaxLifetime: getEnvDuration("SESSION_MAX_LIFETIME", 24*time.Hour),
+
+		Secrets:                store,
+		SecretsRefreshInterval: getEnvDuration("SECRETS_REFRESH_INTERVAL", time.Minute),
+
+		DataDir: dataDir,
+
+		StateBackend: stateBackend,
+		RedisURL:     redisURL,
+		StatePrefix:  getEnv("STATE_PREFIX", "craas-web:"),
+
 		CORSAllowedOrigin: getEnv("CORS_ALLOWED_ORIGIN", ""),
 	}, nil
 }
 
+const (
+	AuthModeLocal  = "local"
+	AuthModeHeader = "header"
+)
+
+// State backends.
+const (
+	StateBackendMemory = "memory"
+	StateBackendRedis  = "redis"
+)
+
+// SharedState reports whether the state is shared with other replicas.
+func (c *Config) SharedState() bool {
+	return c.StateBackend == StateBackendRedis
+}
+
+// Selectel (Keystone) auth methods.
+const (
+	AuthMethodPassword      = "password"
+	AuthMethodAppCredential = "application_credential"
+	AuthMethodToken         = "token"
+)
+
+// HeaderAuth reports whether identities come from a trusted reverse proxy.
+func (c *Config) HeaderAuth() bool {
+	return c.AuthEnabled && c.AuthMode == AuthModeHeader
+}
+
+// IsAdmin reports whether the user may manage other users' sessions.
+// When neither AUTH_ADMINS nor AUTH_ADMIN_GROUPS is set, the configured login
+// is the administrator.
+func (c *Config) IsAdmin(user string, groups []string) bool {
+	if len(c.AuthAdmins) == 0 && len(c.AuthAdminGroups) == 0 {
+		return user != "" && user == c.AuthLogin
+	}
+	for _, admin := range c.AuthAdmins {
+		if admin == user {
+			return true
+		}
+	}
+	for _, group := range groups {
+		for _, admin := range c.AuthAdminGroups {
+			if admin == group {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// DeleteEnabled reports whether any destructive action is enabled.
+func (c *Config) DeleteEnabled() bool {
+	return c.EnableDeleteRegistry || c.EnableDeleteRepository || c.EnableDeleteImage
+}
+
+// loadOrGenerateSecret returns a random JWT secret. When dataDir is set, the
+// secret is stored there so that sessions survive restarts.
+func loadOrGenerateSecret(dataDir string) (string, error) {
+	var path string
+	if dataDir != "" {
+		path = filepath.Join(dataDir, "jwt_secret")
+		if data, err := os.ReadFile(path); err == nil && len(strings.TrimSpace(string(data))) > 0 {
+			log.Println("JWT_SECRET not provided, using the secret stored in DATA_DIR")
+			return strings.TrimSpace(string(data)), nil
+		}
+	}
+
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	secret := hex.EncodeToString(b)
+
+	if path == "" {
+		log.Println("JWT_SECRET not provided, generated a random secure secret for this session")
+		return secret, nil
+	}
+	if err := os.MkdirAll(dataDir, 0o700); err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(path, []byte(secret), 0o600); err != nil {
+		return "", err
+	}
+	log.Println("JWT_SECRET not provided, generated a random secure secret and stored it in DATA_DIR")
+	return secret, nil
+}
+
+// parseCIDRs parses networks in CIDR notation. Bare IPs are treated as single hosts.
+func parseCIDRs(values []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, v := range values {
+		if !strings.Contains(v, "/") {
+			ip := net.ParseIP(v)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP address %q", v)
+			}
+			bits := 8 * net.IPv4len
+			if ip.To4() == nil {
+				bits = 8 * net.IPv6len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(v)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// DefaultCraasRegion names the endpoint set by SELECTEL_CRAAS_URL.
+const DefaultCraasRegion = "default"
+
+// loadCraasRegions reads SELECTEL_CRAAS_REGIONS (region=url),
+// SELECTEL_CRAAS_PROJECT_REGIONS (project=region|region) and
+// SELECTEL_CRAAS_REGISTRY_REGIONS (registry=region).
+func loadCraasRegions() (map[string]string, map[string][]string, map[string]string, error) {
+	regions, err := getEnvMap("SELECTEL_CRAAS_REGIONS")
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if _, ok := regions[DefaultCraasRegion]; ok {
+		return nil, nil, nil, fmt.Errorf("SELECTEL_CRAAS_REGIONS: region %q is reserved for SELECTEL_CRAAS_URL", DefaultCraasRegion)
+	}
+	known := func(key, region string) error {
+		if _, ok := regions[region]; !ok && region != DefaultCraasRegion {
+			return fmt.Errorf("%s: unknown region %q", key, region)
+		}
+		return nil
+	}
+
+	byProject, err := getEnvMap("SELECTEL_CRAAS_PROJECT_REGIONS")
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	projectRegions := make(map[string][]string, len(byProject))
+	for project, value := range byProject {
+		for _, region := range strings.Split(value, "|") {
+			region = strings.TrimSpace(region)
+			if err := known("SELECTEL_CRAAS_PROJECT_REGIONS", region); err != nil {
+				return nil, nil, nil, err
+			}
+			projectRegions[project] = append(projectRegions[project], region)
+		}
+	}
+
+	registryRegions, err := getEnvMap("SELECTEL_CRAAS_REGISTRY_REGIONS")
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	for _, region := range registryRegions {
+		if err := known("SELECTEL_CRAAS_REGISTRY_REGIONS", region); err != nil {
+			return nil, nil, nil, err
+		}
+	}
+	return regions, projectRegions, registryRegions, nil
+}
+
+// newSecretStore reads secrets from Vault when VAULT_ADDR is set.
+func newSecretStore() (*secrets.Store, error) {
+	addr := getEnv("VAULT_ADDR", "")
+	if addr == "" {
+		return secrets.NewStore(nil), nil
+	}
+	token, err := getEnvOrFile("VAULT_TOKEN")
+	if err != nil {
+		return nil, err
+	}
+	secretID, err := getEnvOrFile("VAULT_SECRET_ID")
+	if err != nil {
+		return nil, err
+	}
+	vault, err := secrets.NewVault(secrets.VaultConfig{
+		Addr:      addr,
+		Namespace: getEnv("VAULT_NAMESPACE", ""),
+		Mount:     getEnv("VAULT_KV_MOUNT", "secret"),
+		Path:      getEnv("VAULT_SECRET_PATH", ""),
+		Token:     token,
+		RoleID:    getEnv("VAULT_ROLE_ID", ""),
+		SecretID:  secretID,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return secrets.NewStore(vault), nil
+}
+
+// getEnvOrFile reads KEY, or the file named by KEY_FILE.
+func getEnvOrFile(key string) (string, error) {
+	if path := getEnv(key+"_FILE", ""); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return "", fmt.Errorf("failed to read %s_FILE: %w", key, err)
+		}
+		return strings.TrimSpace(string(data)), nil
+	}
+	return getEnv(key, ""), nil
+}
+
 func getEnv(key, fallback string) string {
 	if value, exists := os.LookupEnv(key); exists {
 		return value
@@ -110,6 +556,40 @@ func getEnvSlice(key string, fallback []string) []string {
 	return fallback
 }
 
+// getEnvMap parses comma-separated key=value pairs.
+func getEnvMap(key string) (map[string]string, error) {
+	result := make(map[string]string)
+	for _, entry := range getEnvSlice(key, nil) {
+		k, v, ok := strings.Cut(entry, "=")
+		k, v = strings.TrimSpace(k), strings.TrimSpace(v)
+		if !ok || k == "" || v == "" {
+			return nil, fmt.Errorf("invalid %s entry %q: expected key=value", key, entry)
+		}
+		result[k] = v
+	}
+	return result, nil
+}
+
+func getEnvDuration(key string, fallback time.Duration) time.Duration {
+	if value, exists := os.LookupEnv(key); exists {
+		if d, err := time.ParseDuration(value); err == nil {
+			return d
+		}
+		log.Printf("Warning: Invalid duration value for env %s: %s. Using fallback %v", key, value, fallback)
+	}
+	return fallback
+}
+
+func getEnvInt(key string, fallback int) int {
+	if value, exists := os.LookupEnv(key); exists {
+		if intVal, err := strconv.Atoi(value); err == nil {
+			return intVal
+		}
+		log.Printf("Warning: Invalid integer value for env %s: %s. Using fallback %v", key, value, fallback)
+	}
+	return fallback
+}
+
 func getEnvBool(key string, fallback bool) bool {
 	if value, exists := os.LookupEnv(key); exists {
 		if boolVal, err := strconv.ParseBool(value); err == nil {
@@ -0,0 +1,87 @@
+package config
+
+import (
+	"fmt"
+	"path"
+)
+
+// ProjectPolicy limits and labels the projects shown in the interface.
+// Patterns are matched against the project ID and name with path.Match
+// syntax, e.g. "prod-*".
+type ProjectPolicy struct {
+	Allow   []string          // Empty allows every project
+	Deny    []string          // Takes precedence over Allow
+	Aliases map[string]string // Project ID or name to display name
+	Order   []string          // Matching projects are listed first, in this order
+}
+
+// Active reports whether the policy filters projects at all.
+func (p ProjectPolicy) Active() bool {
+	return len(p.Allow) > 0 || len(p.Deny) > 0
+}
+
+// Allowed reports whether the project may be used.
+func (p ProjectPolicy) Allowed(id, name string) bool {
+	if matchAny(p.Deny, id, name) {
+		return false
+	}
+	return len(p.Allow) == 0 || matchAny(p.Allow, id, name)
+}
+
+// Alias returns the display name of the project, or "".
+func (p ProjectPolicy) Alias(id, name string) string {
+	if alias, ok := p.Aliases[id]; ok {
+		return alias
+	}
+	return p.Aliases[name]
+}
+
+// Rank returns the position of the first Order pattern matching the project,
+// or len(Order) for projects not listed.
+func (p ProjectPolicy) Rank(id, name string) int {
+	for i, pattern := range p.Order {
+		if match(pattern, id, name) {
+			return i
+		}
+	}
+	return len(p.Order)
+}
+
+func matchAny(patterns []string, id, name string) bool {
+	for _, pattern := range patterns {
+		if match(pattern, id, name) {
+			return true
+		}
+	}
+	return false
+}
+
+func match(pattern, id, name string) bool {
+	// Patterns are validated on load, so errors cannot occur here.
+	if ok, _ := path.Match(pattern, id); ok {
+		return true
+	}
+	ok, _ := path.Match(pattern, name)
+	return ok
+}
+
+func loadProjectPolicy() (ProjectPolicy, error) {
+	p := ProjectPolicy{
+		Allow: getEnvSlice("PROJECTS_ALLOW", nil),
+		Deny:  getEnvSlice("PROJECTS_DENY", nil),
+		Order: getEnvSlice("PROJECTS_ORDER", nil),
+	}
+	for key, patterns := range map[string][]string{"PROJECTS_ALLOW": p.Allow, "PROJECTS_DENY": p.Deny, "PROJECTS_ORDER": p.Order} {
+		for _, pattern := range patterns {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return ProjectPolicy{}, fmt.Errorf("invalid %s pattern %q: %w", key, pattern, err)
+			}
+		}
+	}
+	aliases, err := getEnvMap("PROJECT_ALIASES")
+	if err != nil {
+		return ProjectPolicy{}, err
+	}
+	p.Aliases = aliases
+	return p, nil
+}
@@ -0,0 +1,209 @@
+package craas
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/generic/selectel-craas-web/internal/state"
+)
+
+type refreshKey struct{}
+
+type callerKey struct{}
+
+// WithCaller records whose credentials the requests made with ctx use, e.g.
+// an account ID. Cached listings are only served to the same caller, since
+// Selectel may let another one see less of the project.
+func WithCaller(ctx context.Context, caller string) context.Context {
+	return context.WithValue(ctx, callerKey{}, caller)
+}
+
+// WithRefresh makes the listings requested with ctx bypass the cache. The
+// fresh results are still stored for later requests.
+func WithRefresh(ctx context.Context) context.Context {
+	return context.WithValue(ctx, refreshKey{}, true)
+}
+
+// listCache keeps listings for a TTL. Keys are paths below a project, e.g.
+// project/registry/repository/images/caller, so that a mutation can drop a
+// subtree for every caller.
+// With a shared state store, the listings are kept there as JSON instead, so
+// that a mutation through one replica is seen by all. There each project's
+// listings are stored under its current generation, and a mutation starts a
+// new one: invalidating is a single write, but drops the whole project.
+type listCache struct {
+	ttl    time.Duration
+	now    func() time.Time
+	shared state.Store
+	logger *slog.Logger
+
+	mu      sync.Mutex
+	entries map[string]cacheEntry
+}
+
+type cacheEntry struct {
+	value   any
+	expires time.Time
+}
+
+// keySep cannot occur in IDs or repository names.
+const keySep = "\x00"
+
+func newListCache(ttl time.Duration) *listCache {
+	if ttl <= 0 {
+		return nil
+	}
+	return &listCache{ttl: ttl, now: time.Now, entries: make(map[string]cacheEntry)}
+}
+
+func cacheKey(parts ...string) string {
+	return strings.Join(parts, keySep)
+}
+
+func (c *listCache) get(key string) (any, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	if !c.now().Before(e.expires) {
+		delete(c.entries, key)
+		return nil, false
+	}
+	return e.value, true
+}
+
+func (c *listCache) set(key string, value any) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.now()
+	for k, e := range c.entries {
+		if !now.Before(e.expires) {
+			delete(c.entries, k)
+		}
+	}
+	c.entries[key] = cacheEntry{value: value, expires: now.Add(c.ttl)}
+}
+
+// invalidate drops the entry at the path and everything below it.
+func (c *listCache) invalidate(ctx context.Context, parts ...string) {
+	if c == nil {
+		return
+	}
+	if c.shared != nil {
+		c.invalidateShared(ctx, parts[0])
+		return
+	}
+	key := cacheKey(parts...)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for k := range c.entries {
+		if k == key || strings.HasPrefix(k, key+keySep) {
+			delete(c.entries, k)
+		}
+	}
+}
+
+// cachedList returns the listing stored under the project and caller in ctx
+// and path, or fetches and stores it. Requests without a project scope or a
+// caller are not cached. Callers get their own copy of the slice, so they may
+// reorder it.
+func cachedList[T any](ctx context.Context, c *listCache, path []string, fetch func() ([]T, error)) ([]T, error) {
+	sc, _ := ctx.Value(scopeKey{}).(scope)
+	caller, _ := ctx.Value(callerKey{}).(string)
+	if c == nil || sc.projectID == "" || caller == "" {
+		return fetch()
+	}
+	parts := append([]string{sc.projectID}, path...)
+	key := cacheKey(append(parts, caller)...)
+	refresh, _ := ctx.Value(refreshKey{}).(bool)
+	if c.shared != nil {
+		return sharedList(ctx, c, sc.projectID, key, refresh, fetch)
+	}
+
+	if !refresh {
+		if v, ok := c.get(key); ok {
+			return slices.Clone(v.([]T)), nil
+		}
+	}
+	result, err := fetch()
+	if err != nil {
+		return nil, err
+	}
+	c.set(key, slices.Clone(result))
+	return result, nil
+}
+
+// The shared cache is best effort: a failing state store makes every
+// listing a miss, and the TTL bounds how long a missed invalidation lasts.
+
+// sharedList is cachedList for the shared cache. The generation is read
+// before fetching, so a listing fetched while the project is invalidated is
+// stored under the old generation and never served.
+func sharedList[T any](ctx context.Context, c *listCache, projectID, key string, refresh bool, fetch func() ([]T, error)) ([]T, error) {
+	gen, err := c.shared.Get(ctx, generationKey(projectID))
+	if errors.Is(err, state.ErrNotFound) {
+		gen = []byte("0")
+	} else if err != nil {
+		return fetch()
+	}
+	key = "cache/" + string(gen) + "/" + key
+
+	if !refresh {
+		var v []T
+		if data, err := c.shared.Get(ctx, key); err == nil && json.Unmarshal(data, &v) == nil {
+			return v, nil
+		}
+	}
+	result, err := fetch()
+	if err != nil {
+		return nil, err
+	}
+	if data, err := json.Marshal(result); err == nil {
+		c.shared.Set(ctx, key, data, c.ttl)
+	}
+	return result, nil
+}
+
+// generationKey holds the current generation of a project's listings. It
+// does not expire, so that a generation is never reused.
+func generationKey(projectID string) string {
+	return "cachegen/" + projectID
+}
+
+// invalidateShared starts a new generation for the project. The listings of
+// earlier ones are no longer read and expire with their TTL.
+func (c *listCache) invalidateShared(ctx context.Context, projectID string) {
+	b := make([]byte, 8)
+	rand.Read(b)
+	if err := c.shared.Set(ctx, generationKey(projectID), []byte(hex.EncodeToString(b)), 0); err != nil {
+		c.logger.Warn("failed to invalidate shared listing cache", "project_id", projectID, "error", err)
+	}
+}
+
+// ShareCache keeps the listing cache in the state store. It must be called
+// before the Service is used.
+func (s *Service) ShareCache(st state.Store) {
+	if s.cache != nil {
+		s.cache.shared = st
+		s.cache.logger = s.logger
+	}
+}
+
+// invalidateScope drops the cached listings at path below the project in ctx.
+func (s *Service) invalidateScope(ctx context.Context, path ...string) {
+	sc, _ := ctx.Value(scopeKey{}).(scope)
+	if sc.projectID == "" {
+		return
+	}
+	s.cache.invalidate(ctx, append([]string{sc.projectID}, path...)...)
+}
@@ -0,0 +1,197 @@
+package craas
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/generic/selectel-craas-web/internal/config"
+	"github.com/generic/selectel-craas-web/internal/state"
+	"github.com/selectel/craas-go/pkg/v1/repository"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestListCache(t *testing.T) {
+	var images, tags, repos atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == "GET" && strings.HasSuffix(r.URL.Path, "/images"):
+			images.Add(1)
+			w.Write([]byte(`[{"digest": "sha256:aaa", "tags": ["v1"]}]`))
+		case r.Method == "GET" && strings.HasSuffix(r.URL.Path, "/tags"):
+			tags.Add(1)
+			w.Write([]byte(`["v1"]`))
+		case r.Method == "GET" && strings.HasSuffix(r.URL.Path, "/repositories"):
+			repos.Add(1)
+			w.Write([]byte(`[{"name": "app"}]`))
+		case r.Method == "DELETE":
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer ts.Close()
+
+	svc := New(&config.Config{CacheTTL: time.Minute}, testLogger)
+	svc.endpoint = ts.URL + "/v1"
+	now := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+	svc.cache.now = func() time.Time { return now }
+	ctx := WithCaller(WithScope(context.Background(), "p1", "reg1"), "default")
+
+	list := func(ctx context.Context) {
+		t.Helper()
+		result, err := svc.ListImages(ctx, "token", "reg1", "app")
+		require.NoError(t, err)
+		require.Len(t, result, 1)
+		_, err = svc.ListTags(ctx, "token", "reg1", "app")
+		require.NoError(t, err)
+		_, err = svc.ListRepositories(ctx, "token", "reg1")
+		require.NoError(t, err)
+	}
+
+	list(ctx)
+	list(ctx)
+	assert.Equal(t, int32(1), images.Load(), "served from the cache")
+	assert.Equal(t, int32(1), tags.Load())
+	assert.Equal(t, int32(1), repos.Load())
+
+	list(WithRefresh(ctx))
+	assert.Equal(t, int32(2), images.Load(), "refresh bypasses the cache")
+	list(ctx)
+	assert.Equal(t, int32(2), images.Load(), "and stores the fresh listing")
+
+	// Deleting an image drops the repository's listings only
+	require.NoError(t, svc.DeleteImage(ctx, "token", "reg1", "app", "sha256:aaa"))
+	list(ctx)
+	assert.Equal(t, int32(3), images.Load())
+	assert.Equal(t, int32(3), tags.Load())
+	assert.Equal(t, int32(2), repos.Load())
+
+	// Deleting the repository drops the registry's repository list too
+	require.NoError(t, svc.DeleteRepository(ctx, "token", "reg1", "app"))
+	list(ctx)
+	assert.Equal(t, int32(4), images.Load())
+	assert.Equal(t, int32(3), repos.Load())
+
+	// Entries expire
+	now = now.Add(2 * time.Minute)
+	list(ctx)
+	assert.Equal(t, int32(5), images.Load())
+
+	// Other projects and unscoped calls do not share entries
+	list(WithCaller(WithScope(context.Background(), "p2", "reg1"), "default"))
+	assert.Equal(t, int32(6), images.Load())
+	list(context.Background())
+	list(context.Background())
+	assert.Equal(t, int32(8), images.Load())
+
+	// Neither do other callers, nor calls without one
+	alice := WithCaller(WithScope(context.Background(), "p1", "reg1"), "user:alice/1")
+	bob := WithCaller(WithScope(context.Background(), "p1", "reg1"), "user:bob/1")
+	list(alice)
+	list(bob)
+	list(bob)
+	assert.Equal(t, int32(10), images.Load())
+	list(WithScope(context.Background(), "p1", "reg1"))
+	assert.Equal(t, int32(11), images.Load())
+
+	// A mutation drops the listings of every caller
+	require.NoError(t, svc.DeleteImage(alice, "token", "reg1", "app", "sha256:aaa"))
+	list(bob)
+	assert.Equal(t, int32(12), images.Load())
+}
+
+func TestListCache_Copies(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`["v1", "v2"]`))
+	}))
+	defer ts.Close()
+
+	svc := New(&config.Config{CacheTTL: time.Minute}, testLogger)
+	svc.endpoint = ts.URL + "/v1"
+	ctx := WithCaller(WithScope(context.Background(), "p1", "reg1"), "default")
+
+	first, err := svc.ListTags(ctx, "token", "reg1", "app")
+	require.NoError(t, err)
+	first[0] = "modified"
+
+	second, err := svc.ListTags(ctx, "token", "reg1", "app")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"v1", "v2"}, second, "callers cannot change cached listings")
+}
+
+func TestListCache_Disabled(t *testing.T) {
+	svc := New(&config.Config{}, testLogger)
+	assert.Nil(t, svc.cache)
+	svc.invalidateScope(WithScope(context.Background(), "p1", ""), "registries")
+}
+
+func TestListCache_Shared(t *testing.T) {
+	var images atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == "GET" && strings.HasSuffix(r.URL.Path, "/images"):
+			images.Add(1)
+			w.Write([]byte(`[{"digest": "sha256:aaa", "tags": ["v1"], "createdAt": "2024-01-01T00:00:00Z"}]`))
+		case r.Method == "DELETE":
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer ts.Close()
+
+	// Two replicas sharing one Redis
+	mr := miniredis.RunT(t)
+	newReplica := func() *Service {
+		st, err := state.NewRedis("redis://"+mr.Addr(), "test:")
+		require.NoError(t, err)
+		t.Cleanup(func() { st.Close() })
+		svc := New(&config.Config{CacheTTL: time.Minute, SelectelCraasURL: ts.URL + "/v1"}, testLogger)
+		svc.ShareCache(st)
+		return svc
+	}
+	a, b := newReplica(), newReplica()
+	ctx := WithCaller(WithScope(context.Background(), "p1", "reg1"), "default")
+
+	list := func(svc *Service, repo string) []*repository.Image {
+		t.Helper()
+		result, err := svc.ListImages(ctx, "token", "reg1", repo)
+		require.NoError(t, err)
+		return result
+	}
+
+	first := list(a, "app")
+	second := list(b, "app")
+	assert.Equal(t, int32(1), images.Load(), "served from the shared cache")
+	assert.Equal(t, first, second)
+	list(b, "app2")
+	assert.Equal(t, int32(2), images.Load())
+
+	// A deletion through one replica is seen by the other
+	require.NoError(t, b.DeleteImage(ctx, "token", "reg1", "app", "sha256:aaa"))
+	list(a, "app")
+	assert.Equal(t, int32(3), images.Load())
+	list(b, "app2")
+	assert.Equal(t, int32(4), images.Load(), "the whole project is dropped")
+
+	// Another caller of the project has its own entries
+	_, err := a.ListImages(WithCaller(ctx, "user:alice/1"), "token", "reg1", "app")
+	require.NoError(t, err)
+	assert.Equal(t, int32(5), images.Load())
+
+	// Other projects stay cached
+	other := WithCaller(WithScope(context.Background(), "p2", "reg1"), "default")
+	_, err = a.ListImages(other, "token", "reg1", "app")
+	require.NoError(t, err)
+	require.NoError(t, a.DeleteImage(ctx, "token", "reg1", "app", "sha256:aaa"))
+	_, err = b.ListImages(other, "token", "reg1", "app")
+	require.NoError(t, err)
+	assert.Equal(t, int32(6), images.Load())
+}
@@ -0,0 +1,110 @@
+package craas
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	clientv1 "github.com/selectel/craas-go/pkg/v1/client"
+)
+
+// A client is dropped when its token is renewed or invalidated, see
+// Service.RetireToken. Clients of tokens that are never retired, e.g. those of
+// per-user clients that were discarded, are dropped after sdkClientIdleTTL.
+// maxSDKClients bounds the pool when many users are active.
+const (
+	sdkClientIdleTTL = 10 * time.Minute
+	maxSDKClients    = 1024
+)
+
+// clientPool reuses craas-go clients per token and endpoint. The clients
+// share the Service's http.Client, so they also share its connections.
+type clientPool struct {
+	now func() time.Time
+
+	mu      sync.Mutex
+	clients map[clientKey]*pooledClient
+	swept   time.Time
+}
+
+type clientKey struct {
+	token    string
+	endpoint string
+}
+
+type pooledClient struct {
+	client   *clientv1.ServiceClient
+	lastUsed time.Time
+}
+
+func newClientPool() *clientPool {
+	return &clientPool{now: time.Now, clients: make(map[clientKey]*pooledClient)}
+}
+
+// get returns the client for token and endpoint, creating it with httpClient
+// if needed.
+func (p *clientPool) get(httpClient *http.Client, token, endpoint string) (*clientv1.ServiceClient, error) {
+	key := clientKey{token: token, endpoint: endpoint}
+	now := p.now()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if now.Sub(p.swept) >= sdkClientIdleTTL {
+		p.sweepLocked(now)
+	}
+	if pc, ok := p.clients[key]; ok {
+		pc.lastUsed = now
+		return pc.client, nil
+	}
+
+	client, err := clientv1.NewCRaaSClientV1WithCustomHTTP(httpClient, token, endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if len(p.clients) >= maxSDKClients {
+		p.evictOldestLocked()
+	}
+	p.clients[key] = &pooledClient{client: client, lastUsed: now}
+	return client, nil
+}
+
+// sweepLocked drops the clients that were not used for sdkClientIdleTTL.
+// The caller must hold the lock.
+func (p *clientPool) sweepLocked(now time.Time) {
+	p.swept = now
+	for key, pc := range p.clients {
+		if now.Sub(pc.lastUsed) >= sdkClientIdleTTL {
+			delete(p.clients, key)
+		}
+	}
+}
+
+// evictOldestLocked drops the least recently used client. The caller must
+// hold the lock.
+func (p *clientPool) evictOldestLocked() {
+	var oldest clientKey
+	var oldestUsed time.Time
+	for key, pc := range p.clients {
+		if oldestUsed.IsZero() || pc.lastUsed.Before(oldestUsed) {
+			oldest, oldestUsed = key, pc.lastUsed
+		}
+	}
+	delete(p.clients, oldest)
+}
+
+// retire drops the clients of token, on every endpoint.
+func (p *clientPool) retire(token string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for key := range p.clients {
+		if key.token == token {
+			delete(p.clients, key)
+		}
+	}
+}
+
+func (p *clientPool) len() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.clients)
+}
@@ -0,0 +1,135 @@
+package craas
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	clientv1 "github.com/selectel/craas-go/pkg/v1/client"
+	"github.com/selectel/craas-go/pkg/v1/registry"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClientPool(t *testing.T) {
+	p := newClientPool()
+	now := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+	p.now = func() time.Time { return now }
+
+	a, err := p.get(http.DefaultClient, "token-a", "https://cr.example/v1")
+	require.NoError(t, err)
+	again, err := p.get(http.DefaultClient, "token-a", "https://cr.example/v1")
+	require.NoError(t, err)
+	assert.Same(t, a, again)
+
+	// Another token or region gets its own client
+	b, err := p.get(http.DefaultClient, "token-b", "https://cr.example/v1")
+	require.NoError(t, err)
+	assert.NotSame(t, a, b)
+	other, err := p.get(http.DefaultClient, "token-a", "https://ru-3.cr.example/v1")
+	require.NoError(t, err)
+	assert.NotSame(t, a, other)
+	assert.Equal(t, 3, p.len())
+
+	_, err = p.get(http.DefaultClient, "token-a", "https://cr.example/v2")
+	assert.Error(t, err)
+	assert.Equal(t, 3, p.len())
+
+	// Renewed tokens are no longer used and their clients are dropped
+	now = now.Add(sdkClientIdleTTL / 2)
+	_, err = p.get(http.DefaultClient, "token-b", "https://cr.example/v1")
+	require.NoError(t, err)
+	now = now.Add(sdkClientIdleTTL * 3 / 4)
+	_, err = p.get(http.DefaultClient, "token-c", "https://cr.example/v1")
+	require.NoError(t, err)
+	assert.Equal(t, 2, p.len())
+}
+
+func TestClientPoolRetire(t *testing.T) {
+	p := newClientPool()
+	a, err := p.get(http.DefaultClient, "token-a", "https://cr.example/v1")
+	require.NoError(t, err)
+	_, err = p.get(http.DefaultClient, "token-a", "https://ru-3.cr.example/v1")
+	require.NoError(t, err)
+	_, err = p.get(http.DefaultClient, "token-b", "https://cr.example/v1")
+	require.NoError(t, err)
+
+	// A renewed or invalidated token loses its clients in every region
+	svc := &Service{clients: p}
+	svc.RetireToken("token-a")
+	assert.Equal(t, 1, p.len())
+	again, err := p.get(http.DefaultClient, "token-a", "https://cr.example/v1")
+	require.NoError(t, err)
+	assert.NotSame(t, a, again)
+}
+
+func TestClientPoolLimit(t *testing.T) {
+	p := newClientPool()
+	now := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+	p.now = func() time.Time {
+		now = now.Add(time.Millisecond)
+		return now
+	}
+
+	first, err := p.get(http.DefaultClient, "token-0", "https://cr.example/v1")
+	require.NoError(t, err)
+	for i := 1; i <= maxSDKClients; i++ {
+		_, err := p.get(http.DefaultClient, fmt.Sprintf("token-%d", i), "https://cr.example/v1")
+		require.NoError(t, err)
+	}
+	assert.Equal(t, maxSDKClients, p.len())
+
+	// The least recently used client was dropped
+	again, err := p.get(http.DefaultClient, "token-0", "https://cr.example/v1")
+	require.NoError(t, err)
+	assert.NotSame(t, first, again)
+}
+
+// The benchmarks list registries from a TLS server, as a request to
+// cr.selcloud.ru does, through one shared http.Client. They only differ in
+// whether the craas-go client is created for each call or taken from the
+// pool. Compare them with
+//
+//	go test ./internal/craas -run '^$' -bench ListRegistries
+
+func newBenchmarkServer(b *testing.B) *httptest.Server {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`[{"id": "reg1", "name": "registry-1"}]`))
+	}))
+	b.Cleanup(ts.Close)
+	return ts
+}
+
+func BenchmarkListRegistries_ClientPerCall(b *testing.B) {
+	ts := newBenchmarkServer(b)
+	shared := ts.Client()
+
+	for b.Loop() {
+		client, err := clientv1.NewCRaaSClientV1WithCustomHTTP(shared, "token", ts.URL+"/v1")
+		if err != nil {
+			b.Fatal(err)
+		}
+		if _, _, err := registry.List(context.Background(), client); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkListRegistries_Pooled(b *testing.B) {
+	ts := newBenchmarkServer(b)
+	shared := ts.Client()
+	p := newClientPool()
+
+	for b.Loop() {
+		client, err := p.get(shared, "token", ts.URL+"/v1")
+		if err != nil {
+			b.Fatal(err)
+		}
+		if _, _, err := registry.List(context.Background(), client); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
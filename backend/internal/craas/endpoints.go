@@ -0,0 +1,109 @@
+package craas
+
+import (
+	"context"
+	"sort"
+	"sync"
+
+	"github.com/generic/selectel-craas-web/internal/config"
+	"github.com/selectel/craas-go/pkg/v1/registry"
+)
+
+// Registry is a registry annotated with the region it was listed from.
+type Registry struct {
+	*registry.Registry
+	Region string `json:"region,omitempty"`
+}
+
+type scopeKey struct{}
+
+type scope struct {
+	projectID  string
+	registryID string
+}
+
+// WithScope records the project and registry a request operates on, so that
+// the Service routes it to the endpoint of their region.
+func WithScope(ctx context.Context, projectID, registryID string) context.Context {
+	return context.WithValue(ctx, scopeKey{}, scope{projectID: projectID, registryID: registryID})
+}
+
+// regionMap maps projects and registries to CRaaS endpoints. Registries
+// found by ListRegistries are remembered, so that a project spanning several
+// regions needs no per-registry configuration.
+type regionMap struct {
+	urls       map[string]string   // Region name to endpoint, besides the default
+	projects   map[string][]string // Project ID to region names
+	registries map[string]string   // Registry ID to region name
+
+	mu      sync.RWMutex
+	learned map[string]string // Registry ID to region name, from listings
+}
+
+func newRegionMap(cfg *config.Config) *regionMap {
+	return &regionMap{
+		urls:       cfg.CraasRegions,
+		projects:   cfg.CraasProjectRegions,
+		registries: cfg.CraasRegistryRegions,
+		learned:    make(map[string]string),
+	}
+}
+
+// projectRegions returns the regions holding the project's registries.
+func (s *Service) projectRegions(ctx context.Context) []string {
+	sc, _ := ctx.Value(scopeKey{}).(scope)
+	if s.regions != nil {
+		if regions, ok := s.regions.projects[sc.projectID]; ok {
+			return regions
+		}
+	}
+	return []string{config.DefaultCraasRegion}
+}
+
+// endpointFor returns the endpoint for the registry in ctx: the configured
+// registry region, the region it was listed from, or the project's first region.
+func (s *Service) endpointFor(ctx context.Context) string {
+	if s.regions == nil {
+		return s.endpoint
+	}
+	sc, _ := ctx.Value(scopeKey{}).(scope)
+
+	region, ok := s.regions.registries[sc.registryID]
+	if !ok {
+		s.regions.mu.RLock()
+		region, ok = s.regions.learned[sc.registryID]
+		s.regions.mu.RUnlock()
+	}
+	if !ok {
+		region = s.projectRegions(ctx)[0]
+	}
+	return s.regionURL(region)
+}
+
+func (s *Service) regionURL(region string) string {
+	if s.regions == nil {
+		return s.endpoint
+	}
+	if url, ok := s.regions.urls[region]; ok {
+		return url
+	}
+	return s.endpoint
+}
+
+func (s *Service) learnRegions(registries []*Registry) {
+	if s.regions == nil {
+		return
+	}
+	s.regions.mu.Lock()
+	defer s.regions.mu.Unlock()
+	for _, r := range registries {
+		s.regions.learned[r.ID] = r.Region
+	}
+}
+
+// sortRegistries orders results merged from several regions by name.
+func sortRegistries(registries []*Registry) {
+	sort.SliceStable(registries, func(i, j int) bool {
+		return registries[i].Name < registries[j].Name
+	})
+}
@@ -0,0 +1,74 @@
+package craas
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/generic/selectel-craas-web/internal/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// regionServer lists one registry and answers GC size requests for it.
+func regionServer(registryJSON string, gcCalls *int) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1/registries":
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte("[" + registryJSON + "]"))
+		default:
+			*gcCalls++
+			w.Write([]byte(`{}`))
+		}
+	}))
+}
+
+func TestRegions(t *testing.T) {
+	var defaultCalls, ru3Calls, stagingCalls int
+	def := regionServer(`{"id": "reg-b", "name": "b"}`, &defaultCalls)
+	defer def.Close()
+	ru3 := regionServer(`{"id": "reg-a", "name": "a"}`, &ru3Calls)
+	defer ru3.Close()
+	staging := regionServer(`{"id": "reg-s", "name": "s"}`, &stagingCalls)
+	defer staging.Close()
+
+	svc := New(&config.Config{
+		SelectelCraasURL:     def.URL + "/v1",
+		CraasRegions:         map[string]string{"ru-3": ru3.URL + "/v1", "staging": staging.URL + "/v1"},
+		CraasProjectRegions:  map[string][]string{"multi": {"default", "ru-3"}, "stage": {"staging"}},
+		CraasRegistryRegions: map[string]string{"reg-pinned": "ru-3"},
+	}, testLogger)
+
+	// Projects spanning several regions are merged and sorted by name
+	ctx := WithScope(context.Background(), "multi", "")
+	registries, err := svc.ListRegistries(ctx, "token")
+	require.NoError(t, err)
+	require.Len(t, registries, 2)
+	assert.Equal(t, "reg-a", registries[0].ID)
+	assert.Equal(t, "ru-3", registries[0].Region)
+	assert.Equal(t, "reg-b", registries[1].ID)
+	assert.Equal(t, "default", registries[1].Region)
+
+	registries, err = svc.ListRegistries(WithScope(context.Background(), "stage", ""), "token")
+	require.NoError(t, err)
+	require.Len(t, registries, 1)
+	assert.Equal(t, "staging", registries[0].Region)
+
+	gc := func(project, registry string) {
+		_, err := svc.GetGCInfo(WithScope(context.Background(), project, registry), "token", registry)
+		require.NoError(t, err)
+	}
+
+	gc("multi", "reg-a") // Learned from the listing
+	assert.Equal(t, 1, ru3Calls)
+	gc("multi", "reg-pinned") // Configured per registry
+	assert.Equal(t, 2, ru3Calls)
+	gc("multi", "reg-unknown") // The project's first region
+	assert.Equal(t, 1, defaultCalls)
+	gc("stage", "reg-unknown")
+	assert.Equal(t, 1, stagingCalls)
+	gc("other", "reg-x") // Unmapped projects use SELECTEL_CRAAS_URL
+	assert.Equal(t, 2, defaultCalls)
+}
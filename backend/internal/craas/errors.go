@@ -1,6 +1,86 @@
 package craas
 
-import "errors"
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
 
-// ErrUnauthorized indicates that the request was not authorized (HTTP 401).
-var ErrUnauthorized = errors.New("unauthorized")
+	"github.com/selectel/craas-go/pkg/svc"
+)
+
+// Kinds of CRaaS failures. Match them with errors.Is.
+var (
+	ErrUnauthorized = errors.New("unauthorized")     // HTTP 401, the token is invalid or expired
+	ErrForbidden    = errors.New("forbidden")        // HTTP 403
+	ErrNotFound     = errors.New("not found")        // HTTP 404
+	ErrConflict     = errors.New("conflict")         // HTTP 409, e.g. garbage collection already running
+	ErrRateLimited  = errors.New("rate limited")     // HTTP 429
+	ErrBadRequest   = errors.New("request rejected") // HTTP 400 and 422
+	ErrUpstream     = errors.New("upstream error")   // Any other failed response
+)
+
+// Error is a failed CRaaS response.
+type Error struct {
+	Kind       error         // One of the Err* kinds
+	Status     int           // HTTP status returned by CRaaS
+	Message    string        // Explanation from CRaaS or from this package
+	RetryAfter time.Duration // Set on ErrRateLimited when CRaaS sent Retry-After
+}
+
+func (e *Error) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("craas: %s (status %d)", e.Kind, e.Status)
+	}
+	return fmt.Sprintf("craas: %s (status %d): %s", e.Kind, e.Status, e.Message)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Kind
+}
+
+// kindOf classifies an HTTP status.
+func kindOf(status int) error {
+	switch {
+	case status == http.StatusUnauthorized:
+		return ErrUnauthorized
+	case status == http.StatusForbidden:
+		return ErrForbidden
+	case status == http.StatusNotFound:
+		return ErrNotFound
+	case status == http.StatusConflict:
+		return ErrConflict
+	case status == http.StatusTooManyRequests:
+		return ErrRateLimited
+	case status == http.StatusBadRequest || status == http.StatusUnprocessableEntity:
+		return ErrBadRequest
+	default:
+		return ErrUpstream
+	}
+}
+
+// statusError builds the error for a failed raw HTTP response.
+func statusError(resp *http.Response, message string) error {
+	e := &Error{Kind: kindOf(resp.StatusCode), Status: resp.StatusCode, Message: message}
+	if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && e.Kind == ErrRateLimited {
+		e.RetryAfter = time.Duration(seconds) * time.Second
+	}
+	return e
+}
+
+// sdkError classifies an error returned by craas-go. Failures without a
+// response, such as network errors, are returned unchanged.
+func sdkError(result *svc.ResponseResult, err error) error {
+	if err == nil || result == nil || result.Response == nil || result.StatusCode < http.StatusBadRequest {
+		return err
+	}
+	message := err.Error()
+	switch {
+	case result.ErrNotFound != nil && result.ErrNotFound.Error.Message != "":
+		message = result.ErrNotFound.Error.Message
+	case result.ErrGeneric != nil && result.ErrGeneric.Error != "":
+		message = result.ErrGeneric.Error
+	}
+	return statusError(result.Response, message)
+}
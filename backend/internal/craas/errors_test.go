@@ -0,0 +1,82 @@
+package craas
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestErrorKinds(t *testing.T) {
+	tests := []struct {
+		status int
+		body   string
+		kind   error
+	}{
+		{http.StatusUnauthorized, "", ErrUnauthorized},
+		{http.StatusForbidden, `{"error": "access denied"}`, ErrForbidden},
+		{http.StatusNotFound, `{"error": {"id": "reg1", "message": "registry not found"}}`, ErrNotFound},
+		{http.StatusConflict, "", ErrConflict},
+		{http.StatusTooManyRequests, "", ErrRateLimited},
+		{http.StatusBadRequest, `{"error": "invalid name"}`, ErrBadRequest},
+		{http.StatusBadGateway, "<html>bad gateway</html>", ErrUpstream},
+	}
+
+	for _, tt := range tests {
+		t.Run(http.StatusText(tt.status), func(t *testing.T) {
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.status)
+				w.Write([]byte(tt.body))
+			}))
+			defer ts.Close()
+
+			svc := &Service{endpoint: ts.URL + "/v1", logger: testLogger}
+
+			// Through craas-go
+			_, err := svc.ListRepositories(context.Background(), "token", "reg1")
+			assert.ErrorIs(t, err, tt.kind)
+			var e *Error
+			require.ErrorAs(t, err, &e)
+			assert.Equal(t, tt.status, e.Status)
+
+			// Through a raw request
+			_, err = svc.GetGCInfo(context.Background(), "token", "reg1")
+			assert.ErrorIs(t, err, tt.kind)
+		})
+	}
+}
+
+func TestErrorDetails(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v1/registries/reg1/repositories" {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"error": {"id": "reg1", "message": "registry not found"}}`))
+			return
+		}
+		w.Header().Set("Retry-After", "7")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer ts.Close()
+
+	svc := &Service{endpoint: ts.URL + "/v1", logger: testLogger}
+
+	_, err := svc.ListRepositories(context.Background(), "token", "reg1")
+	var e *Error
+	require.ErrorAs(t, err, &e)
+	assert.Equal(t, "registry not found", e.Message)
+
+	_, err = svc.ListTags(context.Background(), "token", "reg1", "repo")
+	require.ErrorAs(t, err, &e)
+	assert.Equal(t, 7*time.Second, e.RetryAfter)
+
+	// Failures without a response are not classified
+	svc.endpoint = "http://127.0.0.1:1/v1"
+	_, err = svc.ListRepositories(context.Background(), "token", "reg1")
+	require.Error(t, err)
+	assert.False(t, errors.As(err, &e))
+}
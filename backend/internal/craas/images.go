@@ -12,14 +12,23 @@ import (
 
 	"golang.org/x/sync/errgroup"
 
+	"github.com/generic/selectel-craas-web/internal/resilience"
 	clientv1 "github.com/selectel/craas-go/pkg/v1/client"
 	"github.com/selectel/craas-go/pkg/v1/repository"
 )
 
 // ListImages returns a list of images in the repository.
 func (s *Service) ListImages(ctx context.Context, token string, registryID, repoName string) ([]*repository.Image, error) {
+	return cachedList(ctx, s.cache, []string{registryID, repoName, "images"}, func() ([]*repository.Image, error) {
+		return s.listImages(ctx, token, registryID, repoName)
+	})
+}
+
+func (s *Service) listImages(ctx context.Context, token string, registryID, repoName string) ([]*repository.Image, error) {
+	ctx, cancel := s.withTimeout(ctx, false)
+	defer cancel()
 	s.logger.Debug("listing images", "registry_id", registryID, "repository", repoName)
-	client, err := clientv1.NewCRaaSClientV1(token, s.endpoint)
+	client, err := s.sdkClient(token, s.endpointFor(ctx))
 	if err != nil {
 		return nil, fmt.Errorf("failed to create client: %w", err)
 	}
@@ -28,12 +37,12 @@ func (s *Service) ListImages(ctx context.Context, token string, registryID, repo
 	encodedRepoName := url.PathEscape(repoName)
 
 	start := time.Now()
-	images, _, err := repository.ListImages(ctx, client, registryID, encodedRepoName)
+	images, result, err := repository.ListImages(ctx, client, registryID, encodedRepoName)
 	duration := time.Since(start)
 
 	if err != nil {
 		s.logger.Error("failed to list images", "registry_id", registryID, "repository", repoName, "error", err)
-		return nil, err
+		return nil, sdkError(result, err)
 	}
 
 	if s.enableMissingTagsCheck {
@@ -74,32 +83,63 @@ func (s *Service) resolveMissingTags(ctx context.Context, client *clientv1.Servi
 		return images
 	}
 
+	fp := fingerprint(images)
+	known := s.Tags.repo(ctx, registryID, repoName)
 	s.logger.Info("found missing tags, resolving", "count", len(missingTags), "tags", missingTags)
 
-	httpClient := &http.Client{
-		Timeout: 10 * time.Second,
+	// The governor enforces the per-project cap on the calls themselves;
+	// more workers than that would only wait in its queue.
+	workers := s.digestWorkers
+	if workers <= 0 {
+		workers = defaultDigestWorkers
 	}
-
 	g, ctx := errgroup.WithContext(ctx)
-	g.SetLimit(5) // Limit concurrency
+	g.SetLimit(workers)
 
 	var mu sync.Mutex
+	verified := make(map[string]tagEntry)
+	var resolved, revalidated int
 
 	for _, tag := range missingTags {
 		tag := tag
 		g.Go(func() error {
-			// Fetch all digests associated with the tag
-			// Use encodedRepoName here too
-			digests, err := s.fetchImageDigests(ctx, httpClient, token, registryID, encodedRepoName, tag)
-			if err != nil {
-				s.logger.Warn("failed to fetch digests for tag", "tag", tag, "error", err)
-				return nil // Don't fail the whole group, just skip
+			entry, found, fresh := s.Tags.lookup(known, fp, tag)
+			if !fresh {
+				// A known tag whose manifest is unchanged only costs a HEAD request.
+				// Without a recorded manifest digest there is nothing to compare.
+				if found {
+					found = entry.Manifest != ""
+				}
+				if found {
+					manifest, err := s.fetchManifestDigest(ctx, token, registryID, encodedRepoName, tag)
+					found = err == nil && manifest == entry.Manifest
+				}
+				if !found {
+					// Fetch all digests associated with the tag
+					// Use encodedRepoName here too
+					manifest, digests, err := s.fetchImageDigests(ctx, token, registryID, encodedRepoName, tag)
+					if err != nil {
+						s.logger.Warn("failed to fetch digests for tag", "tag", tag, "error", err)
+						return nil // Don't fail the whole group, just skip
+					}
+					entry = tagEntry{Manifest: manifest, Digests: digests}
+				}
 			}
 
 			mu.Lock()
 			defer mu.Unlock()
 
-			for _, digest := range digests {
+			if !fresh {
+				entry.VerifiedAt = time.Time{} // Set by the index
+				verified[tag] = entry
+				if found {
+					revalidated++
+				} else {
+					resolved++
+				}
+			}
+
+			for _, digest := range entry.Digests {
 				// Check if we already have this image (by digest)
 				if existingImg, ok := imageMap[digest]; ok {
 					// Add the tag to the existing image
@@ -133,33 +173,65 @@ func (s *Service) resolveMissingTags(ctx context.Context, client *clientv1.Servi
 		s.logger.Error("error resolving missing tags", "error", err)
 	}
 
+	if err := s.Tags.update(ctx, registryID, repoName, fp, allTags, verified); err != nil {
+		s.logger.Warn("failed to save tag index", "error", err)
+	}
+	s.logger.Debug("missing tags resolved", "registry_id", registryID, "repository", repoName,
+		"from_index", len(missingTags)-len(verified), "revalidated", revalidated, "resolved", resolved)
+
 	return images
 }
 
-// fetchImageDigests fetches the digest(s) associated with a tag.
-func (s *Service) fetchImageDigests(ctx context.Context, client *http.Client, token, registryID, repoName, reference string) ([]string, error) {
-	url := fmt.Sprintf("%s/registries/%s/repositories/%s/%s", s.endpoint, registryID, repoName, reference)
-	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+// manifestRequest requests the manifest of a tag.
+func (s *Service) manifestRequest(ctx context.Context, method, token, registryID, repoName, reference string) (*http.Response, error) {
+	url := fmt.Sprintf("%s/registries/%s/repositories/%s/%s", s.endpointFor(ctx), registryID, repoName, reference)
+	req, err := http.NewRequestWithContext(ctx, method, url, nil)
 	if err != nil {
 		return nil, err
 	}
 	req.Header.Set("X-Auth-Token", token)
 	// Add Accept headers to request Manifests/Indices properly instead of empty layer lists
 	req.Header.Set("Accept", "application/vnd.docker.distribution.manifest.v2+json, application/vnd.docker.distribution.manifest.list.v2+json, application/vnd.oci.image.manifest.v1+json, application/vnd.oci.image.index.v1+json, */*")
+	return s.httpClient().Do(req)
+}
 
-	resp, err := client.Do(req)
+// fetchManifestDigest returns the manifest digest a tag points to, without
+// downloading the manifest. It is empty if the registry does not report it.
+func (s *Service) fetchManifestDigest(ctx context.Context, token, registryID, repoName, reference string) (string, error) {
+	ctx, cancel := resilience.WithTimeout(ctx, digestTimeout)
+	defer cancel()
+
+	resp, err := s.manifestRequest(ctx, "HEAD", token, registryID, repoName, reference)
 	if err != nil {
-		return nil, err
+		return "", err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", statusError(resp, "")
+	}
+	return resp.Header.Get("Docker-Content-Digest"), nil
+}
+
+// fetchImageDigests fetches the digest(s) associated with a tag, and the
+// digest of its manifest if the registry reports it.
+func (s *Service) fetchImageDigests(ctx context.Context, token, registryID, repoName, reference string) (string, []string, error) {
+	ctx, cancel := resilience.WithTimeout(ctx, digestTimeout)
+	defer cancel()
+
+	resp, err := s.manifestRequest(ctx, "GET", token, registryID, repoName, reference)
+	if err != nil {
+		return "", nil, err
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+		return "", nil, statusError(resp, "")
 	}
 
 	bodyBytes, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return nil, err
+		return "", nil, err
 	}
 
 	var digests []string
@@ -186,10 +258,10 @@ func (s *Service) fetchImageDigests(ctx context.Context, client *http.Client, to
 			maxLog = len(bodyBytes)
 		}
 		s.logger.Warn("no digests found in response body", "tag", reference, "body_preview", string(bodyBytes[:maxLog]))
-		return nil, fmt.Errorf("no digests found for tag %s", reference)
+		return "", nil, fmt.Errorf("no digests found for tag %s", reference)
 	}
 
-	return digests, nil
+	return headerDigest, digests, nil
 }
 
 // findDigests recursively searches for strings matching digestRegex in the JSON structure.
@@ -217,8 +289,16 @@ func findDigests(data interface{}, seen map[string]struct{}, result *[]string) {
 
 // ListTags returns a list of tags in the repository.
 func (s *Service) ListTags(ctx context.Context, token string, registryID, repoName string) ([]string, error) {
+	return cachedList(ctx, s.cache, []string{registryID, repoName, "tags"}, func() ([]string, error) {
+		return s.listTags(ctx, token, registryID, repoName)
+	})
+}
+
+func (s *Service) listTags(ctx context.Context, token string, registryID, repoName string) ([]string, error) {
+	ctx, cancel := s.withTimeout(ctx, false)
+	defer cancel()
 	s.logger.Debug("listing tags", "registry_id", registryID, "repository", repoName)
-	client, err := clientv1.NewCRaaSClientV1(token, s.endpoint)
+	client, err := s.sdkClient(token, s.endpointFor(ctx))
 	if err != nil {
 		return nil, fmt.Errorf("failed to create client: %w", err)
 	}
@@ -226,12 +306,12 @@ func (s *Service) ListTags(ctx context.Context, token string, registryID, repoNa
 	encodedRepoName := url.PathEscape(repoName)
 
 	start := time.Now()
-	tags, _, err := repository.ListTags(ctx, client, registryID, encodedRepoName)
+	tags, result, err := repository.ListTags(ctx, client, registryID, encodedRepoName)
 	duration := time.Since(start)
 
 	if err != nil {
 		s.logger.Error("failed to list tags", "registry_id", registryID, "repository", repoName, "error", err)
-		return nil, err
+		return nil, sdkError(result, err)
 	}
 	s.logger.Info("listed tags", "registry_id", registryID, "repository", repoName, "count", len(tags), "duration", duration)
 	return tags, nil
@@ -239,8 +319,12 @@ func (s *Service) ListTags(ctx context.Context, token string, registryID, repoNa
 
 // DeleteImage deletes the image by digest.
 func (s *Service) DeleteImage(ctx context.Context, token string, registryID, repoName, digest string) error {
+	ctx, cancel := s.withTimeout(ctx, false)
+	defer cancel()
 	s.logger.Info("deleting image", "registry_id", registryID, "repository", repoName, "digest", digest)
-	client, err := clientv1.NewCRaaSClientV1(token, s.endpoint)
+	defer s.invalidateScope(ctx, registryID, repoName)
+	defer s.forgetTags(ctx, registryID, repoName)
+	client, err := s.sdkClient(token, s.endpointFor(ctx))
 	if err != nil {
 		return fmt.Errorf("failed to create client: %w", err)
 	}
@@ -248,12 +332,12 @@ func (s *Service) DeleteImage(ctx context.Context, token string, registryID, rep
 	encodedRepoName := url.PathEscape(repoName)
 
 	start := time.Now()
-	_, err = repository.DeleteImageManifest(ctx, client, registryID, encodedRepoName, digest)
+	result, err := repository.DeleteImageManifest(ctx, client, registryID, encodedRepoName, digest)
 	duration := time.Since(start)
 
 	if err != nil {
 		s.logger.Error("failed to delete image", "registry_id", registryID, "repository", repoName, "digest", digest, "error", err)
-		return err
+		return sdkError(result, err)
 	}
 	s.logger.Info("image deleted", "registry_id", registryID, "repository", repoName, "digest", digest, "duration", duration)
 	return nil
@@ -3,50 +3,103 @@ package craas
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"sync"
 	"time"
 
-	clientv1 "github.com/selectel/craas-go/pkg/v1/client"
 	"github.com/selectel/craas-go/pkg/v1/registry"
 )
 
 // ListRegistries returns a list of registries for the project (scoped by token).
-func (s *Service) ListRegistries(ctx context.Context, token string) ([]*registry.Registry, error) {
-	s.logger.Debug("listing registries")
-	client, err := clientv1.NewCRaaSClientV1(token, s.endpoint)
+// Projects spanning several regions are listed in each and merged.
+func (s *Service) ListRegistries(ctx context.Context, token string) ([]*Registry, error) {
+	return cachedList(ctx, s.cache, []string{"registries"}, func() ([]*Registry, error) {
+		return s.listAllRegistries(ctx, token)
+	})
+}
+
+func (s *Service) listAllRegistries(ctx context.Context, token string) ([]*Registry, error) {
+	regions := s.projectRegions(ctx)
+	if len(regions) == 1 {
+		result, err := s.listRegistries(ctx, token, regions[0])
+		s.learnRegions(result)
+		return result, err
+	}
+
+	results := make([][]*Registry, len(regions))
+	errs := make([]error, len(regions))
+	var wg sync.WaitGroup
+	for i, region := range regions {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i], errs[i] = s.listRegistries(ctx, token, region)
+		}()
+	}
+	wg.Wait()
+
+	// A partial list could hide registries, so any failing region fails the listing.
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+	var merged []*Registry
+	for _, r := range results {
+		merged = append(merged, r...)
+	}
+	sortRegistries(merged)
+	s.learnRegions(merged)
+	return merged, nil
+}
+
+func (s *Service) listRegistries(ctx context.Context, token, region string) ([]*Registry, error) {
+	ctx, cancel := s.withTimeout(ctx, false)
+	defer cancel()
+	s.logger.Debug("listing registries", "region", region)
+	client, err := s.sdkClient(token, s.regionURL(region))
 	if err != nil {
 		return nil, fmt.Errorf("failed to create client: %w", err)
 	}
 
 	start := time.Now()
-	registries, _, err := registry.List(ctx, client)
+	registries, response, err := registry.List(ctx, client)
 	duration := time.Since(start)
 
 	if err != nil {
-		s.logger.Error("failed to list registries", "error", err)
-		return nil, err
+		s.logger.Error("failed to list registries", "region", region, "error", err)
+		return nil, fmt.Errorf("region %s: %w", region, sdkError(response, err))
+	}
+	s.logger.Info("listed registries", "region", region, "count", len(registries), "duration", duration)
+
+	result := make([]*Registry, 0, len(registries))
+	for _, r := range registries {
+		result = append(result, &Registry{Registry: r, Region: region})
 	}
-	s.logger.Info("listed registries", "count", len(registries), "duration", duration)
-	return registries, nil
+	return result, nil
 }
 
 // DeleteRegistry deletes the registry.
 func (s *Service) DeleteRegistry(ctx context.Context, token string, registryID string) error {
+	ctx, cancel := s.withTimeout(ctx, false)
+	defer cancel()
 	s.logger.Info("deleting registry", "registry_id", registryID)
-	client, err := clientv1.NewCRaaSClientV1(token, s.endpoint)
+	defer s.invalidateScope(ctx, "registries")
+	defer s.invalidateScope(ctx, registryID)
+	defer s.forgetTags(ctx, registryID, "")
+	client, err := s.sdkClient(token, s.endpointFor(ctx))
 	if err != nil {
 		return fmt.Errorf("failed to create client: %w", err)
 	}
 
 	start := time.Now()
-	_, err = registry.Delete(ctx, client, registryID)
+	result, err := registry.Delete(ctx, client, registryID)
 	duration := time.Since(start)
 
 	if err != nil {
 		s.logger.Error("failed to delete registry", "registry_id", registryID, "error", err)
-		return err
+		return sdkError(result, err)
 	}
 	s.logger.Info("registry deleted", "registry_id", registryID, "duration", duration)
 	return nil
@@ -54,9 +107,11 @@ func (s *Service) DeleteRegistry(ctx context.Context, token string, registryID s
 
 // GetGCInfo returns the garbage collection size information.
 func (s *Service) GetGCInfo(ctx context.Context, token, registryID string) (*GCInfo, error) {
+	ctx, cancel := s.withTimeout(ctx, true)
+	defer cancel()
 	s.logger.Debug("getting gc info", "registry_id", registryID)
 
-	url := fmt.Sprintf("%s/registries/%s/garbage-collection/size", s.endpoint, registryID)
+	url := fmt.Sprintf("%s/registries/%s/garbage-collection/size", s.endpointFor(ctx), registryID)
 	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create request: %w", err)
@@ -64,12 +119,8 @@ func (s *Service) GetGCInfo(ctx context.Context, token, registryID string) (*GCI
 
 	req.Header.Set("X-Auth-Token", token)
 
-	httpClient := &http.Client{
-		Timeout: 5 * time.Minute,
-	}
-
 	start := time.Now()
-	resp, err := httpClient.Do(req)
+	resp, err := s.httpClient().Do(req)
 	duration := time.Since(start)
 
 	if err != nil {
@@ -79,12 +130,9 @@ func (s *Service) GetGCInfo(ctx context.Context, token, registryID string) (*GCI
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		if resp.StatusCode == http.StatusUnauthorized {
-			return nil, ErrUnauthorized
-		}
 		body, _ := io.ReadAll(resp.Body)
 		s.logger.Error("get gc info failed", "status", resp.StatusCode, "body", string(body))
-		return nil, fmt.Errorf("request failed with status: %d", resp.StatusCode)
+		return nil, statusError(resp, string(body))
 	}
 
 	var info GCInfo
@@ -99,9 +147,11 @@ func (s *Service) GetGCInfo(ctx context.Context, token, registryID string) (*GCI
 
 // StartGC initiates the garbage collection process.
 func (s *Service) StartGC(ctx context.Context, token, registryID string) error {
+	ctx, cancel := s.withTimeout(ctx, true)
+	defer cancel()
 	s.logger.Info("starting gc", "registry_id", registryID)
 
-	url := fmt.Sprintf("%s/registries/%s/garbage-collection", s.endpoint, registryID)
+	url := fmt.Sprintf("%s/registries/%s/garbage-collection", s.endpointFor(ctx), registryID)
 	req, err := http.NewRequestWithContext(ctx, "POST", url, nil)
 	if err != nil {
 		return fmt.Errorf("failed to create request: %w", err)
@@ -109,12 +159,8 @@ func (s *Service) StartGC(ctx context.Context, token, registryID string) error {
 
 	req.Header.Set("X-Auth-Token", token)
 
-	httpClient := &http.Client{
-		Timeout: 5 * time.Minute,
-	}
-
 	start := time.Now()
-	resp, err := httpClient.Do(req)
+	resp, err := s.httpClient().Do(req)
 	duration := time.Since(start)
 
 	if err != nil {
@@ -124,15 +170,12 @@ func (s *Service) StartGC(ctx context.Context, token, registryID string) error {
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusCreated {
-		if resp.StatusCode == http.StatusUnauthorized {
-			return ErrUnauthorized
-		}
 		if resp.StatusCode == http.StatusConflict {
-			return fmt.Errorf("garbage collection already in progress")
+			return statusError(resp, "garbage collection already in progress")
 		}
 		body, _ := io.ReadAll(resp.Body)
 		s.logger.Error("start gc failed", "status", resp.StatusCode, "body", string(body))
-		return fmt.Errorf("request failed with status: %d", resp.StatusCode)
+		return statusError(resp, string(body))
 	}
 
 	s.logger.Info("gc started", "registry_id", registryID, "duration", duration)
@@ -3,6 +3,7 @@ package craas
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"log/slog"
 	"net/http"
 	"net/http/httptest"
@@ -91,8 +92,8 @@ func TestService_StartGC_Conflict(t *testing.T) {
 	if err == nil {
 		t.Fatal("expected error, got nil")
 	}
-	if err.Error() != "garbage collection already in progress" {
-		t.Errorf("expected 'garbage collection already in progress', got '%s'", err.Error())
+	if !errors.Is(err, ErrConflict) {
+		t.Errorf("expected ErrConflict, got %v", err)
 	}
 }
 
@@ -113,7 +114,7 @@ func TestService_StartGC_Unauthorized(t *testing.T) {
 	if err == nil {
 		t.Fatal("expected error, got nil")
 	}
-	if err != ErrUnauthorized {
+	if !errors.Is(err, ErrUnauthorized) {
 		t.Errorf("expected ErrUnauthorized, got %v", err)
 	}
 }
@@ -135,8 +136,8 @@ func TestService_StartGC_GenericError(t *testing.T) {
 	if err == nil {
 		t.Fatal("expected error, got nil")
 	}
-	expected := "request failed with status: 500"
-	if err.Error() != expected {
-		t.Errorf("expected '%s', got '%s'", expected, err.Error())
+	var e *Error
+	if !errors.As(err, &e) || e.Kind != ErrUpstream || e.Status != http.StatusInternalServerError {
+		t.Errorf("expected ErrUpstream with status 500, got %v", err)
 	}
 }
@@ -10,25 +10,32 @@ import (
 	"net/url"
 	"time"
 
-	clientv1 "github.com/selectel/craas-go/pkg/v1/client"
 	"github.com/selectel/craas-go/pkg/v1/repository"
 )
 
 // ListRepositories returns a list of repositories in the registry.
 func (s *Service) ListRepositories(ctx context.Context, token string, registryID string) ([]*repository.Repository, error) {
+	return cachedList(ctx, s.cache, []string{registryID, "repositories"}, func() ([]*repository.Repository, error) {
+		return s.listRepositories(ctx, token, registryID)
+	})
+}
+
+func (s *Service) listRepositories(ctx context.Context, token string, registryID string) ([]*repository.Repository, error) {
+	ctx, cancel := s.withTimeout(ctx, false)
+	defer cancel()
 	s.logger.Debug("listing repositories", "registry_id", registryID)
-	client, err := clientv1.NewCRaaSClientV1(token, s.endpoint)
+	client, err := s.sdkClient(token, s.endpointFor(ctx))
 	if err != nil {
 		return nil, fmt.Errorf("failed to create client: %w", err)
 	}
 
 	start := time.Now()
-	repos, _, err := repository.ListRepositories(ctx, client, registryID)
+	repos, result, err := repository.ListRepositories(ctx, client, registryID)
 	duration := time.Since(start)
 
 	if err != nil {
 		s.logger.Error("failed to list repositories", "registry_id", registryID, "error", err)
-		return nil, err
+		return nil, sdkError(result, err)
 	}
 	s.logger.Info("listed repositories", "registry_id", registryID, "count", len(repos), "duration", duration)
 	return repos, nil
@@ -36,8 +43,13 @@ func (s *Service) ListRepositories(ctx context.Context, token string, registryID
 
 // DeleteRepository deletes the repository.
 func (s *Service) DeleteRepository(ctx context.Context, token string, registryID, repoName string) error {
+	ctx, cancel := s.withTimeout(ctx, false)
+	defer cancel()
 	s.logger.Info("deleting repository", "registry_id", registryID, "repository", repoName)
-	client, err := clientv1.NewCRaaSClientV1(token, s.endpoint)
+	defer s.invalidateScope(ctx, registryID, "repositories")
+	defer s.invalidateScope(ctx, registryID, repoName)
+	defer s.forgetTags(ctx, registryID, repoName)
+	client, err := s.sdkClient(token, s.endpointFor(ctx))
 	if err != nil {
 		return fmt.Errorf("failed to create client: %w", err)
 	}
@@ -45,12 +57,12 @@ func (s *Service) DeleteRepository(ctx context.Context, token string, registryID
 	encodedRepoName := url.PathEscape(repoName)
 
 	start := time.Now()
-	_, err = repository.DeleteRepository(ctx, client, registryID, encodedRepoName)
+	result, err := repository.DeleteRepository(ctx, client, registryID, encodedRepoName)
 	duration := time.Since(start)
 
 	if err != nil {
 		s.logger.Error("failed to delete repository", "registry_id", registryID, "repository", repoName, "error", err)
-		return err
+		return sdkError(result, err)
 	}
 	s.logger.Info("repository deleted", "registry_id", registryID, "repository", repoName, "duration", duration)
 	return nil
@@ -58,11 +70,16 @@ func (s *Service) DeleteRepository(ctx context.Context, token string, registryID
 
 // CleanupRepository cleans up the repository.
 func (s *Service) CleanupRepository(ctx context.Context, token, registryID, repoName string, digests []string, disableGC bool) (*CleanupResult, error) {
+	ctx, cancel := s.withTimeout(ctx, true)
+	defer cancel()
 	s.logger.Info("cleaning up repository", "registry_id", registryID, "repository", repoName, "digest_count", len(digests), "disable_gc", disableGC)
+	// Some digests may be gone even if the cleanup fails
+	defer s.invalidateScope(ctx, registryID, repoName)
+	defer s.forgetTags(ctx, registryID, repoName)
 
 	encodedRepoName := url.PathEscape(repoName)
 	encodedRegistryID := url.PathEscape(registryID)
-	cleanupUrl := fmt.Sprintf("%s/registries/%s/repositories/%s/cleanup", s.endpoint, encodedRegistryID, encodedRepoName)
+	cleanupUrl := fmt.Sprintf("%s/registries/%s/repositories/%s/cleanup", s.endpointFor(ctx), encodedRegistryID, encodedRepoName)
 
 	reqBody := CleanupRequest{
 		Digests:   digests,
@@ -82,13 +99,8 @@ func (s *Service) CleanupRepository(ctx context.Context, token, registryID, repo
 	req.Header.Set("X-Auth-Token", token)
 	req.Header.Set("Content-Type", "application/json")
 
-	// Use a client with appropriate timeout
-	httpClient := &http.Client{
-		Timeout: 60 * time.Second, // Increased timeout for potentially long-running cleanup
-	}
-
 	start := time.Now()
-	resp, err := httpClient.Do(req)
+	resp, err := s.httpClient().Do(req)
 	duration := time.Since(start)
 
 	if err != nil {
@@ -100,7 +112,7 @@ func (s *Service) CleanupRepository(ctx context.Context, token, registryID, repo
 	if resp.StatusCode != http.StatusOK {
 		body, _ := io.ReadAll(resp.Body)
 		s.logger.Error("cleanup request failed", "status", resp.StatusCode, "body", string(body))
-		return nil, fmt.Errorf("cleanup request failed with status: %d", resp.StatusCode)
+		return nil, statusError(resp, string(body))
 	}
 
 	var result CleanupResult
@@ -1,25 +1,90 @@
 package craas
 
 import (
+	"context"
 	"log/slog"
+	"net/http"
 	"regexp"
+	"time"
 
 	"github.com/generic/selectel-craas-web/internal/config"
+	"github.com/generic/selectel-craas-web/internal/resilience"
+	clientv1 "github.com/selectel/craas-go/pkg/v1/client"
 )
 
 // digestRegex matches standard SHA256 digests.
 var digestRegex = regexp.MustCompile(`^sha256:[a-f0-9]{64}$`)
 
+// digestTimeout bounds each manifest request when resolving missing tags.
+const digestTimeout = 10 * time.Second
+
+// defaultDigestWorkers bounds parallel manifest requests per listing when
+// UPSTREAM_MAX_CONCURRENCY_PER_PROJECT is unlimited.
+const defaultDigestWorkers = 5
+
 type Service struct {
-	endpoint               string
+	endpoint               string // Default region
+	regions                *regionMap
+	cache                  *listCache   // Nil when CACHE_TTL is 0
+	HTTPClient             *http.Client // Shared outbound client, see the transport package
+	clients                *clientPool
+	Tags                   *TagIndex // Digests of tags missing from image listings
+	timeout                time.Duration
+	longTimeout            time.Duration // Cleanup and garbage collection
 	logger                 *slog.Logger
 	enableMissingTagsCheck bool
+	digestWorkers          int // Parallel manifest requests per listing
 }
 
 func New(cfg *config.Config, logger *slog.Logger) *Service {
+	tags, _ := NewTagIndex("", cfg.TagIndexMaxAge, logger) // In memory until main sets a persistent one
 	return &Service{
 		endpoint:               cfg.SelectelCraasURL,
+		regions:                newRegionMap(cfg),
+		cache:                  newListCache(cfg.CacheTTL),
+		clients:                newClientPool(),
+		Tags:                   tags,
+		timeout:                cfg.UpstreamTimeout,
+		longTimeout:            cfg.UpstreamLongTimeout,
 		logger:                 logger.With("service", "craas"),
 		enableMissingTagsCheck: cfg.EnableMissingTagsCheck,
+		digestWorkers:          cfg.UpstreamMaxConcurrencyPerProject,
+	}
+}
+
+// sdkClient returns the pooled craas-go client for token and endpoint, which
+// uses the shared transport.
+func (s *Service) sdkClient(token, endpoint string) (*clientv1.ServiceClient, error) {
+	if s.clients == nil {
+		return clientv1.NewCRaaSClientV1WithCustomHTTP(s.httpClient(), token, endpoint)
+	}
+	return s.clients.get(s.httpClient(), token, endpoint)
+}
+
+// RetireToken drops the clients made for a token that is no longer used.
+// Set it as the Retired hook of the auth clients.
+func (s *Service) RetireToken(token string) {
+	if s.clients != nil {
+		s.clients.retire(token)
+	}
+}
+
+func (s *Service) httpClient() *http.Client {
+	if s.HTTPClient != nil {
+		return s.HTTPClient
+	}
+	return http.DefaultClient
+}
+
+// withTimeout bounds one operation by UPSTREAM_TIMEOUT, or by
+// UPSTREAM_LONG_TIMEOUT for long ones. Cancelling the request cancels it too.
+func (s *Service) withTimeout(ctx context.Context, long bool) (context.Context, context.CancelFunc) {
+	d := s.timeout
+	if long {
+		d = s.longTimeout
+	}
+	if d <= 0 {
+		return context.WithCancel(ctx)
 	}
+	return resilience.WithTimeout(ctx, d)
 }
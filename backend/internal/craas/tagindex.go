@@ -0,0 +1,286 @@
+package craas
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/generic/selectel-craas-web/internal/state"
+	"github.com/selectel/craas-go/pkg/v1/repository"
+)
+
+// TagIndex remembers the digests found for tags that image listings omit,
+// so that the missing-tags check only resolves tags that are new or changed.
+// It is kept in memory and optionally persisted to a JSON file.
+type TagIndex struct {
+	mu     sync.Mutex
+	repos  map[string]*repoTags // Keyed by registry ID and repository name
+	path   string
+	maxAge time.Duration
+	shared state.Store
+	logger *slog.Logger
+	now    func() time.Time
+}
+
+// sharedTimeout bounds the calls to the state store that outlive a request.
+const sharedTimeout = 5 * time.Second
+
+// repoTags is the index of one repository.
+type repoTags struct {
+	// Fingerprint of the image listing the entries were verified against.
+	// While it is unchanged no listed image was pushed, deleted or retagged,
+	// so the entries are trusted until maxAge.
+	Fingerprint string              `json:"fingerprint"`
+	Tags        map[string]tagEntry `json:"tags"`
+}
+
+type tagEntry struct {
+	Manifest   string    `json:"manifest,omitempty"` // Docker-Content-Digest of the tag's manifest
+	Digests    []string  `json:"digests"`
+	VerifiedAt time.Time `json:"verifiedAt"`
+}
+
+// NewTagIndex creates an index. If path is not empty, the index is loaded
+// from it and every change is written back. An unreadable file is discarded,
+// since the index can always be rebuilt.
+func NewTagIndex(path string, maxAge time.Duration, logger *slog.Logger) (*TagIndex, error) {
+	idx := &TagIndex{
+		repos:  make(map[string]*repoTags),
+		path:   path,
+		maxAge: maxAge,
+		logger: logger,
+		now:    time.Now,
+	}
+	if path == "" {
+		return idx, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return idx, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &idx.repos); err != nil {
+		logger.Warn("discarding unreadable tag index", "path", path, "error", err)
+		idx.repos = make(map[string]*repoTags)
+	}
+	return idx, nil
+}
+
+// Share keeps the index in st instead of the file, so that every replica
+// uses what any of them verified. It must be called before the index is used.
+func (idx *TagIndex) Share(st state.Store) {
+	idx.shared = st
+}
+
+func tagIndexKey(registryID, repoName string) string {
+	return registryID + "/" + repoName
+}
+
+// fingerprint identifies the content of an image listing: its digests and
+// the tags of each.
+func fingerprint(images []*repository.Image) string {
+	lines := make([]string, 0, len(images))
+	for _, img := range images {
+		tags := slices.Clone(img.Tags)
+		slices.Sort(tags)
+		lines = append(lines, img.Digest+" "+strings.Join(tags, ","))
+	}
+	slices.Sort(lines)
+	sum := sha256.Sum256([]byte(strings.Join(lines, "\n")))
+	return hex.EncodeToString(sum[:])
+}
+
+// repo returns the index of a repository, or nil. It must not be modified.
+// A shared index that cannot be read is treated as empty.
+func (idx *TagIndex) repo(ctx context.Context, registryID, repoName string) *repoTags {
+	if idx == nil {
+		return nil
+	}
+	key := tagIndexKey(registryID, repoName)
+	if idx.shared != nil {
+		data, err := idx.shared.Get(ctx, "tagindex/"+key)
+		if err != nil {
+			if !errors.Is(err, state.ErrNotFound) {
+				idx.logger.Warn("failed to read shared tag index", "error", err)
+			}
+			return nil
+		}
+		var repo repoTags
+		if json.Unmarshal(data, &repo) != nil {
+			return nil
+		}
+		return &repo
+	}
+
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	return idx.repos[key] // Replaced, never changed, by update
+}
+
+// lookup returns the entry of a tag in repo. fresh reports whether it can be
+// used without asking the registry: the listing is unchanged and the entry is
+// younger than maxAge. Otherwise the entry's manifest digest must be checked.
+func (idx *TagIndex) lookup(repo *repoTags, fp, tag string) (entry tagEntry, found, fresh bool) {
+	if repo == nil {
+		return tagEntry{}, false, false
+	}
+	entry, found = repo.Tags[tag]
+	if !found {
+		return tagEntry{}, false, false
+	}
+	fresh = repo.Fingerprint == fp && (idx.maxAge <= 0 || idx.now().Sub(entry.VerifiedAt) < idx.maxAge)
+	return entry, true, fresh
+}
+
+// errUnchanged leaves a shared index entry as it is.
+var errUnchanged = errors.New("tag index unchanged")
+
+// update records the entries just verified against the listing fp. Earlier
+// entries are kept only if they were verified against the same listing, and
+// tags that no longer exist are dropped.
+func (idx *TagIndex) update(ctx context.Context, registryID, repoName, fp string, tags []string, verified map[string]tagEntry) error {
+	if idx == nil {
+		return nil
+	}
+	key := tagIndexKey(registryID, repoName)
+	if idx.shared != nil {
+		// Also record what was verified when the request ended meanwhile
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), sharedTimeout)
+		defer cancel()
+		err := idx.shared.Update(ctx, "tagindex/"+key, func(data []byte) ([]byte, time.Duration, error) {
+			var old *repoTags
+			if data != nil && json.Unmarshal(data, &old) != nil {
+				old = nil
+			}
+			repo, changed := idx.merge(old, fp, tags, verified)
+			if !changed {
+				return nil, 0, errUnchanged
+			}
+			if repo == nil {
+				return nil, 0, nil
+			}
+			data, err := json.Marshal(repo)
+			return data, idx.sharedTTL(), err
+		})
+		if errors.Is(err, errUnchanged) {
+			return nil
+		}
+		return err
+	}
+
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	repo, changed := idx.merge(idx.repos[key], fp, tags, verified)
+	if !changed {
+		return nil
+	}
+	if repo == nil {
+		delete(idx.repos, key)
+	} else {
+		idx.repos[key] = repo
+	}
+	return idx.saveLocked()
+}
+
+// merge returns the index of a repository after update, or nil if it has no
+// entries left, and whether it differs from old.
+func (idx *TagIndex) merge(old *repoTags, fp string, tags []string, verified map[string]tagEntry) (*repoTags, bool) {
+	if old != nil && old.Fingerprint != fp {
+		old = nil
+	}
+	if old == nil && len(verified) == 0 {
+		return nil, false // Nothing was known and nothing was learned
+	}
+
+	repo := &repoTags{Fingerprint: fp, Tags: make(map[string]tagEntry)}
+	for _, tag := range tags {
+		if e, ok := verified[tag]; ok {
+			e.VerifiedAt = idx.now()
+			repo.Tags[tag] = e
+		} else if old != nil {
+			if e, ok := old.Tags[tag]; ok {
+				repo.Tags[tag] = e
+			}
+		}
+	}
+	if old != nil && len(verified) == 0 && len(repo.Tags) == len(old.Tags) {
+		return old, false // Unchanged
+	}
+	if len(repo.Tags) == 0 {
+		return nil, true
+	}
+	return repo, true
+}
+
+// sharedTTL is how long a repository is kept in the shared index after it
+// was last updated, or 0 to keep it when entries never age. Older entries
+// would be checked anyway, and registries that were deleted drop out of the
+// index this way.
+func (idx *TagIndex) sharedTTL() time.Duration {
+	return 2 * idx.maxAge
+}
+
+// invalidate forgets a repository, or every repository of the registry when
+// repoName is empty.
+func (idx *TagIndex) invalidate(ctx context.Context, registryID, repoName string) error {
+	if idx == nil {
+		return nil
+	}
+	if idx.shared != nil {
+		if repoName == "" {
+			return nil // Registry IDs are not reused, so its entries just expire
+		}
+		return idx.shared.Delete(ctx, "tagindex/"+tagIndexKey(registryID, repoName))
+	}
+
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	for key := range idx.repos {
+		if key == tagIndexKey(registryID, repoName) || (repoName == "" && strings.HasPrefix(key, registryID+"/")) {
+			delete(idx.repos, key)
+		}
+	}
+	return idx.saveLocked()
+}
+
+func (idx *TagIndex) saveLocked() error {
+	if idx.path == "" {
+		return nil
+	}
+
+	data, err := json.Marshal(idx.repos)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(idx.path), 0o700); err != nil {
+		return err
+	}
+	tmp := idx.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, idx.path)
+}
+
+// forgetTags drops the tag index of a repository, or of every repository of
+// the registry when repoName is empty, after its images changed.
+func (s *Service) forgetTags(ctx context.Context, registryID, repoName string) {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), sharedTimeout)
+	defer cancel()
+	if err := s.Tags.invalidate(ctx, registryID, repoName); err != nil {
+		s.logger.Warn("failed to save tag index", "error", err)
+	}
+}
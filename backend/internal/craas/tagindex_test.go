@@ -0,0 +1,268 @@
+package craas
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/generic/selectel-craas-web/internal/state"
+	"github.com/selectel/craas-go/pkg/v1/repository"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTagIndex(t *testing.T) {
+	hApp := "sha256:a1a1a1a1a1a1a1a1a1a1a1a1a1a1a1a1a1a1a1a1a1a1a1a1a1a1a1a1a1a1a1a1"
+	hOld := "sha256:b2b2b2b2b2b2b2b2b2b2b2b2b2b2b2b2b2b2b2b2b2b2b2b2b2b2b2b2b2b2b2b2"
+	hNew := "sha256:c3c3c3c3c3c3c3c3c3c3c3c3c3c3c3c3c3c3c3c3c3c3c3c3c3c3c3c3c3c3c3c3"
+
+	var mu sync.Mutex
+	listing := `[{"digest": "` + hApp + `", "tags": ["v1"]}]`
+	target := hOld // The manifest digest is the image digest
+	var gets, heads atomic.Int32
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/images"):
+			w.Write([]byte(listing))
+		case strings.HasSuffix(r.URL.Path, "/tags"):
+			w.Write([]byte(`["v1", "latest"]`))
+		case strings.HasSuffix(r.URL.Path, "/cleanup"):
+			w.Write([]byte(`{"deleted": [], "failed": []}`))
+		case strings.HasSuffix(r.URL.Path, "/latest"):
+			w.Header().Set("Docker-Content-Digest", target)
+			if r.Method == "HEAD" {
+				heads.Add(1)
+				return
+			}
+			gets.Add(1)
+			w.Write([]byte(`{"digest": "` + target + `"}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer ts.Close()
+
+	path := filepath.Join(t.TempDir(), "tag_index.json")
+	idx, err := NewTagIndex(path, time.Hour, testLogger)
+	require.NoError(t, err)
+	now := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+	idx.now = func() time.Time { return now }
+
+	svc := &Service{endpoint: ts.URL + "/v1", logger: testLogger, enableMissingTagsCheck: true, Tags: idx}
+	latest := func() string {
+		t.Helper()
+		images, err := svc.ListImages(context.Background(), "token", "reg1", "app")
+		require.NoError(t, err)
+		for _, img := range images {
+			for _, tag := range img.Tags {
+				if tag == "latest" {
+					return img.Digest
+				}
+			}
+		}
+		return ""
+	}
+	set := func(fn func()) {
+		mu.Lock()
+		defer mu.Unlock()
+		fn()
+	}
+
+	assert.Equal(t, hOld, latest())
+	assert.Equal(t, int32(1), gets.Load(), "a new tag is resolved")
+
+	assert.Equal(t, hOld, latest())
+	assert.Equal(t, int32(1), gets.Load(), "an unchanged repository needs no requests")
+	assert.Equal(t, int32(0), heads.Load())
+
+	// Something was pushed, but the tag still points to the same manifest
+	set(func() {
+		listing = `[{"digest": "` + hApp + `", "tags": ["v1"]}, {"digest": "` + hNew + `", "tags": []}]`
+	})
+	assert.Equal(t, hOld, latest())
+	assert.Equal(t, int32(1), heads.Load(), "the manifest digest is checked")
+	assert.Equal(t, int32(1), gets.Load())
+
+	// The tag moved
+	set(func() {
+		listing = `[{"digest": "` + hApp + `", "tags": ["v1"]}]`
+		target = hNew
+	})
+	assert.Equal(t, hNew, latest())
+	assert.Equal(t, int32(2), heads.Load())
+	assert.Equal(t, int32(2), gets.Load(), "a changed tag is resolved again")
+
+	// Entries are re-checked after maxAge even if nothing changed
+	now = now.Add(2 * time.Hour)
+	assert.Equal(t, hNew, latest())
+	assert.Equal(t, int32(3), heads.Load())
+	assert.Equal(t, int32(2), gets.Load())
+
+	// The index survives a restart
+	restarted, err := NewTagIndex(path, time.Hour, testLogger)
+	require.NoError(t, err)
+	restarted.now = idx.now
+	svc.Tags = restarted
+	assert.Equal(t, hNew, latest())
+	assert.Equal(t, int32(2), gets.Load())
+	assert.Equal(t, int32(3), heads.Load())
+
+	// A cleanup forgets the repository
+	_, err = svc.CleanupRepository(context.Background(), "token", "reg1", "app", []string{hApp}, true)
+	require.NoError(t, err)
+	assert.Equal(t, hNew, latest())
+	assert.Equal(t, int32(3), gets.Load())
+}
+
+func TestTagIndex_NoManifestDigest(t *testing.T) {
+	hApp := "sha256:a1a1a1a1a1a1a1a1a1a1a1a1a1a1a1a1a1a1a1a1a1a1a1a1a1a1a1a1a1a1a1a1"
+	hOld := "sha256:b2b2b2b2b2b2b2b2b2b2b2b2b2b2b2b2b2b2b2b2b2b2b2b2b2b2b2b2b2b2b2b2"
+	hNew := "sha256:c3c3c3c3c3c3c3c3c3c3c3c3c3c3c3c3c3c3c3c3c3c3c3c3c3c3c3c3c3c3c3c3"
+
+	var mu sync.Mutex
+	listing := `[{"digest": "` + hApp + `", "tags": ["v1"]}]`
+	target := hOld
+	var gets, heads atomic.Int32
+
+	// The registry does not report Docker-Content-Digest
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/images"):
+			w.Write([]byte(listing))
+		case strings.HasSuffix(r.URL.Path, "/tags"):
+			w.Write([]byte(`["v1", "latest"]`))
+		case strings.HasSuffix(r.URL.Path, "/latest"):
+			if r.Method == "HEAD" {
+				heads.Add(1)
+				return
+			}
+			gets.Add(1)
+			w.Write([]byte(`{"digest": "` + target + `"}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer ts.Close()
+
+	idx, err := NewTagIndex("", time.Hour, testLogger)
+	require.NoError(t, err)
+	svc := &Service{endpoint: ts.URL + "/v1", logger: testLogger, enableMissingTagsCheck: true, Tags: idx}
+	latest := func() string {
+		t.Helper()
+		images, err := svc.ListImages(context.Background(), "token", "reg1", "app")
+		require.NoError(t, err)
+		for _, img := range images {
+			if slices.Contains(img.Tags, "latest") {
+				return img.Digest
+			}
+		}
+		return ""
+	}
+
+	assert.Equal(t, hOld, latest())
+	assert.Equal(t, int32(1), gets.Load())
+
+	// The tag moved and the listing changed: the entry cannot be checked with
+	// HEAD, so the digests are fetched again
+	mu.Lock()
+	listing = `[{"digest": "` + hApp + `", "tags": ["v1"]}, {"digest": "` + hNew + `", "tags": []}]`
+	target = hNew
+	mu.Unlock()
+	assert.Equal(t, hNew, latest())
+	assert.Equal(t, int32(2), gets.Load())
+	assert.Equal(t, int32(0), heads.Load())
+}
+
+func TestFingerprint(t *testing.T) {
+	a := &repository.Image{Digest: "sha256:a", Tags: []string{"v1", "v2"}}
+	b := &repository.Image{Digest: "sha256:b", Tags: []string{"v3"}}
+	fp := fingerprint([]*repository.Image{a, b})
+
+	reordered := &repository.Image{Digest: "sha256:a", Tags: []string{"v2", "v1"}}
+	assert.Equal(t, fp, fingerprint([]*repository.Image{b, reordered}), "order does not matter")
+
+	// A tag moved onto another listed image
+	moved := &repository.Image{Digest: "sha256:b", Tags: []string{"v3", "v2"}}
+	assert.NotEqual(t, fp, fingerprint([]*repository.Image{{Digest: "sha256:a", Tags: []string{"v1"}}, moved}))
+}
+
+func TestTagIndex_Unreadable(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tag_index.json")
+	require.NoError(t, os.WriteFile(path, []byte("not json"), 0o600))
+
+	idx, err := NewTagIndex(path, time.Hour, testLogger)
+	require.NoError(t, err, "a broken index is rebuilt rather than fatal")
+	_, found, _ := idx.lookup(idx.repo(t.Context(), "reg1", "app"), "", "latest")
+	assert.False(t, found)
+}
+
+func TestTagIndex_Shared(t *testing.T) {
+	hApp := "sha256:a1a1a1a1a1a1a1a1a1a1a1a1a1a1a1a1a1a1a1a1a1a1a1a1a1a1a1a1a1a1a1a1"
+	hOld := "sha256:b2b2b2b2b2b2b2b2b2b2b2b2b2b2b2b2b2b2b2b2b2b2b2b2b2b2b2b2b2b2b2b2"
+
+	var gets atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/images"):
+			w.Write([]byte(`[{"digest": "` + hApp + `", "tags": ["v1"]}]`))
+		case strings.HasSuffix(r.URL.Path, "/tags"):
+			w.Write([]byte(`["v1", "latest"]`))
+		case strings.HasSuffix(r.URL.Path, "/latest"):
+			w.Header().Set("Docker-Content-Digest", hOld)
+			gets.Add(1)
+			w.Write([]byte(`{"digest": "` + hOld + `"}`))
+		case r.Method == "DELETE":
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer ts.Close()
+
+	// Two replicas sharing one Redis
+	mr := miniredis.RunT(t)
+	newReplica := func() *Service {
+		st, err := state.NewRedis("redis://"+mr.Addr(), "test:")
+		require.NoError(t, err)
+		t.Cleanup(func() { st.Close() })
+		idx, err := NewTagIndex("", time.Hour, testLogger)
+		require.NoError(t, err)
+		idx.Share(st)
+		return &Service{endpoint: ts.URL + "/v1", logger: testLogger, enableMissingTagsCheck: true, Tags: idx}
+	}
+	a, b := newReplica(), newReplica()
+	latest := func(svc *Service) string {
+		t.Helper()
+		images, err := svc.ListImages(context.Background(), "token", "reg1", "app")
+		require.NoError(t, err)
+		for _, img := range images {
+			if slices.Contains(img.Tags, "latest") {
+				return img.Digest
+			}
+		}
+		return ""
+	}
+
+	assert.Equal(t, hOld, latest(a))
+	assert.Equal(t, hOld, latest(b))
+	assert.Equal(t, int32(1), gets.Load(), "a tag resolved by one replica is known to the other")
+
+	// A deletion through one replica drops the repository for both
+	require.NoError(t, b.DeleteImage(context.Background(), "token", "reg1", "app", hOld))
+	assert.Equal(t, hOld, latest(a))
+	assert.Equal(t, int32(2), gets.Load())
+}
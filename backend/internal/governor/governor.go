@@ -0,0 +1,279 @@
+// Package governor limits how many calls to Selectel run at once, process
+// wide and per project, and lets interactive requests overtake background work.
+package governor
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Priority orders requests waiting for a slot.
+type Priority int
+
+const (
+	Interactive Priority = iota // A user is waiting for the result
+	Background                  // Jobs nobody is waiting on
+	numPriorities
+)
+
+func (p Priority) String() string {
+	if p == Background {
+		return "background"
+	}
+	return "interactive"
+}
+
+type projectKey struct{}
+type priorityKey struct{}
+
+// WithProject counts calls made with ctx against the project's cap.
+func WithProject(ctx context.Context, projectID string) context.Context {
+	return context.WithValue(ctx, projectKey{}, projectID)
+}
+
+// WithPriority sets the priority of calls made with ctx. The default is Interactive.
+func WithPriority(ctx context.Context, p Priority) context.Context {
+	return context.WithValue(ctx, priorityKey{}, p)
+}
+
+// Options configures a Governor. Zero values mean no limit.
+type Options struct {
+	Global     int // Calls in flight across the process
+	PerProject int // Calls in flight for one project
+}
+
+// Governor is an http.RoundTripper that holds each call until a slot is free.
+// A slot is taken until the response headers arrive.
+type Governor struct {
+	next http.RoundTripper
+	opts Options
+	now  func() time.Time
+
+	mu         sync.Mutex
+	inFlight   int
+	perProject map[string]int
+	queue      []*waiter // By priority, then arrival
+	stats      [numPriorities]priorityStats
+}
+
+type waiter struct {
+	project  string
+	priority Priority
+	ready    chan struct{} // Closed when the slot is granted
+	granted  bool
+}
+
+type priorityStats struct {
+	acquired  int64
+	waited    int64
+	canceled  int64
+	waitTotal time.Duration
+	waitMax   time.Duration
+}
+
+// New wraps next, or http.DefaultTransport when next is nil.
+func New(next http.RoundTripper, opts Options) *Governor {
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	return &Governor{
+		next:       next,
+		opts:       opts,
+		now:        time.Now,
+		perProject: make(map[string]int),
+	}
+}
+
+// RoundTrip implements http.RoundTripper.
+func (g *Governor) RoundTrip(req *http.Request) (*http.Response, error) {
+	release, err := g.Acquire(req.Context())
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	return g.next.RoundTrip(req)
+}
+
+// Acquire waits for a slot for the project and priority in ctx. The returned
+// function frees it; it must be called exactly once.
+func (g *Governor) Acquire(ctx context.Context) (func(), error) {
+	project, _ := ctx.Value(projectKey{}).(string)
+	priority, _ := ctx.Value(priorityKey{}).(Priority)
+	if priority < 0 || priority >= numPriorities {
+		priority = Interactive
+	}
+
+	start := g.now()
+	w := &waiter{project: project, priority: priority, ready: make(chan struct{})}
+	g.mu.Lock()
+	g.enqueueLocked(w)
+	g.dispatchLocked()
+	queued := !w.granted
+	g.mu.Unlock()
+
+	select {
+	case <-w.ready:
+	case <-ctx.Done():
+		g.mu.Lock()
+		if !w.granted {
+			g.removeLocked(w)
+			g.stats[priority].canceled++
+			g.mu.Unlock()
+			return nil, ctx.Err()
+		}
+		g.mu.Unlock()
+		// Granted at the same time: keep the slot, the caller will fail fast anyway.
+	}
+
+	wait := g.now().Sub(start)
+	g.mu.Lock()
+	st := &g.stats[priority]
+	st.acquired++
+	if queued {
+		st.waited++
+		st.waitTotal += wait
+		st.waitMax = max(st.waitMax, wait)
+	}
+	g.mu.Unlock()
+
+	var once sync.Once
+	return func() { once.Do(func() { g.release(project) }) }, nil
+}
+
+func (g *Governor) release(project string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.inFlight--
+	if project != "" {
+		if g.perProject[project]--; g.perProject[project] <= 0 {
+			delete(g.perProject, project)
+		}
+	}
+	g.dispatchLocked()
+}
+
+// enqueueLocked inserts w behind waiters of the same or a higher priority.
+func (g *Governor) enqueueLocked(w *waiter) {
+	i := len(g.queue)
+	for i > 0 && g.queue[i-1].priority > w.priority {
+		i--
+	}
+	g.queue = append(g.queue, nil)
+	copy(g.queue[i+1:], g.queue[i:])
+	g.queue[i] = w
+}
+
+func (g *Governor) removeLocked(w *waiter) {
+	for i, q := range g.queue {
+		if q == w {
+			g.queue = append(g.queue[:i], g.queue[i+1:]...)
+			return
+		}
+	}
+}
+
+// dispatchLocked grants free slots in queue order, skipping waiters whose
+// project is at its cap so they do not hold up other projects.
+func (g *Governor) dispatchLocked() {
+	for i := 0; i < len(g.queue); {
+		if g.opts.Global > 0 && g.inFlight >= g.opts.Global {
+			return
+		}
+		w := g.queue[i]
+		if w.project != "" && g.opts.PerProject > 0 && g.perProject[w.project] >= g.opts.PerProject {
+			i++
+			continue
+		}
+		g.queue = append(g.queue[:i], g.queue[i+1:]...)
+		g.inFlight++
+		if w.project != "" {
+			g.perProject[w.project]++
+		}
+		w.granted = true
+		close(w.ready)
+	}
+}
+
+// Stats is a snapshot of the governor's state and queue-time metrics.
+type Stats struct {
+	GlobalLimit     int             `json:"globalLimit"`     // 0 means unlimited
+	PerProjectLimit int             `json:"perProjectLimit"` // 0 means unlimited
+	InFlight        int             `json:"inFlight"`
+	Queued          int             `json:"queued"`
+	Projects        map[string]int  `json:"projects"` // Calls in flight per project
+	Priorities      []PriorityStats `json:"priorities"`
+}
+
+// PriorityStats are the queue-time metrics of one priority since startup.
+type PriorityStats struct {
+	Priority string  `json:"priority"`
+	Acquired int64   `json:"acquired"` // Calls that got a slot
+	Waited   int64   `json:"waited"`   // Of those, calls that had to queue
+	Canceled int64   `json:"canceled"` // Calls whose request ended while queued
+	Queued   int     `json:"queued"`   // Waiting now
+	AvgWait  float64 `json:"avgWaitMs"`
+	MaxWait  float64 `json:"maxWaitMs"`
+}
+
+// Stats returns the current state and metrics.
+func (g *Governor) Stats() Stats {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	s := Stats{
+		GlobalLimit:     g.opts.Global,
+		PerProjectLimit: g.opts.PerProject,
+		InFlight:        g.inFlight,
+		Queued:          len(g.queue),
+		Projects:        make(map[string]int, len(g.perProject)),
+	}
+	for project, n := range g.perProject {
+		s.Projects[project] = n
+	}
+	for p := range numPriorities {
+		st := g.stats[p]
+		ps := PriorityStats{
+			Priority: p.String(),
+			Acquired: st.acquired,
+			Waited:   st.waited,
+			Canceled: st.canceled,
+			MaxWait:  milliseconds(st.waitMax),
+		}
+		if st.waited > 0 {
+			ps.AvgWait = milliseconds(st.waitTotal / time.Duration(st.waited))
+		}
+		for _, w := range g.queue {
+			if w.priority == p {
+				ps.Queued++
+			}
+		}
+		s.Priorities = append(s.Priorities, ps)
+	}
+	return s
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// Find returns the Governor in the transport chain of c, if any. Wrapping
+// transports expose the next one with an Unwrap method.
+func Find(c *http.Client) *Governor {
+	if c == nil {
+		return nil
+	}
+	rt := c.Transport
+	for rt != nil {
+		if g, ok := rt.(*Governor); ok {
+			return g
+		}
+		u, ok := rt.(interface{ Unwrap() http.RoundTripper })
+		if !ok {
+			return nil
+		}
+		rt = u.Unwrap()
+	}
+	return nil
+}
@@ -0,0 +1,153 @@
+package governor
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// acquireAsync waits for a slot in the background and reports the label
+// once it is granted.
+func acquireAsync(ctx context.Context, g *Governor, label string, granted chan<- string) <-chan func() {
+	releases := make(chan func(), 1)
+	go func() {
+		release, err := g.Acquire(ctx)
+		if err != nil {
+			close(releases)
+			return
+		}
+		granted <- label
+		releases <- release
+	}()
+	return releases
+}
+
+func waitQueued(t *testing.T, g *Governor, n int) {
+	require.Eventually(t, func() bool { return g.Stats().Queued == n }, time.Second, time.Millisecond)
+}
+
+func TestGlobalLimit(t *testing.T) {
+	g := New(nil, Options{Global: 2})
+
+	r1, err := g.Acquire(t.Context())
+	require.NoError(t, err)
+	r2, err := g.Acquire(t.Context())
+	require.NoError(t, err)
+
+	granted := make(chan string, 1)
+	releases := acquireAsync(t.Context(), g, "third", granted)
+	waitQueued(t, g, 1)
+	assert.Equal(t, 2, g.Stats().InFlight)
+
+	r1()
+	r1() // Releasing twice frees one slot only
+	assert.Equal(t, "third", <-granted)
+	(<-releases)()
+	r2()
+
+	s := g.Stats()
+	assert.Zero(t, s.InFlight)
+	assert.Zero(t, s.Queued)
+	assert.Equal(t, int64(3), s.Priorities[Interactive].Acquired)
+	assert.Equal(t, int64(1), s.Priorities[Interactive].Waited)
+}
+
+func TestPerProjectLimit(t *testing.T) {
+	g := New(nil, Options{Global: 3, PerProject: 1})
+	a := WithProject(t.Context(), "a")
+	b := WithProject(t.Context(), "b")
+
+	ra, err := g.Acquire(a)
+	require.NoError(t, err)
+
+	granted := make(chan string, 2)
+	acquireAsync(a, g, "a", granted)
+	waitQueued(t, g, 1)
+
+	// Another project is not held up behind the waiting one
+	releases := acquireAsync(b, g, "b", granted)
+	assert.Equal(t, "b", <-granted)
+	assert.Equal(t, map[string]int{"a": 1, "b": 1}, g.Stats().Projects)
+
+	ra()
+	assert.Equal(t, "a", <-granted)
+	(<-releases)()
+}
+
+func TestInteractiveBeforeBackground(t *testing.T) {
+	g := New(nil, Options{Global: 1})
+	release, err := g.Acquire(t.Context())
+	require.NoError(t, err)
+
+	granted := make(chan string, 3)
+	bg := WithPriority(t.Context(), Background)
+	bgReleases := acquireAsync(bg, g, "background", granted)
+	waitQueued(t, g, 1)
+	first := acquireAsync(t.Context(), g, "interactive 1", granted)
+	waitQueued(t, g, 2)
+	second := acquireAsync(t.Context(), g, "interactive 2", granted)
+	waitQueued(t, g, 3)
+
+	s := g.Stats()
+	assert.Equal(t, 2, s.Priorities[Interactive].Queued)
+	assert.Equal(t, 1, s.Priorities[Background].Queued)
+
+	release()
+	assert.Equal(t, "interactive 1", <-granted)
+	(<-first)()
+	assert.Equal(t, "interactive 2", <-granted)
+	(<-second)()
+	assert.Equal(t, "background", <-granted)
+	(<-bgReleases)()
+}
+
+func TestCanceledWhileQueued(t *testing.T) {
+	g := New(nil, Options{Global: 1})
+	release, err := g.Acquire(t.Context())
+	require.NoError(t, err)
+	defer release()
+
+	ctx, cancel := context.WithTimeout(t.Context(), 10*time.Millisecond)
+	defer cancel()
+	_, err = g.Acquire(WithPriority(ctx, Background))
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+
+	s := g.Stats()
+	assert.Zero(t, s.Queued)
+	assert.Equal(t, 1, s.InFlight)
+	assert.Equal(t, int64(1), s.Priorities[Background].Canceled)
+}
+
+func TestRoundTrip(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer ts.Close()
+
+	g := New(nil, Options{Global: 1})
+	// Wrapped like the resilience transport does
+	client := &http.Client{Transport: wrapper{g}}
+	require.Same(t, g, Find(client))
+	assert.Nil(t, Find(&http.Client{}))
+
+	req, err := http.NewRequestWithContext(WithProject(t.Context(), "p"), "GET", ts.URL, nil)
+	require.NoError(t, err)
+	resp, err := client.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+
+	s := g.Stats()
+	assert.Zero(t, s.InFlight) // Released once the response arrived
+	assert.Empty(t, s.Projects)
+	assert.Equal(t, int64(1), s.Priorities[Interactive].Acquired)
+}
+
+type wrapper struct{ next http.RoundTripper }
+
+func (w wrapper) RoundTrip(req *http.Request) (*http.Response, error) { return w.next.RoundTrip(req) }
+func (w wrapper) Unwrap() http.RoundTripper                           { return w.next }
@@ -0,0 +1,436 @@
+package inventory
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/generic/selectel-craas-web/internal/auth"
+	"github.com/generic/selectel-craas-web/internal/config"
+	"github.com/generic/selectel-craas-web/internal/craas"
+	"github.com/generic/selectel-craas-web/internal/governor"
+	"github.com/generic/selectel-craas-web/internal/state"
+	"github.com/selectel/craas-go/pkg/v1/repository"
+	"golang.org/x/time/rate"
+)
+
+// Source is an account to crawl.
+type Source struct {
+	Account string // Account ID
+	Auth    auth.Authenticator
+}
+
+// Crawler walks every allowed project, registry and repository of its
+// sources with the craas.Service list methods and records them in a Store.
+// Its calls have background priority and are rate limited, so browsing
+// users are served first.
+type Crawler struct {
+	craas    *craas.Service
+	sources  []Source
+	policy   config.ProjectPolicy
+	store    *Store
+	interval time.Duration
+	limiter  *rate.Limiter
+	shared   state.Store
+	logger   *slog.Logger
+	now      func() time.Time
+
+	mu       sync.Mutex
+	progress progress
+}
+
+// progress is the state of the crawls. With a shared state store it is
+// kept there, so that every replica reports the crawls of all.
+type progress struct {
+	Running  bool      `json:"running"`
+	Started  time.Time `json:"started,omitzero"`  // Of the running or last crawl
+	Finished time.Time `json:"finished,omitzero"` // Of the last complete crawl
+	Complete time.Time `json:"complete,omitzero"` // Start of the last complete crawl
+	Next     time.Time `json:"next,omitzero"`
+}
+
+// Keys of the crawl lock and progress in the shared state store.
+const (
+	crawlLockKey  = "inventory/crawl"
+	progressKey   = "inventory/progress"
+	crawlLockTTL  = time.Minute // Extended while crawling
+	sharedTimeout = 5 * time.Second
+)
+
+// NewCrawler creates a crawler that pauses INVENTORY_INTERVAL between crawls
+// and makes at most INVENTORY_RATE listing calls per minute.
+func NewCrawler(cfg *config.Config, svc *craas.Service, sources []Source, store *Store, logger *slog.Logger) *Crawler {
+	return &Crawler{
+		craas:    svc,
+		sources:  sources,
+		policy:   cfg.Projects,
+		store:    store,
+		interval: cfg.InventoryInterval,
+		limiter:  rate.NewLimiter(rate.Every(time.Minute/time.Duration(max(cfg.InventoryRate, 1))), 1),
+		logger:   logger.With("service", "inventory"),
+		now:      time.Now,
+	}
+}
+
+// Share keeps the inventory and the crawl progress in st, and makes the
+// replicas sharing it take turns: only one crawls at a time, and a crawl is
+// skipped when another replica finished one less than INVENTORY_INTERVAL ago.
+// It must be called before the crawler is used.
+func (c *Crawler) Share(st state.Store) {
+	c.shared = st
+	c.store.Share(st)
+}
+
+// Run crawls right away and then again INVENTORY_INTERVAL after each crawl,
+// until ctx is done.
+func (c *Crawler) Run(ctx context.Context) {
+	for {
+		c.Crawl(ctx)
+		wait := c.interval
+		if c.shared != nil {
+			// The next crawl is due INVENTORY_INTERVAL after the last one of
+			// any replica. If one is running, check again after its lock
+			// would have expired.
+			p := c.loadProgress(ctx)
+			wait = max(p.Finished.Add(c.interval).Sub(c.now()), crawlLockTTL)
+		}
+
+		c.setProgress(ctx, func(p *progress) { p.Next = c.now().Add(wait) })
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+// Crawl updates the inventory of every source once. With a shared state
+// store, it does nothing while another replica crawls or when a crawl is not
+// due yet.
+func (c *Crawler) Crawl(ctx context.Context) {
+	if c.shared != nil {
+		release, err := state.TryHold(ctx, c.shared, crawlLockKey, crawlLockTTL)
+		if errors.Is(err, state.ErrLocked) {
+			c.logger.Debug("another replica is crawling the inventory")
+			return
+		}
+		if err != nil {
+			c.logger.Warn("failed to lock inventory crawl", "error", err)
+			return
+		}
+		defer release()
+
+		if p := c.loadProgress(ctx); c.now().Before(p.Finished.Add(c.interval)) {
+			c.logger.Debug("inventory was crawled recently by another replica", "finished", p.Finished)
+			return
+		}
+		// Continue from the inventory of the last crawl, whichever replica made it
+		if err := c.store.load(ctx); err != nil {
+			c.logger.Warn("failed to load shared inventory", "error", err)
+			return
+		}
+	}
+
+	start := c.now()
+	c.setProgress(ctx, func(p *progress) {
+		p.Running = true
+		p.Started = start
+	})
+	c.logger.Info("inventory crawl started", "accounts", len(c.sources))
+
+	ctx = governor.WithPriority(ctx, governor.Background)
+	for _, src := range c.sources {
+		if err := c.crawlAccount(ctx, src); err != nil {
+			c.logger.Warn("failed to crawl account", "account", src.Account, "error", err)
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+
+	complete := ctx.Err() == nil
+	finished := c.now()
+	c.setProgress(context.WithoutCancel(ctx), func(p *progress) {
+		p.Running = false
+		if complete {
+			p.Finished = finished
+			p.Complete = start
+		}
+	})
+	if complete {
+		c.logger.Info("inventory crawl finished", "duration", finished.Sub(start))
+	}
+}
+
+// setProgress changes the progress of this replica, and the shared one.
+func (c *Crawler) setProgress(ctx context.Context, fn func(p *progress)) {
+	c.mu.Lock()
+	fn(&c.progress)
+	p := c.progress
+	c.mu.Unlock()
+	if c.shared == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, sharedTimeout)
+	defer cancel()
+	err := c.shared.Update(ctx, progressKey, func(old []byte) ([]byte, time.Duration, error) {
+		shared := p
+		var prev progress
+		if old != nil && json.Unmarshal(old, &prev) == nil {
+			fn(&prev)
+			shared = prev
+		}
+		data, err := json.Marshal(shared)
+		return data, 0, err
+	})
+	if err != nil {
+		c.logger.Warn("failed to share inventory progress", "error", err)
+	}
+}
+
+// loadProgress returns the shared progress, or that of this replica without
+// a shared state store or when it cannot be read.
+func (c *Crawler) loadProgress(ctx context.Context) progress {
+	c.mu.Lock()
+	p := c.progress
+	c.mu.Unlock()
+	if c.shared == nil {
+		return p
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, sharedTimeout)
+	defer cancel()
+	data, err := c.shared.Get(ctx, progressKey)
+	if err != nil {
+		if !errors.Is(err, state.ErrNotFound) {
+			c.logger.Warn("failed to load inventory progress", "error", err)
+		}
+		return p
+	}
+	var shared progress
+	if err := json.Unmarshal(data, &shared); err != nil {
+		return p
+	}
+	return shared
+}
+
+func (c *Crawler) crawlAccount(ctx context.Context, src Source) error {
+	token, err := src.Auth.GetAccountToken(ctx)
+	if err != nil {
+		return err
+	}
+	projects, err := src.Auth.ListProjects(ctx, token)
+	if err != nil {
+		src.Auth.InvalidateAccountToken()
+		return err
+	}
+
+	allowed := make(map[string]bool)
+	for _, p := range projects {
+		if !c.policy.Allowed(p.ID, p.Name) {
+			continue
+		}
+		allowed[p.ID] = true
+		if alias := c.policy.Alias(p.ID, p.Name); alias != "" {
+			p.Name = alias
+		}
+		c.crawlProject(ctx, src, p)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+	}
+
+	// Projects that are gone or no longer allowed
+	c.store.retain(src.Account, func(r *Registry) bool { return allowed[r.ProjectID] })
+	return c.store.save(ctx)
+}
+
+func (c *Crawler) crawlProject(ctx context.Context, src Source, p auth.Project) {
+	ctx = governor.WithProject(craas.WithRefresh(craas.WithCaller(ctx, src.Account)), p.ID)
+
+	var registries []*craas.Registry
+	err := c.withToken(ctx, src, p.ID, func(token string) error {
+		var err error
+		registries, err = c.craas.ListRegistries(craas.WithScope(ctx, p.ID, ""), token)
+		return err
+	})
+	if err != nil {
+		if ctx.Err() == nil {
+			c.logger.Warn("failed to list registries", "account", src.Account, "project_id", p.ID, "error", err)
+			c.store.failProject(src.Account, p.ID, err, c.now())
+		}
+		return
+	}
+
+	seen := make(map[string]bool, len(registries))
+	for _, reg := range registries {
+		seen[reg.ID] = true
+		c.crawlRegistry(ctx, src, p, reg)
+		if ctx.Err() != nil {
+			return
+		}
+	}
+
+	// Deleted registries
+	c.store.retain(src.Account, func(r *Registry) bool { return r.ProjectID != p.ID || seen[r.ID] })
+	if err := c.store.save(ctx); err != nil {
+		c.logger.Warn("failed to save inventory", "error", err)
+	}
+}
+
+func (c *Crawler) crawlRegistry(ctx context.Context, src Source, p auth.Project, reg *craas.Registry) {
+	ctx = craas.WithScope(ctx, p.ID, reg.ID)
+	result := &Registry{
+		Account:     src.Account,
+		ProjectID:   p.ID,
+		ProjectName: p.Name,
+		ID:          reg.ID,
+		Name:        reg.Name,
+		Region:      reg.Region,
+		Size:        reg.Size,
+	}
+
+	var repos []*repository.Repository
+	err := c.withToken(ctx, src, p.ID, func(token string) error {
+		var err error
+		repos, err = c.craas.ListRepositories(ctx, token, reg.ID)
+		return err
+	})
+	if err == nil {
+		result.Repositories = make([]Repository, 0, len(repos))
+		for _, repo := range repos {
+			var images []*repository.Image
+			err = c.withToken(ctx, src, p.ID, func(token string) error {
+				var err error
+				images, err = c.craas.ListImages(ctx, token, reg.ID, repo.Name)
+				return err
+			})
+			if err != nil {
+				break
+			}
+			result.Repositories = append(result.Repositories, Repository{
+				Name:      repo.Name,
+				Size:      repo.Size,
+				UpdatedAt: repo.UpdatedAt,
+				Images:    convertImages(images),
+			})
+		}
+	}
+
+	if err != nil {
+		if ctx.Err() == nil {
+			c.logger.Warn("failed to crawl registry", "account", src.Account, "registry_id", reg.ID, "error", err)
+			c.store.fail(*result, err, c.now())
+		}
+		return
+	}
+	slices.SortFunc(result.Repositories, func(a, b Repository) int { return strings.Compare(a.Name, b.Name) })
+	result.CrawledAt = c.now()
+	c.store.put(result)
+}
+
+// convertImages keeps what the inventory needs, newest first.
+func convertImages(images []*repository.Image) []Image {
+	result := make([]Image, 0, len(images))
+	for _, img := range images {
+		result = append(result, Image{
+			Digest:    img.Digest,
+			Tags:      slices.Clone(img.Tags),
+			Size:      img.Size,
+			CreatedAt: img.CreatedAt,
+		})
+	}
+	slices.SortStableFunc(result, func(a, b Image) int { return b.CreatedAt.Compare(a.CreatedAt) })
+	return result
+}
+
+// withToken waits for the rate limiter and calls op with a project token,
+// once more with a fresh token if the first was rejected.
+func (c *Crawler) withToken(ctx context.Context, src Source, projectID string, op func(token string) error) error {
+	if err := c.limiter.Wait(ctx); err != nil {
+		return err
+	}
+	token, err := src.Auth.GetProjectToken(ctx, projectID)
+	if err != nil {
+		return err
+	}
+	err = op(token)
+	if !errors.Is(err, craas.ErrUnauthorized) {
+		return err
+	}
+	src.Auth.InvalidateProjectToken(projectID)
+	if token, err = src.Auth.GetProjectToken(ctx, projectID); err != nil {
+		return err
+	}
+	return op(token)
+}
+
+// Status describes the crawler and the freshness of each registry.
+type Status struct {
+	Running      bool             `json:"running"`
+	LastStarted  time.Time        `json:"lastStarted,omitzero"`
+	LastFinished time.Time        `json:"lastFinished,omitzero"` // Of the last complete crawl
+	NextCrawl    time.Time        `json:"nextCrawl,omitzero"`
+	Registries   []RegistryStatus `json:"registries"`
+}
+
+// RegistryStatus is the crawl state of one registry. It is stale when the
+// last complete crawl could not refresh it.
+type RegistryStatus struct {
+	ProjectID    string    `json:"projectId"`
+	ProjectName  string    `json:"projectName"`
+	RegistryID   string    `json:"registryId"`
+	RegistryName string    `json:"registryName"`
+	CrawledAt    time.Time `json:"crawledAt,omitzero"`
+	Stale        bool      `json:"stale"`
+	Error        string    `json:"error,omitempty"`
+	FailedAt     time.Time `json:"failedAt,omitzero"`
+	Repositories int       `json:"repositories"`
+	Images       int       `json:"images"`
+	Size         int64     `json:"size"`
+}
+
+// Status returns the state of the crawler and the registries of the account.
+func (c *Crawler) Status(ctx context.Context, account string) Status {
+	p := c.loadProgress(ctx)
+	status := Status{Running: p.Running, LastStarted: p.Started, LastFinished: p.Finished, NextCrawl: p.Next}
+	complete := p.Complete
+	if status.Running {
+		status.NextCrawl = time.Time{}
+	}
+
+	c.store.refresh(ctx)
+	c.store.mu.RLock()
+	defer c.store.mu.RUnlock()
+	status.Registries = []RegistryStatus{}
+	for _, r := range c.store.sortedLocked(account) {
+		rs := RegistryStatus{
+			ProjectID:    r.ProjectID,
+			ProjectName:  r.ProjectName,
+			RegistryID:   r.ID,
+			RegistryName: r.Name,
+			CrawledAt:    r.CrawledAt,
+			Stale:        r.CrawledAt.IsZero() || complete.IsZero() || r.CrawledAt.Before(complete),
+			Error:        r.Error,
+			FailedAt:     r.FailedAt,
+			Repositories: len(r.Repositories),
+			Size:         r.Size,
+		}
+		for _, repo := range r.Repositories {
+			rs.Images += len(repo.Images)
+		}
+		status.Registries = append(status.Registries, rs)
+	}
+	return status
+}
+
+// Search finds images of the account, see Store.Search.
+func (c *Crawler) Search(ctx context.Context, account, query string, limit int) ([]Hit, int) {
+	return c.store.Search(ctx, account, query, limit)
+}
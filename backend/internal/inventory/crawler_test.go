@@ -0,0 +1,255 @@
+package inventory
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/generic/selectel-craas-web/internal/auth"
+	"github.com/generic/selectel-craas-web/internal/config"
+	"github.com/generic/selectel-craas-web/internal/craas"
+	"github.com/generic/selectel-craas-web/internal/state"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var testLogger = slog.New(slog.NewTextHandler(os.Stdout, nil))
+
+type fakeAuth struct {
+	projects    []auth.Project
+	invalidated atomic.Int32
+}
+
+func (f *fakeAuth) GetAccountToken(ctx context.Context) (string, error) { return "account", nil }
+func (f *fakeAuth) InvalidateAccountToken()                             {}
+func (f *fakeAuth) ListProjects(ctx context.Context, token string) ([]auth.Project, error) {
+	return f.projects, nil
+}
+func (f *fakeAuth) GetProjectToken(ctx context.Context, projectID string) (string, error) {
+	return "token-" + projectID, nil
+}
+func (f *fakeAuth) InvalidateProjectToken(projectID string) { f.invalidated.Add(1) }
+
+// fakeCraas serves one project with registry reg1 holding app and lib. The
+// responses can be changed between crawls.
+type fakeCraas struct {
+	mu         sync.Mutex
+	registries string
+	libStatus  int
+	unauthOnce bool
+	requests   map[string]int
+}
+
+func (f *fakeCraas) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.requests[r.Header.Get("X-Auth-Token")]++
+
+	switch r.URL.Path {
+	case "/v1/registries":
+		w.Write([]byte(f.registries))
+	case "/v1/registries/reg1/repositories":
+		w.Write([]byte(`[{"name": "lib", "size": 10}, {"name": "app", "size": 300}]`))
+	case "/v1/registries/reg1/repositories/app/images":
+		if f.unauthOnce {
+			f.unauthOnce = false
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte(`[
+			{"digest": "sha256:aaa1", "tags": ["v1.0"], "size": 100, "createdAt": "2024-01-01T00:00:00Z"},
+			{"digest": "sha256:bbb2", "tags": ["v2.0", "latest"], "size": 200, "createdAt": "2024-02-01T00:00:00Z"}
+		]`))
+	case "/v1/registries/reg1/repositories/lib/images":
+		if f.libStatus != 0 {
+			w.WriteHeader(f.libStatus)
+			return
+		}
+		w.Write([]byte(`[{"digest": "sha256:ccc3", "tags": [], "size": 10, "createdAt": "2024-03-01T00:00:00Z"}]`))
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (f *fakeCraas) set(fn func()) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	fn()
+}
+
+func newTestCrawler(t *testing.T, path string) (*Crawler, *fakeCraas, *fakeAuth) {
+	fc := &fakeCraas{registries: `[{"id": "reg1", "name": "main", "size": 310}]`, requests: make(map[string]int)}
+	ts := httptest.NewServer(fc)
+	t.Cleanup(ts.Close)
+
+	cfg := &config.Config{
+		SelectelCraasURL: ts.URL + "/v1",
+		InventoryRate:    60000,
+		Projects:         config.ProjectPolicy{Deny: []string{"sandbox"}, Aliases: map[string]string{"p1": "Production"}},
+	}
+	fa := &fakeAuth{projects: []auth.Project{{ID: "p1", Name: "prod"}, {ID: "p2", Name: "sandbox"}}}
+	store, err := NewStore(path, testLogger)
+	require.NoError(t, err)
+	c := NewCrawler(cfg, craas.New(cfg, testLogger), []Source{{Account: "default", Auth: fa}}, store, testLogger)
+
+	// Every reading of the clock is a second later
+	now := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+	c.now = func() time.Time {
+		now = now.Add(time.Second)
+		return now
+	}
+	return c, fc, fa
+}
+
+func TestCrawl(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "inventory.json")
+	c, fc, fa := newTestCrawler(t, path)
+	fc.set(func() { fc.unauthOnce = true })
+
+	c.Crawl(t.Context())
+
+	// Denied projects are not crawled, and a rejected token is renewed
+	assert.Zero(t, fc.requests["token-p2"])
+	assert.Equal(t, int32(1), fa.invalidated.Load())
+
+	status := c.Status(t.Context(), "default")
+	assert.False(t, status.Running)
+	assert.False(t, status.LastFinished.IsZero())
+	require.Len(t, status.Registries, 1)
+	reg := status.Registries[0]
+	assert.Equal(t, "Production", reg.ProjectName)
+	assert.Equal(t, "main", reg.RegistryName)
+	assert.Equal(t, 2, reg.Repositories)
+	assert.Equal(t, 3, reg.Images)
+	assert.Equal(t, int64(310), reg.Size)
+	assert.False(t, reg.Stale)
+	assert.Empty(t, reg.Error)
+	assert.Empty(t, c.Status(t.Context(), "other").Registries)
+
+	hits, total := c.Search(t.Context(), "default", "V2", 10)
+	require.Equal(t, 1, total)
+	assert.Equal(t, "app", hits[0].Repository)
+	assert.Equal(t, "sha256:bbb2", hits[0].Digest)
+	assert.Equal(t, "p1", hits[0].ProjectID)
+
+	// Repository names match every image, newest first; digests by prefix
+	hits, total = c.Search(t.Context(), "default", "app", 1)
+	assert.Equal(t, 2, total)
+	require.Len(t, hits, 1)
+	assert.Equal(t, "sha256:bbb2", hits[0].Digest)
+	_, total = c.Search(t.Context(), "default", "ccc", 10)
+	assert.Equal(t, 1, total)
+
+	// The inventory survives a restart
+	store, err := NewStore(path, testLogger)
+	require.NoError(t, err)
+	_, total = store.Search(t.Context(), "default", "app", 10)
+	assert.Equal(t, 2, total)
+}
+
+func TestCrawlFailure(t *testing.T) {
+	c, fc, _ := newTestCrawler(t, "")
+	c.Crawl(t.Context())
+	crawledAt := c.Status(t.Context(), "default").Registries[0].CrawledAt
+
+	// A failing registry keeps its content and becomes stale
+	fc.set(func() { fc.libStatus = http.StatusInternalServerError })
+	c.Crawl(t.Context())
+
+	reg := c.Status(t.Context(), "default").Registries[0]
+	assert.True(t, reg.Stale)
+	assert.NotEmpty(t, reg.Error)
+	assert.Equal(t, crawledAt, reg.CrawledAt)
+	assert.Equal(t, 3, reg.Images)
+
+	// And recovers with the next crawl
+	fc.set(func() { fc.libStatus = 0 })
+	c.Crawl(t.Context())
+	reg = c.Status(t.Context(), "default").Registries[0]
+	assert.False(t, reg.Stale)
+	assert.Empty(t, reg.Error)
+
+	// Deleted registries are dropped
+	fc.set(func() { fc.registries = `[]` })
+	c.Crawl(t.Context())
+	assert.Empty(t, c.Status(t.Context(), "default").Registries)
+}
+
+func TestCrawlCanceled(t *testing.T) {
+	c, _, _ := newTestCrawler(t, "")
+	ctx, cancel := context.WithCancel(t.Context())
+	cancel()
+
+	c.Crawl(ctx)
+
+	status := c.Status(t.Context(), "default")
+	assert.False(t, status.Running)
+	assert.True(t, status.LastFinished.IsZero())
+	assert.Empty(t, status.Registries)
+}
+
+func TestCrawlShared(t *testing.T) {
+	c1, fc, _ := newTestCrawler(t, "")
+	store, err := NewStore("", testLogger)
+	require.NoError(t, err)
+	c2 := NewCrawler(&config.Config{}, c1.craas, c1.sources, store, testLogger)
+	c2.policy = c1.policy
+
+	// Two replicas sharing one Redis and a clock
+	mr := miniredis.RunT(t)
+	for _, c := range []*Crawler{c1, c2} {
+		st, err := state.NewRedis("redis://"+mr.Addr(), "test:")
+		require.NoError(t, err)
+		t.Cleanup(func() { st.Close() })
+		c.Share(st)
+		c.interval = time.Hour
+	}
+	clock := c1.now
+	var skipped time.Duration
+	c1.now = func() time.Time { return clock().Add(skipped) }
+	c2.now = c1.now
+	requests := func() int {
+		fc.mu.Lock()
+		defer fc.mu.Unlock()
+		n := 0
+		for _, count := range fc.requests {
+			n += count
+		}
+		return n
+	}
+
+	c1.Crawl(t.Context())
+	crawled := requests()
+	assert.NotZero(t, crawled)
+
+	// The other replica serves the same inventory and does not crawl it again
+	c2.Crawl(t.Context())
+	assert.Equal(t, crawled, requests())
+	status := c2.Status(t.Context(), "default")
+	assert.Equal(t, c1.Status(t.Context(), "default").LastFinished, status.LastFinished)
+	require.Len(t, status.Registries, 1)
+	assert.Equal(t, 3, status.Registries[0].Images)
+	_, total := c2.Search(t.Context(), "default", "V2", 10)
+	assert.Equal(t, 1, total)
+
+	// Only one replica crawls at a time
+	skipped = 2 * time.Hour
+	release, err := state.TryLock(t.Context(), c1.shared, crawlLockKey, time.Minute)
+	require.NoError(t, err)
+	c2.Crawl(t.Context())
+	assert.Equal(t, crawled, requests())
+	release()
+
+	fc.set(func() { fc.registries = `[]` })
+	c2.Crawl(t.Context())
+	assert.Greater(t, requests(), crawled)
+	assert.Empty(t, c1.Status(t.Context(), "default").Registries, "the crawl of one replica is seen by all")
+}
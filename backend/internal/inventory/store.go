@@ -0,0 +1,323 @@
+// Package inventory keeps a local copy of the registries, repositories and
+// images of every configured account, refreshed by a background crawler, so
+// that overviews and search do not have to call Selectel.
+package inventory
+
+import (
+	"cmp"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/generic/selectel-craas-web/internal/state"
+)
+
+// Registry is the crawled content of one registry.
+type Registry struct {
+	Account      string       `json:"account"`
+	ProjectID    string       `json:"projectId"`
+	ProjectName  string       `json:"projectName"`
+	ID           string       `json:"id"`
+	Name         string       `json:"name"`
+	Region       string       `json:"region,omitempty"`
+	Size         int64        `json:"size"`
+	Repositories []Repository `json:"repositories"`
+	CrawledAt    time.Time    `json:"crawledAt,omitzero"` // Last successful crawl
+	Error        string       `json:"error,omitempty"`    // Why the last crawl failed; the content is older
+	FailedAt     time.Time    `json:"failedAt,omitzero"`
+}
+
+type Repository struct {
+	Name      string    `json:"name"`
+	Size      int64     `json:"size"`
+	UpdatedAt time.Time `json:"updatedAt"`
+	Images    []Image   `json:"images"`
+}
+
+type Image struct {
+	Digest    string    `json:"digest"`
+	Tags      []string  `json:"tags"`
+	Size      int64     `json:"size"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// Store holds the inventory in memory and optionally persists it to a JSON
+// file, or to a state store shared by every replica. An unreadable copy is
+// discarded, since the crawler rebuilds it.
+type Store struct {
+	mu         sync.RWMutex
+	registries map[string]*Registry // Keyed by account, project and registry ID
+	path       string
+	shared     state.Store
+	version    string // Of the shared inventory in registries
+	logger     *slog.Logger
+}
+
+// Keys of the shared inventory. The version changes with every save, so that
+// replicas only read the inventory when it changed.
+const (
+	sharedInventoryKey = "inventory/registries"
+	sharedVersionKey   = "inventory/version"
+)
+
+// NewStore creates a store. If path is not empty, the inventory is loaded
+// from it and saved back after every crawled project.
+func NewStore(path string, logger *slog.Logger) (*Store, error) {
+	s := &Store{registries: make(map[string]*Registry), path: path, logger: logger}
+	if path == "" {
+		return s, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if s.registries, err = decodeRegistries(data); err != nil {
+		logger.Warn("discarding unreadable inventory", "path", path, "error", err)
+	}
+	return s, nil
+}
+
+// Share keeps the inventory in st instead of the file, so that every replica
+// serves what the last crawl recorded. It must be called before the store is
+// used.
+func (s *Store) Share(st state.Store) {
+	s.shared = st
+}
+
+func decodeRegistries(data []byte) (map[string]*Registry, error) {
+	result := make(map[string]*Registry)
+	var registries []*Registry
+	if err := json.Unmarshal(data, &registries); err != nil {
+		return result, err
+	}
+	for _, r := range registries {
+		result[registryKey(r.Account, r.ProjectID, r.ID)] = r
+	}
+	return result, nil
+}
+
+// load reads the shared inventory if another replica saved a newer one.
+func (s *Store) load(ctx context.Context) error {
+	if s.shared == nil {
+		return nil
+	}
+	version, err := s.shared.Get(ctx, sharedVersionKey)
+	if errors.Is(err, state.ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	s.mu.RLock()
+	current := s.version == string(version)
+	s.mu.RUnlock()
+	if current {
+		return nil
+	}
+
+	// The inventory is written before its version, so it is at least as new
+	data, err := s.shared.Get(ctx, sharedInventoryKey)
+	if errors.Is(err, state.ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	registries, err := decodeRegistries(data)
+	if err != nil {
+		s.logger.Warn("discarding unreadable shared inventory", "error", err)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.registries, s.version = registries, string(version)
+	return nil
+}
+
+// refresh loads the shared inventory before it is read. On failure the
+// inventory loaded last is served.
+func (s *Store) refresh(ctx context.Context) {
+	if err := s.load(ctx); err != nil {
+		s.logger.Warn("failed to load shared inventory", "error", err)
+	}
+}
+
+func registryKey(account, projectID, registryID string) string {
+	return account + "/" + projectID + "/" + registryID
+}
+
+// put stores a successful crawl of a registry.
+func (s *Store) put(r *Registry) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.registries[registryKey(r.Account, r.ProjectID, r.ID)] = r
+}
+
+// fail records a failed crawl of a registry, keeping its earlier content.
+func (s *Store) fail(meta Registry, err error, at time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := registryKey(meta.Account, meta.ProjectID, meta.ID)
+	r, ok := s.registries[key]
+	if !ok {
+		r = &meta
+		s.registries[key] = r
+	}
+	r.Error = err.Error()
+	r.FailedAt = at
+}
+
+// failProject records a failed listing of a project's registries.
+func (s *Store) failProject(account, projectID string, err error, at time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, r := range s.registries {
+		if r.Account == account && r.ProjectID == projectID {
+			r.Error = err.Error()
+			r.FailedAt = at
+		}
+	}
+}
+
+// retain drops the registries of the account for which keep returns false,
+// e.g. after they were deleted.
+func (s *Store) retain(account string, keep func(r *Registry) bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for key, r := range s.registries {
+		if r.Account == account && !keep(r) {
+			delete(s.registries, key)
+		}
+	}
+}
+
+// sortedLocked returns the registries of the account by project and registry name.
+// The caller must hold the lock.
+func (s *Store) sortedLocked(account string) []*Registry {
+	var result []*Registry
+	for _, r := range s.registries {
+		if r.Account == account {
+			result = append(result, r)
+		}
+	}
+	slices.SortFunc(result, func(a, b *Registry) int {
+		return cmp.Or(
+			strings.Compare(a.ProjectName, b.ProjectName),
+			strings.Compare(a.ProjectID, b.ProjectID),
+			strings.Compare(a.Name, b.Name),
+			strings.Compare(a.ID, b.ID),
+		)
+	})
+	return result
+}
+
+// Hit is an image found by Search.
+type Hit struct {
+	ProjectID    string `json:"projectId"`
+	ProjectName  string `json:"projectName"`
+	RegistryID   string `json:"registryId"`
+	RegistryName string `json:"registryName"`
+	Repository   string `json:"repository"`
+	Image
+}
+
+// Search finds the images of the account whose repository name or one of
+// whose tags contains query, ignoring case, or whose digest starts with it.
+// It returns at most limit hits and the number of all matches.
+func (s *Store) Search(ctx context.Context, account, query string, limit int) ([]Hit, int) {
+	query = strings.ToLower(strings.TrimSpace(query))
+	s.refresh(ctx)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	hits := []Hit{}
+	total := 0
+	for _, r := range s.sortedLocked(account) {
+		for _, repo := range r.Repositories {
+			repoMatches := strings.Contains(strings.ToLower(repo.Name), query)
+			for _, img := range repo.Images {
+				if !repoMatches && !imageMatches(img, query) {
+					continue
+				}
+				total++
+				if len(hits) < limit {
+					hits = append(hits, Hit{
+						ProjectID:    r.ProjectID,
+						ProjectName:  r.ProjectName,
+						RegistryID:   r.ID,
+						RegistryName: r.Name,
+						Repository:   repo.Name,
+						Image:        img,
+					})
+				}
+			}
+		}
+	}
+	return hits, total
+}
+
+func imageMatches(img Image, query string) bool {
+	if strings.HasPrefix(img.Digest, query) || strings.HasPrefix(img.Digest, "sha256:"+query) {
+		return true
+	}
+	return slices.ContainsFunc(img.Tags, func(tag string) bool {
+		return strings.Contains(strings.ToLower(tag), query)
+	})
+}
+
+func (s *Store) save(ctx context.Context) error {
+	if s.path == "" && s.shared == nil {
+		return nil
+	}
+
+	s.mu.RLock()
+	registries := make([]*Registry, 0, len(s.registries))
+	for _, r := range s.registries {
+		registries = append(registries, r)
+	}
+	data, err := json.Marshal(registries)
+	s.mu.RUnlock()
+	if err != nil {
+		return err
+	}
+	if s.shared != nil {
+		return s.saveShared(ctx, data)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(s.path), 0o700); err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+func (s *Store) saveShared(ctx context.Context, data []byte) error {
+	b := make([]byte, 8)
+	rand.Read(b)
+	version := hex.EncodeToString(b)
+	if err := s.shared.Set(ctx, sharedInventoryKey, data, 0); err != nil {
+		return err
+	}
+	if err := s.shared.Set(ctx, sharedVersionKey, []byte(version), 0); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.version = version
+	return nil
+}
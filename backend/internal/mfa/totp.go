@@ -0,0 +1,125 @@
+package mfa
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"image/png"
+	"strings"
+	"time"
+
+	"github.com/pquerna/otp"
+	"github.com/pquerna/otp/totp"
+)
+
+const (
+	period = 30
+	// skew is the number of periods accepted before and after the current one.
+	skew = 1
+	// RecoveryCodeCount is the number of recovery codes issued at once.
+	RecoveryCodeCount = 10
+)
+
+// Enrollment is a freshly generated TOTP secret with its provisioning data.
+type Enrollment struct {
+	Secret string `json:"secret"`
+	URI    string `json:"otpauthUrl"`
+	// QRCode is a PNG data URL of the otpauth URI.
+	QRCode string `json:"qrCode"`
+}
+
+// NewEnrollment generates a new TOTP secret for the account.
+func NewEnrollment(issuer, account string) (*Enrollment, error) {
+	key, err := totp.Generate(totp.GenerateOpts{
+		Issuer:      issuer,
+		AccountName: account,
+		Period:      period,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	img, err := key.Image(256, 256)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, err
+	}
+
+	return &Enrollment{
+		Secret: key.Secret(),
+		URI:    key.URL(),
+		QRCode: "data:image/png;base64," + base64.StdEncoding.EncodeToString(buf.Bytes()),
+	}, nil
+}
+
+// ValidateCode checks the code against the secret. Codes from a time step at
+// or before lastStep are rejected to prevent replay. On success the matched
+// step is returned and must be stored as the new lastStep.
+func ValidateCode(secret, code string, lastStep int64, now time.Time) (int64, bool) {
+	code = strings.TrimSpace(code)
+	if len(code) != 6 {
+		return 0, false
+	}
+
+	current := now.Unix() / period
+	for i := int64(-skew); i <= skew; i++ {
+		step := current + i
+		if step <= lastStep {
+			continue
+		}
+		expected, err := totp.GenerateCodeCustom(secret, time.Unix(step*period, 0), totp.ValidateOpts{
+			Period:    period,
+			Digits:    otp.DigitsSix,
+			Algorithm: otp.AlgorithmSHA1,
+		})
+		if err != nil {
+			return 0, false
+		}
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// NewRecoveryCodes generates recovery codes. It returns the codes to show to
+// the user once and their hashes to store.
+func NewRecoveryCodes() (codes []string, hashes []string, err error) {
+	for i := 0; i < RecoveryCodeCount; i++ {
+		b := make([]byte, 5)
+		if _, err := rand.Read(b); err != nil {
+			return nil, nil, err
+		}
+		h := hex.EncodeToString(b)
+		code := fmt.Sprintf("%s-%s", h[:5], h[5:])
+		codes = append(codes, code)
+		hashes = append(hashes, hashRecoveryCode(code))
+	}
+	return codes, hashes, nil
+}
+
+// UseRecoveryCode looks the code up among the hashes. It returns the remaining
+// hashes with the matched one removed.
+func UseRecoveryCode(hashes []string, code string) ([]string, bool) {
+	h := hashRecoveryCode(code)
+	for i, stored := range hashes {
+		if subtle.ConstantTimeCompare([]byte(stored), []byte(h)) == 1 {
+			remaining := append([]string{}, hashes[:i]...)
+			return append(remaining, hashes[i+1:]...), true
+		}
+	}
+	return hashes, false
+}
+
+func hashRecoveryCode(code string) string {
+	normalized := strings.ToLower(strings.ReplaceAll(strings.TrimSpace(code), " ", ""))
+	sum := sha256.Sum256([]byte(normalized))
+	return hex.EncodeToString(sum[:])
+}
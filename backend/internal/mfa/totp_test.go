@@ -0,0 +1,60 @@
+package mfa
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pquerna/otp/totp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewEnrollment(t *testing.T) {
+	e, err := NewEnrollment("CRaaS UI", "admin")
+	require.NoError(t, err)
+
+	assert.NotEmpty(t, e.Secret)
+	assert.True(t, strings.HasPrefix(e.URI, "otpauth://totp/CRaaS%20UI:admin?"))
+	assert.True(t, strings.HasPrefix(e.QRCode, "data:image/png;base64,"))
+}
+
+func TestValidateCode(t *testing.T) {
+	e, err := NewEnrollment("CRaaS UI", "admin")
+	require.NoError(t, err)
+
+	now := time.Date(2030, 1, 1, 12, 0, 0, 0, time.UTC)
+	code, err := totp.GenerateCode(e.Secret, now)
+	require.NoError(t, err)
+
+	step, ok := ValidateCode(e.Secret, code, 0, now)
+	assert.True(t, ok)
+
+	// The same code must not be accepted twice
+	_, ok = ValidateCode(e.Secret, code, step, now)
+	assert.False(t, ok)
+
+	// Codes from the previous period are accepted to tolerate clock drift
+	_, ok = ValidateCode(e.Secret, code, 0, now.Add(period*time.Second))
+	assert.True(t, ok)
+
+	// But not older ones
+	_, ok = ValidateCode(e.Secret, code, 0, now.Add(3*period*time.Second))
+	assert.False(t, ok)
+
+	_, ok = ValidateCode(e.Secret, "000000x", 0, now)
+	assert.False(t, ok)
+}
+
+func TestRecoveryCodes(t *testing.T) {
+	codes, hashes, err := NewRecoveryCodes()
+	require.NoError(t, err)
+	require.Len(t, codes, RecoveryCodeCount)
+
+	remaining, ok := UseRecoveryCode(hashes, strings.ToUpper(codes[3]))
+	assert.True(t, ok)
+	assert.Len(t, remaining, RecoveryCodeCount-1)
+
+	_, ok = UseRecoveryCode(remaining, codes[3])
+	assert.False(t, ok, "a recovery code can only be used once")
+}
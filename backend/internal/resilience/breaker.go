@@ -0,0 +1,122 @@
+package resilience
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrCircuitOpen is returned without calling the endpoint while its circuit is open.
+var ErrCircuitOpen = errors.New("upstream temporarily unavailable, circuit open")
+
+// Circuit states.
+const (
+	StateClosed   = "closed"    // Requests flow normally
+	StateOpen     = "open"      // Requests fail fast until the cool-down ends
+	StateHalfOpen = "half-open" // One probe request decides whether to close again
+)
+
+// EndpointStatus is the public view of one endpoint's circuit.
+type EndpointStatus struct {
+	Endpoint    string     `json:"endpoint"`
+	State       string     `json:"state"`
+	Failures    int        `json:"failures"` // Consecutive failures
+	LastError   string     `json:"lastError,omitempty"`
+	OpenedAt    *time.Time `json:"openedAt,omitempty"`
+	RetryAt     *time.Time `json:"retryAt,omitempty"` // When the next probe is allowed
+	LastSuccess *time.Time `json:"lastSuccess,omitempty"`
+}
+
+// breaker is the circuit of one endpoint. It opens after threshold
+// consecutive failures and lets one probe through after cooldown.
+type breaker struct {
+	mu          sync.Mutex
+	state       string
+	failures    int
+	lastError   string
+	openedAt    time.Time
+	lastSuccess time.Time
+	probing     bool
+}
+
+// allow reports whether a request may be sent now.
+func (b *breaker) allow(now time.Time, cooldown time.Duration) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case StateOpen:
+		if now.Before(b.openedAt.Add(cooldown)) {
+			return false
+		}
+		b.state = StateHalfOpen
+		b.probing = true
+		return true
+	case StateHalfOpen:
+		if b.probing {
+			return false
+		}
+		b.probing = true
+		return true
+	default:
+		return true
+	}
+}
+
+func (b *breaker) success(now time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.state = StateClosed
+	b.failures = 0
+	b.probing = false
+	b.lastSuccess = now
+}
+
+func (b *breaker) failure(now time.Time, threshold int, err string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures++
+	b.lastError = err
+	b.probing = false
+	if b.state == StateHalfOpen || b.failures >= threshold {
+		b.state = StateOpen
+		b.openedAt = now
+	}
+}
+
+// abandon ends a request that neither succeeded nor failed, e.g. because the
+// caller went away. If it was the probe, the circuit opens again for another
+// cool-down instead of waiting for a probe that never reports.
+func (b *breaker) abandon(now time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == StateHalfOpen && b.probing {
+		b.state = StateOpen
+		b.openedAt = now
+		b.probing = false
+	}
+}
+
+func (b *breaker) status(endpoint string, cooldown time.Duration) EndpointStatus {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	s := EndpointStatus{
+		Endpoint:  endpoint,
+		State:     b.state,
+		Failures:  b.failures,
+		LastError: b.lastError,
+	}
+	if s.State == "" {
+		s.State = StateClosed
+	}
+	if b.state == StateOpen || b.state == StateHalfOpen {
+		openedAt, retryAt := b.openedAt, b.openedAt.Add(cooldown)
+		s.OpenedAt, s.RetryAt = &openedAt, &retryAt
+	}
+	if !b.lastSuccess.IsZero() {
+		last := b.lastSuccess
+		s.LastSuccess = &last
+	}
+	return s
+}
@@ -0,0 +1,246 @@
+// Package resilience retries transient upstream failures and stops calling
+// endpoints that keep failing.
+package resilience
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Options configures a Transport. Zero values disable the feature.
+type Options struct {
+	Retries          int           // Extra attempts for idempotent requests
+	BaseDelay        time.Duration // First backoff; doubled on each retry
+	MaxDelay         time.Duration // Cap for backoff and Retry-After
+	BreakerThreshold int           // Consecutive failures that open a circuit; 0 disables
+	BreakerCooldown  time.Duration // How long an open circuit fails fast
+}
+
+// Transport wraps a RoundTripper with retries and per-endpoint circuit breakers.
+type Transport struct {
+	next http.RoundTripper
+	opts Options
+	now  func() time.Time
+
+	// sleep waits for d or until ctx is done; replaced in tests.
+	sleep func(ctx context.Context, d time.Duration) error
+
+	mu       sync.Mutex
+	breakers map[string]*breaker
+}
+
+// New wraps next, or http.DefaultTransport when next is nil.
+func New(next http.RoundTripper, opts Options) *Transport {
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	return &Transport{
+		next:     next,
+		opts:     opts,
+		now:      time.Now,
+		sleep:    sleep,
+		breakers: make(map[string]*breaker),
+	}
+}
+
+type idempotentKey struct{}
+
+// Idempotent marks requests made with ctx as safe to retry even though
+// their method is not, e.g. a POST that only issues a token.
+func Idempotent(ctx context.Context) context.Context {
+	return context.WithValue(ctx, idempotentKey{}, true)
+}
+
+// ErrTimeout is the cause of contexts made by WithTimeout. It wraps
+// context.DeadlineExceeded, so callers need not tell the two apart.
+var ErrTimeout = fmt.Errorf("upstream call timed out: %w", context.DeadlineExceeded)
+
+// WithTimeout bounds one upstream call by d. Unlike a deadline set by the
+// caller, running out of it counts against the endpoint's circuit, so an
+// endpoint that hangs trips it like one that fails.
+func WithTimeout(ctx context.Context, d time.Duration) (context.Context, context.CancelFunc) {
+	return context.WithTimeoutCause(ctx, d, ErrTimeout)
+}
+
+// Unwrap returns the wrapped RoundTripper.
+func (t *Transport) Unwrap() http.RoundTripper {
+	return t.next
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	endpoint := req.URL.Scheme + "://" + req.URL.Host
+	b := t.breaker(endpoint)
+
+	attempts := 1
+	if t.retryable(req) {
+		attempts += max(t.opts.Retries, 0)
+	}
+
+	for attempt := 1; ; attempt++ {
+		if t.opts.BreakerThreshold > 0 && !b.allow(t.now(), t.opts.BreakerCooldown) {
+			return nil, fmt.Errorf("%s: %w", endpoint, ErrCircuitOpen)
+		}
+
+		if attempt > 1 && req.Body != nil && req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req = req.Clone(req.Context())
+			req.Body = body
+		}
+
+		resp, err := t.next.RoundTrip(req)
+		if t.opts.BreakerThreshold > 0 {
+			failed, reason := t.failed(req, resp, err)
+			if failed {
+				b.failure(t.now(), t.opts.BreakerThreshold, reason)
+			} else if err == nil {
+				b.success(t.now())
+			} else {
+				b.abandon(t.now())
+			}
+		}
+
+		if attempt >= attempts || !transient(req, resp, err) {
+			return resp, err
+		}
+
+		delay := t.backoff(attempt)
+		if resp != nil {
+			if wait, ok := retryAfter(resp, t.now()); ok {
+				if t.opts.MaxDelay > 0 && wait > t.opts.MaxDelay {
+					// Waiting that long would outlast the user; report the failure instead.
+					return resp, err
+				}
+				delay = wait
+			}
+			io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+			resp.Body.Close()
+		}
+		if err := t.sleep(req.Context(), delay); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// Status returns the circuit of every endpoint called so far.
+func (t *Transport) Status() []EndpointStatus {
+	t.mu.Lock()
+	endpoints := make([]string, 0, len(t.breakers))
+	for endpoint := range t.breakers {
+		endpoints = append(endpoints, endpoint)
+	}
+	t.mu.Unlock()
+	sort.Strings(endpoints)
+
+	result := make([]EndpointStatus, 0, len(endpoints))
+	for _, endpoint := range endpoints {
+		result = append(result, t.breaker(endpoint).status(endpoint, t.opts.BreakerCooldown))
+	}
+	return result
+}
+
+func (t *Transport) breaker(endpoint string) *breaker {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	b, ok := t.breakers[endpoint]
+	if !ok {
+		b = &breaker{state: StateClosed}
+		t.breakers[endpoint] = b
+	}
+	return b
+}
+
+func (t *Transport) retryable(req *http.Request) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return true
+	}
+	idempotent, _ := req.Context().Value(idempotentKey{}).(bool)
+	return idempotent && (req.Body == nil || req.GetBody != nil)
+}
+
+// failed reports whether the outcome counts against the endpoint's circuit.
+// Cancellations and deadlines of the caller and client errors do not, but
+// running out of a WithTimeout does.
+func (t *Transport) failed(req *http.Request, resp *http.Response, err error) (bool, string) {
+	if err != nil {
+		if ctx := req.Context(); ctx.Err() != nil {
+			if !errors.Is(context.Cause(ctx), ErrTimeout) {
+				return false, ""
+			}
+			return true, ErrTimeout.Error()
+		}
+		return true, err.Error()
+	}
+	if resp.StatusCode >= 500 {
+		return true, resp.Status
+	}
+	return false, ""
+}
+
+// transient reports whether another attempt may succeed.
+func transient(req *http.Request, resp *http.Response, err error) bool {
+	if err != nil {
+		return req.Context().Err() == nil && !errors.Is(err, ErrCircuitOpen)
+	}
+	switch resp.StatusCode {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// backoff returns an exponential delay with full jitter.
+func (t *Transport) backoff(attempt int) time.Duration {
+	if t.opts.BaseDelay <= 0 {
+		return 0
+	}
+	d := t.opts.BaseDelay << (attempt - 1)
+	if t.opts.MaxDelay > 0 && (d > t.opts.MaxDelay || d <= 0) {
+		d = t.opts.MaxDelay
+	}
+	return rand.N(d) + 1
+}
+
+// retryAfter parses Retry-After on 429 and 503 responses, in seconds or as an HTTP date.
+func retryAfter(resp *http.Response, now time.Time) (time.Duration, bool) {
+	if resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode != http.StatusServiceUnavailable {
+		return 0, false
+	}
+	value := resp.Header.Get("Retry-After")
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if at, err := http.ParseTime(value); err == nil {
+		return max(at.Sub(now), 0), true
+	}
+	return 0, false
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return ctx.Err()
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,286 @@
+package resilience
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestTransport records the delays instead of sleeping.
+func newTestTransport(opts Options) (*Transport, *[]time.Duration) {
+	t := New(nil, opts)
+	var delays []time.Duration
+	t.sleep = func(ctx context.Context, d time.Duration) error {
+		delays = append(delays, d)
+		return ctx.Err()
+	}
+	return t, &delays
+}
+
+// flaky fails with status the first n requests, then succeeds.
+func flaky(n int32, status int, header http.Header) (*httptest.Server, *atomic.Int32) {
+	var requests atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if requests.Add(1) <= n {
+			for k, v := range header {
+				w.Header()[k] = v
+			}
+			w.WriteHeader(status)
+			return
+		}
+		w.Write(body)
+	}))
+	return ts, &requests
+}
+
+func TestRetryTransient(t *testing.T) {
+	ts, requests := flaky(2, http.StatusBadGateway, nil)
+	defer ts.Close()
+
+	rt, delays := newTestTransport(Options{Retries: 2, BaseDelay: 100 * time.Millisecond, MaxDelay: time.Second})
+	client := &http.Client{Transport: rt}
+
+	resp, err := client.Get(ts.URL)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, int32(3), requests.Load())
+
+	// Exponential backoff with full jitter
+	require.Len(t, *delays, 2)
+	assert.LessOrEqual(t, (*delays)[0], 100*time.Millisecond)
+	assert.LessOrEqual(t, (*delays)[1], 200*time.Millisecond)
+}
+
+func TestRetryGivesUp(t *testing.T) {
+	ts, requests := flaky(10, http.StatusServiceUnavailable, nil)
+	defer ts.Close()
+
+	rt, _ := newTestTransport(Options{Retries: 2})
+	resp, err := (&http.Client{Transport: rt}).Get(ts.URL)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode, "the last response is returned")
+	assert.Equal(t, int32(3), requests.Load())
+}
+
+func TestNoRetry(t *testing.T) {
+	t.Run("Non-Idempotent", func(t *testing.T) {
+		ts, requests := flaky(1, http.StatusBadGateway, nil)
+		defer ts.Close()
+
+		rt, _ := newTestTransport(Options{Retries: 2})
+		resp, err := (&http.Client{Transport: rt}).Post(ts.URL, "application/json", bytes.NewBufferString("{}"))
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusBadGateway, resp.StatusCode)
+		assert.Equal(t, int32(1), requests.Load())
+	})
+
+	t.Run("Client Error", func(t *testing.T) {
+		ts, requests := flaky(1, http.StatusNotFound, nil)
+		defer ts.Close()
+
+		rt, _ := newTestTransport(Options{Retries: 2})
+		resp, err := (&http.Client{Transport: rt}).Get(ts.URL)
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+		assert.Equal(t, int32(1), requests.Load())
+	})
+}
+
+func TestRetryIdempotentPost(t *testing.T) {
+	ts, requests := flaky(1, http.StatusBadGateway, nil)
+	defer ts.Close()
+
+	rt, _ := newTestTransport(Options{Retries: 2})
+	req, err := http.NewRequestWithContext(Idempotent(context.Background()), "POST", ts.URL, bytes.NewBufferString("payload"))
+	require.NoError(t, err)
+	resp, err := (&http.Client{Transport: rt}).Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(resp.Body)
+	assert.Equal(t, "payload", string(body), "the body is replayed on retry")
+	assert.Equal(t, int32(2), requests.Load())
+}
+
+func TestRetryAfter(t *testing.T) {
+	ts, _ := flaky(1, http.StatusTooManyRequests, http.Header{"Retry-After": {"2"}})
+	defer ts.Close()
+
+	rt, delays := newTestTransport(Options{Retries: 1, BaseDelay: time.Millisecond, MaxDelay: 5 * time.Second})
+	resp, err := (&http.Client{Transport: rt}).Get(ts.URL)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, []time.Duration{2 * time.Second}, *delays)
+
+	// Waits longer than MaxDelay are not worth it
+	ts2, requests := flaky(1, http.StatusServiceUnavailable, http.Header{"Retry-After": {"60"}})
+	defer ts2.Close()
+	resp, err = (&http.Client{Transport: rt}).Get(ts2.URL)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	assert.Equal(t, int32(1), requests.Load())
+
+	now := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+	date := &http.Response{StatusCode: http.StatusServiceUnavailable, Header: http.Header{
+		"Retry-After": {now.Add(3 * time.Second).Format(http.TimeFormat)},
+	}}
+	wait, ok := retryAfter(date, now)
+	assert.True(t, ok)
+	assert.Equal(t, 3*time.Second, wait)
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	ts, requests := flaky(3, http.StatusInternalServerError, nil)
+	defer ts.Close()
+
+	rt, _ := newTestTransport(Options{BreakerThreshold: 3, BreakerCooldown: 30 * time.Second})
+	now := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+	rt.now = func() time.Time { return now }
+	client := &http.Client{Transport: rt}
+
+	for range 3 {
+		resp, err := client.Get(ts.URL)
+		require.NoError(t, err)
+		resp.Body.Close()
+	}
+
+	status := rt.Status()
+	require.Len(t, status, 1)
+	assert.Equal(t, ts.URL, status[0].Endpoint)
+	assert.Equal(t, StateOpen, status[0].State)
+	assert.Equal(t, 3, status[0].Failures)
+	assert.Equal(t, now.Add(30*time.Second), *status[0].RetryAt)
+
+	// Fails fast while open
+	_, err := client.Get(ts.URL)
+	assert.ErrorIs(t, err, ErrCircuitOpen)
+	assert.Equal(t, int32(3), requests.Load())
+
+	// A successful probe after the cool-down closes the circuit
+	now = now.Add(31 * time.Second)
+	resp, err := client.Get(ts.URL)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, StateClosed, rt.Status()[0].State)
+	assert.Equal(t, 0, rt.Status()[0].Failures)
+}
+
+func TestCircuitBreakerDisabled(t *testing.T) {
+	ts, requests := flaky(5, http.StatusInternalServerError, nil)
+	defer ts.Close()
+
+	rt, _ := newTestTransport(Options{BreakerCooldown: 30 * time.Second})
+	client := &http.Client{Transport: rt}
+	for range 5 {
+		resp, err := client.Get(ts.URL)
+		require.NoError(t, err)
+		resp.Body.Close()
+	}
+	assert.Equal(t, int32(5), requests.Load())
+
+	status := rt.Status()
+	require.Len(t, status, 1)
+	assert.Equal(t, StateClosed, status[0].State, "failures are not counted without a threshold")
+	assert.Equal(t, 0, status[0].Failures)
+}
+
+func TestCircuitHalfOpenFailure(t *testing.T) {
+	b := &breaker{state: StateClosed}
+	now := time.Now()
+
+	b.failure(now, 1, "502 Bad Gateway")
+	assert.False(t, b.allow(now, time.Minute))
+
+	// Only one probe at a time
+	now = now.Add(time.Minute)
+	assert.True(t, b.allow(now, time.Minute))
+	assert.False(t, b.allow(now, time.Minute))
+
+	// A failed probe opens the circuit again
+	b.failure(now, 5, "502 Bad Gateway")
+	assert.Equal(t, StateOpen, b.status("x", time.Minute).State)
+	assert.False(t, b.allow(now, time.Minute))
+}
+
+func TestCanceledRequestsDoNotTrip(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer ts.Close()
+
+	rt, _ := newTestTransport(Options{Retries: 2, BreakerThreshold: 1, BreakerCooldown: time.Minute})
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, "GET", ts.URL, nil)
+	_, err := (&http.Client{Transport: rt}).Do(req)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Equal(t, StateClosed, rt.Status()[0].State)
+}
+
+func TestCircuitCanceledProbe(t *testing.T) {
+	ts, requests := flaky(1, http.StatusBadGateway, nil)
+	defer ts.Close()
+
+	rt, _ := newTestTransport(Options{BreakerThreshold: 1, BreakerCooldown: 30 * time.Second})
+	now := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+	rt.now = func() time.Time { return now }
+	client := &http.Client{Transport: rt}
+
+	resp, err := client.Get(ts.URL)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, StateOpen, rt.Status()[0].State)
+
+	// The caller of the probe went away before it was sent
+	now = now.Add(31 * time.Second)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	req, _ := http.NewRequestWithContext(ctx, "GET", ts.URL, nil)
+	_, err = client.Do(req)
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Equal(t, StateOpen, rt.Status()[0].State)
+	assert.Equal(t, 1, rt.Status()[0].Failures)
+
+	// The next probe is allowed after another cool-down
+	_, err = client.Get(ts.URL)
+	assert.ErrorIs(t, err, ErrCircuitOpen)
+	now = now.Add(31 * time.Second)
+	resp, err = client.Get(ts.URL)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, StateClosed, rt.Status()[0].State)
+	assert.Equal(t, int32(2), requests.Load())
+}
+
+func TestTimeoutsTrip(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer ts.Close()
+
+	rt, _ := newTestTransport(Options{BreakerThreshold: 1, BreakerCooldown: time.Minute})
+	ctx, cancel := WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, "GET", ts.URL, nil)
+	_, err := (&http.Client{Transport: rt}).Do(req)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	status := rt.Status()[0]
+	assert.Equal(t, StateOpen, status.State)
+	assert.Equal(t, ErrTimeout.Error(), status.LastError)
+}
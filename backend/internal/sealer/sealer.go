@@ -0,0 +1,76 @@
+package sealer
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"strings"
+)
+
+// KeySize is the length of the key in bytes, before base64 encoding.
+const KeySize = 32
+
+var (
+	// ErrNoKey indicates that no encryption key is configured.
+	ErrNoKey = errors.New("no encryption key configured")
+	// ErrBadKey indicates a key that is not KeySize bytes in base64.
+	ErrBadKey = errors.New("encryption key must be 32 random bytes in base64, e.g. from openssl rand -base64 32")
+	// ErrInvalid indicates a sealed value that was tampered with, sealed
+	// with a different key or moved from where it was sealed.
+	ErrInvalid = errors.New("sealed value is invalid or was encrypted with another key")
+)
+
+// Sealer encrypts small secrets with AES-256-GCM.
+type Sealer struct {
+	aead cipher.AEAD
+}
+
+// New takes a random 256-bit key in base64. Passphrases are rejected: the
+// key is used as is, without a key derivation function.
+func New(key string) (*Sealer, error) {
+	if key == "" {
+		return nil, ErrNoKey
+	}
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(key))
+	if err != nil || len(raw) != KeySize {
+		return nil, ErrBadKey
+	}
+	block, err := aes.NewCipher(raw)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &Sealer{aead: aead}, nil
+}
+
+// Seal encrypts the plaintext. The result is base64 with the nonce prepended.
+// The label says where the value is kept, e.g. a field and a user name; it
+// is authenticated but not stored, and Open needs the same one, so a value
+// copied to another user or field does not open.
+func (s *Sealer) Seal(plaintext []byte, label string) (string, error) {
+	nonce := make([]byte, s.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := s.aead.Seal(nonce, nonce, plaintext, []byte(label))
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// Open decrypts a value produced by Seal with the same label.
+func (s *Sealer) Open(sealed, label string) ([]byte, error) {
+	data, err := base64.StdEncoding.DecodeString(sealed)
+	if err != nil || len(data) < s.aead.NonceSize() {
+		return nil, ErrInvalid
+	}
+	nonce, ciphertext := data[:s.aead.NonceSize()], data[s.aead.NonceSize():]
+	plaintext, err := s.aead.Open(nil, nonce, ciphertext, []byte(label))
+	if err != nil {
+		return nil, ErrInvalid
+	}
+	return plaintext, nil
+}
@@ -0,0 +1,69 @@
+package sealer
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newKey(t *testing.T) string {
+	t.Helper()
+	key := make([]byte, KeySize)
+	_, err := rand.Read(key)
+	require.NoError(t, err)
+	return base64.StdEncoding.EncodeToString(key)
+}
+
+func TestSealOpen(t *testing.T) {
+	s, err := New(newKey(t))
+	require.NoError(t, err)
+
+	sealed, err := s.Seal([]byte("secret"), "alice")
+	require.NoError(t, err)
+	assert.NotContains(t, sealed, "secret")
+
+	plaintext, err := s.Open(sealed, "alice")
+	require.NoError(t, err)
+	assert.Equal(t, "secret", string(plaintext))
+
+	// Every seal uses a fresh nonce
+	again, _ := s.Seal([]byte("secret"), "alice")
+	assert.NotEqual(t, sealed, again)
+
+	// A value moved to another label does not open
+	_, err = s.Open(sealed, "bob")
+	assert.ErrorIs(t, err, ErrInvalid)
+}
+
+func TestOpen_WrongKeyOrTampered(t *testing.T) {
+	s, _ := New(newKey(t))
+	other, _ := New(newKey(t))
+
+	sealed, _ := s.Seal([]byte("secret"), "alice")
+	_, err := other.Open(sealed, "alice")
+	assert.ErrorIs(t, err, ErrInvalid)
+
+	tampered := []byte(sealed)
+	tampered[len(tampered)-3] ^= 1
+	_, err = s.Open(string(tampered), "alice")
+	assert.ErrorIs(t, err, ErrInvalid)
+
+	_, err = s.Open("not base64!", "alice")
+	assert.ErrorIs(t, err, ErrInvalid)
+}
+
+func TestNew_Key(t *testing.T) {
+	_, err := New("")
+	assert.ErrorIs(t, err, ErrNoKey)
+
+	for _, key := range []string{"passphrase", base64.StdEncoding.EncodeToString([]byte("too short"))} {
+		_, err = New(key)
+		assert.ErrorIs(t, err, ErrBadKey, key)
+	}
+
+	_, err = New(newKey(t) + "\n")
+	assert.NoError(t, err, "a trailing newline from a secret file is ignored")
+}
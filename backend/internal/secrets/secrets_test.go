@@ -0,0 +1,148 @@
+package secrets
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type staticSource map[string]string
+
+func (s staticSource) Read(context.Context) (map[string]string, error) { return s, nil }
+
+func TestStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "password")
+	require.NoError(t, os.WriteFile(path, []byte("from-file\n"), 0o600))
+	t.Setenv("FILE_SECRET_FILE", path)
+
+	store := NewStore(staticSource{"VAULT_SECRET": "from-vault", "FILE_SECRET": "ignored"})
+	store.Track("ENV_SECRET", "from-env")
+	store.Track("VAULT_SECRET", "from-env")
+	store.Track("FILE_SECRET", "from-env")
+	store.Track("EMPTY", "")
+	require.NoError(t, store.Refresh(context.Background()))
+
+	assert.Equal(t, "from-env", store.Get("ENV_SECRET", "fallback"))
+	assert.Equal(t, "from-vault", store.Get("VAULT_SECRET", "fallback"))
+	assert.Equal(t, "from-file", store.Get("FILE_SECRET", "fallback"), "files take precedence")
+	assert.Equal(t, "fallback", store.Get("EMPTY", "fallback"))
+	assert.Equal(t, "fallback", store.Get("UNKNOWN", "fallback"))
+
+	// Rotation is picked up on the next refresh
+	require.NoError(t, os.WriteFile(path, []byte("rotated"), 0o600))
+	require.NoError(t, store.Refresh(context.Background()))
+	assert.Equal(t, "rotated", store.Get("FILE_SECRET", ""))
+
+	// A failed refresh keeps the previous values
+	require.NoError(t, os.Remove(path))
+	assert.Error(t, store.Refresh(context.Background()))
+	assert.Equal(t, "rotated", store.Get("FILE_SECRET", ""))
+
+	var nilStore *Store
+	assert.Equal(t, "fallback", nilStore.Get("ANY", "fallback"))
+}
+
+// fakeVault serves one KV v2 secret and an AppRole login.
+func fakeVault(logins *int32) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1/auth/approle/login":
+			var body map[string]string
+			json.NewDecoder(r.Body).Decode(&body)
+			if body["role_id"] != "role" || body["secret_id"] != "secret" {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			atomic.AddInt32(logins, 1)
+			w.Write([]byte(`{"auth": {"client_token": "approle-token", "lease_duration": 3600}}`))
+		case "/v1/kv/data/craas":
+			if token := r.Header.Get("X-Vault-Token"); token != "root" && token != "approle-token" {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			w.Write([]byte(`{"data": {"data": {"SELECTEL_PASSWORD": "s3cret", "PORT": 8080}, "metadata": {"version": 2}}}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+}
+
+func TestVault(t *testing.T) {
+	var logins int32
+	ts := fakeVault(&logins)
+	defer ts.Close()
+
+	_, err := NewVault(VaultConfig{Addr: ts.URL, Path: "craas"})
+	assert.Error(t, err, "credentials are required")
+
+	t.Run("Token", func(t *testing.T) {
+		v, err := NewVault(VaultConfig{Addr: ts.URL, Mount: "kv", Path: "craas", Token: "root"})
+		require.NoError(t, err)
+		data, err := v.Read(context.Background())
+		require.NoError(t, err)
+		assert.Equal(t, map[string]string{"SELECTEL_PASSWORD": "s3cret", "PORT": "8080"}, data)
+	})
+
+	t.Run("Bad Token", func(t *testing.T) {
+		v, err := NewVault(VaultConfig{Addr: ts.URL, Mount: "kv", Path: "craas", Token: "wrong"})
+		require.NoError(t, err)
+		_, err = v.Read(context.Background())
+		assert.ErrorIs(t, err, ErrVaultAuth)
+	})
+
+	t.Run("AppRole", func(t *testing.T) {
+		v, err := NewVault(VaultConfig{Addr: ts.URL, Mount: "kv", Path: "craas", RoleID: "role", SecretID: "secret"})
+		require.NoError(t, err)
+		for i := 0; i < 3; i++ {
+			data, err := v.Read(context.Background())
+			require.NoError(t, err)
+			assert.Equal(t, "s3cret", data["SELECTEL_PASSWORD"])
+		}
+		assert.Equal(t, int32(1), atomic.LoadInt32(&logins), "the AppRole token is reused")
+	})
+}
+
+// TestVault_DevServer runs against a local dev server started with
+// `vault server -dev -dev-root-token-id=root`:
+//
+//	VAULT_TEST_ADDR=http://127.0.0.1:8200 VAULT_TEST_TOKEN=root go test ./internal/secrets/
+func TestVault_DevServer(t *testing.T) {
+	addr, token := os.Getenv("VAULT_TEST_ADDR"), os.Getenv("VAULT_TEST_TOKEN")
+	if addr == "" || token == "" {
+		t.Skip("VAULT_TEST_ADDR and VAULT_TEST_TOKEN are not set")
+	}
+
+	v, err := NewVault(VaultConfig{Addr: addr, Path: "selectel-craas-web-test", Token: token})
+	require.NoError(t, err)
+
+	write := func(value string) {
+		body, _ := json.Marshal(map[string]interface{}{"data": map[string]string{"JWT_SECRET": value}})
+		req, err := http.NewRequest("POST", addr+"/v1/secret/data/selectel-craas-web-test", bytes.NewReader(body))
+		require.NoError(t, err)
+		req.Header.Set("X-Vault-Token", token)
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+
+	store := NewStore(v)
+	store.Track("JWT_SECRET", "")
+
+	write("first")
+	require.NoError(t, store.Refresh(context.Background()))
+	assert.Equal(t, "first", store.Get("JWT_SECRET", ""))
+
+	write("second")
+	require.NoError(t, store.Refresh(context.Background()))
+	assert.Equal(t, "second", store.Get("JWT_SECRET", ""))
+}
@@ -0,0 +1,125 @@
+// Package secrets resolves secret configuration values from mounted files,
+// HashiCorp Vault or the environment, and follows their rotation at runtime.
+package secrets
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Source provides secrets by name, e.g. the fields of one Vault KV secret.
+type Source interface {
+	Read(ctx context.Context) (map[string]string, error)
+}
+
+// Store holds the current value of every tracked secret. A key resolves, in
+// order of precedence, from the file named by KEY_FILE, from the source, then
+// from the environment value it was tracked with.
+type Store struct {
+	source Source
+
+	mu     sync.RWMutex
+	env    map[string]string
+	files  map[string]string
+	values map[string]string
+}
+
+// NewStore returns a store reading from source, which may be nil.
+func NewStore(source Source) *Store {
+	return &Store{
+		source: source,
+		env:    make(map[string]string),
+		files:  make(map[string]string),
+		values: make(map[string]string),
+	}
+}
+
+// Track registers a secret with its environment value. If KEY_FILE is set in
+// the environment, the file takes precedence. Call Refresh afterwards.
+func (s *Store) Track(key, envValue string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.env[key] = envValue
+	if path := os.Getenv(key + "_FILE"); path != "" {
+		s.files[key] = path
+	}
+}
+
+// Get returns the current value of the secret, or fallback when it is empty
+// or not tracked. A nil store always returns fallback.
+func (s *Store) Get(key, fallback string) string {
+	if s == nil {
+		return fallback
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if v := s.values[key]; v != "" {
+		return v
+	}
+	return fallback
+}
+
+// Refresh re-reads the files and the source. On error the previous values are kept.
+func (s *Store) Refresh(ctx context.Context) error {
+	s.mu.RLock()
+	files := make(map[string]string, len(s.files))
+	for k, v := range s.files {
+		files[k] = v
+	}
+	s.mu.RUnlock()
+
+	var remote map[string]string
+	if s.source != nil {
+		var err error
+		if remote, err = s.source.Read(ctx); err != nil {
+			return err
+		}
+	}
+
+	fromFiles := make(map[string]string, len(files))
+	for key, path := range files {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("failed to read %s_FILE: %w", key, err)
+		}
+		fromFiles[key] = strings.TrimSpace(string(data))
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	values := make(map[string]string, len(s.env))
+	for key, v := range s.env {
+		if f, ok := fromFiles[key]; ok {
+			v = f
+		} else if r, ok := remote[key]; ok {
+			v = r
+		}
+		values[key] = v
+	}
+	s.values = values
+	return nil
+}
+
+// Watch refreshes the secrets every interval until ctx is done.
+func (s *Store) Watch(ctx context.Context, interval time.Duration, logger *slog.Logger) {
+	if interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := s.Refresh(ctx); err != nil {
+				logger.Warn("failed to refresh secrets, keeping the previous values", "error", err)
+			}
+		}
+	}
+}
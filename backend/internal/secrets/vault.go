@@ -0,0 +1,181 @@
+package secrets
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrVaultAuth indicates that Vault rejected the token or the AppRole login.
+var ErrVaultAuth = errors.New("vault authentication failed")
+
+// VaultConfig describes one KV v2 secret and how to authenticate. Either
+// Token or RoleID and SecretID (AppRole) must be set.
+type VaultConfig struct {
+	Addr      string
+	Namespace string
+	Mount     string // KV v2 mount, e.g. "secret"
+	Path      string // Secret path inside the mount
+	Token     string
+	RoleID    string
+	SecretID  string
+}
+
+// Vault reads the fields of a KV v2 secret.
+type Vault struct {
+	cfg    VaultConfig
+	client *http.Client
+	now    func() time.Time
+
+	mu          sync.Mutex
+	token       string
+	tokenExpiry time.Time // Zero for tokens that do not expire
+}
+
+// NewVault validates the configuration. No request is made until Read.
+func NewVault(cfg VaultConfig) (*Vault, error) {
+	if cfg.Addr == "" || cfg.Path == "" {
+		return nil, errors.New("vault requires an address and a secret path")
+	}
+	if cfg.Token == "" && (cfg.RoleID == "" || cfg.SecretID == "") {
+		return nil, errors.New("vault requires a token or an AppRole role ID and secret ID")
+	}
+	if cfg.Mount == "" {
+		cfg.Mount = "secret"
+	}
+	cfg.Addr = strings.TrimRight(cfg.Addr, "/")
+	return &Vault{
+		cfg:    cfg,
+		client: &http.Client{Timeout: 10 * time.Second},
+		now:    time.Now,
+		token:  cfg.Token,
+	}, nil
+}
+
+// Read returns the latest version of the secret. Non-string fields are JSON-encoded.
+func (v *Vault) Read(ctx context.Context) (map[string]string, error) {
+	data, err := v.read(ctx)
+	if errors.Is(err, ErrVaultAuth) && v.cfg.RoleID != "" {
+		// The AppRole token may have been revoked; log in again once.
+		v.mu.Lock()
+		v.token = ""
+		v.mu.Unlock()
+		data, err = v.read(ctx)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	result := make(map[string]string, len(data))
+	for key, raw := range data {
+		var s string
+		if err := json.Unmarshal(raw, &s); err == nil {
+			result[key] = s
+			continue
+		}
+		result[key] = string(raw)
+	}
+	return result, nil
+}
+
+func (v *Vault) read(ctx context.Context) (map[string]json.RawMessage, error) {
+	token, err := v.clientToken(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var resp struct {
+		Data struct {
+			Data map[string]json.RawMessage `json:"data"`
+		} `json:"data"`
+	}
+	url := fmt.Sprintf("%s/v1/%s/data/%s", v.cfg.Addr, strings.Trim(v.cfg.Mount, "/"), strings.Trim(v.cfg.Path, "/"))
+	if err := v.do(ctx, "GET", url, token, nil, &resp); err != nil {
+		return nil, fmt.Errorf("failed to read vault secret %s: %w", v.cfg.Path, err)
+	}
+	return resp.Data.Data, nil
+}
+
+// clientToken returns the configured token, or logs in with AppRole when the
+// previous login expired.
+func (v *Vault) clientToken(ctx context.Context) (string, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if v.cfg.RoleID == "" {
+		return v.token, nil
+	}
+	if v.token != "" && (v.tokenExpiry.IsZero() || v.now().Before(v.tokenExpiry)) {
+		return v.token, nil
+	}
+
+	var resp struct {
+		Auth struct {
+			ClientToken   string `json:"client_token"`
+			LeaseDuration int    `json:"lease_duration"`
+		} `json:"auth"`
+	}
+	body := map[string]string{"role_id": v.cfg.RoleID, "secret_id": v.cfg.SecretID}
+	if err := v.do(ctx, "POST", v.cfg.Addr+"/v1/auth/approle/login", "", body, &resp); err != nil {
+		return "", fmt.Errorf("vault approle login: %w", err)
+	}
+	if resp.Auth.ClientToken == "" {
+		return "", fmt.Errorf("vault approle login: %w", ErrVaultAuth)
+	}
+
+	v.token = resp.Auth.ClientToken
+	v.tokenExpiry = time.Time{}
+	if resp.Auth.LeaseDuration > 0 {
+		// Log in again a little before the lease ends.
+		lease := time.Duration(resp.Auth.LeaseDuration) * time.Second
+		v.tokenExpiry = v.now().Add(lease - lease/10)
+	}
+	return v.token, nil
+}
+
+func (v *Vault) do(ctx context.Context, method, url, token string, body, out interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, url, reader)
+	if err != nil {
+		return err
+	}
+	if token != "" {
+		req.Header.Set("X-Vault-Token", token)
+	}
+	if v.cfg.Namespace != "" {
+		req.Header.Set("X-Vault-Namespace", v.cfg.Namespace)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusForbidden || resp.StatusCode == http.StatusUnauthorized:
+		return ErrVaultAuth
+	case resp.StatusCode != http.StatusOK:
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("unexpected status %d: %s", resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
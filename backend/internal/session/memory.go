@@ -0,0 +1,131 @@
+package session
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// MemoryStore keeps sessions in process memory and optionally mirrors them to
+// a JSON file so that sessions survive restarts.
+type MemoryStore struct {
+	mu       sync.Mutex
+	sessions map[string]Session
+	path     string
+	dirty    bool
+}
+
+// NewMemoryStore creates a store. If path is not empty, existing sessions are
+// loaded from it and changes are written back.
+func NewMemoryStore(path string) (*MemoryStore, error) {
+	st := &MemoryStore{
+		sessions: make(map[string]Session),
+		path:     path,
+	}
+	if path == "" {
+		return st, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return st, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var sessions []Session
+	if err := json.Unmarshal(data, &sessions); err != nil {
+		return nil, err
+	}
+	for _, s := range sessions {
+		st.sessions[s.ID] = s
+	}
+	return st, nil
+}
+
+func (st *MemoryStore) Save(s *Session) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	_, existed := st.sessions[s.ID]
+	st.sessions[s.ID] = *s
+	st.dirty = true
+	if existed {
+		// Activity updates are flushed periodically to avoid a write per request.
+		return nil
+	}
+	return st.flushLocked()
+}
+
+func (st *MemoryStore) Get(id string) (*Session, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	s, ok := st.sessions[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &s, nil
+}
+
+func (st *MemoryStore) Delete(id string) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	if _, ok := st.sessions[id]; !ok {
+		return nil
+	}
+	delete(st.sessions, id)
+	st.dirty = true
+	return st.flushLocked()
+}
+
+func (st *MemoryStore) List() ([]*Session, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	result := make([]*Session, 0, len(st.sessions))
+	for _, s := range st.sessions {
+		s := s
+		result = append(result, &s)
+	}
+	return result, nil
+}
+
+// Flush writes pending changes to disk.
+func (st *MemoryStore) Flush() error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return st.flushLocked()
+}
+
+func (st *MemoryStore) flushLocked() error {
+	if st.path == "" || !st.dirty {
+		return nil
+	}
+
+	sessions := make([]Session, 0, len(st.sessions))
+	for _, s := range st.sessions {
+		sessions = append(sessions, s)
+	}
+	data, err := json.Marshal(sessions)
+	if err != nil {
+		return err
+	}
+
+	// Write to a temporary file first so a crash never leaves a truncated file.
+	tmp := st.path + ".tmp"
+	if err := os.MkdirAll(filepath.Dir(st.path), 0o700); err != nil {
+		return err
+	}
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, st.path); err != nil {
+		return err
+	}
+	st.dirty = false
+	return nil
+}
@@ -0,0 +1,242 @@
+package session
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"sort"
+	"time"
+)
+
+var (
+	// ErrNotFound indicates that the session does not exist or was revoked.
+	ErrNotFound = errors.New("session not found")
+	// ErrExpired indicates that the session exceeded its idle or absolute lifetime.
+	ErrExpired = errors.New("session expired")
+)
+
+// Session represents a server-side login session.
+type Session struct {
+	ID         string    `json:"id"`
+	User       string    `json:"user"`
+	CreatedAt  time.Time `json:"createdAt"`
+	LastSeenAt time.Time `json:"lastSeenAt"`
+	ExpiresAt  time.Time `json:"expiresAt"`
+	UserAgent  string    `json:"userAgent,omitempty"`
+	RemoteAddr string    `json:"remoteAddr,omitempty"`
+	// MFA is true if the user completed a second factor in this session.
+	MFA bool `json:"mfa"`
+}
+
+// Store persists sessions. Implementations must be safe for concurrent use.
+type Store interface {
+	Save(s *Session) error
+	Get(id string) (*Session, error)
+	Delete(id string) error
+	List() ([]*Session, error)
+}
+
+// Manager applies lifetime policy on top of a Store.
+type Manager struct {
+	store       Store
+	idleTimeout time.Duration
+	maxLifetime time.Duration
+	now         func() time.Time
+}
+
+func NewManager(store Store, idleTimeout, maxLifetime time.Duration) *Manager {
+	return &Manager{
+		store:       store,
+		idleTimeout: idleTimeout,
+		maxLifetime: maxLifetime,
+		now:         time.Now,
+	}
+}
+
+// Create starts a new session for the user.
+func (m *Manager) Create(user, userAgent, remoteAddr string, mfa bool) (*Session, error) {
+	id, err := newID()
+	if err != nil {
+		return nil, err
+	}
+
+	now := m.now()
+	s := &Session{
+		ID:         id,
+		User:       user,
+		CreatedAt:  now,
+		LastSeenAt: now,
+		ExpiresAt:  now.Add(m.maxLifetime),
+		UserAgent:  userAgent,
+		RemoteAddr: remoteAddr,
+		MFA:        mfa,
+	}
+	if err := m.store.Save(s); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Validate returns the session if it is still alive and slides its idle window.
+// The window only moves once LastSeenAt is touchInterval old, so that not
+// every request writes to the store.
+func (m *Manager) Validate(id string) (*Session, error) {
+	s, err := m.store.Get(id)
+	if err != nil {
+		return nil, err
+	}
+
+	now := m.now()
+	if m.expired(s, now) {
+		m.store.Delete(id)
+		return nil, ErrExpired
+	}
+
+	if now.Sub(s.LastSeenAt) < m.touchInterval() {
+		return s, nil
+	}
+	s.LastSeenAt = now
+	if err := m.store.Save(s); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// touchInterval is a tenth of the idle timeout, at most a minute. A session
+// may expire up to that much before the idle timeout has passed since its
+// last request.
+func (m *Manager) touchInterval() time.Duration {
+	if m.idleTimeout <= 0 {
+		return time.Minute
+	}
+	return min(m.idleTimeout/10, time.Minute)
+}
+
+// Get returns the session if it is still alive without recording activity.
+func (m *Manager) Get(id string) (*Session, error) {
+	s, err := m.store.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	if m.expired(s, m.now()) {
+		return nil, ErrExpired
+	}
+	return s, nil
+}
+
+// MarkMFA records that the user completed a second factor in the session.
+func (m *Manager) MarkMFA(id string) error {
+	s, err := m.Get(id)
+	if err != nil {
+		return err
+	}
+	s.MFA = true
+	return m.store.Save(s)
+}
+
+// IdleExpiresAt returns the moment the session expires if it stays unused.
+func (m *Manager) IdleExpiresAt(s *Session) time.Time {
+	idle := s.LastSeenAt.Add(m.idleTimeout)
+	if m.idleTimeout <= 0 || idle.After(s.ExpiresAt) {
+		return s.ExpiresAt
+	}
+	return idle
+}
+
+// Revoke deletes the session.
+func (m *Manager) Revoke(id string) error {
+	return m.store.Delete(id)
+}
+
+// RevokeUser deletes all sessions of the user and returns how many were removed.
+func (m *Manager) RevokeUser(user string) (int, error) {
+	sessions, err := m.ListUser(user)
+	if err != nil {
+		return 0, err
+	}
+	for _, s := range sessions {
+		if err := m.store.Delete(s.ID); err != nil {
+			return 0, err
+		}
+	}
+	return len(sessions), nil
+}
+
+// List returns all live sessions ordered by creation time.
+func (m *Manager) List() ([]*Session, error) {
+	all, err := m.store.List()
+	if err != nil {
+		return nil, err
+	}
+
+	now := m.now()
+	live := make([]*Session, 0, len(all))
+	for _, s := range all {
+		if m.expired(s, now) {
+			continue
+		}
+		live = append(live, s)
+	}
+	sort.Slice(live, func(i, j int) bool {
+		return live[i].CreatedAt.Before(live[j].CreatedAt)
+	})
+	return live, nil
+}
+
+// ListUser returns live sessions of the user.
+func (m *Manager) ListUser(user string) ([]*Session, error) {
+	all, err := m.List()
+	if err != nil {
+		return nil, err
+	}
+	var result []*Session
+	for _, s := range all {
+		if s.User == user {
+			result = append(result, s)
+		}
+	}
+	return result, nil
+}
+
+// Cleanup removes expired sessions from the store.
+func (m *Manager) Cleanup() {
+	all, err := m.store.List()
+	if err != nil {
+		return
+	}
+	now := m.now()
+	for _, s := range all {
+		if m.expired(s, now) {
+			m.store.Delete(s.ID)
+		}
+	}
+}
+
+// StartCleanup periodically drops expired sessions and flushes stores that
+// buffer writes.
+func (m *Manager) StartCleanup(interval time.Duration) {
+	go func() {
+		for {
+			time.Sleep(interval)
+			m.Cleanup()
+			if f, ok := m.store.(interface{ Flush() error }); ok {
+				f.Flush()
+			}
+		}
+	}()
+}
+
+func (m *Manager) expired(s *Session, now time.Time) bool {
+	if !now.Before(s.ExpiresAt) {
+		return true
+	}
+	return m.idleTimeout > 0 && now.Sub(s.LastSeenAt) > m.idleTimeout
+}
+
+func newID() (string, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,174 @@
+package session
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/generic/selectel-craas-web/internal/state"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestManager(t *testing.T, idle, max time.Duration) (*Manager, *time.Time) {
+	store, err := NewMemoryStore("")
+	require.NoError(t, err)
+
+	now := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+	m := NewManager(store, idle, max)
+	m.now = func() time.Time { return now }
+	return m, &now
+}
+
+func TestManager_IdleTimeout(t *testing.T) {
+	m, now := newTestManager(t, 10*time.Minute, time.Hour)
+
+	s, err := m.Create("alice", "ua", "127.0.0.1", false)
+	require.NoError(t, err)
+
+	// Activity within the idle window slides it forward
+	*now = now.Add(9 * time.Minute)
+	_, err = m.Validate(s.ID)
+	assert.NoError(t, err)
+
+	*now = now.Add(9 * time.Minute)
+	_, err = m.Validate(s.ID)
+	assert.NoError(t, err)
+
+	// No activity for longer than the idle timeout
+	*now = now.Add(11 * time.Minute)
+	_, err = m.Validate(s.ID)
+	assert.ErrorIs(t, err, ErrExpired)
+
+	_, err = m.Validate(s.ID)
+	assert.ErrorIs(t, err, ErrNotFound)
+}
+
+func TestManager_ValidateSavesOncePerInterval(t *testing.T) {
+	m, now := newTestManager(t, 30*time.Minute, time.Hour)
+
+	s, err := m.Create("alice", "ua", "127.0.0.1", false)
+	require.NoError(t, err)
+	created := s.LastSeenAt
+
+	// Requests within a minute leave the stored session alone
+	*now = now.Add(30 * time.Second)
+	s, err = m.Validate(s.ID)
+	require.NoError(t, err)
+	assert.Equal(t, created, s.LastSeenAt)
+
+	*now = now.Add(time.Minute)
+	s, err = m.Validate(s.ID)
+	require.NoError(t, err)
+	assert.Equal(t, *now, s.LastSeenAt)
+	stored, err := m.Get(s.ID)
+	require.NoError(t, err)
+	assert.Equal(t, *now, stored.LastSeenAt)
+}
+
+func TestManager_MaxLifetime(t *testing.T) {
+	m, now := newTestManager(t, 10*time.Minute, 30*time.Minute)
+
+	s, err := m.Create("alice", "", "", false)
+	require.NoError(t, err)
+
+	for i := 0; i < 3; i++ {
+		*now = now.Add(9 * time.Minute)
+		s, err = m.Validate(s.ID)
+		require.NoError(t, err)
+	}
+	assert.Equal(t, s.ExpiresAt, m.IdleExpiresAt(s), "idle expiry must not exceed the absolute expiry")
+
+	*now = now.Add(4 * time.Minute)
+	_, err = m.Validate(s.ID)
+	assert.ErrorIs(t, err, ErrExpired)
+}
+
+func TestManager_Revoke(t *testing.T) {
+	m, _ := newTestManager(t, time.Hour, 24*time.Hour)
+
+	a1, _ := m.Create("alice", "", "", false)
+	a2, _ := m.Create("alice", "", "", false)
+	b1, _ := m.Create("bob", "", "", false)
+
+	require.NoError(t, m.Revoke(a1.ID))
+	_, err := m.Validate(a1.ID)
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	sessions, err := m.ListUser("alice")
+	require.NoError(t, err)
+	assert.Len(t, sessions, 1)
+	assert.Equal(t, a2.ID, sessions[0].ID)
+
+	count, err := m.RevokeUser("alice")
+	require.NoError(t, err)
+	assert.Equal(t, 1, count)
+
+	all, err := m.List()
+	require.NoError(t, err)
+	assert.Len(t, all, 1)
+	assert.Equal(t, b1.ID, all[0].ID)
+}
+
+func TestMemoryStore_Persistence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sessions.json")
+
+	store, err := NewMemoryStore(path)
+	require.NoError(t, err)
+	m := NewManager(store, time.Hour, 24*time.Hour)
+
+	s, err := m.Create("alice", "", "", false)
+	require.NoError(t, err)
+
+	reloaded, err := NewMemoryStore(path)
+	require.NoError(t, err)
+	got, err := reloaded.Get(s.ID)
+	require.NoError(t, err)
+	assert.Equal(t, "alice", got.User)
+
+	require.NoError(t, m.Revoke(s.ID))
+	reloaded, err = NewMemoryStore(path)
+	require.NoError(t, err)
+	_, err = reloaded.Get(s.ID)
+	assert.ErrorIs(t, err, ErrNotFound)
+}
+
+func TestSharedStore(t *testing.T) {
+	mr := miniredis.RunT(t)
+	newReplica := func() *Manager {
+		st, err := state.NewRedis("redis://"+mr.Addr(), "test:")
+		require.NoError(t, err)
+		t.Cleanup(func() { st.Close() })
+		return NewManager(NewSharedStore(st), time.Hour, 24*time.Hour)
+	}
+	a, b := newReplica(), newReplica()
+
+	// A session started on one replica is valid on the other
+	s, err := a.Create("alice", "ua", "127.0.0.1", false)
+	require.NoError(t, err)
+	got, err := b.Validate(s.ID)
+	require.NoError(t, err)
+	assert.Equal(t, "alice", got.User)
+	require.NoError(t, b.MarkMFA(s.ID))
+	got, err = a.Get(s.ID)
+	require.NoError(t, err)
+	assert.True(t, got.MFA)
+
+	listed, err := a.ListUser("alice")
+	require.NoError(t, err)
+	assert.Len(t, listed, 1)
+
+	// And a revocation ends it everywhere
+	require.NoError(t, b.Revoke(s.ID))
+	_, err = a.Validate(s.ID)
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	// Sessions expire in Redis with their absolute lifetime
+	_, err = a.Create("bob", "ua", "127.0.0.1", false)
+	require.NoError(t, err)
+	mr.FastForward(25 * time.Hour)
+	listed, err = b.List()
+	require.NoError(t, err)
+	assert.Empty(t, listed)
+}
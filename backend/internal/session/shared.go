@@ -0,0 +1,82 @@
+package session
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/generic/selectel-craas-web/internal/state"
+)
+
+// stateTimeout bounds each call to the state store, as Store has no context.
+const stateTimeout = 5 * time.Second
+
+// SharedStore keeps sessions in a state store, so that every replica sharing
+// it accepts them. Each session expires with its absolute lifetime.
+type SharedStore struct {
+	state state.Store
+}
+
+func NewSharedStore(st state.Store) *SharedStore {
+	return &SharedStore{state: st}
+}
+
+func sessionKey(id string) string {
+	return "session/" + id
+}
+
+func (st *SharedStore) Save(s *Session) error {
+	ttl := time.Until(s.ExpiresAt)
+	if ttl <= 0 {
+		return st.Delete(s.ID)
+	}
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), stateTimeout)
+	defer cancel()
+	return st.state.Set(ctx, sessionKey(s.ID), data, ttl)
+}
+
+func (st *SharedStore) Get(id string) (*Session, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), stateTimeout)
+	defer cancel()
+	data, err := st.state.Get(ctx, sessionKey(id))
+	if errors.Is(err, state.ErrNotFound) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	var s Session
+	if err := json.Unmarshal(data, &s); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+func (st *SharedStore) Delete(id string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), stateTimeout)
+	defer cancel()
+	return st.state.Delete(ctx, sessionKey(id))
+}
+
+func (st *SharedStore) List() ([]*Session, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), stateTimeout)
+	defer cancel()
+	found, err := st.state.Scan(ctx, sessionKey(""))
+	if err != nil {
+		return nil, err
+	}
+	result := make([]*Session, 0, len(found))
+	for _, data := range found {
+		var s Session
+		if err := json.Unmarshal(data, &s); err != nil {
+			continue
+		}
+		result = append(result, &s)
+	}
+	return result, nil
+}
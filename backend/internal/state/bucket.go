@@ -0,0 +1,60 @@
+package state
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+)
+
+// Limit is a token bucket that holds Burst tokens and gains one every Every.
+type Limit struct {
+	Every time.Duration
+	Burst int
+}
+
+// Decision is the outcome of taking a token.
+type Decision struct {
+	Allowed    bool
+	Remaining  int           // Whole tokens left
+	RetryAfter time.Duration // Until the next token, when not allowed
+}
+
+type bucket struct {
+	Tokens float64   `json:"tokens"`
+	At     time.Time `json:"at"`
+}
+
+// Allow takes a token from the bucket stored under key. A bucket that is not
+// used until it is full again is dropped.
+func Allow(ctx context.Context, st Store, key string, l Limit, now time.Time) (Decision, error) {
+	var d Decision
+	err := st.Update(ctx, key, func(old []byte) ([]byte, time.Duration, error) {
+		b := bucket{Tokens: float64(l.Burst), At: now}
+		if old != nil {
+			if err := json.Unmarshal(old, &b); err != nil {
+				b = bucket{Tokens: float64(l.Burst), At: now}
+			}
+			if elapsed := now.Sub(b.At); elapsed > 0 {
+				b.Tokens = min(float64(l.Burst), b.Tokens+float64(elapsed)/float64(l.Every))
+			}
+			b.At = now
+		}
+
+		d = Decision{}
+		if b.Tokens >= 1 {
+			b.Tokens--
+			d.Allowed = true
+		} else {
+			d.RetryAfter = time.Duration((1 - b.Tokens) * float64(l.Every))
+		}
+		d.Remaining = int(b.Tokens)
+
+		value, err := json.Marshal(b)
+		if err != nil {
+			return nil, 0, err
+		}
+		refill := time.Duration((float64(l.Burst) - b.Tokens) * float64(l.Every))
+		return value, max(refill, time.Second), nil
+	})
+	return d, err
+}
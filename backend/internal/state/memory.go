@@ -0,0 +1,121 @@
+package state
+
+import (
+	"context"
+	"maps"
+	"strings"
+	"sync"
+	"time"
+)
+
+// memorySweepInterval is how often writes drop expired keys.
+const memorySweepInterval = time.Minute
+
+// Memory keeps the state in process memory. It is the default for a single
+// replica.
+type Memory struct {
+	mu      sync.Mutex
+	entries map[string]memoryEntry
+	swept   time.Time
+	now     func() time.Time
+}
+
+type memoryEntry struct {
+	value   []byte
+	expires time.Time // Zero without expiry
+}
+
+func NewMemory() *Memory {
+	return &Memory{entries: make(map[string]memoryEntry), now: time.Now}
+}
+
+func (m *Memory) Get(ctx context.Context, key string) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	value, ok := m.getLocked(key, m.now())
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return value, nil
+}
+
+func (m *Memory) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.setLocked(key, value, ttl, m.now())
+	return nil
+}
+
+func (m *Memory) Delete(ctx context.Context, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.entries, key)
+	return nil
+}
+
+func (m *Memory) Update(ctx context.Context, key string, fn UpdateFunc) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := m.now()
+	old, _ := m.getLocked(key, now)
+	value, ttl, err := fn(old)
+	if err != nil {
+		return err
+	}
+	if value == nil {
+		delete(m.entries, key)
+		return nil
+	}
+	m.setLocked(key, value, ttl, now)
+	return nil
+}
+
+func (m *Memory) Scan(ctx context.Context, prefix string) (map[string][]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := m.now()
+	result := make(map[string][]byte)
+	for key := range m.entries {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		if value, ok := m.getLocked(key, now); ok {
+			result[key] = value
+		}
+	}
+	return result, nil
+}
+
+func (m *Memory) Close() error {
+	return nil
+}
+
+// getLocked returns a copy of the value, so that callers may keep it. The
+// caller must hold the lock.
+func (m *Memory) getLocked(key string, now time.Time) ([]byte, bool) {
+	e, ok := m.entries[key]
+	if !ok {
+		return nil, false
+	}
+	if !e.expires.IsZero() && !now.Before(e.expires) {
+		delete(m.entries, key)
+		return nil, false
+	}
+	return append([]byte{}, e.value...), true
+}
+
+// setLocked stores a copy of value and from time to time drops expired keys.
+// The caller must hold the lock.
+func (m *Memory) setLocked(key string, value []byte, ttl time.Duration, now time.Time) {
+	if now.Sub(m.swept) >= memorySweepInterval {
+		m.swept = now
+		maps.DeleteFunc(m.entries, func(_ string, e memoryEntry) bool {
+			return !e.expires.IsZero() && !now.Before(e.expires)
+		})
+	}
+	e := memoryEntry{value: append([]byte{}, value...)}
+	if ttl > 0 {
+		e.expires = now.Add(ttl)
+	}
+	m.entries[key] = e
+}
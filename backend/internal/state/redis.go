@@ -0,0 +1,146 @@
+package state
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// maxUpdateAttempts bounds the retries of an Update that keeps racing.
+const maxUpdateAttempts = 16
+
+// scanBatch is the number of keys Scan asks for and reads at once.
+const scanBatch = 100
+
+// Redis shares the state between replicas. Every key is prefixed with
+// STATE_PREFIX, so that several deployments can use one database.
+type Redis struct {
+	client *redis.Client
+	prefix string
+}
+
+// NewRedis connects to the database at url, e.g. redis://:password@host:6379/0
+// or rediss:// for TLS.
+func NewRedis(url, prefix string) (*Redis, error) {
+	opts, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, fmt.Errorf("invalid REDIS_URL: %w", err)
+	}
+	client := redis.NewClient(opts)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := client.Ping(ctx).Err(); err != nil {
+		client.Close()
+		return nil, fmt.Errorf("failed to connect to Redis: %w", err)
+	}
+	return &Redis{client: client, prefix: prefix}, nil
+}
+
+func (r *Redis) Get(ctx context.Context, key string) ([]byte, error) {
+	value, err := r.client.Get(ctx, r.prefix+key).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, ErrNotFound
+	}
+	return value, err
+}
+
+func (r *Redis) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	return r.client.Set(ctx, r.prefix+key, value, ttl).Err()
+}
+
+func (r *Redis) Delete(ctx context.Context, key string) error {
+	return r.client.Del(ctx, r.prefix+key).Err()
+}
+
+// Update watches the key and retries when another writer changed it before
+// the transaction ran.
+func (r *Redis) Update(ctx context.Context, key string, fn UpdateFunc) error {
+	k := r.prefix + key
+	for range maxUpdateAttempts {
+		err := r.client.Watch(ctx, func(tx *redis.Tx) error {
+			old, err := tx.Get(ctx, k).Bytes()
+			if errors.Is(err, redis.Nil) {
+				old = nil
+			} else if err != nil {
+				return err
+			}
+
+			value, ttl, err := fn(old)
+			if err != nil {
+				return err
+			}
+			_, err = tx.TxPipelined(ctx, func(p redis.Pipeliner) error {
+				if value == nil {
+					p.Del(ctx, k)
+				} else {
+					p.Set(ctx, k, value, ttl)
+				}
+				return nil
+			})
+			return err
+		}, k)
+		if !errors.Is(err, redis.TxFailedErr) {
+			return err
+		}
+	}
+	return ErrConflict
+}
+
+func (r *Redis) Scan(ctx context.Context, prefix string) (map[string][]byte, error) {
+	result := make(map[string][]byte)
+	iter := r.client.Scan(ctx, 0, escapeGlob(r.prefix+prefix)+"*", scanBatch).Iterator()
+	var keys []string
+	flush := func() error {
+		if len(keys) == 0 {
+			return nil
+		}
+		values, err := r.client.MGet(ctx, keys...).Result()
+		if err != nil {
+			return err
+		}
+		for i, v := range values {
+			if s, ok := v.(string); ok { // Nil if the key expired meanwhile
+				result[strings.TrimPrefix(keys[i], r.prefix)] = []byte(s)
+			}
+		}
+		keys = keys[:0]
+		return nil
+	}
+
+	for iter.Next(ctx) {
+		keys = append(keys, iter.Val())
+		if len(keys) == scanBatch {
+			if err := flush(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return nil, err
+	}
+	if err := flush(); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (r *Redis) Close() error {
+	return r.client.Close()
+}
+
+// escapeGlob quotes the characters that are special in a SCAN pattern.
+func escapeGlob(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if strings.IndexByte(`*?[]\`, s[i]) >= 0 {
+			b.WriteByte('\\')
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
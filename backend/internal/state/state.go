@@ -0,0 +1,193 @@
+// Package state holds the state that replicas behind a load balancer must
+// agree on: rate-limit buckets, login lockouts, Selectel tokens, sessions,
+// listing caches and locks. The default Memory store keeps it in the process;
+// Redis shares it between replicas.
+package state
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/generic/selectel-craas-web/internal/config"
+)
+
+var (
+	ErrNotFound = errors.New("state: key not found")
+	ErrLocked   = errors.New("state: locked by another holder")
+	// ErrConflict means an Update kept racing with other writers.
+	ErrConflict = errors.New("state: too many concurrent updates")
+)
+
+// UpdateFunc computes the new value of a key from the current one, which is
+// nil if the key does not exist. Returning a nil value deletes the key. A ttl
+// of 0 keeps the value until it is deleted.
+type UpdateFunc func(old []byte) (value []byte, ttl time.Duration, err error)
+
+// Store is a key-value store with expiring keys. Implementations must be safe
+// for concurrent use, also by several processes sharing one backend.
+type Store interface {
+	// Get returns the value of key or ErrNotFound.
+	Get(ctx context.Context, key string) ([]byte, error)
+	// Set stores value under key for ttl, or without expiry if ttl is 0.
+	Set(ctx context.Context, key string, value []byte, ttl time.Duration) error
+	Delete(ctx context.Context, key string) error
+	// Update atomically replaces the value of key. fn may be called more
+	// than once when other writers change the key meanwhile; its error is
+	// returned as is.
+	Update(ctx context.Context, key string, fn UpdateFunc) error
+	// Scan returns the keys starting with prefix and their values.
+	Scan(ctx context.Context, prefix string) (map[string][]byte, error)
+	Close() error
+}
+
+// New returns the store selected by STATE_BACKEND.
+func New(cfg *config.Config) (Store, error) {
+	switch cfg.StateBackend {
+	case "", config.StateBackendMemory:
+		return NewMemory(), nil
+	case config.StateBackendRedis:
+		return NewRedis(cfg.RedisURL, cfg.StatePrefix)
+	default:
+		return nil, fmt.Errorf("unknown state backend %q", cfg.StateBackend)
+	}
+}
+
+// Take returns the value of key and deletes it, so that only one caller gets it.
+func Take(ctx context.Context, st Store, key string) ([]byte, error) {
+	var value []byte
+	err := st.Update(ctx, key, func(old []byte) ([]byte, time.Duration, error) {
+		value = old
+		return nil, 0, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if value == nil {
+		return nil, ErrNotFound
+	}
+	return value, nil
+}
+
+// GetOrSet stores value under key unless the key exists, and returns the
+// value that is stored.
+func GetOrSet(ctx context.Context, st Store, key string, value []byte, ttl time.Duration) ([]byte, error) {
+	var result []byte
+	err := st.Update(ctx, key, func(old []byte) ([]byte, time.Duration, error) {
+		if old != nil {
+			result = old
+			return nil, 0, errKeep
+		}
+		result = value
+		return value, ttl, nil
+	})
+	if errors.Is(err, errKeep) {
+		err = nil
+	}
+	return result, err
+}
+
+// errKeep aborts an Update without changing the key.
+var errKeep = errors.New("keep")
+
+// lockRetry is how often Lock tries again to acquire a held lock.
+const lockRetry = 50 * time.Millisecond
+
+// TryLock acquires the lock named key for at most ttl, or returns ErrLocked.
+// The returned function releases it, unless it expired and was taken by
+// someone else meanwhile.
+func TryLock(ctx context.Context, st Store, key string, ttl time.Duration) (func(), error) {
+	owner, err := acquire(ctx, st, key, ttl)
+	if err != nil {
+		return nil, err
+	}
+	return func() {
+		release(ctx, st, key, owner)
+	}, nil
+}
+
+// TryHold is TryLock for tasks that may outlast ttl: the lock is extended
+// every ttl/3 until it is released, so ttl only bounds how long a holder
+// that died keeps others waiting.
+func TryHold(ctx context.Context, st Store, key string, ttl time.Duration) (func(), error) {
+	owner, err := acquire(ctx, st, key, ttl)
+	if err != nil {
+		return nil, err
+	}
+	bg, stop := context.WithCancel(context.WithoutCancel(ctx))
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(ttl / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-bg.Done():
+				return
+			case <-ticker.C:
+			}
+			st.Update(bg, "lock/"+key, func(old []byte) ([]byte, time.Duration, error) {
+				if string(old) != string(owner) {
+					return nil, 0, errKeep // Lost it, e.g. while the store was unreachable
+				}
+				return owner, ttl, nil
+			})
+		}
+	}()
+	return func() {
+		stop()
+		<-done
+		release(ctx, st, key, owner)
+	}, nil
+}
+
+// acquire stores a random owner under the lock named key if it is free.
+func acquire(ctx context.Context, st Store, key string, ttl time.Duration) ([]byte, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	owner := []byte(hex.EncodeToString(b))
+
+	err := st.Update(ctx, "lock/"+key, func(old []byte) ([]byte, time.Duration, error) {
+		if old != nil {
+			return nil, 0, ErrLocked
+		}
+		return owner, ttl, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return owner, nil
+}
+
+// release deletes the lock named key if owner still holds it, even if the
+// caller's context is done.
+func release(ctx context.Context, st Store, key string, owner []byte) {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 5*time.Second)
+	defer cancel()
+	st.Update(ctx, "lock/"+key, func(old []byte) ([]byte, time.Duration, error) {
+		if string(old) != string(owner) {
+			return nil, 0, errKeep
+		}
+		return nil, 0, nil
+	})
+}
+
+// Lock waits until it acquires the lock named key, see TryLock.
+func Lock(ctx context.Context, st Store, key string, ttl time.Duration) (func(), error) {
+	for {
+		unlock, err := TryLock(ctx, st, key, ttl)
+		if !errors.Is(err, ErrLocked) {
+			return unlock, err
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(lockRetry):
+		}
+	}
+}
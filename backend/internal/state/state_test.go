@@ -0,0 +1,200 @@
+package state
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// backends returns every Store implementation with a function that moves its
+// clock forward. Redis is played by miniredis.
+func backends() map[string]func(t *testing.T) (Store, func(time.Duration)) {
+	return map[string]func(t *testing.T) (Store, func(time.Duration)){
+		"memory": func(t *testing.T) (Store, func(time.Duration)) {
+			m := NewMemory()
+			var mu sync.Mutex
+			now := time.Now()
+			m.now = func() time.Time {
+				mu.Lock()
+				defer mu.Unlock()
+				return now
+			}
+			return m, func(d time.Duration) {
+				mu.Lock()
+				defer mu.Unlock()
+				now = now.Add(d)
+			}
+		},
+		"redis": func(t *testing.T) (Store, func(time.Duration)) {
+			mr := miniredis.RunT(t)
+			r, err := NewRedis("redis://"+mr.Addr(), "test:")
+			require.NoError(t, err)
+			t.Cleanup(func() { r.Close() })
+			return r, mr.FastForward
+		},
+	}
+}
+
+func TestStore(t *testing.T) {
+	for name, newStore := range backends() {
+		t.Run(name, func(t *testing.T) {
+			st, advance := newStore(t)
+			ctx := t.Context()
+
+			_, err := st.Get(ctx, "a")
+			assert.ErrorIs(t, err, ErrNotFound)
+
+			require.NoError(t, st.Set(ctx, "a", []byte("1"), time.Minute))
+			require.NoError(t, st.Set(ctx, "b", []byte("2"), 0))
+			require.NoError(t, st.Set(ctx, "c*", []byte("3"), 0))
+			value, err := st.Get(ctx, "a")
+			require.NoError(t, err)
+			assert.Equal(t, "1", string(value))
+
+			// Prefixes are literal
+			found, err := st.Scan(ctx, "c*")
+			require.NoError(t, err)
+			assert.Equal(t, map[string][]byte{"c*": []byte("3")}, found)
+
+			advance(2 * time.Minute)
+			_, err = st.Get(ctx, "a")
+			assert.ErrorIs(t, err, ErrNotFound)
+			found, err = st.Scan(ctx, "")
+			require.NoError(t, err)
+			assert.Len(t, found, 2)
+
+			require.NoError(t, st.Delete(ctx, "b"))
+			_, err = st.Get(ctx, "b")
+			assert.ErrorIs(t, err, ErrNotFound)
+
+			// Take gets a value only once
+			value, err = Take(ctx, st, "c*")
+			require.NoError(t, err)
+			assert.Equal(t, "3", string(value))
+			_, err = Take(ctx, st, "c*")
+			assert.ErrorIs(t, err, ErrNotFound)
+
+			// GetOrSet keeps the first value
+			value, err = GetOrSet(ctx, st, "secret", []byte("first"), 0)
+			require.NoError(t, err)
+			assert.Equal(t, "first", string(value))
+			value, err = GetOrSet(ctx, st, "secret", []byte("second"), 0)
+			require.NoError(t, err)
+			assert.Equal(t, "first", string(value))
+		})
+	}
+}
+
+func TestUpdateConcurrent(t *testing.T) {
+	for name, newStore := range backends() {
+		t.Run(name, func(t *testing.T) {
+			st, _ := newStore(t)
+			ctx := t.Context()
+
+			var wg sync.WaitGroup
+			for range 4 {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for range 5 {
+						err := st.Update(ctx, "counter", func(old []byte) ([]byte, time.Duration, error) {
+							return append(old, 'x'), 0, nil
+						})
+						assert.NoError(t, err)
+					}
+				}()
+			}
+			wg.Wait()
+
+			value, err := st.Get(ctx, "counter")
+			require.NoError(t, err)
+			assert.Len(t, value, 20)
+		})
+	}
+}
+
+func TestAllow(t *testing.T) {
+	for name, newStore := range backends() {
+		t.Run(name, func(t *testing.T) {
+			st, _ := newStore(t)
+			ctx := t.Context()
+			l := Limit{Every: time.Minute, Burst: 2}
+			now := time.Now()
+
+			d, err := Allow(ctx, st, "ip", l, now)
+			require.NoError(t, err)
+			assert.Equal(t, Decision{Allowed: true, Remaining: 1}, d)
+			d, _ = Allow(ctx, st, "ip", l, now)
+			assert.Equal(t, Decision{Allowed: true, Remaining: 0}, d)
+
+			d, _ = Allow(ctx, st, "ip", l, now.Add(15*time.Second))
+			assert.False(t, d.Allowed)
+			assert.Equal(t, 45*time.Second, d.RetryAfter)
+
+			d, _ = Allow(ctx, st, "other", l, now)
+			assert.True(t, d.Allowed)
+
+			// A token per minute
+			d, _ = Allow(ctx, st, "ip", l, now.Add(time.Minute))
+			assert.True(t, d.Allowed)
+		})
+	}
+}
+
+func TestLock(t *testing.T) {
+	for name, newStore := range backends() {
+		t.Run(name, func(t *testing.T) {
+			st, advance := newStore(t)
+			ctx := t.Context()
+
+			unlock, err := TryLock(ctx, st, "crawl", time.Minute)
+			require.NoError(t, err)
+			_, err = TryLock(ctx, st, "crawl", time.Minute)
+			assert.ErrorIs(t, err, ErrLocked)
+			unlock()
+
+			unlock, err = TryLock(ctx, st, "crawl", time.Minute)
+			require.NoError(t, err)
+
+			// An expired lock can be taken, and the first holder does not
+			// release the new one
+			advance(2 * time.Minute)
+			unlock2, err := Lock(ctx, st, "crawl", time.Minute)
+			require.NoError(t, err)
+			unlock()
+			_, err = TryLock(ctx, st, "crawl", time.Minute)
+			assert.ErrorIs(t, err, ErrLocked)
+			unlock2()
+		})
+	}
+}
+
+func TestHold(t *testing.T) {
+	for name, newStore := range backends() {
+		t.Run(name, func(t *testing.T) {
+			st, advance := newStore(t)
+			ctx := t.Context()
+			ttl := 30 * time.Millisecond
+
+			release, err := TryHold(ctx, st, "crawl", ttl)
+			require.NoError(t, err)
+
+			// The lock outlives its ttl while it is held
+			for range 3 {
+				advance(ttl * 2 / 3)
+				time.Sleep(ttl)
+				_, err = TryLock(ctx, st, "crawl", ttl)
+				assert.ErrorIs(t, err, ErrLocked)
+			}
+
+			release()
+			unlock, err := TryLock(ctx, st, "crawl", ttl)
+			require.NoError(t, err)
+			unlock()
+		})
+	}
+}
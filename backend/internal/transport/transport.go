@@ -0,0 +1,97 @@
+// Package transport builds the HTTP client shared by all calls to Selectel.
+package transport
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/generic/selectel-craas-web/internal/config"
+	"github.com/generic/selectel-craas-web/internal/governor"
+	"github.com/generic/selectel-craas-web/internal/resilience"
+)
+
+// New returns a client with one pooled transport configured by the
+// OUTBOUND_* variables, wrapped with the UPSTREAM_* concurrency limits,
+// retries and circuit breakers. Limits apply per attempt, so backoff does
+// not hold a slot. It has no overall timeout: callers bound each operation
+// with a context deadline instead.
+func New(cfg *config.Config) (*http.Client, error) {
+	t, err := newTransport(cfg)
+	if err != nil {
+		return nil, err
+	}
+	limited := governor.New(t, governor.Options{
+		Global:     cfg.UpstreamMaxConcurrency,
+		PerProject: cfg.UpstreamMaxConcurrencyPerProject,
+	})
+	return &http.Client{Transport: resilience.New(limited, resilience.Options{
+		Retries:          cfg.UpstreamRetries,
+		BaseDelay:        cfg.UpstreamRetryBaseDelay,
+		MaxDelay:         cfg.UpstreamRetryMaxDelay,
+		BreakerThreshold: cfg.UpstreamBreakerThreshold,
+		BreakerCooldown:  cfg.UpstreamBreakerCooldown,
+	})}, nil
+}
+
+func newTransport(cfg *config.Config) (*http.Transport, error) {
+	proxy := http.ProxyFromEnvironment
+	if cfg.OutboundProxy != "" {
+		u, err := url.Parse(cfg.OutboundProxy)
+		if err != nil || u.Host == "" {
+			return nil, fmt.Errorf("invalid OUTBOUND_PROXY %q", cfg.OutboundProxy)
+		}
+		proxy = http.ProxyURL(u)
+	}
+
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if len(cfg.OutboundCAFiles) > 0 {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		for _, file := range cfg.OutboundCAFiles {
+			pem, err := os.ReadFile(file)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read CA bundle: %w", err)
+			}
+			if !pool.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("no certificates found in CA bundle %s", file)
+			}
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if cfg.OutboundClientCert != "" || cfg.OutboundClientKey != "" {
+		if cfg.OutboundClientCert == "" || cfg.OutboundClientKey == "" {
+			return nil, errors.New("OUTBOUND_CLIENT_CERT and OUTBOUND_CLIENT_KEY must be set together")
+		}
+		cert, err := tls.LoadX509KeyPair(cfg.OutboundClientCert, cfg.OutboundClientKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return &http.Transport{
+		Proxy: proxy,
+		DialContext: (&net.Dialer{
+			Timeout:   10 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		TLSClientConfig:       tlsConfig,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          100,
+		MaxIdleConnsPerHost:   max(cfg.OutboundMaxIdleConnsPerHost, 1),
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: time.Second,
+	}, nil
+}
@@ -0,0 +1,125 @@
+package transport
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/generic/selectel-craas-web/internal/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeCA stores the certificate of a TLS test server as a PEM bundle.
+func writeCA(t *testing.T, ts *httptest.Server) string {
+	path := filepath.Join(t.TempDir(), "ca.pem")
+	data := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ts.Certificate().Raw})
+	require.NoError(t, os.WriteFile(path, data, 0o600))
+	return path
+}
+
+func TestCustomCA(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+
+	client, err := New(&config.Config{})
+	require.NoError(t, err)
+	_, err = client.Get(ts.URL)
+	assert.Error(t, err, "the test CA is not trusted by default")
+
+	client, err = New(&config.Config{OutboundCAFiles: []string{writeCA(t, ts)}})
+	require.NoError(t, err)
+	resp, err := client.Get(ts.URL)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+func TestClientCertificate(t *testing.T) {
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.TLS.PeerCertificates[0].Subject.CommonName))
+	}))
+	ts.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+	ts.StartTLS()
+	defer ts.Close()
+
+	// Self-signed client certificate
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "craas-ui"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	require.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600))
+	require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600))
+
+	client, err := New(&config.Config{
+		OutboundCAFiles:    []string{writeCA(t, ts)},
+		OutboundClientCert: certFile,
+		OutboundClientKey:  keyFile,
+	})
+	require.NoError(t, err)
+	resp, err := client.Get(ts.URL)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	assert.Equal(t, "craas-ui", string(body))
+}
+
+func TestProxy(t *testing.T) {
+	var proxied bool
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied = r.URL.Host == "selectel.invalid"
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer proxy.Close()
+
+	client, err := New(&config.Config{OutboundProxy: proxy.URL})
+	require.NoError(t, err)
+	resp, err := client.Get("http://selectel.invalid/v1/registries")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.True(t, proxied)
+
+	u, _ := url.Parse(proxy.URL)
+	_, err = New(&config.Config{OutboundProxy: u.Host})
+	assert.Error(t, err, "the proxy needs a scheme")
+}
+
+func TestInvalidConfig(t *testing.T) {
+	_, err := New(&config.Config{OutboundCAFiles: []string{"/nonexistent.pem"}})
+	assert.Error(t, err)
+
+	empty := filepath.Join(t.TempDir(), "empty.pem")
+	require.NoError(t, os.WriteFile(empty, []byte("not a certificate"), 0o600))
+	_, err = New(&config.Config{OutboundCAFiles: []string{empty}})
+	assert.Error(t, err)
+
+	_, err = New(&config.Config{OutboundClientCert: "cert.pem"})
+	assert.Error(t, err, "the key is required too")
+}
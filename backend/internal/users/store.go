@@ -0,0 +1,261 @@
+package users
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/generic/selectel-craas-web/internal/state"
+	"github.com/go-webauthn/webauthn/webauthn"
+)
+
+// User holds per-user authentication settings of the web interface.
+type User struct {
+	Name string `json:"name"`
+	TOTP *TOTP  `json:"totp,omitempty"`
+
+	// WebAuthnID is the random user handle shared with authenticators.
+	WebAuthnID []byte    `json:"webauthnId,omitempty"`
+	Passkeys   []Passkey `json:"passkeys,omitempty"`
+
+	// SelectelCredentials are the user's own Selectel credentials, encrypted.
+	SelectelCredentials string `json:"selectelCredentials,omitempty"`
+}
+
+// Passkey is a registered WebAuthn credential.
+type Passkey struct {
+	Name       string              `json:"name"`
+	CreatedAt  time.Time           `json:"createdAt"`
+	LastUsedAt time.Time           `json:"lastUsedAt,omitempty"`
+	Credential webauthn.Credential `json:"credential"`
+}
+
+// TOTP holds the time-based one-time password enrollment of a user.
+type TOTP struct {
+	// Secret is the active base32 secret. Empty until enrollment is confirmed.
+	// Sealed by the API when an encryption key is configured, plaintext otherwise.
+	Secret string `json:"secret,omitempty"`
+	// PendingSecret is a secret that was issued but not confirmed yet, stored
+	// like Secret.
+	PendingSecret string `json:"pendingSecret,omitempty"`
+	// LastUsedStep prevents replaying a code within its validity window.
+	LastUsedStep int64 `json:"lastUsedStep,omitempty"`
+	// RecoveryCodes are SHA-256 hashes of unused recovery codes.
+	RecoveryCodes []string `json:"recoveryCodes,omitempty"`
+}
+
+// TOTPEnabled reports whether the user has a confirmed TOTP enrollment.
+func (u *User) TOTPEnabled() bool {
+	return u != nil && u.TOTP != nil && u.TOTP.Secret != ""
+}
+
+// Store keeps users in memory and optionally persists them to a JSON file,
+// or keeps them in a state store shared by every replica.
+type Store struct {
+	mu     sync.Mutex
+	users  map[string]*User
+	path   string
+	shared state.Store
+}
+
+// stateTimeout bounds each call to the shared state store.
+const stateTimeout = 5 * time.Second
+
+func userKey(name string) string {
+	return "user/" + name
+}
+
+// NewStore creates a store. If path is not empty, users are loaded from it and
+// every change is written back.
+func NewStore(path string) (*Store, error) {
+	s := &Store{
+		users: make(map[string]*User),
+		path:  path,
+	}
+	if path == "" {
+		return s, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var list []*User
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, err
+	}
+	for _, u := range list {
+		s.users[u.Name] = u
+	}
+	return s, nil
+}
+
+// Share keeps the users in st instead of the file, so that an enrollment,
+// a passkey or credentials saved through one replica are seen by all. Users
+// loaded from the file that st does not know yet are copied to it. It must be
+// called before the store is used.
+func (s *Store) Share(st state.Store) error {
+	ctx, cancel := context.WithTimeout(context.Background(), stateTimeout)
+	defer cancel()
+	for name, u := range s.users {
+		data, err := json.Marshal(u)
+		if err != nil {
+			return err
+		}
+		if _, err := state.GetOrSet(ctx, st, userKey(name), data, 0); err != nil {
+			return err
+		}
+	}
+	s.shared = st
+	s.users = nil
+	return nil
+}
+
+// Get returns a copy of the user. The second value is false if the user has
+// no stored settings. Only a shared store fails.
+func (s *Store) Get(name string) (*User, bool, error) {
+	if s.shared != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), stateTimeout)
+		defer cancel()
+		data, err := s.shared.Get(ctx, userKey(name))
+		if errors.Is(err, state.ErrNotFound) {
+			return &User{Name: name}, false, nil
+		}
+		if err != nil {
+			return nil, false, err
+		}
+		var u User
+		if err := json.Unmarshal(data, &u); err != nil {
+			return nil, false, err
+		}
+		return &u, true, nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u, ok := s.users[name]
+	if !ok {
+		return &User{Name: name}, false, nil
+	}
+	return clone(u), true, nil
+}
+
+// Find returns a copy of the first user matching the predicate.
+func (s *Store) Find(match func(u *User) bool) (*User, bool, error) {
+	if s.shared != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), stateTimeout)
+		defer cancel()
+		found, err := s.shared.Scan(ctx, userKey(""))
+		if err != nil {
+			return nil, false, err
+		}
+		for _, data := range found {
+			var u User
+			if json.Unmarshal(data, &u) == nil && match(&u) {
+				return &u, true, nil
+			}
+		}
+		return nil, false, nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, u := range s.users {
+		if match(u) {
+			return clone(u), true, nil
+		}
+	}
+	return nil, false, nil
+}
+
+// Update applies fn to the user and persists the result. Changes are discarded
+// if fn returns an error. With a shared store, fn runs again when another
+// replica changed the user meanwhile.
+func (s *Store) Update(name string, fn func(u *User) error) error {
+	if s.shared != nil {
+		return s.updateShared(name, fn)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u, ok := s.users[name]
+	if !ok {
+		u = &User{Name: name}
+	}
+	updated := clone(u)
+	if err := fn(updated); err != nil {
+		return err
+	}
+
+	s.users[name] = updated
+	if err := s.saveLocked(); err != nil {
+		// Keep memory consistent with what is on disk.
+		if ok {
+			s.users[name] = u
+		} else {
+			delete(s.users, name)
+		}
+		return err
+	}
+	return nil
+}
+
+func (s *Store) updateShared(name string, fn func(u *User) error) error {
+	ctx, cancel := context.WithTimeout(context.Background(), stateTimeout)
+	defer cancel()
+	return s.shared.Update(ctx, userKey(name), func(old []byte) ([]byte, time.Duration, error) {
+		u := &User{Name: name}
+		if old != nil {
+			if err := json.Unmarshal(old, u); err != nil {
+				return nil, 0, err
+			}
+		}
+		if err := fn(u); err != nil {
+			return nil, 0, err
+		}
+		data, err := json.Marshal(u)
+		return data, 0, err
+	})
+}
+
+func (s *Store) saveLocked() error {
+	if s.path == "" {
+		return nil
+	}
+
+	list := make([]*User, 0, len(s.users))
+	for _, u := range s.users {
+		list = append(list, u)
+	}
+	data, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(s.path), 0o700); err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+// clone returns a deep copy so callers never share state with the store.
+func clone(u *User) *User {
+	data, _ := json.Marshal(u)
+	var c User
+	json.Unmarshal(data, &c)
+	return &c
+}
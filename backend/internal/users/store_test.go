@@ -0,0 +1,61 @@
+package users
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/generic/selectel-craas-web/internal/state"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSharedStore(t *testing.T) {
+	// A user enrolled before the replicas shared their state
+	path := filepath.Join(t.TempDir(), "users.json")
+	local, err := NewStore(path)
+	require.NoError(t, err)
+	require.NoError(t, local.Update("alice", func(u *User) error {
+		u.TOTP = &TOTP{Secret: "ALICE"}
+		return nil
+	}))
+
+	st := state.NewMemory()
+	a, err := NewStore(path)
+	require.NoError(t, err)
+	require.NoError(t, a.Share(st))
+	b, err := NewStore("")
+	require.NoError(t, err)
+	require.NoError(t, b.Share(st))
+
+	u, found, err := b.Get("alice")
+	require.NoError(t, err)
+	assert.True(t, found)
+	assert.True(t, u.TOTPEnabled(), "existing users are copied to the shared store")
+
+	// A change through one replica is seen by the other
+	require.NoError(t, b.Update("bob", func(u *User) error {
+		u.WebAuthnID = []byte("bob-handle")
+		return nil
+	}))
+	u, found, err = a.Find(func(u *User) bool { return string(u.WebAuthnID) == "bob-handle" })
+	require.NoError(t, err)
+	require.True(t, found)
+	assert.Equal(t, "bob", u.Name)
+
+	// A failing update changes nothing
+	errRejected := errors.New("rejected")
+	err = a.Update("alice", func(u *User) error {
+		u.TOTP = nil
+		return errRejected
+	})
+	assert.ErrorIs(t, err, errRejected)
+	u, _, err = b.Get("alice")
+	require.NoError(t, err)
+	assert.True(t, u.TOTPEnabled())
+
+	u, found, err = a.Get("carol")
+	require.NoError(t, err)
+	assert.False(t, found)
+	assert.Equal(t, "carol", u.Name)
+}
@@ -9,6 +9,21 @@ const client = axios.create({
   }
 })
 
+// CSRF token echoed back on state-changing requests (double-submit).
+let csrfToken: string | null = null
+
+export const setCsrfToken = (token: string | null) => {
+  csrfToken = token
+}
+
+client.interceptors.request.use(config => {
+  const method = (config.method || 'get').toLowerCase()
+  if (csrfToken && !['get', 'head', 'options'].includes(method)) {
+    config.headers.set('X-CSRF-Token', csrfToken)
+  }
+  return config
+})
+
 client.interceptors.response.use(
   response => response,
   error => {
@@ -53,7 +68,9 @@ export const formatError = (err: unknown): string => {
         return data
     }
     if (data && typeof data === 'object' && 'error' in data) {
-      return String((data as { error: unknown }).error)
+      const { error, requestId } = data as { error: unknown, requestId?: string }
+      // The request ID lets operators find the failure in the server logs
+      return requestId ? `${String(error)} (request ${requestId})` : String(error)
     }
     return err.message
   } else if (err instanceof Error) {
@@ -1,6 +1,12 @@
 import { defineStore } from 'pinia'
 import { ref, computed } from 'vue'
-import client from '@/api/client'
+import client, { setCsrfToken } from '@/api/client'
+
+interface LoginResponse {
+  user: string
+  mfaRequired?: boolean
+  mfaToken?: string
+}
 
 export const useAuthStore = defineStore('auth', () => {
   const user = ref<string | null>(localStorage.getItem('auth_user'))
@@ -13,6 +19,9 @@ export const useAuthStore = defineStore('auth', () => {
       if (res.data.authenticated) {
         user.value = res.data.user
         localStorage.setItem('auth_user', res.data.user)
+
+        const csrf = await client.get<{csrfToken: string}>('/auth/csrf')
+        setCsrfToken(csrf.data.csrfToken)
       } else {
         throw new Error('Not authenticated')
       }
@@ -23,12 +32,26 @@ export const useAuthStore = defineStore('auth', () => {
     }
   }
 
-  const login = async (creds: {login: string, password: string}) => {
-    const res = await client.post<{user: string}>('/login', creds)
+  // Returns a challenge token if the password was accepted but a second factor is required.
+  const login = async (creds: {login: string, password: string}): Promise<string | null> => {
+    const res = await client.post<LoginResponse>('/login', creds)
+    if (res.data.mfaRequired && res.data.mfaToken) {
+      return res.data.mfaToken
+    }
+
+    await completeLogin(res.data.user)
+    return null
+  }
+
+  const loginMfa = async (mfaToken: string, code: string) => {
+    const res = await client.post<LoginResponse>('/login/2fa', { mfaToken, code })
+    await completeLogin(res.data.user)
+  }
 
+  const completeLogin = async (name: string) => {
     // Set user state
-    user.value = res.data.user
-    localStorage.setItem('auth_user', res.data.user)
+    user.value = name
+    localStorage.setItem('auth_user', name)
 
     // Verify session
     await checkAuth()
@@ -40,6 +63,7 @@ export const useAuthStore = defineStore('auth', () => {
     } catch {
       // Ignore errors during logout
     } finally {
+      setCsrfToken(null)
       user.value = null
       localStorage.removeItem('auth_user')
     }
@@ -49,6 +73,7 @@ export const useAuthStore = defineStore('auth', () => {
     user,
     isAuthenticated,
     login,
+    loginMfa,
     logout,
     checkAuth
   }
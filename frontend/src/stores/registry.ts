@@ -3,9 +3,11 @@ import { ref } from 'vue'
 import axios from 'axios'
 import client, { formatError } from '@/api/client'
 import { useNotificationStore } from '@/stores/notifications'
-import type { Project, Registry, Repository, Image, GCInfo, CleanupResult } from '@/types'
+import type { Account, Project, Registry, Repository, Image, GCInfo, CleanupResult, UpstreamStatus } from '@/types'
 
 export const useRegistryStore = defineStore('registry', () => {
+  const accounts = ref<Account[]>([])
+  const selectedAccountId = ref<string | null>(localStorage.getItem('selected_account'))
   const projects = ref<Project[]>([])
   const registries = ref<Registry[]>([])
   const images = ref<Image[]>([])
@@ -20,22 +22,65 @@ export const useRegistryStore = defineStore('registry', () => {
   const gcLoading = ref(false) // GC info/action loading
 
   const error = ref<string | null>(null)
+  const upstream = ref<UpstreamStatus[]>([]) // Circuit state of the Selectel endpoints
   const notifications = useNotificationStore()
 
+  const fetchUpstreamStatus = async () => {
+    try {
+      const res = await client.get<UpstreamStatus[]>('/upstream/status')
+      upstream.value = res.data
+    } catch (err) {
+      console.error(err)
+    }
+  }
+
   const handleError = (err: unknown) => {
     console.error(err)
     error.value = formatError(err)
+    if (axios.isAxiosError(err) && err.response?.status === 503) {
+      void fetchUpstreamStatus()
+    }
   }
 
   const clearNotifications = () => {
       error.value = null
   }
 
+  // Routes of non-default accounts are namespaced under /accounts/{id}.
+  const accountPrefix = () => {
+    const account = accounts.value.find(a => a.id === selectedAccountId.value)
+    return account && !account.default ? `/accounts/${encodeURIComponent(account.id)}` : ''
+  }
+
+  const fetchAccounts = async () => {
+    try {
+      const res = await client.get<Account[]>('/accounts')
+      accounts.value = res.data
+      if (!accounts.value.some(a => a.id === selectedAccountId.value)) {
+        selectedAccountId.value = accounts.value[0]?.id ?? null
+      }
+    } catch (err) {
+      handleError(err)
+    }
+  }
+
+  const selectAccount = async (id: string) => {
+    selectedAccountId.value = id
+    localStorage.setItem('selected_account', id)
+    selectedProjectId.value = null
+    registries.value = []
+    images.value = []
+    await fetchProjects()
+    if (selectedProjectId.value) {
+      await loadProjectData(selectedProjectId.value)
+    }
+  }
+
   const fetchProjects = async () => {
     loading.value = true
     clearNotifications()
     try {
-      const res = await client.get<Project[]>('/projects')
+      const res = await client.get<Project[]>(`${accountPrefix()}/projects`)
       projects.value = res.data
 
       // Auto-select first project if none selected and list not empty
@@ -49,11 +94,14 @@ export const useRegistryStore = defineStore('registry', () => {
     }
   }
 
-  const fetchRegistries = async (pid: string) => {
+  // refresh bypasses the server-side listing cache
+  const fetchRegistries = async (pid: string, refresh = false) => {
     // Note: External callers should manage global loading state if chained
     clearNotifications()
     try {
-      const res = await client.get<Registry[]>(`/projects/${pid}/registries`)
+      const res = await client.get<Registry[]>(`${accountPrefix()}/projects/${pid}/registries`, {
+        params: refresh ? { refresh: true } : undefined
+      })
       // Map to add UI specific fields
       registries.value = res.data.map((r) => ({
           ...r,
@@ -66,14 +114,16 @@ export const useRegistryStore = defineStore('registry', () => {
     }
   }
 
-  const fetchRepositories = async (pid: string, rid: string) => {
+  const fetchRepositories = async (pid: string, rid: string, refresh = false) => {
       const registry = registries.value.find(r => r.id === rid)
       if (registry) {
           registry.loadingRepos = true
       }
 
       try {
-          const res = await client.get<Repository[]>(`/projects/${pid}/registries/${rid}/repositories`)
+          const res = await client.get<Repository[]>(`${accountPrefix()}/projects/${pid}/registries/${rid}/repositories`, {
+              params: refresh ? { refresh: true } : undefined
+          })
           if (registry) {
               registry.repositories = res.data
           }
@@ -87,14 +137,14 @@ export const useRegistryStore = defineStore('registry', () => {
   }
 
   // Orchestrator: Fetch registries then repositories for all
-  const loadProjectData = async (pid: string) => {
+  const loadProjectData = async (pid: string, refresh = false) => {
       loading.value = true
       selectedProjectId.value = pid
       try {
-        await fetchRegistries(pid)
+        await fetchRegistries(pid, refresh)
 
         // Parallel fetch repositories for all registries
-        const promises = registries.value.map(r => fetchRepositories(pid, r.id))
+        const promises = registries.value.map(r => fetchRepositories(pid, r.id, refresh))
         await Promise.all(promises)
       } finally {
         loading.value = false
@@ -103,7 +153,7 @@ export const useRegistryStore = defineStore('registry', () => {
 
   const refreshStructure = async () => {
       if (selectedProjectId.value) {
-          await loadProjectData(selectedProjectId.value)
+          await loadProjectData(selectedProjectId.value, true)
       }
   }
 
@@ -111,7 +161,7 @@ export const useRegistryStore = defineStore('registry', () => {
       loading.value = true
       clearNotifications()
       try {
-          await client.delete(`/projects/${pid}/registries/${rid}`)
+          await client.delete(`${accountPrefix()}/projects/${pid}/registries/${rid}`)
           registries.value = registries.value.filter(r => r.id !== rid)
           notifications.addNotification("Registry deleted successfully", "success")
       } catch (err) {
@@ -126,7 +176,7 @@ export const useRegistryStore = defineStore('registry', () => {
       loading.value = true
       clearNotifications()
       try {
-          await client.delete(`/projects/${pid}/registries/${rid}/repository`, { params: { name: rname } })
+          await client.delete(`${accountPrefix()}/projects/${pid}/registries/${rid}/repository`, { params: { name: rname } })
 
           // Update local state
           const registry = registries.value.find(r => r.id === rid)
@@ -156,7 +206,7 @@ export const useRegistryStore = defineStore('registry', () => {
       images.value = []
       clearNotifications()
       try {
-          const res = await client.get<Image[]>(`/projects/${pid}/registries/${rid}/images`, {
+          const res = await client.get<Image[]>(`${accountPrefix()}/projects/${pid}/registries/${rid}/images`, {
               params: { repository: rname },
               signal
           })
@@ -178,7 +228,7 @@ export const useRegistryStore = defineStore('registry', () => {
       digests.forEach(d => deletionLoading.value.add(d))
       clearNotifications()
       try {
-          const res = await client.post<CleanupResult>(`/projects/${pid}/registries/${rid}/cleanup`, {
+          const res = await client.post<CleanupResult>(`${accountPrefix()}/projects/${pid}/registries/${rid}/cleanup`, {
               digests: digests,
               disable_gc: disableGC
           }, {
@@ -200,7 +250,7 @@ export const useRegistryStore = defineStore('registry', () => {
       gcLoading.value = true
       clearNotifications()
       try {
-          const res = await client.get<GCInfo>(`/projects/${pid}/registries/${rid}/gc`)
+          const res = await client.get<GCInfo>(`${accountPrefix()}/projects/${pid}/registries/${rid}/gc`)
           gcInfo.value = res.data
       } catch (err) {
           handleError(err)
@@ -213,7 +263,7 @@ export const useRegistryStore = defineStore('registry', () => {
       gcLoading.value = true
       clearNotifications()
       try {
-          await client.post(`/projects/${pid}/registries/${rid}/gc`)
+          await client.post(`${accountPrefix()}/projects/${pid}/registries/${rid}/gc`)
           notifications.addNotification("Garbage collection initiated", "success")
       } catch (err) {
           handleError(err)
@@ -224,6 +274,8 @@ export const useRegistryStore = defineStore('registry', () => {
   }
 
   return {
+      accounts,
+      selectedAccountId,
       projects,
       registries,
       images,
@@ -234,6 +286,10 @@ export const useRegistryStore = defineStore('registry', () => {
       deletionLoading,
       gcLoading,
       error,
+      upstream,
+      fetchUpstreamStatus,
+      fetchAccounts,
+      selectAccount,
       fetchProjects,
       fetchRegistries,
       deleteRegistry,
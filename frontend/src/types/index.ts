@@ -1,6 +1,13 @@
+export interface Account {
+  id: string
+  name: string
+  default: boolean
+}
+
 export interface Project {
   id: string
   name: string
+  alias?: string
 }
 
 export interface Registry {
@@ -9,6 +16,7 @@ export interface Registry {
   status: string
   createdAt: string
   size: number
+  region?: string
   // Extended for UI
   repositories?: Repository[]
   loadingRepos?: boolean
@@ -38,3 +46,13 @@ export interface GCInfo {
   sizeSummary: number
   sizeUntagged: number
 }
+
+export interface UpstreamStatus {
+  endpoint: string
+  state: 'closed' | 'open' | 'half-open'
+  failures: number
+  lastError?: string
+  openedAt?: string
+  retryAt?: string
+  lastSuccess?: string
+}